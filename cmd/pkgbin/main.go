@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/handlers"
+	"github.com/pkgb-in/pkgbin/internal/pipeline"
+	"github.com/pkgb-in/pkgbin/internal/server"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// main serves npm, PyPI and RubyGems on one listener, routing each request
+// to the registry its Host is mapped to by server.registry_hosts.
+func main() {
+	if err := config.Load(os.Getenv("PKGBIN_CONFIG")); err != nil {
+		log.Fatalf("config load failed: %v", err)
+	}
+	if err := upstream.ConfigureHTTPClient(config.HTTP); err != nil {
+		log.Fatalf("http client: %v", err)
+	}
+	if len(config.Server.RegistryHosts) == 0 {
+		log.Fatal("server.registry_hosts maps no host to a registry")
+	}
+	chains, err := pipeline.Setup(models.RegistryNPM, models.RegistryPyPI, models.RegistryRubyGems)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Other hosts, such as the address load balancers probe, only get the
+	// health checks
+	fallback := http.NewServeMux()
+	fallback.HandleFunc("/ping", pipeline.PingHandler)
+	fallback.HandleFunc("/healthz", handlers.HealthzHandler)
+	fallback.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No registry is served on "+r.Host, http.StatusNotFound)
+	})
+
+	ListenHost := config.Server.Host
+	ListenPort := config.Server.Port
+	log.Printf("pkgbin started on %s:%s", ListenHost, ListenPort)
+	if err := server.ListenAndServe(ListenHost+":"+ListenPort, handlers.RegistryHostHandler(chains, fallback)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,946 @@
+// Command pkgbinctl drives a pkgbin proxy through its admin API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: pkgbinctl [-url URL] [-token TOKEN] <command> [arguments]
+
+Commands:
+  stats                  show cache and download statistics
+  top [-misses] [-n N]   list the most downloaded (or most missed) files
+  platforms              show the cached PyPI distributions per wheel
+                         platform tag
+  explain PATH           explain how the proxy handles a request for PATH:
+                         cache file name, upstream and checks made
+  purge [-n] [-not-accessed DAYS] [-larger-than MB] [-platform GLOB]
+        [-refused-platforms] [pattern…]
+                         purge cached files matching package or file name
+                         globs, age, size and PyPI wheel platform tags;
+                         -n only lists them
+  trash                  list the purged files that can still be restored
+  restore [-n] pattern…  restore purged files matching package or file
+                         name globs; -n only lists them
+  prefetch -f FILE       cache the tarballs of a package-lock.json, or the
+                         registry paths listed one per line in FILE
+  seed -registry REGISTRY DIR
+                         cache the .tgz, .whl, .egg, .tar.gz, .zip or .gem
+                         files of DIR, checking each is a valid artifact
+  import -format FORMAT DIR
+                         import the cache of another repository manager
+                         from DIR on the proxy's host; FORMAT is
+                         artifactory, nexus, devpi or verdaccio
+  projects               list the projects registered with their lockfile
+  project-add NAME FILE  register project NAME with the lockfile FILE, or
+                         replace its lockfile: package-lock.json,
+                         requirements.txt, poetry.lock, uv.lock,
+                         Pipfile.lock or Gemfile.lock
+  project-rm NAME        unregister project NAME
+  gc [-n]                purge the cached files of the versions no
+                         registered project pins; -n only lists them
+  backup [-files] FILE   save the database metadata of the proxy to FILE,
+                         with a manifest of the cached files with -files
+  restore-backup FILE    replace the database metadata of the proxy with
+                         the backup in FILE
+  reload                 reload the configuration file of the proxy,
+                         listing the changes that need a restart
+
+The proxy URL and admin token default to $PKGBIN_URL and $PKGBIN_TOKEN.
+`
+
+// maxPrefetchBatch matches the number of paths the API accepts at once.
+const maxPrefetchBatch = 100
+
+// maxRestoreBatch matches the number of files the API restores at once.
+const maxRestoreBatch = 1000
+
+// client calls the admin API of one proxy.
+type client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func main() {
+	flags := flag.NewFlagSet("pkgbinctl", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	baseURL := flags.String("url", envOr("PKGBIN_URL", "http://localhost:8080"), "proxy URL, including any /~<name> repository prefix")
+	token := flags.String("token", os.Getenv("PKGBIN_TOKEN"), "admin token")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{
+		baseURL: strings.TrimSuffix(*baseURL, "/"),
+		token:   *token,
+		http:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	var err error
+	switch cmd, args := flags.Arg(0), flags.Args()[1:]; cmd {
+	case "stats":
+		err = c.stats()
+	case "top":
+		err = c.top(args)
+	case "platforms":
+		err = c.platforms()
+	case "explain":
+		err = c.explain(args)
+	case "purge":
+		err = c.purge(args)
+	case "trash":
+		err = c.trash()
+	case "restore":
+		err = c.restore(args)
+	case "prefetch":
+		err = c.prefetch(args)
+	case "seed":
+		err = c.seed(args)
+	case "import":
+		err = c.importCache(args)
+	case "projects":
+		err = c.projects()
+	case "project-add":
+		err = c.projectAdd(args)
+	case "project-rm":
+		err = c.projectRemove(args)
+	case "gc":
+		err = c.gc(args)
+	case "backup":
+		err = c.backup(args)
+	case "restore-backup":
+		err = c.restoreBackup(args)
+	case "reload":
+		err = c.reload()
+	default:
+		fmt.Fprintf(os.Stderr, "pkgbinctl: unknown command %q\n\n", cmd)
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pkgbinctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// call sends a request to the API endpoint and decodes the JSON answer
+// into out.
+func (c *client) call(method, endpoint string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/api/v1/"+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, endpoint, out)
+}
+
+// upload posts the file at path to the API endpoint and decodes the JSON
+// answer into out.
+func (c *client) upload(endpoint, path string, out any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/api/v1/"+endpoint, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return c.send(req, endpoint, out)
+}
+
+// send authenticates req and decodes the JSON answer into out. Error
+// answers are turned into errors carrying their message.
+func (c *client) send(req *http.Request, endpoint string, out any) error {
+	method := req.Method
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return apiError(method, endpoint, resp, data)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// download saves the answer of the API endpoint to the file at path.
+func (c *client) download(endpoint, path string) error {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/api/v1/"+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		data, _ := io.ReadAll(resp.Body)
+		return apiError(req.Method, endpoint, resp, data)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// apiError turns an error answer into an error carrying its message.
+func apiError(method, endpoint string, resp *http.Response, data []byte) error {
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
+		return fmt.Errorf("%s %s: %s", method, endpoint, apiErr.Message)
+	}
+	return fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+}
+
+type packageInfo struct {
+	Name      string `json:"name"`
+	CacheHit  int64  `json:"cache_hit"`
+	CacheMiss int64  `json:"cache_miss"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+type packageList struct {
+	Packages []packageInfo `json:"packages"`
+}
+
+func (c *client) stats() error {
+	var s struct {
+		Files          int64      `json:"files"`
+		CacheSizeBytes int64      `json:"cache_size_bytes"`
+		PackagesServed int64      `json:"packages_served"`
+		UpdatedAt      *time.Time `json:"updated_at"`
+		UnusedPackages int64      `json:"unused_packages"`
+		DailyDownloads []struct {
+			Day         string `json:"day"`
+			CacheHit    int64  `json:"cache_hit"`
+			CacheMiss   int64  `json:"cache_miss"`
+			BytesServed int64  `json:"bytes_served"`
+		} `json:"daily_downloads"`
+		Circuits []struct {
+			Host     string `json:"host"`
+			State    string `json:"state"`
+			Failures int    `json:"failures"`
+		} `json:"circuits"`
+		BytesSaved     int64    `json:"bytes_saved"`
+		CostSaved      *float64 `json:"cost_saved"`
+		Currency       string   `json:"currency"`
+		MonthlySavings []struct {
+			Month      string   `json:"month"`
+			CacheHit   int64    `json:"cache_hit"`
+			BytesSaved int64    `json:"bytes_saved"`
+			CostSaved  *float64 `json:"cost_saved"`
+		} `json:"monthly_savings"`
+	}
+	if err := c.call(http.MethodGet, "stats", nil, &s); err != nil {
+		return err
+	}
+
+	fmt.Printf("Cached files:     %d (%s)\n", s.Files, formatBytes(s.CacheSizeBytes))
+	fmt.Printf("Packages served:  %d\n", s.PackagesServed)
+	fmt.Printf("Unused (30 days): %d\n", s.UnusedPackages)
+	fmt.Printf("Bandwidth saved:  %s%s\n", formatBytes(s.BytesSaved), formatCost(s.Currency, s.CostSaved))
+	if s.UpdatedAt != nil {
+		fmt.Printf("Updated:          %s\n", s.UpdatedAt.Local().Format("Jan 02, 2006 15:04:05"))
+	}
+	if len(s.DailyDownloads) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "DAY\tHITS\tMISSES\tHIT RATE\tSERVED\t")
+		for _, d := range s.DailyDownloads {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t\n", d.Day, d.CacheHit, d.CacheMiss, hitRate(d.CacheHit, d.CacheMiss), formatBytes(d.BytesServed))
+		}
+		w.Flush()
+	}
+	if len(s.MonthlySavings) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "MONTH\tHITS\tSAVED\t")
+		for _, m := range s.MonthlySavings {
+			fmt.Fprintf(w, "%s\t%d\t%s%s\t\n", m.Month, m.CacheHit, formatBytes(m.BytesSaved), formatCost(s.Currency, m.CostSaved))
+		}
+		w.Flush()
+	}
+	for _, circuit := range s.Circuits {
+		fmt.Printf("\nUpstream %s: circuit %s after %d failures\n", circuit.Host, circuit.State, circuit.Failures)
+	}
+	return nil
+}
+
+func (c *client) top(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	misses := flags.Bool("misses", false, "rank by cache misses instead of downloads")
+	limit := flags.Int("n", 20, "number of files to list")
+	flags.Parse(args)
+
+	order := "-downloads"
+	if *misses {
+		order = "-cache_miss"
+	}
+	var list packageList
+	query := url.Values{"sort": {order}, "per_page": {strconv.Itoa(*limit)}}
+	if err := c.call(http.MethodGet, "packages?"+query.Encode(), nil, &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tHITS\tMISSES\tHIT RATE\tSIZE")
+	for _, p := range list.Packages {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", p.Name, p.CacheHit, p.CacheMiss, hitRate(p.CacheHit, p.CacheMiss), formatBytes(p.SizeBytes))
+	}
+	return w.Flush()
+}
+
+func (c *client) platforms() error {
+	var platforms []struct {
+		Platform  string   `json:"platform"`
+		ABIs      []string `json:"abis"`
+		Files     int64    `json:"files"`
+		SizeBytes int64    `json:"size_bytes"`
+		CacheHit  int64    `json:"cache_hit"`
+		CacheMiss int64    `json:"cache_miss"`
+		Refused   bool     `json:"refused"`
+	}
+	if err := c.call(http.MethodGet, "platforms", nil, &platforms); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLATFORM	ABIS	FILES	SIZE	HITS	MISSES	CACHED")
+	for _, p := range platforms {
+		cached := "yes"
+		if p.Refused {
+			cached = "no"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%d\t%s\n", p.Platform, strings.Join(p.ABIs, ","), p.Files, formatBytes(p.SizeBytes), p.CacheHit, p.CacheMiss, cached)
+	}
+	return w.Flush()
+}
+
+func (c *client) explain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("explain needs a registry path or URL")
+	}
+	var e struct {
+		Kind        string `json:"kind"`
+		Package     string `json:"package"`
+		Version     string `json:"version"`
+		FileName    string `json:"file_name"`
+		CachePath   string `json:"cache_path"`
+		Upstream    string `json:"upstream"`
+		Routed      bool   `json:"routed"`
+		UpstreamURL string `json:"upstream_url"`
+		Steps       []struct {
+			Check  string `json:"check"`
+			Result string `json:"result"`
+			Detail string `json:"detail"`
+		} `json:"steps"`
+		Decision string `json:"decision"`
+	}
+	if err := c.call(http.MethodGet, "explain?"+url.Values{"path": {args[0]}}.Encode(), nil, &e); err != nil {
+		return err
+	}
+
+	fmt.Printf("Kind:       %s\n", e.Kind)
+	if e.Package != "" {
+		fmt.Printf("Package:    %s %s\n", e.Package, e.Version)
+	}
+	if e.FileName != "" {
+		fmt.Printf("Cache file: %s\n", e.FileName)
+	}
+	upstream := e.Upstream
+	if e.Routed {
+		upstream += " (routed)"
+	}
+	fmt.Printf("Upstream:   %s\n", upstream)
+	if e.UpstreamURL != "" {
+		fmt.Printf("Fetched as: %s\n", e.UpstreamURL)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, step := range e.Steps {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", step.Check, step.Result, step.Detail)
+	}
+	w.Flush()
+	fmt.Printf("\nDecision: %s\n", e.Decision)
+	return nil
+}
+
+func (c *client) purge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only list the files that would be purged")
+	notAccessed := flags.Int("not-accessed", 0, "only purge files not downloaded for this many days")
+	largerThan := flags.Float64("larger-than", 0, "only purge files larger than this many MB")
+	platform := flags.String("platform", "", "only purge PyPI wheels with a platform tag matching this glob")
+	refusedPlatforms := flags.Bool("refused-platforms", false, "only purge PyPI wheels for platforms wheel_platforms refuses")
+	flags.Parse(args)
+	patterns := flags.Args()
+	if len(patterns) == 0 {
+		if *notAccessed == 0 && *largerThan == 0 && *platform == "" && !*refusedPlatforms {
+			return fmt.Errorf("purge needs a pattern, -not-accessed, -larger-than, -platform or -refused-platforms")
+		}
+		patterns = []string{""}
+	}
+
+	// Let the proxy select the files, then purge exactly what was listed
+	seen := make(map[string]bool)
+	var names []string
+	for _, pattern := range patterns {
+		var result struct {
+			Matched []string `json:"matched"`
+		}
+		selector := map[string]any{
+			"pattern":           pattern,
+			"not_accessed_days": *notAccessed,
+			"larger_than_mb":    *largerThan,
+			"platform":          *platform,
+			"refused_platforms": *refusedPlatforms,
+			"dry_run":           true,
+		}
+		if err := c.call(http.MethodPost, "purge", selector, &result); err != nil {
+			return err
+		}
+		for _, name := range result.Matched {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("No cached files match")
+		return nil
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	var result struct {
+		Message string   `json:"message"`
+		Failed  []string `json:"failed"`
+	}
+	if err := c.call(http.MethodPost, "purge", map[string][]string{"packages": names}, &result); err != nil {
+		return err
+	}
+	fmt.Printf("%s (%d files)\n", result.Message, len(names))
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("failed to purge %s", strings.Join(result.Failed, ", "))
+	}
+	return nil
+}
+
+type trashedFile struct {
+	File        string    `json:"file"`
+	PackageName string    `json:"package_name"`
+	Size        int64     `json:"size"`
+	PurgedAt    time.Time `json:"purged_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (c *client) trash() error {
+	var files []trashedFile
+	if err := c.call(http.MethodGet, "trash", nil, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Println("The trash is empty")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tPURGED\tEXPIRES")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.File, formatBytes(f.Size),
+			f.PurgedAt.Local().Format("Jan 02 15:04"), f.ExpiresAt.Local().Format("Jan 02 15:04"))
+	}
+	return w.Flush()
+}
+
+func (c *client) restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only list the files that would be restored")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("restore needs a pattern")
+	}
+	var files []trashedFile
+	if err := c.call(http.MethodGet, "trash", nil, &files); err != nil {
+		return err
+	}
+	var names []string
+	for _, f := range files {
+		for _, pattern := range flags.Args() {
+			fileMatch, err := path.Match(pattern, f.File)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			packageMatch, _ := path.Match(pattern, f.PackageName)
+			if fileMatch || packageMatch {
+				names = append(names, f.File)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("No purged files match")
+		return nil
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	var restored int
+	var cached, missing []string
+	for len(names) > 0 {
+		batch := names[:min(len(names), maxRestoreBatch)]
+		names = names[len(batch):]
+		var result struct {
+			Restored []string `json:"restored"`
+			Cached   []string `json:"cached"`
+			Missing  []string `json:"missing"`
+		}
+		if err := c.call(http.MethodPost, "restore", map[string][]string{"files": batch}, &result); err != nil {
+			return err
+		}
+		restored += len(result.Restored)
+		cached = append(cached, result.Cached...)
+		missing = append(missing, result.Missing...)
+	}
+	fmt.Printf("Restored %d files\n", restored)
+	if len(cached) > 0 {
+		fmt.Printf("Already cached again: %s\n", strings.Join(cached, ", "))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no longer in the trash: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c *client) prefetch(args []string) error {
+	flags := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	file := flags.String("f", "", "package-lock.json, or a file listing registry paths")
+	flags.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("prefetch needs -f")
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	paths, err := prefetchPaths(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *file, err)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%s lists nothing to prefetch", *file)
+	}
+
+	failed := 0
+	for len(paths) > 0 {
+		batch := paths[:min(len(paths), maxPrefetchBatch)]
+		paths = paths[len(batch):]
+		var result struct {
+			Results []struct {
+				Path   string `json:"path"`
+				Status int    `json:"status"`
+				Cached bool   `json:"cached"`
+			} `json:"results"`
+		}
+		if err := c.call(http.MethodPost, "prefetch", map[string][]string{"paths": batch}, &result); err != nil {
+			return err
+		}
+		for _, r := range result.Results {
+			if r.Cached {
+				fmt.Printf("cached  %s\n", r.Path)
+			} else {
+				failed++
+				fmt.Printf("failed  %s (%d %s)\n", r.Path, r.Status, http.StatusText(r.Status))
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be cached", failed)
+	}
+	return nil
+}
+
+// seedExts are the extensions of the files seeded into each registry.
+var seedExts = map[string][]string{
+	"npm":      {".tgz"},
+	"pypi":     {".whl", ".egg", ".tar.gz", ".tar.bz2", ".zip"},
+	"rubygems": {".gem"},
+}
+
+func (c *client) seed(args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	registry := flags.String("registry", "", "registry of the proxy: npm, pypi or rubygems")
+	flags.Parse(args)
+	exts, ok := seedExts[*registry]
+	if !ok || flags.NArg() != 1 {
+		return fmt.Errorf("seed needs -registry npm, pypi or rubygems and a directory")
+	}
+
+	var files []string
+	err := filepath.WalkDir(flags.Arg(0), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, ext := range exts {
+			if d.Type().IsRegular() && strings.HasSuffix(strings.ToLower(d.Name()), ext) {
+				files = append(files, path)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s holds no %s files", flags.Arg(0), *registry)
+	}
+
+	failed := 0
+	for _, path := range files {
+		var result struct {
+			File   string `json:"file"`
+			Cached bool   `json:"cached"`
+		}
+		query := url.Values{"registry": {*registry}, "file": {filepath.Base(path)}}
+		if err := c.upload("seed?"+query.Encode(), path, &result); err != nil {
+			failed++
+			fmt.Printf("failed  %s (%v)\n", path, err)
+			continue
+		}
+		if result.Cached {
+			fmt.Printf("cached  %s as %s\n", path, result.File)
+		} else {
+			fmt.Printf("exists  %s as %s\n", path, result.File)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be seeded", failed)
+	}
+	return nil
+}
+
+func (c *client) importCache(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "layout of the cache: artifactory, nexus, devpi or verdaccio")
+	flags.Parse(args)
+	if *format == "" || flags.NArg() != 1 {
+		return fmt.Errorf("import needs -format and a directory")
+	}
+
+	var result struct {
+		Message string `json:"message"`
+	}
+	request := map[string]string{"format": *format, "path": flags.Arg(0)}
+	if err := c.call(http.MethodPost, "import", request, &result); err != nil {
+		return err
+	}
+	fmt.Println(result.Message)
+	return nil
+}
+
+// prefetchPaths returns the registry paths to prefetch from an npm
+// package-lock.json (lockfile versions 1 to 3) or from a plain list of
+// paths or URLs, one per line.
+func prefetchPaths(data []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		var paths []string
+		for _, line := range strings.Split(string(trimmed), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				paths = append(paths, registryPath(line))
+			}
+		}
+		return paths, nil
+	}
+
+	var lock struct {
+		Packages map[string]struct {
+			Resolved string `json:"resolved"`
+		} `json:"packages"`
+		Dependencies map[string]lockDependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(trimmed, &lock); err != nil {
+		return nil, fmt.Errorf("not a package-lock.json: %w", err)
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(resolved string) {
+		if !strings.HasSuffix(resolved, ".tgz") {
+			return
+		}
+		p := registryPath(resolved)
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, pkg := range lock.Packages {
+		add(pkg.Resolved)
+	}
+	var walk func(deps map[string]lockDependency)
+	walk = func(deps map[string]lockDependency) {
+		for _, dep := range deps {
+			add(dep.Resolved)
+			walk(dep.Dependencies)
+		}
+	}
+	walk(lock.Dependencies)
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// lockDependency is an entry of the nested dependencies of a version 1
+// package-lock.json.
+type lockDependency struct {
+	Resolved     string                    `json:"resolved"`
+	Dependencies map[string]lockDependency `json:"dependencies"`
+}
+
+// registryPath strips the scheme and host from a resolved URL, so tarballs
+// resolved against any registry are fetched through the proxy.
+func registryPath(resolved string) string {
+	if u, err := url.Parse(resolved); err == nil && u.Host != "" {
+		return u.EscapedPath()
+	}
+	return resolved
+}
+
+func hitRate(hits, misses int64) string {
+	if hits+misses == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(hits)*100/float64(hits+misses))
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// formatCost returns an estimated cost to append to a size, or "" without
+// one.
+func formatCost(currency string, cost *float64) string {
+	if cost == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%s%.2f)", currency, *cost)
+}
+
+type project struct {
+	Name      string    `json:"name"`
+	Packages  int       `json:"packages"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (c *client) projects() error {
+	var projects []project
+	if err := c.call(http.MethodGet, "projects", nil, &projects); err != nil {
+		return err
+	}
+	if len(projects) == 0 {
+		fmt.Println("No project is registered")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tPACKAGES\tUPDATED")
+	for _, p := range projects {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", p.Name, p.Packages, p.UpdatedAt.Local().Format("Jan 02 15:04"))
+	}
+	return w.Flush()
+}
+
+func (c *client) projectAdd(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("project-add needs a project name and its lockfile")
+	}
+	var result project
+	if err := c.upload("projects/"+url.PathEscape(args[0]), args[1], &result); err != nil {
+		return err
+	}
+	fmt.Printf("Registered %s, pinning %d package versions\n", result.Name, result.Packages)
+	return nil
+}
+
+func (c *client) projectRemove(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("project-rm needs a project name")
+	}
+	var result struct {
+		Message string `json:"message"`
+	}
+	if err := c.call(http.MethodDelete, "projects/"+url.PathEscape(args[0]), nil, &result); err != nil {
+		return err
+	}
+	fmt.Println(result.Message)
+	return nil
+}
+
+func (c *client) gc(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only list the files that would be purged")
+	flags.Parse(args)
+	var result struct {
+		Message string   `json:"message"`
+		Matched []string `json:"matched"`
+		Deleted []string `json:"deleted"`
+		Failed  []string `json:"failed"`
+		Bytes   int64    `json:"bytes"`
+	}
+	if err := c.call(http.MethodPost, "gc", map[string]bool{"dry_run": *dryRun}, &result); err != nil {
+		return err
+	}
+	for _, name := range append(result.Matched, result.Deleted...) {
+		fmt.Println(name)
+	}
+	fmt.Printf("%s (%s)\n", result.Message, formatBytes(result.Bytes))
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("failed to purge %s", strings.Join(result.Failed, ", "))
+	}
+	return nil
+}
+
+func (c *client) backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	files := flags.Bool("files", false, "add a manifest of the cached files and their digests")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("backup needs the file to write")
+	}
+	endpoint := "backup"
+	if *files {
+		endpoint += "?files=true"
+	}
+	if err := c.download(endpoint, flags.Arg(0)); err != nil {
+		return err
+	}
+	info, err := os.Stat(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved %s (%s)\n", flags.Arg(0), formatBytes(info.Size()))
+	return nil
+}
+
+func (c *client) restoreBackup(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("restore-backup needs the backup file")
+	}
+	var result struct {
+		CreatedAt time.Time      `json:"created_at"`
+		Rows      map[string]int `json:"rows"`
+		Skipped   []string       `json:"skipped"`
+		Files     *struct {
+			Checked    int `json:"checked"`
+			Missing    int `json:"missing"`
+			Mismatched int `json:"mismatched"`
+		} `json:"files"`
+	}
+	if err := c.upload("restore-backup", args[0], &result); err != nil {
+		return err
+	}
+	fmt.Printf("Restored the backup of %s\n", result.CreatedAt.Local().Format("Jan 02, 2006 15:04:05"))
+	tables := make([]string, 0, len(result.Rows))
+	for table := range result.Rows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("  %-18s %d rows\n", table, result.Rows[table])
+	}
+	for _, table := range result.Skipped {
+		fmt.Printf("  %-18s kept, as it is append-only\n", table)
+	}
+	if f := result.Files; f != nil {
+		fmt.Printf("Cached files: %d checked, %d missing, %d differing\n", f.Checked, f.Missing, f.Mismatched)
+	}
+	return nil
+}
+
+func (c *client) reload() error {
+	var result struct {
+		Message         string   `json:"message"`
+		RestartRequired []string `json:"restart_required"`
+	}
+	if err := c.call(http.MethodPost, "reload", nil, &result); err != nil {
+		return err
+	}
+	fmt.Println(result.Message)
+	for _, name := range result.RestartRequired {
+		fmt.Printf("  %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package config
+
+// Admin permissions grantable to tokens. PermissionAll grants every one.
+const (
+	PermissionPurge    = "purge"
+	PermissionRefresh  = "refresh"
+	PermissionPublish  = "publish"
+	PermissionPrefetch = "prefetch"
+	PermissionAll      = "*"
+)
+
+// AdminToken is a bearer token for the admin endpoints. The token value is
+// a Secret so it never has to be written into the config file.
+type AdminToken struct {
+	Name        string   `json:"name"`
+	Token       Secret   `json:"token"`
+	Permissions []string `json:"permissions"`
+}
+
+// AdminConfig holds the tokens accepted by the mutating admin endpoints.
+// Without tokens those endpoints are left open, as in earlier versions.
+type AdminConfig struct {
+	Tokens []AdminToken `json:"tokens"`
+}
+
+var Admin = AdminConfig{}
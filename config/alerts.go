@@ -0,0 +1,53 @@
+package config
+
+import "time"
+
+// AlertsConfig defines the operational alerts and where they are sent. A
+// rule with a zero threshold is disabled, and nothing is checked without a
+// notifier.
+type AlertsConfig struct {
+	// CheckInterval is how often the rules are evaluated; ratios cover the
+	// downloads and upstream requests since they were last evaluated.
+	CheckInterval Duration `json:"check_interval"`
+	// RepeatInterval is how often an alert that keeps firing is sent again;
+	// zero only sends it once.
+	RepeatInterval Duration `json:"repeat_interval"`
+	// DiskUsagePercent fires when the filesystem of the cache directory is
+	// fuller than that.
+	DiskUsagePercent float64 `json:"disk_usage_percent"`
+	// HitRatioPercent fires when fewer downloads than that were cache hits.
+	HitRatioPercent float64 `json:"hit_ratio_percent"`
+	// UpstreamErrorPercent fires when more upstream requests than that
+	// failed or were refused by an open circuit breaker.
+	UpstreamErrorPercent float64 `json:"upstream_error_percent"`
+	// MinSamples is how many downloads or upstream requests a check must
+	// see before the ratio rules apply, so a handful of requests does not
+	// page anyone.
+	MinSamples int64 `json:"min_samples"`
+	// Alerts go to every notifier configured
+	Slack SlackNotifier `json:"slack"`
+	SMTP  SMTPNotifier  `json:"smtp"`
+}
+
+// SlackNotifier posts alerts to a Slack incoming webhook.
+type SlackNotifier struct {
+	WebhookURL Secret `json:"webhook_url"`
+}
+
+// SMTPNotifier mails alerts through an SMTP server. Username enables
+// PLAIN authentication, which needs TLS unless the server is localhost.
+type SMTPNotifier struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password Secret   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+var Alerts = AlertsConfig{
+	CheckInterval:  Duration{time.Minute},
+	RepeatInterval: Duration{time.Hour},
+	MinSamples:     20,
+	SMTP:           SMTPNotifier{Port: 587},
+}
@@ -0,0 +1,11 @@
+package config
+
+// Blocklist configures a feed of known-malicious or typosquatting package
+// names that pkgbin refuses to proxy or cache. The feed is a text file with
+// one package per line, optionally followed by a version to block only
+// that version; blank lines and lines starting with "#" are ignored.
+type Blocklist struct {
+	URL      string       `json:"url"`
+	Auth     UpstreamAuth `json:"auth"`
+	Interval Duration     `json:"interval"`
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthands accepted for common schedules.
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronField is the range of values of one field of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Cron is a standard five-field cron expression (minute, hour, day of
+// month, month, day of week) read from a JSON string. Fields accept *,
+// values, ranges, lists and steps such as */15 or 1-5; Sunday is 0 or 7.
+// As in cron, a time matches a day of month or a day of week when both are
+// restricted.
+type Cron struct {
+	expr string
+	// bits holds the values each field matches
+	bits [5]uint64
+}
+
+// ParseCron parses a cron expression.
+func ParseCron(expr string) (Cron, error) {
+	c := Cron{expr: expr}
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return Cron{}, fmt.Errorf("invalid cron expression %q: want 5 fields", expr)
+	}
+	for i, field := range fields {
+		bits, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return Cron{}, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		c.bits[i] = bits
+	}
+	// Sunday is both 0 and 7
+	if c.bits[4]&(1<<7) != 0 {
+		c.bits[4] |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, stepText)
+			}
+			step = n
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loText); err != nil {
+				return 0, fmt.Errorf("invalid %s %q", f.name, part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiText); err != nil {
+					return 0, fmt.Errorf("invalid %s %q", f.name, part)
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if lo < f.min || hi > f.max || lo > hi {
+				return 0, fmt.Errorf("%s %q out of range %d-%d", f.name, part, f.min, f.max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Matches reports whether the minute of t is one the expression selects.
+func (c Cron) Matches(t time.Time) bool {
+	if c.expr == "" {
+		return false
+	}
+	if c.bits[0]&(1<<t.Minute()) == 0 || c.bits[1]&(1<<t.Hour()) == 0 || c.bits[3]&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := c.bits[2]&(1<<t.Day()) != 0
+	dow := c.bits[4]&(1<<int(t.Weekday())) != 0
+	if c.restricted(2) && c.restricted(4) {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// restricted reports whether field i leaves out any of its values.
+func (c Cron) restricted(i int) bool {
+	f := cronFields[i]
+	all := uint64(1)<<(f.max+1) - uint64(1)<<f.min
+	if i == 4 {
+		all = 1<<7 - 1
+		return c.bits[i]&all != all
+	}
+	return c.bits[i] != all
+}
+
+func (c Cron) String() string {
+	return c.expr
+}
+
+func (c Cron) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.expr)
+}
+
+func (c *Cron) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseCron(s)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// matchesWithin reports whether the expression matches any minute of the
+// span after from.
+func (c Cron) matchesWithin(from time.Time, span time.Duration) bool {
+	t := from.Truncate(time.Minute)
+	for end := from.Add(span); !t.After(end); t = t.Add(time.Minute) {
+		if c.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// applyEnv overrides the settings of s containers are usually given as
+// environment variables: PORT, the port the proxies listen on, and
+// NPM_CACHE_DIR, PYPI_CACHE_DIR and GEM_CACHE_DIR, the cache directories
+// of the default repositories. They take precedence over the config file.
+func (s *Settings) applyEnv() error {
+	if port := os.Getenv("PORT"); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("PORT %q is not a port number", port)
+		}
+		s.Server.Port = port
+	}
+	for env, dir := range map[string]*string{
+		"NPM_CACHE_DIR":  &s.NPM.CacheDir,
+		"PYPI_CACHE_DIR": &s.PyPI.CacheDir,
+		"GEM_CACHE_DIR":  &s.RubyGems.CacheDir,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*dir = value
+		}
+	}
+	return nil
+}
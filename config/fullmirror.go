@@ -0,0 +1,17 @@
+package config
+
+// FullMirror lists the packages of a repository downloaded in full ahead
+// of any request, rather than as clients happen to ask for them, and
+// checked upstream for new versions every Interval.
+type FullMirror struct {
+	Packages []MirroredPackage `json:"packages"`
+	Interval Duration          `json:"interval"`
+}
+
+// MirroredPackage is a package mirrored in full, or only its versions in
+// the Versions range (e.g. ">=4.0.0 <5.0.0") when set. Name is PEP 503
+// normalized for PyPI.
+type MirroredPackage struct {
+	Name     string `json:"name"`
+	Versions string `json:"versions,omitempty"`
+}
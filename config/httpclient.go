@@ -0,0 +1,42 @@
+package config
+
+import "time"
+
+// HTTPClient tunes the connections pkgbin opens to upstream registries and
+// other outside services.
+type HTTPClient struct {
+	// ConnectTimeout bounds establishing a TCP connection and TLSTimeout
+	// the TLS handshake after it.
+	ConnectTimeout Duration `json:"connect_timeout"`
+	TLSTimeout     Duration `json:"tls_timeout"`
+	// ResponseHeaderTimeout bounds waiting for a response once the request
+	// is sent; ReadTimeout aborts a download that receives nothing for
+	// that long, however long the download takes overall.
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	ReadTimeout           Duration `json:"read_timeout"`
+	// Keep-alive pool sizing. MaxConnsPerHost of zero means unlimited.
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`
+	MaxIdleConns        int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`
+	// Proxy is an outbound proxy URL. Without it the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are honored.
+	Proxy string `json:"proxy"`
+	// CABundle is a PEM file of extra certificate authorities trusted in
+	// addition to the system ones, e.g. a corporate TLS inspection CA.
+	CABundle string `json:"ca_bundle"`
+	// Resolver is the DNS server ("host:port", port 53 by default) upstream
+	// host names are looked up with instead of the system resolver, e.g.
+	// when internal DNS points the public registries at pkgbin itself.
+	Resolver string `json:"resolver"`
+}
+
+var HTTP = HTTPClient{
+	ConnectTimeout:        Duration{10 * time.Second},
+	TLSTimeout:            Duration{10 * time.Second},
+	ResponseHeaderTimeout: Duration{30 * time.Second},
+	ReadTimeout:           Duration{time.Minute},
+	IdleConnTimeout:       Duration{90 * time.Second},
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   16,
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// Settings is the whole configuration, laid out as the JSON configuration
+// file. Sections that are omitted keep their built-in defaults.
+type Settings struct {
+	Server   ServerConfig        `json:"server"`
+	Admin    AdminConfig         `json:"admin"`
+	OIDC     OIDCConfig          `json:"oidc"`
+	HTTP     HTTPClient          `json:"http_client"`
+	NPM      NPMProxyConfig      `json:"npm"`
+	PyPI     PyPIProxyConfig     `json:"pypi"`
+	RubyGems RubyGemsProxyConfig `json:"rubygems"`
+	Alerts   AlertsConfig        `json:"alerts"`
+}
+
+// builtin are the defaults the configuration file is read over.
+var builtin Settings
+
+func init() {
+	builtin = globals()
+}
+
+// globals returns the configuration held by the package variables.
+func globals() Settings {
+	return Settings{
+		Server:   Server,
+		Admin:    Admin,
+		OIDC:     OIDC,
+		HTTP:     HTTP,
+		NPM:      NPMConfig,
+		PyPI:     PyPIConfig,
+		RubyGems: RubyGemsConfig,
+		Alerts:   Alerts,
+	}
+}
+
+// install puts s into effect at startup. The package variables keep the
+// configuration loaded then; those reloaded later are only read through
+// Current.
+func (s *Settings) install() {
+	Server, Admin, OIDC, HTTP = s.Server, s.Admin, s.OIDC, s.HTTP
+	NPMConfig, PyPIConfig, RubyGemsConfig = s.NPM, s.PyPI, s.RubyGems
+	Alerts = s.Alerts
+	settings.Store(s)
+}
+
+// settings is the configuration in effect, replaced as a whole by reloads.
+var settings atomic.Pointer[Settings]
+
+// Current returns the configuration in effect, or that of the package
+// variables before Load. It must not be modified: a reload publishes new
+// settings instead, so requests holding these finish with them.
+func Current() *Settings {
+	if s := settings.Load(); s != nil {
+		return s
+	}
+	s := globals()
+	return &s
+}
+
+// loadedPath is the configuration file Load read.
+var loadedPath string
+
+// Load reads the JSON configuration file at path over the defaults, then
+// applies the environment overrides. An empty path leaves the defaults to
+// the environment.
+func Load(path string) error {
+	s, err := parse(path)
+	if err != nil {
+		return err
+	}
+	s.install()
+	loadedPath = path
+	return nil
+}
+
+// parse reads the configuration file at path over the built-in defaults,
+// with the environment overrides, and validates it.
+func parse(path string) (*Settings, error) {
+	s := builtin
+	// Decoding appends to the slices of the defaults, which must not change
+	s.OIDC.Scopes = slices.Clone(builtin.OIDC.Scopes)
+	if path == "" {
+		return &s, s.applyEnv()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	// Before named repositories derive their directories from the defaults
+	if err := s.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	// Named repositories inherit the registry settings decoded above
+	var sections struct {
+		NPM      struct{ Repositories []json.RawMessage } `json:"npm"`
+		PyPI     struct{ Repositories []json.RawMessage } `json:"pypi"`
+		RubyGems struct{ Repositories []json.RawMessage } `json:"rubygems"`
+	}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	err = decodeRepositories(sections.NPM.Repositories, func(name string) any {
+		repo := s.NPM
+		repo.Name, repo.Repositories = name, nil
+		repo.detach()
+		// Packages mirrored by the default repository are not by the others
+		repo.FullMirror.Packages = nil
+		// Each host is answered for by one repository
+		repo.TransparentHosts = nil
+		repo.CacheDir = repositoryDir(s.NPM.CacheDir, name)
+		repo.ExternalURL = repositoryURL(s.NPM.ExternalURL, name)
+		repo.MetadataDir = repositoryDir(s.NPM.MetadataDir, name)
+		repo.LocalDir = repositoryDir(s.NPM.LocalDir, name)
+		s.NPM.Repositories = append(s.NPM.Repositories, &repo)
+		return &repo
+	})
+	if err != nil {
+		return nil, fmt.Errorf("npm repositories in %s: %w", path, err)
+	}
+	err = decodeRepositories(sections.PyPI.Repositories, func(name string) any {
+		repo := s.PyPI
+		repo.Name, repo.Repositories = name, nil
+		repo.detach()
+		// Packages mirrored by the default repository are not by the others
+		repo.FullMirror.Packages = nil
+		// Each host is answered for by one repository
+		repo.TransparentHosts = nil
+		repo.CacheDir = repositoryDir(s.PyPI.CacheDir, name)
+		repo.ExternalURL = repositoryURL(s.PyPI.ExternalURL, name)
+		repo.MetadataDir = repositoryDir(s.PyPI.MetadataDir, name)
+		repo.Mirror.Dir = repositoryDir(s.PyPI.Mirror.Dir, name)
+		s.PyPI.Repositories = append(s.PyPI.Repositories, &repo)
+		return &repo
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pypi repositories in %s: %w", path, err)
+	}
+	err = decodeRepositories(sections.RubyGems.Repositories, func(name string) any {
+		repo := s.RubyGems
+		repo.Name, repo.Repositories = name, nil
+		repo.detach()
+		// Packages mirrored by the default repository are not by the others
+		repo.FullMirror.Packages = nil
+		// Each host is answered for by one repository
+		repo.TransparentHosts = nil
+		repo.CacheDir = repositoryDir(s.RubyGems.CacheDir, name)
+		repo.ExternalURL = repositoryURL(s.RubyGems.ExternalURL, name)
+		repo.MetadataDir = repositoryDir(s.RubyGems.MetadataDir, name)
+		s.RubyGems.Repositories = append(s.RubyGems.Repositories, &repo)
+		return &repo
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rubygems repositories in %s: %w", path, err)
+	}
+
+	externalURLs := []string{s.NPM.ExternalURL, s.PyPI.ExternalURL, s.RubyGems.ExternalURL}
+	noStores := []NoStore{s.NPM.NoStore, s.PyPI.NoStore, s.RubyGems.NoStore}
+	retentions := []Retention{s.NPM.Retention, s.PyPI.Retention, s.RubyGems.Retention}
+	tarballHosts := [][]string{s.NPM.TarballHosts}
+	wheelPlatforms := []WheelPlatforms{s.PyPI.WheelPlatforms}
+	transparentHosts := [][]string{s.NPM.TransparentHosts, s.PyPI.TransparentHosts, s.RubyGems.TransparentHosts}
+	for _, repo := range s.NPM.Repositories {
+		externalURLs = append(externalURLs, repo.ExternalURL)
+		noStores = append(noStores, repo.NoStore)
+		retentions = append(retentions, repo.Retention)
+		tarballHosts = append(tarballHosts, repo.TarballHosts)
+		transparentHosts = append(transparentHosts, repo.TransparentHosts)
+	}
+	for _, repo := range s.PyPI.Repositories {
+		externalURLs = append(externalURLs, repo.ExternalURL)
+		noStores = append(noStores, repo.NoStore)
+		retentions = append(retentions, repo.Retention)
+		wheelPlatforms = append(wheelPlatforms, repo.WheelPlatforms)
+		transparentHosts = append(transparentHosts, repo.TransparentHosts)
+	}
+	for _, repo := range s.RubyGems.Repositories {
+		externalURLs = append(externalURLs, repo.ExternalURL)
+		noStores = append(noStores, repo.NoStore)
+		retentions = append(retentions, repo.Retention)
+		transparentHosts = append(transparentHosts, repo.TransparentHosts)
+	}
+	for _, externalURL := range externalURLs {
+		if err := validateExternalURL(externalURL); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := validateInstanceURL("replica_of", s.Server.ReplicaOf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateInstanceURL("sync primary", s.Server.Sync.Primary); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateUpstreamDeletions(s.Server.UpstreamDeletions); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.Server.Maintenance.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.Server.CostPerGB < 0 {
+		return nil, fmt.Errorf("%s: cost_per_gb must not be negative", path)
+	}
+	for _, noStore := range noStores {
+		if err := noStore.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, retention := range retentions {
+		if err := retention.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, platforms := range wheelPlatforms {
+		if err := platforms.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, hosts := range tarballHosts {
+		if err := validateTarballHosts(hosts); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := validateTransparentHosts(transparentHosts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateRegistryHosts(s.Server.RegistryHosts, transparentHosts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// detach gives a named repository copied from the default repository
+// slices of its own, as decoding its section writes into those it holds.
+func (c *NPMProxyConfig) detach() {
+	c.Routes, c.Policy.Rules = slices.Clone(c.Routes), slices.Clone(c.Policy.Rules)
+	c.PublishScopes, c.PublishTokens = slices.Clone(c.PublishScopes), slices.Clone(c.PublishTokens)
+	c.TarballHosts = slices.Clone(c.TarballHosts)
+	c.NoStore.Packages, c.NoStore.Versions = slices.Clone(c.NoStore.Packages), slices.Clone(c.NoStore.Versions)
+	c.Retention.Rules = slices.Clone(c.Retention.Rules)
+}
+
+// detach does for PyPI what NPMProxyConfig.detach does for npm.
+func (c *PyPIProxyConfig) detach() {
+	c.Routes, c.Policy.Rules = slices.Clone(c.Routes), slices.Clone(c.Policy.Rules)
+	c.NoStore.Packages, c.NoStore.Versions = slices.Clone(c.NoStore.Packages), slices.Clone(c.NoStore.Versions)
+	c.Retention.Rules = slices.Clone(c.Retention.Rules)
+	c.WheelPlatforms.Allow, c.WheelPlatforms.Deny = slices.Clone(c.WheelPlatforms.Allow), slices.Clone(c.WheelPlatforms.Deny)
+}
+
+// detach does for RubyGems what NPMProxyConfig.detach does for npm.
+func (c *RubyGemsProxyConfig) detach() {
+	c.Routes, c.Policy.Rules = slices.Clone(c.Routes), slices.Clone(c.Policy.Rules)
+	c.NoStore.Packages, c.NoStore.Versions = slices.Clone(c.NoStore.Packages), slices.Clone(c.NoStore.Versions)
+	c.Retention.Rules = slices.Clone(c.Retention.Rules)
+}
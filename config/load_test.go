@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNamedRepositoriesKeepDefaultSlices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"npm": {
+			"routes": [{"pattern": "@corp/*", "upstream": "https://corp.example.com"}],
+			"policy": {"rules": [{"action": "deny", "name": "left-pad"}]},
+			"publish_scopes": ["@corp"],
+			"tarball_hosts": ["codeload.github.com"],
+			"no_store": {"packages": ["huge-*"]},
+			"repositories": [{
+				"name": "x",
+				"routes": [{"pattern": "@x/*", "upstream": "https://x.example.com"}],
+				"policy": {"rules": [{"action": "allow", "name": "lodash"}]},
+				"publish_scopes": ["@x"],
+				"tarball_hosts": ["x.example.com"],
+				"no_store": {"packages": ["x-*"]}
+			}]
+		},
+		"pypi": {
+			"routes": [{"pattern": "corp-*", "upstream": "https://corp.example.com"}],
+			"repositories": [{"name": "x", "routes": [{"pattern": "x-*", "upstream": "https://x.example.com"}]}]
+		}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	npm := s.NPM
+	if got := npm.Routes[0].Upstream; got != "https://corp.example.com" {
+		t.Errorf("default npm route goes to %s", got)
+	}
+	if got := npm.Policy.Rules[0].Name; got != "left-pad" {
+		t.Errorf("default npm policy rule names %s", got)
+	}
+	if got := npm.PublishScopes[0]; got != "@corp" {
+		t.Errorf("default npm publish scope is %s", got)
+	}
+	if got := npm.TarballHosts[0]; got != "codeload.github.com" {
+		t.Errorf("default npm tarball host is %s", got)
+	}
+	if got := npm.NoStore.Packages[0]; got != "huge-*" {
+		t.Errorf("default npm no_store package is %s", got)
+	}
+	if got := npm.Repositories[0].Routes[0].Upstream; got != "https://x.example.com" {
+		t.Errorf("named npm route goes to %s", got)
+	}
+	if got := s.PyPI.Routes[0].Upstream; got != "https://corp.example.com" {
+		t.Errorf("default PyPI route goes to %s", got)
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Heavy background jobs that maintenance windows can confine
+const (
+	MaintenanceScrub        = "scrub"
+	MaintenanceRevalidate   = "revalidate"
+	MaintenanceReconcile    = "reconcile"
+	MaintenanceRefresh      = "refresh"
+	MaintenanceHistoryPrune = "history_prune"
+	MaintenanceBackup       = "backup"
+	MaintenanceMirror       = "mirror"
+	MaintenanceFullMirror   = "full_mirror"
+	MaintenanceRetention    = "retention"
+)
+
+// MaintenanceJobs lists every job maintenance windows can confine.
+var MaintenanceJobs = []string{
+	MaintenanceScrub,
+	MaintenanceRevalidate,
+	MaintenanceReconcile,
+	MaintenanceRefresh,
+	MaintenanceHistoryPrune,
+	MaintenanceBackup,
+	MaintenanceMirror,
+	MaintenanceFullMirror,
+	MaintenanceRetention,
+}
+
+// Bounds of the duration of a window. Hourly jobs need an hour to be due
+// in every window.
+const (
+	minMaintenanceWindow = time.Hour
+	maxMaintenanceWindow = 7 * 24 * time.Hour
+)
+
+// Maintenance confines the heavy background jobs to time windows, so they
+// do not compete with peak traffic. Without windows the jobs run whenever
+// they are due.
+type Maintenance struct {
+	Windows []MaintenanceWindow `json:"windows"`
+	// Jobs lists the jobs confined to the windows; empty confines every
+	// one of MaintenanceJobs.
+	Jobs []string `json:"jobs"`
+}
+
+// MaintenanceWindow opens at every minute Start matches, in local time,
+// and stays open for Duration.
+type MaintenanceWindow struct {
+	Start    Cron     `json:"start"`
+	Duration Duration `json:"duration"`
+}
+
+// Confines reports whether job only runs within the windows.
+func (m Maintenance) Confines(job string) bool {
+	return len(m.Windows) > 0 && (len(m.Jobs) == 0 || slices.Contains(m.Jobs, job))
+}
+
+func (m Maintenance) validate() error {
+	for _, job := range m.Jobs {
+		if !slices.Contains(MaintenanceJobs, job) {
+			return fmt.Errorf("unknown maintenance job %q, want one of %v", job, MaintenanceJobs)
+		}
+	}
+	for _, w := range m.Windows {
+		if w.Start.String() == "" {
+			return fmt.Errorf("maintenance window needs a start")
+		}
+		if w.Duration.Duration < minMaintenanceWindow || w.Duration.Duration > maxMaintenanceWindow {
+			return fmt.Errorf("maintenance window %q: duration must be between %s and %s", w.Start, minMaintenanceWindow, maxMaintenanceWindow)
+		}
+		if !w.Start.matchesWithin(time.Now(), 366*24*time.Hour) {
+			return fmt.Errorf("maintenance window %q never opens", w.Start)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"path"
+)
+
+// NoStore selects the artifacts of a repository that are proxied from
+// upstream without being cached, such as nightly or snapshot builds that
+// would only crowd out useful files. Packages and Versions are path.Match
+// globs on the package name (PEP 503 normalized for PyPI), e.g.
+// "@mycorp/nightly-*", and on the version, e.g. "*-SNAPSHOT" or "*.dev*";
+// artifacts matching either list are streamed through. All streams every
+// artifact of the repository through.
+type NoStore struct {
+	All      bool     `json:"all"`
+	Packages []string `json:"packages"`
+	Versions []string `json:"versions"`
+}
+
+// validate checks the patterns of n.
+func (n NoStore) validate() error {
+	for _, pattern := range append(append([]string{}, n.Packages...), n.Versions...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid no_store pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -1,11 +1,94 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type NPMProxyConfig struct {
-	Upstream string `json:"upstream"`
-	CacheDir string `json:"cache_dir"`
+	// Name is empty for the default repository and set for the named
+	// repositories served under RepositoryPrefix.
+	Name         string            `json:"-"`
+	Repositories []*NPMProxyConfig `json:"-"`
+
+	Upstream        string            `json:"upstream"`
+	CacheDir        string            `json:"cache_dir"`
+	Auth            UpstreamAuth      `json:"auth"`
+	Routes          []UpstreamRoute   `json:"routes"`
+	Policy          Policy            `json:"policy"`
+	Vulnerabilities VulnerabilityScan `json:"vulnerabilities"`
+	Blocklist       Blocklist         `json:"blocklist"`
+	MetadataDir     string            `json:"metadata_dir"`
+	MetadataTTL     Duration          `json:"metadata_ttl"`
+	// AuditCacheTTL caches security audit responses for identical request
+	// bodies; zero disables caching.
+	AuditCacheTTL Duration `json:"audit_cache_ttl"`
+	// AuditOffline answers audits with an empty advisory set without
+	// contacting upstream, for air-gapped deployments.
+	AuditOffline bool `json:"audit_offline"`
+	// LocalDir stores packages published to pkgbin itself.
+	LocalDir string `json:"local_dir"`
+	// PublishScopes lists the scopes (e.g. "@mycorp") that may be published
+	// locally; "*" allows any package name. Empty disables publishing.
+	PublishScopes []string `json:"publish_scopes"`
+	// PublishTokens, when set, restricts publishing to clients presenting
+	// one of these bearer tokens, read from the environment or files.
+	PublishTokens []Secret `json:"publish_tokens"`
+	// MaxConcurrentFetches caps simultaneous upstream artifact downloads
+	// across the registry; zero means unlimited.
+	MaxConcurrentFetches int `json:"max_concurrent_fetches"`
+	// NoStore lists artifacts streamed from upstream without being cached.
+	NoStore NoStore `json:"no_store"`
+	// MaxArtifactSize is the largest artifact cached, in bytes; larger ones
+	// are streamed through, or refused with RejectOversized. Zero means no
+	// limit.
+	MaxArtifactSize int64 `json:"max_artifact_size"`
+	RejectOversized bool  `json:"reject_oversized"`
+	// VerifySignatures caches a tarball only once the registry signature
+	// of its version verifies against the keys the upstream publishes.
+	VerifySignatures bool `json:"verify_signatures"`
+	// ExternalURL is the base URL clients reach the registry at, used in
+	// rewritten metadata and dashboard links. Without it the URL is
+	// derived from each request.
+	ExternalURL string `json:"external_url"`
+	// TarballHosts lists the hosts other than the upstreams (e.g.
+	// "codeload.github.com", or "*.example.com" for its subdomains) whose
+	// tarballs packuments may point at. Those are proxied and cached too;
+	// tarballs of other hosts are left for clients to fetch.
+	TarballHosts []string `json:"tarball_hosts"`
+	// TransparentHosts lists the public registry hosts (e.g.
+	// "registry.npmjs.org") this repository answers for when internal DNS
+	// points them at pkgbin, so clients reach it without any configuration.
+	// Every request made to them is served by the registry, whatever its
+	// path.
+	TransparentHosts []string `json:"transparent_hosts"`
+	// FullMirror lists the packages downloaded in full ahead of requests.
+	FullMirror FullMirror `json:"full_mirror"`
+	// Retention limits how many versions of each package stay cached.
+	Retention Retention `json:"retention"`
+}
+
+// validateTarballHosts checks the entries of tarball_hosts are host names.
+func validateTarballHosts(hosts []string) error {
+	for _, host := range hosts {
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "/*?#@ ") {
+			return fmt.Errorf("tarball_hosts: %q is not a host name", host)
+		}
+	}
+	return nil
 }
 
 var NPMConfig = NPMProxyConfig{
-	Upstream: "https://registry.npmjs.org",
-	CacheDir: "./npm_cache_data",
+	Upstream:        "https://registry.npmjs.org",
+	CacheDir:        "./npm_cache_data",
+	Vulnerabilities: VulnerabilityScan{APIURL: "https://api.osv.dev", ResultTTL: Duration{24 * time.Hour}},
+	Blocklist:       Blocklist{Interval: Duration{time.Hour}},
+	MetadataDir:     "./npm_metadata_data",
+	MetadataTTL:     Duration{time.Minute},
+	AuditCacheTTL:   Duration{5 * time.Minute},
+	LocalDir:        "./npm_local_data",
+	FullMirror:      FullMirror{Interval: Duration{time.Hour}},
+	Retention:       Retention{Interval: Duration{time.Hour}},
 }
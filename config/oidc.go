@@ -0,0 +1,38 @@
+package config
+
+import "time"
+
+// OIDCConfig enables single sign-on for the dashboard and the admin
+// endpoints through an OpenID Connect provider. It is disabled while
+// Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret Secret `json:"client_secret"`
+	// RedirectURL is the externally reachable /auth/callback URL registered
+	// with the provider.
+	RedirectURL string   `json:"redirect_url"`
+	Scopes      []string `json:"scopes"`
+	// GroupsClaim names the ID token claim listing the user's groups.
+	GroupsClaim string `json:"groups_claim"`
+	// AdminGroups may use the dashboard and every admin endpoint;
+	// ViewerGroups may only view the dashboard. Empty ViewerGroups lets
+	// any authenticated user view it.
+	AdminGroups  []string `json:"admin_groups"`
+	ViewerGroups []string `json:"viewer_groups"`
+	// SessionSecret signs session cookies. Without it a random key is used,
+	// so sessions do not survive restarts or span several instances.
+	SessionSecret Secret   `json:"session_secret"`
+	SessionTTL    Duration `json:"session_ttl"`
+}
+
+// Enabled reports whether an OIDC provider is configured.
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+var OIDC = OIDCConfig{
+	Scopes:      []string{"openid", "profile", "email"},
+	GroupsClaim: "groups",
+	SessionTTL:  Duration{8 * time.Hour},
+}
@@ -0,0 +1,27 @@
+package config
+
+// Policy decides which packages a repository serves. Rules are evaluated in
+// order and the first one matching a package decides; packages no rule
+// matches are allowed unless Default is "deny". Versions found yanked or
+// unpublished upstream are refused when Yanked is "deny", and only flagged
+// otherwise.
+type Policy struct {
+	Default string       `json:"default"`
+	Rules   []PolicyRule `json:"rules"`
+	Yanked  string       `json:"yanked"`
+}
+
+// PolicyRule allows or denies the packages matching all of its set
+// criteria. Name is a path.Match glob (e.g. "left-pad" or "@mycorp/*"),
+// Scope an npm scope such as "@mycorp", Regex a regular expression on the
+// name and Versions a version range such as ">=1.0.0 <1.4.2 || 2.0.0".
+// A rule with Versions only applies to downloads of matching versions;
+// metadata stays available so other versions can still be installed.
+type PolicyRule struct {
+	Action   string `json:"action"`
+	Name     string `json:"name,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+	Versions string `json:"versions,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
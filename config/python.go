@@ -1,11 +1,73 @@
 package config
 
+import "time"
+
 type PyPIProxyConfig struct {
-	Upstream string `json:"upstream"`
-	CacheDir string `json:"cache_dir"`
+	// Name is empty for the default repository and set for the named
+	// repositories served under RepositoryPrefix.
+	Name         string             `json:"-"`
+	Repositories []*PyPIProxyConfig `json:"-"`
+
+	Upstream        string            `json:"upstream"`
+	CacheDir        string            `json:"cache_dir"`
+	Auth            UpstreamAuth      `json:"auth"`
+	Routes          []UpstreamRoute   `json:"routes"`
+	Policy          Policy            `json:"policy"`
+	Vulnerabilities VulnerabilityScan `json:"vulnerabilities"`
+	Blocklist       Blocklist         `json:"blocklist"`
+	// MaxConcurrentFetches caps simultaneous upstream artifact downloads
+	// across the registry; zero means unlimited.
+	MaxConcurrentFetches int `json:"max_concurrent_fetches"`
+	// NoStore lists artifacts streamed from upstream without being cached.
+	NoStore NoStore `json:"no_store"`
+	// MaxArtifactSize is the largest artifact cached, in bytes; larger ones
+	// are streamed through, or refused with RejectOversized. Zero means no
+	// limit.
+	MaxArtifactSize int64 `json:"max_artifact_size"`
+	RejectOversized bool  `json:"reject_oversized"`
+	// MetadataDir caches the PEP 740 provenance of distribution files.
+	MetadataDir string `json:"metadata_dir"`
+	// ProvenanceTTL is how long cached provenance is served without
+	// revalidating it, when upstream sends no caching headers.
+	ProvenanceTTL Duration `json:"provenance_ttl"`
+	// ExternalURL is the base URL clients reach the registry at, used in
+	// rewritten metadata and dashboard links. Without it the URL is
+	// derived from each request.
+	ExternalURL string `json:"external_url"`
+	// TransparentHosts lists the public registry hosts (e.g.
+	// "registry.npmjs.org") this repository answers for when internal DNS
+	// points them at pkgbin, so clients reach it without any configuration.
+	// Every request made to them is served by the registry, whatever its
+	// path.
+	TransparentHosts []string `json:"transparent_hosts"`
+	// Mirror keeps a static copy of the cache that can be served as a
+	// PEP 503 index.
+	Mirror PyPIMirror `json:"mirror"`
+	// FullMirror lists the packages downloaded in full ahead of requests.
+	FullMirror FullMirror `json:"full_mirror"`
+	// Retention limits how many versions of each package stay cached.
+	Retention Retention `json:"retention"`
+	// WheelPlatforms limits the platforms wheels are cached for.
+	WheelPlatforms WheelPlatforms `json:"wheel_platforms"`
+}
+
+// PyPIMirror lays the cached distributions out in Dir every Interval (zero
+// disables it) as bandersnatch does: simple/<project>/index.html pages
+// linking to the files under packages/, so any static web server can serve
+// them to offline consumers.
+type PyPIMirror struct {
+	Dir      string   `json:"dir"`
+	Interval Duration `json:"interval"`
 }
 
 var PyPIConfig = PyPIProxyConfig{
-	Upstream: "https://pypi.org",
-	CacheDir: "./pypi_cache_data",
+	Upstream:        "https://pypi.org",
+	CacheDir:        "./pypi_cache_data",
+	Vulnerabilities: VulnerabilityScan{APIURL: "https://api.osv.dev", ResultTTL: Duration{24 * time.Hour}},
+	Blocklist:       Blocklist{Interval: Duration{time.Hour}},
+	MetadataDir:     "./pypi_metadata_data",
+	ProvenanceTTL:   Duration{24 * time.Hour},
+	Mirror:          PyPIMirror{Dir: "./pypi_mirror"},
+	FullMirror:      FullMirror{Interval: Duration{time.Hour}},
+	Retention:       Retention{Interval: Duration{time.Hour}},
 }
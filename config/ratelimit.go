@@ -0,0 +1,16 @@
+package config
+
+// RateLimit limits the requests and bandwidth of each client IP. Zero
+// values disable the corresponding limit.
+type RateLimit struct {
+	// RequestsPerSecond is the sustained request rate; Burst is how many
+	// requests may arrive at once (defaults to RequestsPerSecond).
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// BytesPerSecond throttles the responses sent to each client; BurstBytes
+	// defaults to one second worth.
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	BurstBytes     int64 `json:"burst_bytes"`
+	// Exempt lists client IPs or CIDR ranges that are never limited.
+	Exempt []string `json:"exempt"`
+}
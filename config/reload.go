@@ -0,0 +1,123 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+// Path returns the configuration file Load read, empty when there was
+// none.
+func Path() string {
+	return loadedPath
+}
+
+// Reload reads the configuration file Load read again, with the
+// environment overrides, and publishes it as Current once check accepts
+// it. On any error the configuration in effect is left as it was. The
+// settings only read at startup, such as the listen address, the cache
+// directories and the named repositories served, keep their value; those
+// the file changed are returned, as they need a restart. Requests in flight
+// carry on with the settings they started with.
+func Reload(check func(*Settings) error) (restartOnly []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	s, err := parse(loadedPath)
+	if err != nil {
+		return nil, err
+	}
+	restartOnly = s.keepStartupSettings(Current())
+	if check != nil {
+		if err := check(s); err != nil {
+			return nil, err
+		}
+	}
+	settings.Store(s)
+	sort.Strings(restartOnly)
+	return restartOnly, nil
+}
+
+// keepStartupSettings sets the settings of s only read at startup back to
+// those of live, returning the names of those that differed. live is left
+// as it is.
+func (s *Settings) keepStartupSettings(live *Settings) []string {
+	var changed []string
+	keep(&changed, "server.host", &s.Server.Host, live.Server.Host)
+	keep(&changed, "server.port", &s.Server.Port, live.Server.Port)
+	keep(&changed, "server.tls", &s.Server.TLS, live.Server.TLS)
+	keep(&changed, "server.registry_hosts", &s.Server.RegistryHosts, live.Server.RegistryHosts)
+	keep(&changed, "server.debug", &s.Server.Debug, live.Server.Debug)
+	keep(&changed, "server.cluster", &s.Server.Cluster, live.Server.Cluster)
+	keep(&changed, "server.replica_of", &s.Server.ReplicaOf, live.Server.ReplicaOf)
+	keep(&changed, "server.sync", &s.Server.Sync, live.Server.Sync)
+	keep(&changed, "http_client", &s.HTTP, live.HTTP)
+	keep(&changed, "oidc", &s.OIDC, live.OIDC)
+	keep(&changed, "alerts", &s.Alerts, live.Alerts)
+
+	keepNPM := func(prefix string, fresh, old *NPMProxyConfig) {
+		keep(&changed, prefix+"cache_dir", &fresh.CacheDir, old.CacheDir)
+		keep(&changed, prefix+"metadata_dir", &fresh.MetadataDir, old.MetadataDir)
+		keep(&changed, prefix+"local_dir", &fresh.LocalDir, old.LocalDir)
+		keep(&changed, prefix+"transparent_hosts", &fresh.TransparentHosts, old.TransparentHosts)
+	}
+	keepPyPI := func(prefix string, fresh, old *PyPIProxyConfig) {
+		keep(&changed, prefix+"cache_dir", &fresh.CacheDir, old.CacheDir)
+		keep(&changed, prefix+"metadata_dir", &fresh.MetadataDir, old.MetadataDir)
+		keep(&changed, prefix+"mirror", &fresh.Mirror, old.Mirror)
+		keep(&changed, prefix+"transparent_hosts", &fresh.TransparentHosts, old.TransparentHosts)
+	}
+	keepGems := func(prefix string, fresh, old *RubyGemsProxyConfig) {
+		keep(&changed, prefix+"cache_dir", &fresh.CacheDir, old.CacheDir)
+		keep(&changed, prefix+"metadata_dir", &fresh.MetadataDir, old.MetadataDir)
+		keep(&changed, prefix+"transparent_hosts", &fresh.TransparentHosts, old.TransparentHosts)
+	}
+	keepNPM("npm.", &s.NPM, &live.NPM)
+	keepPyPI("pypi.", &s.PyPI, &live.PyPI)
+	keepGems("rubygems.", &s.RubyGems, &live.RubyGems)
+	s.NPM.Repositories = reloadRepositories(&changed, "npm", live.NPM.Repositories, s.NPM.Repositories,
+		func(repo *NPMProxyConfig) string { return repo.Name }, keepNPM)
+	s.PyPI.Repositories = reloadRepositories(&changed, "pypi", live.PyPI.Repositories, s.PyPI.Repositories,
+		func(repo *PyPIProxyConfig) string { return repo.Name }, keepPyPI)
+	s.RubyGems.Repositories = reloadRepositories(&changed, "rubygems", live.RubyGems.Repositories, s.RubyGems.Repositories,
+		func(repo *RubyGemsProxyConfig) string { return repo.Name }, keepGems)
+	return changed
+}
+
+// keep sets *fresh back to old, adding name to changed when they differ.
+func keep[T any](changed *[]string, name string, fresh *T, old T) {
+	if !reflect.DeepEqual(*fresh, old) {
+		*changed = append(*changed, name)
+		*fresh = old
+	}
+}
+
+// reloadRepositories returns the named repositories live of registry with
+// their settings in fresh, keeping their directories. Repositories added or
+// removed are reported in changed: those removed keep their settings in
+// live, and those added are left out.
+func reloadRepositories[T any](changed *[]string, registry string, live, fresh []*T, name func(*T) string, keepStartup func(prefix string, fresh, old *T)) []*T {
+	byName := make(map[string]*T, len(fresh))
+	for _, repo := range fresh {
+		byName[name(repo)] = repo
+	}
+	repos := make([]*T, 0, len(live))
+	for _, repo := range live {
+		prefix := registry + ".repositories[" + name(repo) + "]"
+		updated, ok := byName[name(repo)]
+		if !ok {
+			*changed = append(*changed, prefix+" removed")
+			repos = append(repos, repo)
+			continue
+		}
+		delete(byName, name(repo))
+		keepStartup(prefix+".", updated, repo)
+		repos = append(repos, updated)
+	}
+	for repoName := range byName {
+		*changed = append(*changed, registry+".repositories["+repoName+"] added")
+	}
+	return repos
+}
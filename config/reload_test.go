@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReloadPublishesNewSettings(t *testing.T) {
+	saved, savedPath, savedSettings := globals(), loadedPath, settings.Load()
+	t.Cleanup(func() {
+		saved.install()
+		loadedPath = savedPath
+		settings.Store(savedSettings)
+	})
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"npm": {"upstream": "https://a.example.com", "repositories": [{"name": "x", "upstream": "https://xa.example.com"}]}}`)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	before := Current()
+	named := before.NPM.Repositories[0]
+
+	write(`{"npm": {"upstream": "https://b.example.com", "cache_dir": "/elsewhere", "repositories": [{"name": "x", "upstream": "https://xb.example.com"}]}}`)
+	restartOnly, err := Reload(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests holding the settings they started with keep them
+	if before.NPM.Upstream != "https://a.example.com" || named.Upstream != "https://xa.example.com" {
+		t.Errorf("reload changed the settings in effect before it: %s, %s", before.NPM.Upstream, named.Upstream)
+	}
+	if NPMConfig.Upstream != "https://a.example.com" {
+		t.Errorf("reload changed the startup configuration to %s", NPMConfig.Upstream)
+	}
+	after := Current()
+	if after.NPM.Upstream != "https://b.example.com" || after.NPM.Repositories[0].Upstream != "https://xb.example.com" {
+		t.Errorf("reloaded upstreams are %s and %s", after.NPM.Upstream, after.NPM.Repositories[0].Upstream)
+	}
+	if after.NPM.CacheDir != before.NPM.CacheDir || !slices.Contains(restartOnly, "npm.cache_dir") {
+		t.Errorf("cache_dir reloaded as %s, restart required for %v", after.NPM.CacheDir, restartOnly)
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RepositoryPrefix is the URL prefix named repositories are served under,
+// e.g. /~internal/ for the repository "internal". No npm, PyPI or gem name
+// can start with "~", so the prefix never shadows a package.
+const RepositoryPrefix = "/~"
+
+var repositoryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// repositoryDir derives the default directory of a named repository from
+// the matching directory of the registry, e.g. ./npm_cache_data_internal.
+func repositoryDir(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return dir + "_" + name
+}
+
+// repositoryURL derives the default external URL of a named repository
+// from the external URL of the registry.
+func repositoryURL(externalURL, name string) string {
+	if externalURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(externalURL, "/") + RepositoryPrefix + name
+}
+
+// validateExternalURL checks that an external_url is an absolute http(s)
+// URL without query or fragment.
+func validateExternalURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid external_url %q", raw)
+	}
+	return nil
+}
+
+// validateTransparentHosts checks the transparent_hosts of every
+// repository are host names, each listed by one repository only.
+func validateTransparentHosts(repos [][]string) error {
+	seen := make(map[string]bool)
+	for _, hosts := range repos {
+		for _, host := range hosts {
+			if host == "" || host != strings.ToLower(host) || strings.ContainsAny(host, "/*?#@:[] ") {
+				return fmt.Errorf("transparent_hosts: %q is not a lower-case host name", host)
+			}
+			if seen[host] {
+				return fmt.Errorf("transparent_hosts: %s is listed twice", host)
+			}
+			seen[host] = true
+		}
+	}
+	return nil
+}
+
+// decodeRepositories decodes the "repositories" list of a registry section.
+// newRepository returns the config a repository entry is decoded into,
+// pre-filled from the registry's own settings so entries only list what
+// differs.
+func decodeRepositories(raw []json.RawMessage, newRepository func(name string) any) error {
+	seen := make(map[string]bool)
+	for _, entry := range raw {
+		var named struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(entry, &named); err != nil {
+			return err
+		}
+		if !repositoryNamePattern.MatchString(named.Name) {
+			return fmt.Errorf("invalid repository name %q", named.Name)
+		}
+		if seen[named.Name] {
+			return fmt.Errorf("duplicate repository %q", named.Name)
+		}
+		seen[named.Name] = true
+		if err := json.Unmarshal(entry, newRepository(named.Name)); err != nil {
+			return fmt.Errorf("repository %s: %w", named.Name, err)
+		}
+	}
+	return nil
+}
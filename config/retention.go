@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"path"
+)
+
+// Retention keeps at most KeepVersions versions of each cached package of
+// a repository, those accessed most recently, evicting the files of the
+// others every Interval. Rules override the limit for the packages whose
+// name matches their path.Match glob (PEP 503 normalized for PyPI), e.g.
+// "@mycorp/*", the first matching rule applying. A zero limit keeps every
+// version.
+type Retention struct {
+	KeepVersions int             `json:"keep_versions"`
+	Rules        []RetentionRule `json:"rules"`
+	Interval     Duration        `json:"interval"`
+}
+
+// RetentionRule is how many versions of the packages matching Package are
+// kept.
+type RetentionRule struct {
+	Package      string `json:"package"`
+	KeepVersions int    `json:"keep_versions"`
+}
+
+// Enabled reports whether r limits the versions of any package.
+func (r Retention) Enabled() bool {
+	if r.KeepVersions > 0 {
+		return true
+	}
+	for _, rule := range r.Rules {
+		if rule.KeepVersions > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// KeepFor returns how many versions of pkgName are kept, zero for all.
+func (r Retention) KeepFor(pkgName string) int {
+	for _, rule := range r.Rules {
+		if ok, _ := path.Match(rule.Package, pkgName); ok {
+			return rule.KeepVersions
+		}
+	}
+	return r.KeepVersions
+}
+
+// validate checks the limits and patterns of r.
+func (r Retention) validate() error {
+	if r.KeepVersions < 0 {
+		return fmt.Errorf("retention keep_versions must not be negative")
+	}
+	for _, rule := range r.Rules {
+		if _, err := path.Match(rule.Package, ""); err != nil || rule.Package == "" {
+			return fmt.Errorf("invalid retention package pattern %q", rule.Package)
+		}
+		if rule.KeepVersions < 0 {
+			return fmt.Errorf("retention keep_versions of %q must not be negative", rule.Package)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package config
+
+// UpstreamRoute sends packages whose name matches Pattern to a different
+// upstream than the registry default, e.g. "@mycorp/*" for an npm scope,
+// "mycorp-*" for PyPI projects (matched against the PEP 503 normalized
+// name) or gems. Patterns use path.Match syntax; the first match wins.
+type UpstreamRoute struct {
+	Pattern  string       `json:"pattern"`
+	Upstream string       `json:"upstream"`
+	Auth     UpstreamAuth `json:"auth"`
+}
@@ -1,11 +1,57 @@
 package config
 
+import "time"
+
 type RubyGemsProxyConfig struct {
-	Upstream string `json:"upstream"`
-	CacheDir string `json:"cache_dir"`
+	// Name is empty for the default repository and set for the named
+	// repositories served under RepositoryPrefix.
+	Name         string                 `json:"-"`
+	Repositories []*RubyGemsProxyConfig `json:"-"`
+
+	Upstream        string            `json:"upstream"`
+	CacheDir        string            `json:"cache_dir"`
+	Auth            UpstreamAuth      `json:"auth"`
+	Routes          []UpstreamRoute   `json:"routes"`
+	Policy          Policy            `json:"policy"`
+	Vulnerabilities VulnerabilityScan `json:"vulnerabilities"`
+	Blocklist       Blocklist         `json:"blocklist"`
+	MetadataDir     string            `json:"metadata_dir"`
+	MetadataTTL     Duration          `json:"metadata_ttl"`
+	SpecsTTL        Duration          `json:"specs_ttl"`
+	// MaxConcurrentFetches caps simultaneous upstream artifact downloads
+	// across the registry; zero means unlimited.
+	MaxConcurrentFetches int `json:"max_concurrent_fetches"`
+	// NoStore lists artifacts streamed from upstream without being cached.
+	NoStore NoStore `json:"no_store"`
+	// MaxArtifactSize is the largest artifact cached, in bytes; larger ones
+	// are streamed through, or refused with RejectOversized. Zero means no
+	// limit.
+	MaxArtifactSize int64 `json:"max_artifact_size"`
+	RejectOversized bool  `json:"reject_oversized"`
+	// ExternalURL is the base URL clients reach the registry at, used in
+	// rewritten metadata and dashboard links. Without it the URL is
+	// derived from each request.
+	ExternalURL string `json:"external_url"`
+	// TransparentHosts lists the public registry hosts (e.g.
+	// "registry.npmjs.org") this repository answers for when internal DNS
+	// points them at pkgbin, so clients reach it without any configuration.
+	// Every request made to them is served by the registry, whatever its
+	// path.
+	TransparentHosts []string `json:"transparent_hosts"`
+	// FullMirror lists the packages downloaded in full ahead of requests.
+	FullMirror FullMirror `json:"full_mirror"`
+	// Retention limits how many versions of each package stay cached.
+	Retention Retention `json:"retention"`
 }
 
 var RubyGemsConfig = RubyGemsProxyConfig{
-	Upstream: "https://rubygems.org",
-	CacheDir: "./gem_cache_data",
+	Upstream:        "https://rubygems.org",
+	CacheDir:        "./gem_cache_data",
+	Vulnerabilities: VulnerabilityScan{APIURL: "https://api.osv.dev", ResultTTL: Duration{24 * time.Hour}},
+	Blocklist:       Blocklist{Interval: Duration{time.Hour}},
+	MetadataDir:     "./gem_metadata_data",
+	MetadataTTL:     Duration{time.Minute},
+	SpecsTTL:        Duration{10 * time.Minute},
+	FullMirror:      FullMirror{Interval: Duration{time.Hour}},
+	Retention:       Retention{Interval: Duration{time.Hour}},
 }
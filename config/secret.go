@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secret references a sensitive value kept outside the config file, either
+// in an environment variable or in a file (e.g. a mounted Docker or
+// Kubernetes secret).
+type Secret struct {
+	Env  string `json:"env,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+// IsSet reports whether the secret references a source.
+func (s Secret) IsSet() bool {
+	return s.Env != "" || s.File != ""
+}
+
+// Value resolves the secret. File contents are trimmed of surrounding
+// whitespace so trailing newlines do not end up in headers.
+func (s Secret) Value() (string, error) {
+	switch {
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return value, nil
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return "", nil
+	}
+}
+
+// UpstreamAuth holds the credentials pkgbin presents to a private upstream.
+type UpstreamAuth struct {
+	// Token is sent as a bearer token (npm automation tokens and the like).
+	Token Secret `json:"token"`
+	// Username and Password are sent as HTTP basic auth (devpi, Artifactory,
+	// private gem servers).
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+}
@@ -1,11 +1,282 @@
 package config
 
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
 type ServerConfig struct {
 	Host string `json:"host"`
 	Port string `json:"port"`
+	// TLS serves HTTPS instead of plain HTTP when configured.
+	TLS TLSConfig `json:"tls"`
+	// RegistryHosts maps the host names the pkgbin server answers for to
+	// the registry serving their requests, by the name of its section
+	// ("npm", "pypi" or "rubygems"), so one listener serves every
+	// registry. The proxies of a single registry ignore it.
+	RegistryHosts map[string]string `json:"registry_hosts"`
+	// TrustedProxies lists the addresses or CIDR ranges of the reverse
+	// proxies in front of pkgbin. The client address of a request from one
+	// of them is taken from X-Forwarded-For, skipping the trusted proxies it
+	// went through; X-Forwarded-For is ignored from anyone else.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// RateLimit applies per client IP to every registry request.
+	RateLimit RateLimit `json:"rate_limit"`
+	// LoadShedding refuses downloads beyond what the proxy can take on.
+	LoadShedding LoadShedding `json:"load_shedding"`
+	// DiskGuard keeps cache misses from filling the cache volume.
+	DiskGuard DiskGuard `json:"disk_guard"`
+	// UpstreamBytesPerSecond caps the aggregate download bandwidth from all
+	// upstreams; zero means unlimited.
+	UpstreamBytesPerSecond int64 `json:"upstream_bytes_per_second"`
+	// CircuitBreaker stops sending requests to a failing upstream for a
+	// while.
+	CircuitBreaker CircuitBreaker `json:"circuit_breaker"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// after SIGTERM before they are cut off.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// ShutdownDelay is how long the server keeps accepting connections
+	// after SIGTERM, with /healthz failing, so load balancers and
+	// orchestrators stop sending it requests before it drains.
+	ShutdownDelay Duration `json:"shutdown_delay"`
+	// ConfigWatchInterval is how often the configuration file is checked
+	// for changes, which are then reloaded; zero only reloads on SIGHUP or
+	// through the API.
+	ConfigWatchInterval Duration `json:"config_watch_interval"`
+	// TempFileMaxAge is how long a temporary download file may go without
+	// being written to before it is considered abandoned and removed; zero
+	// only cleans up at startup.
+	TempFileMaxAge Duration `json:"temp_file_max_age"`
+	// StatsFlushInterval is how often buffered cache hit and miss counts are
+	// written to the database.
+	StatsFlushInterval Duration `json:"stats_flush_interval"`
+	// HistoryRetention is how long individual download events are kept;
+	// zero keeps them forever.
+	HistoryRetention Duration `json:"history_retention"`
+	// ReconcileInterval is how often cached files are compared with the
+	// packages table and the differences repaired; zero disables it.
+	ReconcileInterval Duration `json:"reconcile_interval"`
+	// RevalidateInterval is how often the versions of cached files are
+	// checked against upstream metadata, flagging those yanked or
+	// unpublished since; zero disables it.
+	RevalidateInterval Duration `json:"revalidate_interval"`
+	// UpstreamDeletions is what revalidation does with cached files that
+	// are gone upstream: UpstreamDeletionsKeep serves them on, for
+	// availability, and UpstreamDeletionsPurge removes them, for
+	// compliance. Either way an audit event is recorded.
+	UpstreamDeletions string `json:"upstream_deletions"`
+	// PurgeRetention is how long purged files are kept in the trash of
+	// their cache directory, from which they can be restored; zero deletes
+	// them right away.
+	PurgeRetention Duration `json:"purge_retention"`
+	// Maintenance confines heavy background jobs to time windows.
+	Maintenance Maintenance `json:"maintenance"`
+	// NegativeCacheTTL is how long artifacts upstream answered 404 for are
+	// answered 404 without asking upstream again; zero disables it.
+	NegativeCacheTTL Duration `json:"negative_cache_ttl"`
+	// Scrub re-verifies cached files against their recorded digests.
+	Scrub Scrub `json:"scrub"`
+	// Backup periodically snapshots the database metadata to files.
+	Backup Backup `json:"backup"`
+	// CostPerGB is the price of a GB of upstream traffic, such as cloud
+	// egress or a metered link, used to estimate what cache hits saved;
+	// zero leaves the estimate out.
+	CostPerGB float64 `json:"cost_per_gb"`
+	// Currency prefixes the cost estimates.
+	Currency string `json:"currency"`
+	// UpstreamProbeInterval is how often every configured upstream is
+	// probed for the status page; zero disables it.
+	UpstreamProbeInterval Duration `json:"upstream_probe_interval"`
+	// Debug serves pprof profiles and expvar variables on a separate port.
+	Debug DebugServer `json:"debug"`
+	// Cluster coordinates instances sharing their cache and database.
+	Cluster Cluster `json:"cluster"`
+	// ReplicaOf makes this instance a read-only replica of the writer
+	// instance at this URL: it serves the artifacts the writer cached, from
+	// shared storage and the shared database, and streams cache misses from
+	// the writer, which caches them, without ever writing to the cache or
+	// the database itself.
+	ReplicaOf string `json:"replica_of"`
+	// Sync keeps the cache of a standby instance warm by copying what its
+	// primary caches.
+	Sync Sync `json:"sync"`
+}
+
+// Sync pulls the files newly cached by the primary instance at Primary,
+// with their package rows, every Interval, authenticating with Auth (an
+// admin token of the primary, typically). Nothing is synced without
+// Primary, or with a zero interval.
+type Sync struct {
+	Primary  string       `json:"primary"`
+	Auth     UpstreamAuth `json:"auth"`
+	Interval Duration     `json:"interval"`
+}
+
+// Cluster is set on every instance of a pkgbin deployment running several
+// behind a load balancer, with the cache directories on shared storage
+// (such as NFS) and one database. Instances then take locks so only one
+// downloads a given file, and only one runs each reconciliation and scrub.
+// The locks are held in Redis when configured, or as Postgres advisory
+// locks otherwise, each on a connection of a pool of LockConnections kept
+// apart from the one of the queries.
+type Cluster struct {
+	Enabled         bool  `json:"enabled"`
+	Redis           Redis `json:"redis"`
+	LockConnections int   `json:"lock_connections"`
+}
+
+// Redis is the server instances of a cluster share their locks through
+// when Address is set, along with their request rate limits, negative
+// cache entries and download counters. Keys are prefixed with KeyPrefix.
+type Redis struct {
+	Address   string `json:"address"`
+	Password  Secret `json:"password"`
+	DB        int    `json:"db"`
+	KeyPrefix string `json:"key_prefix"`
+}
+
+// DebugServer is the listener of the runtime debug endpoints. They are only
+// served when Port is set, and only to localhost by default.
+type DebugServer struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+// Scrub re-hashes every cached file against the digests recorded when it
+// was cached, every Interval (zero disables it), reading at most
+// BytesPerSecond so downloads keep the disk. Corrupted files are moved to
+// QuarantineDir, or deleted without one, and fetched again on their next
+// download.
+type Scrub struct {
+	Interval       Duration `json:"interval"`
+	BytesPerSecond int64    `json:"bytes_per_second"`
+	QuarantineDir  string   `json:"quarantine_dir"`
+}
+
+// Backup writes a snapshot of the database metadata of the registry to Dir
+// every Interval (zero disables it), keeping the Keep latest, with a
+// manifest of the cached files and their digests when Files is set.
+type Backup struct {
+	Dir      string   `json:"dir"`
+	Interval Duration `json:"interval"`
+	Keep     int      `json:"keep"`
+	Files    bool     `json:"files"`
+}
+
+// LoadShedding refuses artifact downloads with a 503 once
+// MaxInFlightDownloads are being served or MaxQueuedFetches cache misses
+// wait for an upstream download slot, telling clients to come back after
+// RetryAfter. Zero limits disable them.
+type LoadShedding struct {
+	MaxInFlightDownloads int      `json:"max_in_flight_downloads"`
+	MaxQueuedFetches     int      `json:"max_queued_fetches"`
+	RetryAfter           Duration `json:"retry_after"`
+}
+
+// DiskGuard checks the free space of the cache volume before a missed
+// artifact is cached. Below MinFreeBytes or MinFreePercent, the least
+// recently used cached files of the registry are evicted to make room when
+// Evict is set; if space is still short, the artifact is streamed to the
+// client without being cached. Zero thresholds disable the check.
+type DiskGuard struct {
+	MinFreeBytes   int64   `json:"min_free_bytes"`
+	MinFreePercent float64 `json:"min_free_percent"`
+	Evict          bool    `json:"evict"`
+}
+
+// CircuitBreaker trips after FailureThreshold consecutive upstream errors
+// and stays open for Cooldown. A zero threshold disables it.
+type CircuitBreaker struct {
+	FailureThreshold int      `json:"failure_threshold"`
+	Cooldown         Duration `json:"cooldown"`
 }
 
 var Server = ServerConfig{
 	Host: "0.0.0.0",
 	Port: "8080",
+	CircuitBreaker: CircuitBreaker{
+		FailureThreshold: 5,
+		Cooldown:         Duration{30 * time.Second},
+	},
+	LoadShedding: LoadShedding{
+		RetryAfter: Duration{5 * time.Second},
+	},
+	ShutdownTimeout:       Duration{30 * time.Second},
+	TempFileMaxAge:        Duration{time.Hour},
+	StatsFlushInterval:    Duration{5 * time.Second},
+	HistoryRetention:      Duration{90 * 24 * time.Hour},
+	ReconcileInterval:     Duration{time.Hour},
+	UpstreamDeletions:     UpstreamDeletionsKeep,
+	PurgeRetention:        Duration{24 * time.Hour},
+	UpstreamProbeInterval: Duration{time.Minute},
+	Currency:              "$",
+	Scrub: Scrub{
+		BytesPerSecond: 20 << 20,
+	},
+	Backup: Backup{
+		Dir:  "./backups",
+		Keep: 7,
+	},
+	Debug: DebugServer{
+		Host: "127.0.0.1",
+	},
+	Cluster: Cluster{
+		Redis:           Redis{KeyPrefix: "pkgbin:"},
+		LockConnections: 16,
+	},
+	Sync: Sync{
+		Interval: Duration{time.Minute},
+	},
+}
+
+// What revalidation does with cached files that are gone upstream
+const (
+	UpstreamDeletionsKeep  = "keep"
+	UpstreamDeletionsPurge = "purge"
+)
+
+// validateUpstreamDeletions checks the upstream_deletions setting.
+func validateUpstreamDeletions(mode string) error {
+	switch mode {
+	case UpstreamDeletionsKeep, UpstreamDeletionsPurge:
+		return nil
+	}
+	return fmt.Errorf("invalid upstream_deletions %q, want %q or %q", mode, UpstreamDeletionsKeep, UpstreamDeletionsPurge)
+}
+
+// validateRegistryHosts checks that the registry_hosts are host names,
+// none of them a transparent host, mapped to a registry section.
+func validateRegistryHosts(hosts map[string]string, transparentHosts [][]string) error {
+	for host, registry := range hosts {
+		if host == "" || host != strings.ToLower(host) || strings.ContainsAny(host, "/*?#@:[] ") {
+			return fmt.Errorf("registry_hosts: %q is not a lower-case host name", host)
+		}
+		switch registry {
+		case "npm", "pypi", "rubygems":
+		default:
+			return fmt.Errorf("registry_hosts: %s is mapped to %q, want \"npm\", \"pypi\" or \"rubygems\"", host, registry)
+		}
+		for _, transparent := range transparentHosts {
+			if slices.Contains(transparent, host) {
+				return fmt.Errorf("registry_hosts: %s is also a transparent host", host)
+			}
+		}
+	}
+	return nil
+}
+
+// validateInstanceURL checks that the URL of another instance, set as
+// setting, is an absolute http(s) URL without query or fragment.
+func validateInstanceURL(setting, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid %s %q", setting, raw)
+	}
+	return nil
 }
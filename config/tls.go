@@ -0,0 +1,35 @@
+package config
+
+// TLSConfig serves HTTPS directly, either with a certificate and key from
+// files or with certificates obtained automatically over ACME.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	ACME     ACME   `json:"acme"`
+	// Certificates are served to the clients asking for one of the names
+	// they cover, e.g. the certificates an internal CA issued for the
+	// transparent hosts of the registries.
+	Certificates []Certificate `json:"certificates"`
+}
+
+// Certificate is a certificate and its key, from PEM files.
+type Certificate struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// ACME obtains and renews certificates for Domains, by default from
+// Let's Encrypt. The listener must be reachable on port 443 of those
+// domains for the TLS-ALPN challenge.
+type ACME struct {
+	Domains []string `json:"domains"`
+	Email   string   `json:"email"`
+	// CacheDir keeps the account key and certificates across restarts.
+	CacheDir     string `json:"cache_dir"`
+	DirectoryURL string `json:"directory_url"`
+}
+
+// Enabled reports whether the listener should serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || len(c.ACME.Domains) > 0 || len(c.Certificates) > 0
+}
@@ -0,0 +1,13 @@
+package config
+
+// VulnerabilityScan configures lookups of known vulnerabilities for the
+// package versions a registry serves, using the OSV.dev API or a local
+// service implementing the same /v1/query endpoint.
+type VulnerabilityScan struct {
+	Enabled bool   `json:"enabled"`
+	APIURL  string `json:"api_url"`
+	// BlockSeverity refuses versions with a vulnerability of at least this
+	// severity (LOW, MEDIUM, HIGH or CRITICAL). Empty only records findings.
+	BlockSeverity string   `json:"block_severity"`
+	ResultTTL     Duration `json:"result_ttl"`
+}
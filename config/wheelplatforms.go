@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"path"
+)
+
+// WheelPlatforms selects the wheels a PyPI repository caches by their
+// platform tags, so builds for platforms no one in the organization runs
+// on do not take up space. Allow and Deny are path.Match globs on the
+// platform tags of wheel file names, e.g. "manylinux*_x86_64",
+// "macosx_*_arm64" or "win*". A wheel is cached when one of its platform
+// tags matches Allow, or Allow is empty, and does not match Deny; other
+// wheels are streamed through. Pure Python wheels, tagged "any", pass
+// Allow, and source distributions are always cached.
+type WheelPlatforms struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Enabled reports whether w refuses any platform.
+func (w WheelPlatforms) Enabled() bool {
+	return len(w.Allow) > 0 || len(w.Deny) > 0
+}
+
+// Allows reports whether w caches the wheels built for platform.
+func (w WheelPlatforms) Allows(platform string) bool {
+	if len(w.Allow) > 0 && platform != "any" && !matchesPattern(w.Allow, platform) {
+		return false
+	}
+	return !matchesPattern(w.Deny, platform)
+}
+
+// validate checks the patterns of w.
+func (w WheelPlatforms) validate() error {
+	for _, pattern := range append(append([]string{}, w.Allow...), w.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid wheel_platforms pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// matchesPattern reports whether s matches one of the path.Match patterns.
+func matchesPattern(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
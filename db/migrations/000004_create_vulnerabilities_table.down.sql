@@ -0,0 +1,2 @@
+-- Drop vulnerabilities table
+DROP TABLE IF EXISTS vulnerabilities;
@@ -0,0 +1,3 @@
+-- Package access is recorded with an upsert from Go, so the database needs
+-- no custom functions
+DROP FUNCTION IF EXISTS record_package_access(VARCHAR, BOOLEAN);
@@ -0,0 +1,6 @@
+-- Drop the cached file columns of packages
+ALTER TABLE packages DROP COLUMN IF EXISTS last_accessed_at;
+ALTER TABLE packages DROP COLUMN IF EXISTS sha512;
+ALTER TABLE packages DROP COLUMN IF EXISTS sha256;
+ALTER TABLE packages DROP COLUMN IF EXISTS size_bytes;
+ALTER TABLE packages DROP COLUMN IF EXISTS registry;
@@ -0,0 +1,5 @@
+-- Record the package name and version parsed from cached file names
+ALTER TABLE packages ADD COLUMN package_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE packages ADD COLUMN version VARCHAR(128) NOT NULL DEFAULT '';
+
+CREATE INDEX idx_packages_package_name ON packages (package_name);
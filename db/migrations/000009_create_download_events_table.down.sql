@@ -0,0 +1,2 @@
+-- Drop download_events table
+DROP TABLE IF EXISTS download_events;
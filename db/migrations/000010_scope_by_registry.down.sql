@@ -0,0 +1,10 @@
+-- Drop the registry scoping of packages and client downloads
+DROP INDEX IF EXISTS idx_download_events_registry;
+
+ALTER TABLE client_downloads DROP CONSTRAINT client_downloads_registry_package_name_client_user_agent_key;
+ALTER TABLE client_downloads ADD CONSTRAINT client_downloads_package_name_client_user_agent_key
+    UNIQUE (package_name, client, user_agent);
+ALTER TABLE client_downloads DROP COLUMN registry;
+
+ALTER TABLE packages DROP CONSTRAINT packages_registry_name_key;
+ALTER TABLE packages ADD CONSTRAINT packages_name_key UNIQUE (name);
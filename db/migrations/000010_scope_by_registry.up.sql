@@ -0,0 +1,16 @@
+-- Scope cached files and client downloads by registry, so proxies sharing
+-- a database keep their packages apart
+UPDATE packages SET registry = 'npm' WHERE registry = '' AND name LIKE '%.tgz';
+UPDATE packages SET registry = 'rubygems' WHERE registry = '' AND name LIKE '%.gem';
+UPDATE packages SET registry = 'pypi' WHERE registry = ''
+    AND (name LIKE '%.whl' OR name LIKE '%.tar.gz' OR name LIKE '%.zip' OR name LIKE '%.egg' OR name LIKE '%.tar.bz2');
+
+ALTER TABLE packages DROP CONSTRAINT packages_name_key;
+ALTER TABLE packages ADD CONSTRAINT packages_registry_name_key UNIQUE (registry, name);
+
+ALTER TABLE client_downloads ADD COLUMN registry VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE client_downloads DROP CONSTRAINT client_downloads_package_name_client_user_agent_key;
+ALTER TABLE client_downloads ADD CONSTRAINT client_downloads_registry_package_name_client_user_agent_key
+    UNIQUE (registry, package_name, client, user_agent);
+
+CREATE INDEX idx_download_events_registry ON download_events (registry);
@@ -0,0 +1,2 @@
+-- Drop cache_snapshots table
+DROP TABLE IF EXISTS cache_snapshots;
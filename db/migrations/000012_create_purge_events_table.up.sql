@@ -0,0 +1,12 @@
+-- Create purge_events table recording every file purged from the cache
+CREATE TABLE purge_events (
+    id BIGSERIAL PRIMARY KEY,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    file_name VARCHAR(255) NOT NULL,
+    package_name VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(128) NOT NULL DEFAULT '',
+    client VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_purge_events_registry_created_at ON purge_events (registry, created_at);
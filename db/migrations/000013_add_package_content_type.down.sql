@@ -0,0 +1,2 @@
+-- Drop the Content-Type of cached files
+ALTER TABLE packages DROP COLUMN IF EXISTS content_type;
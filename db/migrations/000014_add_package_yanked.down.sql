@@ -0,0 +1,3 @@
+-- Drop the yanked flags of cached files
+ALTER TABLE packages DROP COLUMN IF EXISTS yanked_reason;
+ALTER TABLE packages DROP COLUMN IF EXISTS yanked_at;
@@ -0,0 +1,3 @@
+-- Record when upstream stopped serving the version of a cached file, and why
+ALTER TABLE packages ADD COLUMN yanked_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE packages ADD COLUMN yanked_reason VARCHAR(255) NOT NULL DEFAULT '';
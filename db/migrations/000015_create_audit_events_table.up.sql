@@ -0,0 +1,14 @@
+-- Create audit_events table recording the decisions taken on cached files
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    action VARCHAR(64) NOT NULL,
+    file_name VARCHAR(255) NOT NULL DEFAULT '',
+    package_name VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(128) NOT NULL DEFAULT '',
+    actor VARCHAR(255) NOT NULL DEFAULT '',
+    detail VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_audit_events_registry_created_at ON audit_events (registry, created_at);
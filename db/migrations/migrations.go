@@ -0,0 +1,126 @@
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// files holds the versioned schema of every supported database. Postgres
+// migrations live at the top level, SQLite ones in sqlite/.
+//
+//go:embed *.sql sqlite/*.sql
+var files embed.FS
+
+// lockID is the Postgres advisory lock taken while migrating, so replicas
+// starting together apply each migration once.
+const lockID = 0x706b6762696e // "pkgbin"
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_.+\.up\.sql$`)
+
+type migration struct {
+	version uint64
+	name    string
+}
+
+// pending lists the up migrations in dir newer than version, oldest first.
+func pending(dir string, version uint64) ([]migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	var todo []migration
+	for _, entry := range entries {
+		m := fileNamePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		v, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration %s: %w", entry.Name(), err)
+		}
+		if v > version {
+			todo = append(todo, migration{version: v, name: entry.Name()})
+		}
+	}
+	sort.Slice(todo, func(i, j int) bool { return todo[i].version < todo[j].version })
+	return todo, nil
+}
+
+// Run brings the schema of db up to date. Progress is recorded in the
+// schema_migrations table golang-migrate uses, so databases set up with
+// the migrate CLI carry on from the version they are at. All pending
+// migrations are applied in one transaction.
+func Run(db *gorm.DB) error {
+	dir := "."
+	if db.Dialector.Name() == "sqlite" {
+		dir = "sqlite"
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if db.Dialector.Name() == "postgres" {
+		if _, err := tx.Exec(fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", lockID)); err != nil {
+			return fmt.Errorf("locking schema: %w", err)
+		}
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)"); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var version uint64
+	var dirty bool
+	err = tx.QueryRow("SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("schema version %d is dirty: a migration failed halfway, fix the database by hand and clear the dirty flag", version)
+	}
+
+	todo, err := pending(dir, version)
+	if err != nil {
+		return err
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	for _, m := range todo {
+		script, err := fs.ReadFile(files, path.Join(dir, m.name))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(script)); err != nil {
+			return fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+		log.Printf("Applied migration %s", m.name)
+	}
+
+	latest := todo[len(todo)-1].version
+	if _, err := tx.Exec("DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO schema_migrations (version, dirty) VALUES (%d, FALSE)", latest)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Database schema migrated from version %d to %d", version, latest)
+	return nil
+}
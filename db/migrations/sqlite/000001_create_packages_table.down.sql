@@ -0,0 +1,2 @@
+-- Drop packages table
+DROP TABLE IF EXISTS packages;
@@ -0,0 +1,15 @@
+-- Create vulnerabilities table holding findings for cached package versions
+CREATE TABLE vulnerabilities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    file_name VARCHAR(255) NOT NULL,
+    ecosystem VARCHAR(32) NOT NULL,
+    package_name VARCHAR(255) NOT NULL,
+    version VARCHAR(128) NOT NULL,
+    vuln_id VARCHAR(128) NOT NULL,
+    summary TEXT NOT NULL DEFAULT '',
+    severity VARCHAR(16) NOT NULL DEFAULT 'UNKNOWN',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (ecosystem, package_name, version, vuln_id)
+);
+
+CREATE INDEX idx_vulnerabilities_file_name ON vulnerabilities (file_name);
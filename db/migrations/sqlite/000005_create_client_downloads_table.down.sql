@@ -0,0 +1,2 @@
+-- Drop client_downloads table
+DROP TABLE IF EXISTS client_downloads;
@@ -0,0 +1,15 @@
+-- Create client_downloads table attributing downloads to the requesting client
+CREATE TABLE client_downloads (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    package_name VARCHAR(255) NOT NULL,
+    client VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    cache_hit BIGINT NOT NULL DEFAULT 0,
+    cache_miss BIGINT NOT NULL DEFAULT 0,
+    bytes_served BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (package_name, client, user_agent)
+);
+
+CREATE INDEX idx_client_downloads_client ON client_downloads (client);
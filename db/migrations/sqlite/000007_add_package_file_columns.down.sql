@@ -0,0 +1,6 @@
+-- Drop the cached file columns of packages
+ALTER TABLE packages DROP COLUMN last_accessed_at;
+ALTER TABLE packages DROP COLUMN sha512;
+ALTER TABLE packages DROP COLUMN sha256;
+ALTER TABLE packages DROP COLUMN size_bytes;
+ALTER TABLE packages DROP COLUMN registry;
@@ -0,0 +1,6 @@
+-- Record the registry, size, digests and last access of cached files
+ALTER TABLE packages ADD COLUMN registry VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE packages ADD COLUMN size_bytes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE packages ADD COLUMN sha256 VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE packages ADD COLUMN sha512 VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE packages ADD COLUMN last_accessed_at DATETIME;
@@ -0,0 +1,4 @@
+-- Drop the package name and version of cached files
+DROP INDEX IF EXISTS idx_packages_package_name;
+ALTER TABLE packages DROP COLUMN version;
+ALTER TABLE packages DROP COLUMN package_name;
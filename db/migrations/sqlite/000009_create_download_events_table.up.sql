@@ -0,0 +1,15 @@
+-- Create download_events table recording every artifact download
+CREATE TABLE download_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    file_name VARCHAR(255) NOT NULL,
+    package_name VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(128) NOT NULL DEFAULT '',
+    cache_hit BOOLEAN NOT NULL,
+    bytes_served BIGINT NOT NULL DEFAULT 0,
+    client VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_download_events_created_at ON download_events (created_at);
+CREATE INDEX idx_download_events_package_name ON download_events (package_name);
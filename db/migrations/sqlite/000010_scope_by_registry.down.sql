@@ -0,0 +1,41 @@
+-- Drop the registry scoping of packages and client downloads. Rows that
+-- only differ by registry cannot be kept apart and are dropped.
+DROP INDEX IF EXISTS idx_download_events_registry;
+
+CREATE TABLE client_downloads_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    package_name VARCHAR(255) NOT NULL,
+    client VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    cache_hit BIGINT NOT NULL DEFAULT 0,
+    cache_miss BIGINT NOT NULL DEFAULT 0,
+    bytes_served BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (package_name, client, user_agent)
+);
+INSERT OR IGNORE INTO client_downloads_old SELECT id, package_name, client, user_agent, cache_hit, cache_miss,
+    bytes_served, created_at, updated_at FROM client_downloads;
+DROP TABLE client_downloads;
+ALTER TABLE client_downloads_old RENAME TO client_downloads;
+CREATE INDEX idx_client_downloads_client ON client_downloads (client);
+
+CREATE TABLE packages_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    cache_hit INTEGER NOT NULL DEFAULT 0,
+    cache_miss INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    sha512 VARCHAR(128) NOT NULL DEFAULT '',
+    last_accessed_at DATETIME,
+    package_name VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(128) NOT NULL DEFAULT ''
+);
+INSERT OR IGNORE INTO packages_old SELECT * FROM packages;
+DROP TABLE packages;
+ALTER TABLE packages_old RENAME TO packages;
+CREATE INDEX idx_packages_package_name ON packages (package_name);
@@ -0,0 +1,50 @@
+-- Scope cached files and client downloads by registry, so proxies sharing
+-- a database keep their packages apart. SQLite cannot drop a constraint,
+-- so both tables are rebuilt.
+UPDATE packages SET registry = 'npm' WHERE registry = '' AND name LIKE '%.tgz';
+UPDATE packages SET registry = 'rubygems' WHERE registry = '' AND name LIKE '%.gem';
+UPDATE packages SET registry = 'pypi' WHERE registry = ''
+    AND (name LIKE '%.whl' OR name LIKE '%.tar.gz' OR name LIKE '%.zip' OR name LIKE '%.egg' OR name LIKE '%.tar.bz2');
+
+CREATE TABLE packages_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    cache_hit INTEGER NOT NULL DEFAULT 0,
+    cache_miss INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    sha512 VARCHAR(128) NOT NULL DEFAULT '',
+    last_accessed_at DATETIME,
+    package_name VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(128) NOT NULL DEFAULT '',
+    UNIQUE (registry, name)
+);
+INSERT INTO packages_new SELECT id, name, cache_hit, cache_miss, created_at, updated_at, registry,
+    size_bytes, sha256, sha512, last_accessed_at, package_name, version FROM packages;
+DROP TABLE packages;
+ALTER TABLE packages_new RENAME TO packages;
+CREATE INDEX idx_packages_package_name ON packages (package_name);
+
+CREATE TABLE client_downloads_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    package_name VARCHAR(255) NOT NULL,
+    client VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    cache_hit BIGINT NOT NULL DEFAULT 0,
+    cache_miss BIGINT NOT NULL DEFAULT 0,
+    bytes_served BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (registry, package_name, client, user_agent)
+);
+INSERT INTO client_downloads_new (id, package_name, client, user_agent, cache_hit, cache_miss, bytes_served, created_at, updated_at)
+    SELECT id, package_name, client, user_agent, cache_hit, cache_miss, bytes_served, created_at, updated_at FROM client_downloads;
+DROP TABLE client_downloads;
+ALTER TABLE client_downloads_new RENAME TO client_downloads;
+CREATE INDEX idx_client_downloads_client ON client_downloads (client);
+
+CREATE INDEX idx_download_events_registry ON download_events (registry);
@@ -0,0 +1,13 @@
+-- Create cache_snapshots table recording the cache size and download
+-- counters of each registry over time
+CREATE TABLE cache_snapshots (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    file_count BIGINT NOT NULL DEFAULT 0,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    cache_hit BIGINT NOT NULL DEFAULT 0,
+    cache_miss BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_cache_snapshots_registry_created_at ON cache_snapshots (registry, created_at);
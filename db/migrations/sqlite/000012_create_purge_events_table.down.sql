@@ -0,0 +1,2 @@
+-- Drop purge_events table
+DROP TABLE IF EXISTS purge_events;
@@ -0,0 +1,2 @@
+-- Record the Content-Type upstream served each cached file with
+ALTER TABLE packages ADD COLUMN content_type VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- Allow audit_events to be changed again
+DROP TRIGGER IF EXISTS audit_events_no_delete;
+DROP TRIGGER IF EXISTS audit_events_no_update;
@@ -0,0 +1,12 @@
+-- Create projects table holding the package versions the lockfiles of the
+-- registered projects pin, which garbage collection keeps cached
+CREATE TABLE projects (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    registry VARCHAR(16) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    packages TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_projects_registry_name ON projects (registry, name);
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEvent records one decision taken on a cached file, and by whom.
+type AuditEvent struct {
+	ID          int64     `db:"id"`
+	Registry    string    `db:"registry"`
+	Action      string    `db:"action"`
+	FileName    string    `db:"file_name"`
+	PackageName string    `db:"package_name"`
+	Version     string    `db:"version"`
+	Actor       string    `db:"actor"`
+	Detail      string    `db:"detail"`
+	CreatedAt   time.Time `db:"created_at"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// CacheSnapshot records the size of the cache of a registry and its
+// download counters at one point in time.
+type CacheSnapshot struct {
+	ID        int64     `db:"id"`
+	Registry  string    `db:"registry"`
+	FileCount int64     `db:"file_count"`
+	SizeBytes int64     `db:"size_bytes"`
+	CacheHit  int64     `db:"cache_hit"`
+	CacheMiss int64     `db:"cache_miss"`
+	CreatedAt time.Time `db:"created_at"`
+}
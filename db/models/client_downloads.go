@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+type ClientDownload struct {
+	ID          int64     `db:"id"`
+	Registry    string    `db:"registry"`
+	PackageName string    `db:"package_name"`
+	Client      string    `db:"client"`
+	UserAgent   string    `db:"user_agent"`
+	CacheHit    int64     `db:"cache_hit"`
+	CacheMiss   int64     `db:"cache_miss"`
+	BytesServed int64     `db:"bytes_served"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+// ClientSummary aggregates the downloads of one client across packages.
+type ClientSummary struct {
+	Client      string
+	UserAgent   string
+	CacheHit    int64
+	CacheMiss   int64
+	BytesServed int64
+	Packages    int64
+	LastSeen    time.Time
+}
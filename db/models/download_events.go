@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+// DownloadEvent records one artifact download.
+type DownloadEvent struct {
+	ID          int64     `db:"id"`
+	Registry    string    `db:"registry"`
+	FileName    string    `db:"file_name"`
+	PackageName string    `db:"package_name"`
+	Version     string    `db:"version"`
+	CacheHit    bool      `db:"cache_hit"`
+	BytesServed int64     `db:"bytes_served"`
+	Client      string    `db:"client"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// MonthlySavings sums the downloads of one month served from cache, and
+// the bytes they saved fetching from upstream.
+type MonthlySavings struct {
+	Month      string // YYYY-MM
+	CacheHit   int64
+	BytesSaved int64
+}
+
+// DailyDownloads sums the downloads of one day.
+type DailyDownloads struct {
+	Day         string // YYYY-MM-DD
+	CacheHit    int64
+	CacheMiss   int64
+	BytesServed int64
+}
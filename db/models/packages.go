@@ -4,6 +4,13 @@ import (
 	"time"
 )
 
+// Registries a package can be cached from.
+const (
+	RegistryNPM      = "npm"
+	RegistryPyPI     = "pypi"
+	RegistryRubyGems = "rubygems"
+)
+
 type Package struct {
 	ID        int64     `db:"id"`
 	Name      string    `db:"name"`
@@ -11,4 +18,53 @@ type Package struct {
 	CacheMiss int64     `db:"cache_miss"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
+	// Registry is the kind of registry the file was cached from.
+	Registry string `db:"registry"`
+	// SizeBytes and the digests describe the cached file; they are set
+	// when it is downloaded.
+	SizeBytes      int64      `db:"size_bytes"`
+	SHA256         string     `db:"sha256"`
+	SHA512         string     `db:"sha512"`
+	LastAccessedAt *time.Time `db:"last_accessed_at"`
+	// ContentType is the Content-Type upstream served the file with,
+	// replayed on cache hits; empty when unknown.
+	ContentType string `db:"content_type"`
+	// PackageName and Version are parsed from the file name; they are
+	// empty when it does not follow the registry's naming.
+	PackageName string `db:"package_name"`
+	Version     string `db:"version"`
+	// YankedAt is when revalidation found the version yanked or
+	// unpublished upstream, for the reason in YankedReason; nil while
+	// upstream serves it.
+	YankedAt     *time.Time `db:"yanked_at"`
+	YankedReason string     `db:"yanked_reason"`
+}
+
+// PackageSummary aggregates the cached versions of one package.
+type PackageSummary struct {
+	PackageName string
+	Registry    string
+	Versions    int64
+	CacheHit    int64
+	CacheMiss   int64
+	SizeBytes   int64
+}
+
+// CacheTotals sums the downloads of all cached packages. BytesSaved
+// estimates the upstream traffic cache hits avoided.
+type CacheTotals struct {
+	CacheHit   int64
+	CacheMiss  int64
+	BytesSaved int64
+}
+
+// RegistryTotals sums the cached files of one registry and their
+// downloads, with the upstream traffic cache hits avoided.
+type RegistryTotals struct {
+	Registry   string
+	Files      int64
+	SizeBytes  int64
+	CacheHit   int64
+	CacheMiss  int64
+	BytesSaved int64
 }
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// Project is a project registered with its lockfile. Garbage collection
+// keeps the package versions pinned by the projects of a registry cached
+// and purges the others.
+type Project struct {
+	ID       int64  `db:"id"`
+	Registry string `db:"registry"`
+	Name     string `db:"name"`
+	// Packages lists the package versions the lockfile pins, one
+	// "<name> <version>" per line
+	Packages  string    `db:"packages"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// PurgeEvent records one file purged from the cache.
+type PurgeEvent struct {
+	ID          int64     `db:"id"`
+	Registry    string    `db:"registry"`
+	FileName    string    `db:"file_name"`
+	PackageName string    `db:"package_name"`
+	Version     string    `db:"version"`
+	Client      string    `db:"client"`
+	CreatedAt   time.Time `db:"created_at"`
+}
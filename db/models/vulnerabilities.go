@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+type Vulnerability struct {
+	ID          int64     `db:"id"`
+	FileName    string    `db:"file_name"`
+	Ecosystem   string    `db:"ecosystem"`
+	PackageName string    `db:"package_name"`
+	Version     string    `db:"version"`
+	VulnID      string    `db:"vuln_id"`
+	Summary     string    `db:"summary"`
+	Severity    string    `db:"severity"`
+	CreatedAt   time.Time `db:"created_at"`
+}
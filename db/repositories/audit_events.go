@@ -0,0 +1,57 @@
+package repositories
+
+import (
+	"fmt"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type AuditEventRepository struct {
+	db *gorm.DB
+}
+
+var AuditEventRepo *AuditEventRepository
+
+func InitAuditEventRepository() {
+	if initializers.DB == nil {
+		panic("InitAuditEventRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	AuditEventRepo = &AuditEventRepository{db: initializers.DB}
+	fmt.Println("Audit Event Repository initialized")
+}
+
+// InsertEvents stores a batch of audit events
+func (r *AuditEventRepository) InsertEvents(events []models.AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(events, accessBatchSize).Error
+}
+
+// Recent returns the latest audit events of a registry, newest first.
+// Unlike the activity history, audit events are never pruned.
+func (r *AuditEventRepository) Recent(registry string, limit int) ([]models.AuditEvent, error) {
+	var events []models.AuditEvent
+	result := forRegistry(r.db, registry).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&events)
+	return events, result.Error
+}
+
+// Latest returns the latest audit event of a registry for action, nil when
+// there is none.
+func (r *AuditEventRepository) Latest(registry, action string) (*models.AuditEvent, error) {
+	var events []models.AuditEvent
+	result := forRegistry(r.db, registry).
+		Where("action = ?", action).
+		Order("created_at DESC, id DESC").
+		Limit(1).
+		Find(&events)
+	if result.Error != nil || len(events) == 0 {
+		return nil, result.Error
+	}
+	return &events[0], nil
+}
@@ -0,0 +1,76 @@
+package repositories
+
+import (
+	"fmt"
+
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type BackupRepository struct {
+	db *gorm.DB
+}
+
+var BackupRepo *BackupRepository
+
+func InitBackupRepository() {
+	if initializers.DB == nil {
+		panic("InitBackupRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	BackupRepo = &BackupRepository{db: initializers.DB}
+	fmt.Println("Backup Repository initialized")
+}
+
+// EachRow loads the rows of a registry from the table of the models batch
+// points a slice of, batchSize at a time, calling fn with each batch
+// loaded into it.
+func (r *BackupRepository) EachRow(batch any, registry string, batchSize int, fn func() error) error {
+	result := forRegistry(r.db.Model(batch), registry).
+		FindInBatches(batch, batchSize, func(*gorm.DB, int) error {
+			return fn()
+		})
+	return result.Error
+}
+
+// BackupRestore replaces the rows of a registry with those of a backup, in
+// one transaction.
+type BackupRestore struct {
+	tx       *gorm.DB
+	registry string
+}
+
+// BeginRestore starts restoring the rows of a registry.
+func (r *BackupRepository) BeginRestore(registry string) (*BackupRestore, error) {
+	tx := r.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &BackupRestore{tx: tx, registry: registry}, nil
+}
+
+// Clear deletes the rows of the registry from the table of model.
+func (x *BackupRestore) Clear(model any) error {
+	return x.tx.Where("registry = ?", x.registry).Delete(model).Error
+}
+
+// Count returns how many rows of the registry the table of model has.
+func (x *BackupRestore) Count(model any) (int64, error) {
+	var n int64
+	err := x.tx.Model(model).Where("registry = ?", x.registry).Count(&n).Error
+	return n, err
+}
+
+// Insert adds the rows rows points a slice of.
+func (x *BackupRestore) Insert(rows any) error {
+	return x.tx.CreateInBatches(rows, accessBatchSize).Error
+}
+
+// Commit makes the restore visible.
+func (x *BackupRestore) Commit() error {
+	return x.tx.Commit().Error
+}
+
+// Rollback abandons the restore.
+func (x *BackupRestore) Rollback() {
+	x.tx.Rollback()
+}
@@ -0,0 +1,46 @@
+package repositories
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type CacheSnapshotRepository struct {
+	db *gorm.DB
+}
+
+var CacheSnapshotRepo *CacheSnapshotRepository
+
+func InitCacheSnapshotRepository() {
+	if initializers.DB == nil {
+		panic("InitCacheSnapshotRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	CacheSnapshotRepo = &CacheSnapshotRepository{db: initializers.DB}
+	fmt.Println("Cache Snapshot Repository initialized")
+}
+
+// InsertSnapshot stores a snapshot of the cache
+func (r *CacheSnapshotRepository) InsertSnapshot(snapshot *models.CacheSnapshot) error {
+	return r.db.Create(snapshot).Error
+}
+
+// ListSince returns the snapshots of a registry taken since the given time,
+// oldest first
+func (r *CacheSnapshotRepository) ListSince(registry string, since time.Time) ([]models.CacheSnapshot, error) {
+	var snapshots []models.CacheSnapshot
+	result := r.db.Where("registry = ? AND created_at >= ?", registry, since).
+		Order("created_at").
+		Find(&snapshots)
+	return snapshots, result.Error
+}
+
+// DeleteBefore removes the snapshots older than cutoff and returns how many
+// were removed
+func (r *CacheSnapshotRepository) DeleteBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", cutoff).Delete(&models.CacheSnapshot{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,53 @@
+package repositories
+
+import (
+	"fmt"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type ClientDownloadRepository struct {
+	db *gorm.DB
+}
+
+var ClientDownloadRepo *ClientDownloadRepository
+
+func InitClientDownloadRepository() {
+	if initializers.DB == nil {
+		panic("InitClientDownloadRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	ClientDownloadRepo = &ClientDownloadRepository{db: initializers.DB}
+	fmt.Println("Client Download Repository initialized")
+}
+
+// RecordDownload adds one download of a package of a registry by a client to its totals
+func (r *ClientDownloadRepository) RecordDownload(registry, packageName, client, userAgent string, hit bool, bytes int64) error {
+	var hits, misses int64 = 0, 1
+	if hit {
+		hits, misses = 1, 0
+	}
+	result := r.db.Exec(`INSERT INTO client_downloads (registry, package_name, client, user_agent, cache_hit, cache_miss, bytes_served)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (registry, package_name, client, user_agent) DO UPDATE SET
+			cache_hit = client_downloads.cache_hit + EXCLUDED.cache_hit,
+			cache_miss = client_downloads.cache_miss + EXCLUDED.cache_miss,
+			bytes_served = client_downloads.bytes_served + EXCLUDED.bytes_served,
+			updated_at = CURRENT_TIMESTAMP`,
+		registry, packageName, client, userAgent, hits, misses, bytes)
+	return result.Error
+}
+
+// TopClients returns the clients that were served the most bytes of a registry
+func (r *ClientDownloadRepository) TopClients(registry string, limit int) ([]models.ClientSummary, error) {
+	var clients []models.ClientSummary
+	result := forRegistry(r.db.Model(&models.ClientDownload{}), registry).
+		Select("client, user_agent, SUM(cache_hit) AS cache_hit, SUM(cache_miss) AS cache_miss, " +
+			"SUM(bytes_served) AS bytes_served, COUNT(*) AS packages, MAX(updated_at) AS last_seen").
+		Group("client, user_agent").
+		Order("bytes_served DESC").
+		Limit(limit).
+		Scan(&clients)
+	return clients, result.Error
+}
@@ -0,0 +1,80 @@
+package repositories
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type DownloadEventRepository struct {
+	db *gorm.DB
+}
+
+var DownloadEventRepo *DownloadEventRepository
+
+func InitDownloadEventRepository() {
+	if initializers.DB == nil {
+		panic("InitDownloadEventRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	DownloadEventRepo = &DownloadEventRepository{db: initializers.DB}
+	fmt.Println("Download Event Repository initialized")
+}
+
+// InsertEvents stores a batch of download events
+func (r *DownloadEventRepository) InsertEvents(events []models.DownloadEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(events, accessBatchSize).Error
+}
+
+// DeleteBefore removes the events older than cutoff and returns how many
+// were removed
+func (r *DownloadEventRepository) DeleteBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", cutoff).Delete(&models.DownloadEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// Recent returns the latest download events of a registry, newest first
+func (r *DownloadEventRepository) Recent(registry string, limit int) ([]models.DownloadEvent, error) {
+	var events []models.DownloadEvent
+	result := forRegistry(r.db, registry).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&events)
+	return events, result.Error
+}
+
+// DailyDownloads sums the downloads of a registry for every day since the
+// given time, oldest first. Days without downloads are omitted.
+func (r *DownloadEventRepository) DailyDownloads(registry string, since time.Time) ([]models.DailyDownloads, error) {
+	var days []models.DailyDownloads
+	result := forRegistry(r.db.Model(&models.DownloadEvent{}), registry).
+		Select("CAST(DATE(created_at) AS VARCHAR(10)) AS day, "+
+			"SUM(CASE WHEN cache_hit THEN 1 ELSE 0 END) AS cache_hit, "+
+			"SUM(CASE WHEN cache_hit THEN 0 ELSE 1 END) AS cache_miss, "+
+			"SUM(bytes_served) AS bytes_served").
+		Where("created_at >= ?", since).
+		Group("CAST(DATE(created_at) AS VARCHAR(10))").
+		Order("day").
+		Scan(&days)
+	return days, result.Error
+}
+
+// MonthlySavings sums the downloads of a registry served from cache for
+// every month since the given time, oldest first. Months without any are
+// omitted.
+func (r *DownloadEventRepository) MonthlySavings(registry string, since time.Time) ([]models.MonthlySavings, error) {
+	var months []models.MonthlySavings
+	month := "SUBSTR(CAST(DATE(created_at) AS VARCHAR(10)), 1, 7)"
+	result := forRegistry(r.db.Model(&models.DownloadEvent{}), registry).
+		Select(month+" AS month, COUNT(*) AS cache_hit, COALESCE(SUM(bytes_served), 0) AS bytes_saved").
+		Where("cache_hit AND created_at >= ?", since).
+		Group(month).
+		Order("month").
+		Scan(&months)
+	return months, result.Error
+}
@@ -2,6 +2,8 @@ package repositories
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/pkgb-in/pkgbin/db/models"
 	"github.com/pkgb-in/pkgbin/initializers"
@@ -26,9 +28,10 @@ func InitPackageRepository() {
 	fmt.Println("Package Repository initialized")
 }
 
-func (r *PackageRepository) GetPackageByName(name string) (models.Package, error) {
+// GetPackageByName returns the package of a registry cached under a file name
+func (r *PackageRepository) GetPackageByName(registry, name string) (models.Package, error) {
 	var pkg models.Package
-	result := r.db.First(&pkg, "name = ?", name)
+	result := r.db.First(&pkg, "registry = ? AND name = ?", registry, name)
 	return pkg, result.Error
 }
 
@@ -37,61 +40,359 @@ func (r *PackageRepository) CreatePackage(pkg *models.Package) error {
 	return result.Error
 }
 
-func (r *PackageRepository) UpdatePackageAccess(name string, hit bool) error {
-	// Call the Postgres function; SELECT is the correct way to invoke a FUNCTION
-	// Use Raw+Rows to execute without needing to scan a result
-	rows, err := r.db.Raw("SELECT record_package_access(?, ?)", name, hit).Rows()
-	if err != nil {
-		return err
+// PackageAccess is a number of cache hits and misses to add to the
+// counters of a package, and when it was last accessed.
+type PackageAccess struct {
+	Name        string
+	Registry    string
+	PackageName string
+	Version     string
+	Hits        int64
+	Misses      int64
+	LastAccess  time.Time
+}
+
+// accessBatchSize bounds the rows sent in one upsert statement.
+const accessBatchSize = 500
+
+// RecordPackageAccesses adds the given hits and misses to the package
+// counters, creating missing rows, with one upsert per batch of packages.
+// The upsert works on Postgres and SQLite alike.
+func (r *PackageRepository) RecordPackageAccesses(accesses []PackageAccess) error {
+	// A row may only be touched once per statement, so merge repeats first
+	merged := make([]PackageAccess, 0, len(accesses))
+	index := make(map[string]int, len(accesses))
+	for _, a := range accesses {
+		key := a.Registry + "/" + a.Name
+		if i, ok := index[key]; ok {
+			merged[i].Hits += a.Hits
+			merged[i].Misses += a.Misses
+			if a.LastAccess.After(merged[i].LastAccess) {
+				merged[i].LastAccess = a.LastAccess
+			}
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, a)
+	}
+
+	for len(merged) > 0 {
+		batch := merged[:min(len(merged), accessBatchSize)]
+		merged = merged[len(batch):]
+
+		values := make([]string, len(batch))
+		args := make([]any, 0, 7*len(batch))
+		for i, a := range batch {
+			values[i] = "(?, ?, ?, ?, ?, ?, ?)"
+			args = append(args, a.Name, a.Registry, a.PackageName, a.Version, a.Hits, a.Misses, a.LastAccess)
+		}
+		result := r.db.Exec(`INSERT INTO packages (name, registry, package_name, version, cache_hit, cache_miss, last_accessed_at)
+		VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT (registry, name) DO UPDATE SET
+			package_name = EXCLUDED.package_name,
+			version = EXCLUDED.version,
+			cache_hit = packages.cache_hit + EXCLUDED.cache_hit,
+			cache_miss = packages.cache_miss + EXCLUDED.cache_miss,
+			last_accessed_at = EXCLUDED.last_accessed_at,
+			updated_at = CURRENT_TIMESTAMP`,
+			args...)
+		if result.Error != nil {
+			return result.Error
+		}
 	}
-	defer rows.Close()
 	return nil
 }
 
-// ListPackagesPaginated returns a paginated list of packages and the total count
-func (r *PackageRepository) ListPackagesPaginated(page, pageSize int) ([]models.Package, int, error) {
+// RecordArtifact stores the registry, size, digests and Content-Type of a
+// file that was just cached, creating its row if needed.
+func (r *PackageRepository) RecordArtifact(registry, name string, size int64, sha256, sha512, contentType string) error {
+	result := r.db.Exec(`INSERT INTO packages (name, registry, size_bytes, sha256, sha512, content_type)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (registry, name) DO UPDATE SET
+			size_bytes = EXCLUDED.size_bytes,
+			sha256 = EXCLUDED.sha256,
+			sha512 = EXCLUDED.sha512,
+			content_type = EXCLUDED.content_type,
+			updated_at = CURRENT_TIMESTAMP`,
+		name, registry, size, sha256, sha512, contentType)
+	return result.Error
+}
+
+// GetServeHeaders returns the recorded SHA-256 and Content-Type of a cached
+// file of a registry, empty when the file or the value is unknown
+func (r *PackageRepository) GetServeHeaders(registry, name string) (sha256, contentType string, err error) {
 	var pkgs []models.Package
-	var total int64
-	r.db.Model(&models.Package{}).Count(&total)
-	offset := (page - 1) * pageSize
-	result := r.db.Order("id").Limit(pageSize).Offset(offset).Find(&pkgs)
-	return pkgs, int(total), result.Error
+	result := r.db.Select("sha256", "content_type").
+		Where("registry = ? AND name = ?", registry, name).
+		Limit(1).
+		Find(&pkgs)
+	if result.Error != nil || len(pkgs) == 0 {
+		return "", "", result.Error
+	}
+	return pkgs[0].SHA256, pkgs[0].ContentType, nil
+}
+
+// PackageSorts maps the sort keys accepted by ListPackages to the columns
+// they order by.
+var PackageSorts = map[string]string{
+	"id":            "id",
+	"name":          "name",
+	"package_name":  "package_name",
+	"version":       "version",
+	"cache_hit":     "cache_hit",
+	"cache_miss":    "cache_miss",
+	"downloads":     "cache_hit + cache_miss",
+	"size":          "size_bytes",
+	"last_accessed": "last_accessed_at",
+	"created_at":    "created_at",
+	"updated_at":    "updated_at",
+}
+
+// PackageQuery selects a page of the packages of a registry. Sort is a key
+// of PackageSorts, prefixed with "-" for descending order; it defaults to
+// the package ID. UpdatedSince, unless zero, leaves out packages last
+// updated before it.
+type PackageQuery struct {
+	Registry     string
+	Filter       string
+	Sort         string
+	Page         int
+	PageSize     int
+	UpdatedSince time.Time
 }
 
-// ListPackagesByNamePaginated returns a paginated list of packages filtered by name and the total count
-func (r *PackageRepository) ListPackagesByNamePaginated(name string, page, pageSize int) ([]models.Package, int, error) {
+// ListPackages returns the page of packages selected by query and the total
+// count of matching packages
+func (r *PackageRepository) ListPackages(query PackageQuery) ([]models.Package, int, error) {
+	order := "id"
+	if query.Sort != "" {
+		column, ok := PackageSorts[strings.TrimPrefix(query.Sort, "-")]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown sort key %q", query.Sort)
+		}
+		// Postgres and SQLite disagree on where NULLs sort, so rows without
+		// a value come last either way; the ID breaks ties so pages stay
+		// stable
+		if strings.HasPrefix(query.Sort, "-") {
+			order = column + " IS NULL, " + column + " DESC, id"
+		} else {
+			order = column + " IS NULL, " + column + ", id"
+		}
+	}
+
 	var pkgs []models.Package
 	var total int64
-	query := r.db.Model(&models.Package{}).Where("name ILIKE ?", "%"+name+"%")
-	query.Count(&total)
-	offset := (page - 1) * pageSize
-	result := query.Order("id").Limit(pageSize).Offset(offset).Find(&pkgs)
+	db := forRegistry(r.db.Model(&models.Package{}), query.Registry)
+	if query.Filter != "" {
+		db = db.Where(`LOWER(name) LIKE ? ESCAPE '\'`, "%"+likeEscape(strings.ToLower(query.Filter))+"%")
+	}
+	if !query.UpdatedSince.IsZero() {
+		db = db.Where("updated_at >= ?", query.UpdatedSince)
+	}
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	result := db.Order(order).Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&pkgs)
 	return pkgs, int(total), result.Error
 }
 
-// DeletePackagesByNames deletes packages from the database by their names
-func (r *PackageRepository) DeletePackagesByNames(names []string) error {
-	result := r.db.Where("name IN ?", names).Delete(&models.Package{})
+// EachPackage calls fn with the packages of a registry in batches of
+// batchSize, in ID order, stopping at the first error
+func (r *PackageRepository) EachPackage(registry string, batchSize int, fn func([]models.Package) error) error {
+	var batch []models.Package
+	result := forRegistry(r.db.Model(&models.Package{}), registry).
+		FindInBatches(&batch, batchSize, func(*gorm.DB, int) error {
+			return fn(batch)
+		})
+	return result.Error
+}
+
+// ListPackageFiles returns the cached files of a package of registry, newest
+// first. Files whose name could not be parsed count as their own package
+func (r *PackageRepository) ListPackageFiles(registry, packageName string) ([]models.Package, error) {
+	var pkgs []models.Package
+	result := r.db.Where("registry = ? AND COALESCE(NULLIF(package_name, ''), name) = ?", registry, packageName).
+		Order("created_at DESC").
+		Find(&pkgs)
+	return pkgs, result.Error
+}
+
+// FindPurgeCandidates returns the packages of a registry not accessed since
+// accessedBefore and larger than minSize bytes; a zero time or size skips
+// that condition. Packages never accessed count from when they were cached
+func (r *PackageRepository) FindPurgeCandidates(registry string, accessedBefore time.Time, minSize int64) ([]models.Package, error) {
+	var pkgs []models.Package
+	query := r.db.Model(&models.Package{}).
+		Select("name, package_name, size_bytes, last_accessed_at").
+		Where("registry = ?", registry)
+	if !accessedBefore.IsZero() {
+		query = query.Where("COALESCE(last_accessed_at, created_at) < ?", accessedBefore)
+	}
+	if minSize > 0 {
+		query = query.Where("size_bytes > ?", minSize)
+	}
+	result := query.Order("name").Find(&pkgs)
+	return pkgs, result.Error
+}
+
+// LeastRecentlyUsed returns up to limit packages of a registry, those
+// accessed longest ago first. Packages never accessed count from when they
+// were cached
+func (r *PackageRepository) LeastRecentlyUsed(registry string, limit int) ([]models.Package, error) {
+	var pkgs []models.Package
+	result := r.db.Model(&models.Package{}).
+		Select("name, package_name, size_bytes, last_accessed_at").
+		Where("registry = ?", registry).
+		Order("COALESCE(last_accessed_at, created_at)").
+		Limit(limit).
+		Find(&pkgs)
+	return pkgs, result.Error
+}
+
+// DeletePackagesByNames deletes packages of a registry from the database by their names
+func (r *PackageRepository) DeletePackagesByNames(registry string, names []string) error {
+	result := r.db.Where("registry = ? AND name IN ?", registry, names).Delete(&models.Package{})
 	return result.Error
 }
 
-// GetTotalPackagesServed returns the total number of packages served (sum of cache hits and misses)
-func (r *PackageRepository) GetTotalPackagesServed() (int64, error) {
+// GetTotalPackagesServed returns the total number of packages of a registry served (sum of cache hits and misses)
+func (r *PackageRepository) GetTotalPackagesServed(registry string) (int64, error) {
 	var total struct {
 		Total int64
 	}
-	result := r.db.Model(&models.Package{}).Select("COALESCE(SUM(cache_hit + cache_miss), 0) as total").Scan(&total)
+	result := forRegistry(r.db.Model(&models.Package{}), registry).Select("COALESCE(SUM(cache_hit + cache_miss), 0) as total").Scan(&total)
 	return total.Total, result.Error
 }
 
-// TruncatePackagesTable removes all records from the packages table
-func (r *PackageRepository) TruncatePackagesTable() error {
-	result := r.db.Exec("TRUNCATE TABLE packages RESTART IDENTITY CASCADE")
+// TopPackages returns the packages with the most downloads, summing the
+// counters of all their cached versions. Files whose name could not be
+// parsed count as their own package.
+func (r *PackageRepository) TopPackages(registry string, limit int) ([]models.PackageSummary, error) {
+	return r.summarizePackages(registry, "SUM(cache_hit + cache_miss) DESC", limit)
+}
+
+// TopMissedPackages returns the packages with the most cache misses, summed
+// like TopPackages
+func (r *PackageRepository) TopMissedPackages(registry string, limit int) ([]models.PackageSummary, error) {
+	return r.summarizePackages(registry, "SUM(cache_miss) DESC", limit)
+}
+
+// LargestPackages returns the packages taking the most disk space across
+// their cached versions, summed like TopPackages
+func (r *PackageRepository) LargestPackages(registry string, limit int) ([]models.PackageSummary, error) {
+	return r.summarizePackages(registry, "SUM(size_bytes) DESC", limit)
+}
+
+func (r *PackageRepository) summarizePackages(registry, order string, limit int) ([]models.PackageSummary, error) {
+	var summaries []models.PackageSummary
+	result := forRegistry(r.db.Model(&models.Package{}), registry).
+		Select("COALESCE(NULLIF(package_name, ''), name) AS package_name, registry, COUNT(*) AS versions, " +
+			"SUM(cache_hit) AS cache_hit, SUM(cache_miss) AS cache_miss, SUM(size_bytes) AS size_bytes").
+		Group("COALESCE(NULLIF(package_name, ''), name), registry").
+		Order(order).
+		Limit(limit).
+		Scan(&summaries)
+	return summaries, result.Error
+}
+
+// GetCacheTotals sums the cache hits and misses of a registry, and the
+// bytes served from cache
+func (r *PackageRepository) GetCacheTotals(registry string) (models.CacheTotals, error) {
+	var totals models.CacheTotals
+	result := forRegistry(r.db.Model(&models.Package{}), registry).
+		Select("COALESCE(SUM(cache_hit), 0) AS cache_hit, COALESCE(SUM(cache_miss), 0) AS cache_miss, " +
+			"COALESCE(SUM(cache_hit * size_bytes), 0) AS bytes_saved").
+		Scan(&totals)
+	return totals, result.Error
+}
+
+// RegistryTotals sums the files, size and downloads of every registry
+// with cached files
+func (r *PackageRepository) RegistryTotals() ([]models.RegistryTotals, error) {
+	var totals []models.RegistryTotals
+	result := r.db.Model(&models.Package{}).
+		Select("registry, COUNT(*) AS files, COALESCE(SUM(size_bytes), 0) AS size_bytes, " +
+			"SUM(cache_hit) AS cache_hit, SUM(cache_miss) AS cache_miss, " +
+			"COALESCE(SUM(cache_hit * size_bytes), 0) AS bytes_saved").
+		Group("registry").
+		Order("registry").
+		Scan(&totals)
+	return totals, result.Error
+}
+
+// CountUnusedSince counts the packages of a registry that were not
+// downloaded since the given time
+func (r *PackageRepository) CountUnusedSince(registry string, since time.Time) (int64, error) {
+	var count int64
+	result := forRegistry(r.db.Model(&models.Package{}), registry).
+		Where("last_accessed_at IS NULL OR last_accessed_at < ?", since).
+		Count(&count)
+	return count, result.Error
+}
+
+// ListCachedFiles returns the name, registry and last update of the rows of
+// registry, including rows recorded before the registry was stored
+func (r *PackageRepository) ListCachedFiles(registry string) ([]models.Package, error) {
+	var pkgs []models.Package
+	result := r.db.Model(&models.Package{}).
+		Select("name, registry, updated_at").
+		Where("registry = ? OR registry = ''", registry).
+		Find(&pkgs)
+	return pkgs, result.Error
+}
+
+// SetYanked flags the files of registry called names as yanked upstream at
+// yankedAt for reason, or clears the flag when yankedAt is nil. The update
+// time of the rows is left alone.
+func (r *PackageRepository) SetYanked(registry string, names []string, yankedAt *time.Time, reason string) error {
+	result := r.db.Model(&models.Package{}).
+		Where("registry = ? AND name IN ?", registry, names).
+		UpdateColumns(map[string]any{"yanked_at": yankedAt, "yanked_reason": reason})
+	return result.Error
+}
+
+// ListYanked returns the name and yanked reason of the files of registry
+// flagged as yanked upstream
+func (r *PackageRepository) ListYanked(registry string) ([]models.Package, error) {
+	var pkgs []models.Package
+	result := r.db.Model(&models.Package{}).
+		Select("name, yanked_at, yanked_reason").
+		Where("registry = ? AND yanked_at IS NOT NULL", registry).
+		Find(&pkgs)
+	return pkgs, result.Error
+}
+
+// DeleteRegistryPackages removes all records of a registry from the
+// packages table, including those recorded before the registry was stored
+func (r *PackageRepository) DeleteRegistryPackages(registry string) error {
+	result := r.db.Exec("DELETE FROM packages WHERE registry = ? OR registry = ''", registry)
 	return result.Error
 }
 
-// ResetSequence resets the packages table ID sequence to 1
+// ResetSequence resets the packages table ID sequence to follow the highest
+// remaining ID, or to 1 when the table is empty
 func (r *PackageRepository) ResetSequence() error {
-	result := r.db.Exec("ALTER SEQUENCE packages_id_seq RESTART WITH 1")
+	var result *gorm.DB
+	switch r.db.Dialector.Name() {
+	case "sqlite":
+		result = r.db.Exec("UPDATE sqlite_sequence SET seq = (SELECT COALESCE(MAX(id), 0) FROM packages) WHERE name = 'packages'")
+	default:
+		result = r.db.Exec("SELECT setval('packages_id_seq', COALESCE(MAX(id), 0) + 1, false) FROM packages")
+	}
 	return result.Error
 }
+
+// forRegistry restricts query to the rows of registry; an empty registry
+// matches every row.
+func forRegistry(query *gorm.DB, registry string) *gorm.DB {
+	if registry == "" {
+		return query
+	}
+	return query.Where("registry = ?", registry)
+}
+
+// likeEscape escapes the wildcards of LIKE in s, for a pattern matching s
+// literally with ESCAPE '\', which Postgres and SQLite both understand
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
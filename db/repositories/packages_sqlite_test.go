@@ -0,0 +1,61 @@
+//go:build sqlite
+
+package repositories
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pkgb-in/pkgbin/db/migrations"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"gorm.io/gorm"
+)
+
+func TestListPackagesFilterIsLiteral(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations.Run(db); err != nil {
+		t.Fatal(err)
+	}
+	repo := &PackageRepository{db: db}
+	for _, name := range []string{"typing_extensions-4.12.2.tar.gz", "typingXextensions-1.0.tar.gz", "100%-1.0.tar.gz", "1000-1.0.tar.gz", `back\slash-1.0.tar.gz`, "backslash-1.0.tar.gz"} {
+		if err := repo.CreatePackage(&models.Package{Registry: models.RegistryPyPI, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"_", []string{"typing_extensions-4.12.2.tar.gz"}},
+		{"typing_ext", []string{"typing_extensions-4.12.2.tar.gz"}},
+		{"%", []string{"100%-1.0.tar.gz"}},
+		{`\`, []string{`back\slash-1.0.tar.gz`}},
+		{"TYPING", []string{"typingXextensions-1.0.tar.gz", "typing_extensions-4.12.2.tar.gz"}},
+	}
+	for _, tt := range tests {
+		pkgs, total, err := repo.ListPackages(PackageQuery{Registry: models.RegistryPyPI, Filter: tt.filter, Page: 1, PageSize: 50})
+		if err != nil {
+			t.Fatalf("filter %q: %v", tt.filter, err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Name)
+		}
+		sort.Strings(got)
+		if total != len(tt.want) || len(got) != len(tt.want) {
+			t.Errorf("filter %q matched %q (total %d), want %q", tt.filter, got, total, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("filter %q matched %q, want %q", tt.filter, got, tt.want)
+				break
+			}
+		}
+	}
+}
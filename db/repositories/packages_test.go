@@ -0,0 +1,21 @@
+package repositories
+
+import "testing"
+
+func TestLikeEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"lodash", "lodash"},
+		{"typing_extensions", `typing\_extensions`},
+		{"50%", `50\%`},
+		{`back\slash`, `back\\slash`},
+		{`%_\`, `\%\_\\`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := likeEscape(tt.in); got != tt.want {
+			t.Errorf("likeEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"fmt"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type ProjectRepository struct {
+	db *gorm.DB
+}
+
+var ProjectRepo *ProjectRepository
+
+func InitProjectRepository() {
+	if initializers.DB == nil {
+		panic("InitProjectRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	ProjectRepo = &ProjectRepository{db: initializers.DB}
+	fmt.Println("Project Repository initialized")
+}
+
+// SaveProject stores project, replacing the packages of the project of the
+// same registry and name when there is one
+func (r *ProjectRepository) SaveProject(project *models.Project) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var existing []models.Project
+		if err := tx.Where("registry = ? AND name = ?", project.Registry, project.Name).Limit(1).Find(&existing).Error; err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return tx.Create(project).Error
+		}
+		project.ID = existing[0].ID
+		project.CreatedAt = existing[0].CreatedAt
+		return tx.Save(project).Error
+	})
+}
+
+// ListProjects returns the projects of a registry by name
+func (r *ProjectRepository) ListProjects(registry string) ([]models.Project, error) {
+	var projects []models.Project
+	result := forRegistry(r.db, registry).Order("name").Find(&projects)
+	return projects, result.Error
+}
+
+// DeleteProject removes the project of a registry by name, reporting
+// whether there was one
+func (r *ProjectRepository) DeleteProject(registry, name string) (bool, error) {
+	result := r.db.Where("registry = ? AND name = ?", registry, name).Delete(&models.Project{})
+	return result.RowsAffected > 0, result.Error
+}
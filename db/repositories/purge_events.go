@@ -0,0 +1,49 @@
+package repositories
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type PurgeEventRepository struct {
+	db *gorm.DB
+}
+
+var PurgeEventRepo *PurgeEventRepository
+
+func InitPurgeEventRepository() {
+	if initializers.DB == nil {
+		panic("InitPurgeEventRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	PurgeEventRepo = &PurgeEventRepository{db: initializers.DB}
+	fmt.Println("Purge Event Repository initialized")
+}
+
+// InsertEvents stores a batch of purge events
+func (r *PurgeEventRepository) InsertEvents(events []models.PurgeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(events, accessBatchSize).Error
+}
+
+// Recent returns the latest purge events of a registry, newest first
+func (r *PurgeEventRepository) Recent(registry string, limit int) ([]models.PurgeEvent, error) {
+	var events []models.PurgeEvent
+	result := forRegistry(r.db, registry).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&events)
+	return events, result.Error
+}
+
+// DeleteBefore removes the events older than cutoff and returns how many
+// were removed
+func (r *PurgeEventRepository) DeleteBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", cutoff).Delete(&models.PurgeEvent{})
+	return result.RowsAffected, result.Error
+}
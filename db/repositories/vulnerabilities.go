@@ -0,0 +1,48 @@
+package repositories
+
+import (
+	"fmt"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"gorm.io/gorm"
+)
+
+type VulnerabilityRepository struct {
+	db *gorm.DB
+}
+
+var VulnerabilityRepo *VulnerabilityRepository
+
+func InitVulnerabilityRepository() {
+	if initializers.DB == nil {
+		panic("InitVulnerabilityRepository: database is nil; ensure InitDatabase succeeded")
+	}
+	VulnerabilityRepo = &VulnerabilityRepository{db: initializers.DB}
+	fmt.Println("Vulnerability Repository initialized")
+}
+
+// ReplaceFindings records the vulnerabilities found for a package version,
+// replacing the findings of any earlier scan of it.
+func (r *VulnerabilityRepository) ReplaceFindings(ecosystem, name, version string, vulns []models.Vulnerability) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("ecosystem = ? AND package_name = ? AND version = ?", ecosystem, name, version).
+			Delete(&models.Vulnerability{}).Error; err != nil {
+			return err
+		}
+		if len(vulns) == 0 {
+			return nil
+		}
+		return tx.Create(&vulns).Error
+	})
+}
+
+// ListByFileNames returns the recorded findings for the given cached files
+func (r *VulnerabilityRepository) ListByFileNames(fileNames []string) ([]models.Vulnerability, error) {
+	var vulns []models.Vulnerability
+	if len(fileNames) == 0 {
+		return vulns, nil
+	}
+	result := r.db.Where("file_name IN ?", fileNames).Order("vuln_id").Find(&vulns)
+	return vulns, result.Error
+}
@@ -1,17 +1,34 @@
 package initializers
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 
+	"github.com/pkgb-in/pkgbin/db/migrations"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var DB *gorm.DB
 
-func InitDatabase() error {
-	// Database initialization logic goes here
+// drivers maps the DB_DRIVER values pkgbin was built with to the dialector
+// opening that database from the environment. Postgres is always
+// available; SQLite is added by building with -tags sqlite.
+var drivers = map[string]func() gorm.Dialector{
+	"postgres": postgresDialector,
+}
+
+// postgresDialector opens the database of DATABASE_URL, a postgres:// URL
+// or key=value connection string as container platforms hand out, or else
+// the one the DB_* variables describe.
+func postgresDialector() gorm.Dialector {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return postgres.Open(dsn)
+	}
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_USER"),
@@ -19,8 +36,72 @@ func InitDatabase() error {
 		os.Getenv("DB_NAME"),
 		os.Getenv("DB_PORT"),
 	)
+	return postgres.Open(dsn)
+}
+
+func InitDatabase() error {
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = "postgres"
+	}
+	dialector, ok := drivers[driver]
+	if !ok {
+		return fmt.Errorf("unsupported DB_DRIVER %q (SQLite requires building with -tags sqlite)", driver)
+	}
 
 	var err error
-	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	DB, err = gorm.Open(dialector(), &gorm.Config{})
 	return err
 }
+
+// OpenPool opens another connection pool to the database of InitDatabase,
+// of at most n connections, for work that must not take connections from
+// the pool of the queries.
+func OpenPool(n int) (*sql.DB, error) {
+	db, err := gorm.Open(DB.Dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(n)
+	sqlDB.SetMaxIdleConns(n)
+	return sqlDB, nil
+}
+
+// MigrateDatabase applies pending schema migrations unless DB_AUTO_MIGRATE
+// is "false", for deployments that manage the schema themselves.
+func MigrateDatabase() error {
+	if os.Getenv("DB_AUTO_MIGRATE") == "false" {
+		log.Println("Automatic schema migrations disabled")
+		return nil
+	}
+	return migrations.Run(DB)
+}
+
+// CloseDatabase closes the connection pool opened by InitDatabase.
+func CloseDatabase() error {
+	if DB == nil {
+		return nil
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// PingDatabase checks that the database opened by InitDatabase is
+// reachable.
+func PingDatabase(ctx context.Context) error {
+	if DB == nil {
+		return errors.New("database is not initialized")
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
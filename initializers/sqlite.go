@@ -0,0 +1,27 @@
+//go:build sqlite
+
+package initializers
+
+import (
+	"os"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// SQLite support uses a pure Go driver so the static CGO_ENABLED=0 builds
+// keep working. Build with -tags sqlite, or make build-sqlite.
+func init() {
+	drivers["sqlite"] = sqliteDialector
+}
+
+// sqliteDialector opens the database file at DB_PATH. WAL mode lets the
+// dashboard read while downloads are recorded, and the busy timeout makes
+// concurrent writers wait for each other instead of failing.
+func sqliteDialector() gorm.Dialector {
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "./pkgbin.db"
+	}
+	return sqlite.Open(path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+}
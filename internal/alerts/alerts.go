@@ -0,0 +1,179 @@
+// Package alerts watches operational thresholds, such as disk usage and
+// the cache hit ratio, and notifies Slack or email when they are crossed
+// and when they recover.
+package alerts
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/diskspace"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// Source gives the alerts the state of one proxy.
+type Source struct {
+	Registry string
+	CacheDir string
+	// Downloads returns the cache hits and misses served since the proxy
+	// started.
+	Downloads func() (hits, misses int64)
+	// IgnoreUpstreamErrors leaves out the upstream error rate, which is
+	// counted for the whole process: a process serving several registries
+	// checks it for one of its sources only.
+	IgnoreUpstreamErrors bool
+}
+
+// rule is an alert condition, evaluated on every check.
+type rule struct {
+	name string
+	// check returns whether the alert fires and describes the value seen;
+	// ok is false when there is not enough data to tell.
+	check func() (firing bool, detail string, ok bool)
+}
+
+// ruleState is what the last checks of a rule found.
+type ruleState struct {
+	firing   bool
+	lastSent time.Time
+}
+
+// watcher evaluates the rules of a proxy and notifies their changes.
+type watcher struct {
+	source    Source
+	cfg       config.AlertsConfig
+	notifiers []notifier
+	rules     []rule
+	states    map[string]*ruleState
+
+	// Counters at the previous check, for the ratios
+	hits, misses       int64
+	requests, failures int64
+}
+
+// Start evaluates the configured rules for source every check interval.
+// Nothing runs without a rule and a notifier.
+func Start(source Source) error {
+	cfg := config.Alerts
+	notifiers, err := configuredNotifiers(cfg)
+	if err != nil {
+		return err
+	}
+	w := &watcher{source: source, cfg: cfg, notifiers: notifiers, states: make(map[string]*ruleState)}
+	w.hits, w.misses = source.Downloads()
+	w.requests, w.failures = upstream.RequestCounts()
+	if cfg.DiskUsagePercent > 0 {
+		w.rules = append(w.rules, rule{"disk usage", w.checkDisk})
+	}
+	if cfg.HitRatioPercent > 0 {
+		w.rules = append(w.rules, rule{"cache hit ratio", w.checkHitRatio})
+	}
+	if cfg.UpstreamErrorPercent > 0 && !source.IgnoreUpstreamErrors {
+		w.rules = append(w.rules, rule{"upstream error rate", w.checkUpstreamErrors})
+	}
+	if len(w.rules) == 0 || len(notifiers) == 0 || cfg.CheckInterval.Duration <= 0 {
+		return nil
+	}
+	log.Printf("Checking %d alert rule(s) every %s", len(w.rules), cfg.CheckInterval.Duration)
+
+	go func() {
+		ticker := time.NewTicker(cfg.CheckInterval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.check()
+		}
+	}()
+	return nil
+}
+
+// check evaluates every rule, notifying alerts that start firing, keep
+// firing past the repeat interval or recover. In a cluster, only the
+// leader does, so alerts are not sent once per node.
+func (w *watcher) check() {
+	if !cluster.IsLeader(w.source.Registry) {
+		return
+	}
+	for _, r := range w.rules {
+		firing, detail, ok := r.check()
+		if !ok {
+			continue
+		}
+		state, known := w.states[r.name]
+		if !known {
+			state = &ruleState{}
+			w.states[r.name] = state
+		}
+		now := time.Now()
+		switch {
+		case firing && !state.firing,
+			firing && w.cfg.RepeatInterval.Duration > 0 && now.Sub(state.lastSent) >= w.cfg.RepeatInterval.Duration:
+			w.notify(fmt.Sprintf("[pkgbin] %s alert: %s", w.source.Registry, r.name), detail)
+			state.lastSent = now
+		case !firing && state.firing:
+			w.notify(fmt.Sprintf("[pkgbin] %s resolved: %s", w.source.Registry, r.name), detail)
+		}
+		state.firing = firing
+	}
+}
+
+func (w *watcher) checkDisk() (bool, string, bool) {
+	usage, err := diskspace.Stat(w.source.CacheDir)
+	if err != nil {
+		log.Printf("Failed to check disk usage of %s: %v", w.source.CacheDir, err)
+		return false, "", false
+	}
+	used := usage.UsedPercent()
+	return used > w.cfg.DiskUsagePercent,
+		fmt.Sprintf("The filesystem of %s is %.1f%% full (threshold %.1f%%).", w.source.CacheDir, used, w.cfg.DiskUsagePercent), true
+}
+
+func (w *watcher) checkHitRatio() (bool, string, bool) {
+	hits, misses := w.source.Downloads()
+	newHits, newMisses := hits-w.hits, misses-w.misses
+	if newHits+newMisses < w.cfg.MinSamples {
+		return false, "", false
+	}
+	w.hits, w.misses = hits, misses
+	ratio := float64(newHits) * 100 / float64(newHits+newMisses)
+	return ratio < w.cfg.HitRatioPercent,
+		fmt.Sprintf("%.1f%% of the last %d downloads were cache hits (threshold %.1f%%).", ratio, newHits+newMisses, w.cfg.HitRatioPercent), true
+}
+
+func (w *watcher) checkUpstreamErrors() (bool, string, bool) {
+	requests, failures := upstream.RequestCounts()
+	newRequests, newFailures := requests-w.requests, failures-w.failures
+	if newRequests < w.cfg.MinSamples {
+		return false, "", false
+	}
+	w.requests, w.failures = requests, failures
+	rate := float64(newFailures) * 100 / float64(newRequests)
+	detail := fmt.Sprintf("%.1f%% of the last %d upstream requests failed (threshold %.1f%%).", rate, newRequests, w.cfg.UpstreamErrorPercent)
+	var open []string
+	for _, b := range upstream.BreakerStates() {
+		if b.State != upstream.CircuitClosed {
+			open = append(open, b.Host)
+		}
+	}
+	if len(open) > 0 {
+		detail += " Circuit open for " + strings.Join(open, ", ") + "."
+	}
+	return rate > w.cfg.UpstreamErrorPercent, detail, true
+}
+
+// notify sends an alert to every notifier, logging those that fail.
+func (w *watcher) notify(subject, body string) {
+	log.Printf("%s: %s", subject, body)
+	if host, err := os.Hostname(); err == nil {
+		body += "\nHost: " + host
+	}
+	for _, n := range w.notifiers {
+		if err := n.notify(subject, body); err != nil {
+			log.Printf("Failed to send alert through %s: %v", n.name(), err)
+		}
+	}
+}
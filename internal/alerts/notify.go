@@ -0,0 +1,93 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// notifyTimeout bounds how long posting an alert to a webhook may take.
+const notifyTimeout = 10 * time.Second
+
+// notifier delivers alerts somewhere people see them.
+type notifier interface {
+	name() string
+	notify(subject, body string) error
+}
+
+// configuredNotifiers returns the notifiers cfg sets up, resolving their
+// secrets.
+func configuredNotifiers(cfg config.AlertsConfig) ([]notifier, error) {
+	var notifiers []notifier
+	if cfg.Slack.WebhookURL.IsSet() {
+		url, err := cfg.Slack.WebhookURL.Value()
+		if err != nil {
+			return nil, fmt.Errorf("alerts slack webhook_url: %w", err)
+		}
+		notifiers = append(notifiers, &slackNotifier{url: url, client: &http.Client{Timeout: notifyTimeout}})
+	}
+	if cfg.SMTP.Host != "" {
+		if cfg.SMTP.From == "" || len(cfg.SMTP.To) == 0 {
+			return nil, fmt.Errorf("alerts smtp: from and to are required")
+		}
+		password, err := cfg.SMTP.Password.Value()
+		if err != nil {
+			return nil, fmt.Errorf("alerts smtp password: %w", err)
+		}
+		notifiers = append(notifiers, &smtpNotifier{cfg: cfg.SMTP, password: password})
+	}
+	return notifiers, nil
+}
+
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *slackNotifier) name() string { return "Slack" }
+
+func (n *slackNotifier) notify(subject, body string) error {
+	payload, err := json.Marshal(map[string]string{"text": "*" + subject + "*\n" + body})
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	cfg      config.SMTPNotifier
+	password string
+}
+
+func (n *smtpNotifier) name() string { return "SMTP" }
+
+func (n *smtpNotifier) notify(subject, body string) error {
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		auth = smtp.PlainAuth("", n.cfg.Username, n.password, n.cfg.Host)
+	}
+	msg := "From: " + n.cfg.From + "\r\n" +
+		"To: " + strings.Join(n.cfg.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n") + "\r\n"
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	return smtp.SendMail(addr, auth, n.cfg.From, n.cfg.To, []byte(msg))
+}
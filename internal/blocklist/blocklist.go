@@ -0,0 +1,193 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// maxFeedSize bounds the blocklist feeds pkgbin downloads.
+const maxFeedSize = 64 << 20
+
+var client = &http.Client{Timeout: time.Minute, Transport: upstream.Transport}
+
+// List is a blocklist feed kept in sync with its URL.
+type List struct {
+	url       string
+	normalize func(string) string
+
+	mu       sync.RWMutex
+	entries  map[string]map[string]bool // name -> blocked versions; empty blocks all
+	etag     string
+	syncedAt time.Time
+
+	blocked atomic.Int64
+}
+
+var (
+	lists   = make(map[string]*List)
+	listsMu sync.Mutex
+)
+
+// Start begins syncing the feed of cfg every cfg.Interval and returns its
+// list. Repositories sharing a feed URL share one list. normalize maps
+// package names onto the form they are looked up in, e.g. PEP 503 names.
+func Start(cfg config.Blocklist, normalize func(string) string) (*List, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	if l, ok := lists[cfg.URL]; ok {
+		return l, nil
+	}
+	if cfg.Interval.Duration <= 0 {
+		return nil, fmt.Errorf("blocklist %s: interval must be positive", cfg.URL)
+	}
+	if err := upstream.RegisterCredentials(cfg.URL, cfg.Auth); err != nil {
+		return nil, fmt.Errorf("blocklist %s: %w", cfg.URL, err)
+	}
+	if normalize == nil {
+		normalize = func(name string) string { return name }
+	}
+
+	l := &List{url: cfg.URL, normalize: normalize, entries: make(map[string]map[string]bool)}
+	lists[cfg.URL] = l
+	go func() {
+		for {
+			if err := l.sync(); err != nil {
+				log.Printf("Blocklist sync from %s failed, keeping %d entries: %v", l.url, l.Len(), err)
+			}
+			time.Sleep(cfg.Interval.Duration)
+		}
+	}()
+	return l, nil
+}
+
+// For returns the list of the feed at url, if one was started.
+func For(url string) *List {
+	if url == "" {
+		return nil
+	}
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	return lists[url]
+}
+
+// Totals sums the entries and blocked requests of the lists of the feeds
+// at urls, counting a feed listed more than once a single time.
+func Totals(urls ...string) (entries int, blocked int64) {
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		l, ok := lists[url]
+		if !ok || seen[url] {
+			continue
+		}
+		seen[url] = true
+		entries += l.Len()
+		blocked += l.blocked.Load()
+	}
+	return entries, blocked
+}
+
+// Len returns the number of blocked packages.
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+// Blocked reports whether name (at version, when known) is on the list and
+// counts the attempt if it is.
+func (l *List) Blocked(name, version string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	versions, ok := l.entries[l.normalize(name)]
+	l.mu.RUnlock()
+	if !ok || (len(versions) > 0 && !versions[version]) {
+		return false
+	}
+	l.blocked.Add(1)
+	return true
+}
+
+func (l *List) sync() error {
+	req, err := http.NewRequest(http.MethodGet, l.url, nil)
+	if err != nil {
+		return err
+	}
+	l.mu.RLock()
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	l.mu.RUnlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		l.mu.Lock()
+		l.syncedAt = time.Now()
+		l.mu.Unlock()
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("feed returned status %d", resp.StatusCode)
+	}
+
+	entries, err := parse(io.LimitReader(resp.Body, maxFeedSize), l.normalize)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.entries = entries
+	l.etag = resp.Header.Get("ETag")
+	l.syncedAt = time.Now()
+	l.mu.Unlock()
+	log.Printf("Blocklist synced from %s: %d packages", l.url, len(entries))
+	return nil
+}
+
+// parse reads a feed of "<name>" or "<name> <version>" lines.
+func parse(r io.Reader, normalize func(string) string) (map[string]map[string]bool, error) {
+	entries := make(map[string]map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name := normalize(fields[0])
+		versions, exists := entries[name]
+		if !exists {
+			versions = make(map[string]bool)
+			entries[name] = versions
+		} else if len(versions) == 0 {
+			// Already blocked entirely
+			continue
+		}
+		if len(fields) == 1 {
+			entries[name] = map[string]bool{}
+			continue
+		}
+		versions[fields[1]] = true
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,152 @@
+// Package cachekey names the files artifacts are cached under. A key is
+// derived from the download path alone, so it must stay stable: changing
+// how a path is mangled orphans everything already cached under the old
+// name.
+//
+// The mangling flattens paths into one directory and can, in rare cases,
+// give two paths the same key. Claim catches those, so a file is never
+// served for a path it was not downloaded from.
+package cachekey
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+)
+
+// maxClaims bounds how many keys the collision index remembers per
+// process. Past it, the oldest claims are forgotten in no particular order.
+const maxClaims = 200000
+
+// NPMRemoteSegment marks the paths the proxy serves the tarballs of other
+// hosts than the registry under: /<package>/-/remote/<scheme>/<host>/<path>.
+const NPMRemoteSegment = "/-/remote/"
+
+// For returns the key a file downloaded from urlPath of registry is cached
+// under, or "" for an unknown registry.
+func For(registry, urlPath string) string {
+	switch registry {
+	case models.RegistryNPM:
+		return NPM(urlPath)
+	case models.RegistryPyPI:
+		return PyPI(urlPath)
+	case models.RegistryRubyGems:
+		return Gem(urlPath)
+	}
+	return ""
+}
+
+// NPM returns the key of an npm tarball path. Unscoped tarballs keep their
+// name, and scoped ones are prefixed with their scope so packages of
+// different scopes do not collide:
+// /@types/node/-/node-20.1.0.tgz is cached as @types__node__node-20.1.0.tgz.
+// Tarballs of other hosts are named after their host and path, behind a ~
+// npm package names cannot start with:
+// /pkg/-/remote/https/codeload.github.com/u/r/tar.gz/v1 is cached as
+// ~codeload.github.com__u__r__tar.gz__v1.
+func NPM(urlPath string) string {
+	if _, remote, ok := strings.Cut(urlPath, NPMRemoteSegment); ok {
+		_, hostPath, _ := strings.Cut(remote, "/")
+		return "~" + strings.ReplaceAll(strings.Trim(hostPath, "/"), "/", "__")
+	}
+	urlPath = strings.TrimPrefix(urlPath, "/")
+	if strings.HasPrefix(urlPath, "@") {
+		parts := strings.Split(urlPath, "/-/")
+		if len(parts) == 2 {
+			scope := strings.TrimPrefix(parts[0], "@")
+			scope = strings.ReplaceAll(scope, "/", "__")
+			return "@" + scope + "__" + path.Base(parts[1])
+		}
+	}
+	return path.Base(urlPath)
+}
+
+// PyPI returns the key of a PyPI distribution path, its directories joined
+// with __ in front of the file name, which keeps the digest directories
+// PyPI serves files under:
+// /packages/ab/cd/ef01/pkg-1.0-py3-none-any.whl is cached as
+// packages__ab__cd__ef01__pkg-1.0-py3-none-any.whl.
+func PyPI(urlPath string) string {
+	urlPath = strings.TrimPrefix(urlPath, "/")
+	parts := strings.Split(urlPath, "/")
+	if len(parts) > 1 {
+		return strings.Join(parts[:len(parts)-1], "__") + "__" + parts[len(parts)-1]
+	}
+	return path.Base(urlPath)
+}
+
+// Gem returns the key of a gem path, the file name with its platform
+// suffix: /gems/nokogiri-1.16.0-x86_64-linux.gem is cached as
+// nokogiri-1.16.0-x86_64-linux.gem.
+func Gem(urlPath string) string {
+	return path.Base(urlPath)
+}
+
+// CollisionError reports a key already claimed by another download path.
+type CollisionError struct {
+	Registry string
+	Key      string
+	// Path is the path claiming Key, and Claimed the path that claimed it
+	// first
+	Path    string
+	Claimed string
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("%s cache key %s of %s is already used by %s", e.Registry, e.Key, e.Path, e.Claimed)
+}
+
+// claims remembers the download path each key of a registry was first
+// claimed for.
+var claims = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: make(map[string]string)}
+
+// Claim records that key of registry caches the file downloaded from
+// urlPath, and returns a *CollisionError when another path claimed it
+// before. Keys are claimed once the file is cached under them, so a path
+// that was never cached cannot take a key from its owner. Claims only last
+// as long as the process.
+func Claim(registry, key, urlPath string) error {
+	urlPath = canonicalPath(urlPath)
+	id := registry + "/" + key
+	claims.Lock()
+	defer claims.Unlock()
+	if claimed, ok := claims.paths[id]; ok {
+		if claimed != urlPath {
+			return &CollisionError{Registry: registry, Key: key, Path: urlPath, Claimed: claimed}
+		}
+		return nil
+	}
+	if len(claims.paths) >= maxClaims {
+		for old := range claims.paths {
+			delete(claims.paths, old)
+			if len(claims.paths) < maxClaims*9/10 {
+				break
+			}
+		}
+	}
+	claims.paths[id] = urlPath
+	return nil
+}
+
+// Collides returns the error Claim would, without claiming key.
+func Collides(registry, key, urlPath string) error {
+	urlPath = canonicalPath(urlPath)
+	claims.Lock()
+	defer claims.Unlock()
+	if claimed, ok := claims.paths[registry+"/"+key]; ok && claimed != urlPath {
+		return &CollisionError{Registry: registry, Key: key, Path: urlPath, Claimed: claimed}
+	}
+	return nil
+}
+
+// canonicalPath returns urlPath cleaned, so equivalent spellings of one
+// path are not mistaken for a collision.
+func canonicalPath(urlPath string) string {
+	return path.Clean("/" + urlPath)
+}
@@ -0,0 +1,172 @@
+package cachekey
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+)
+
+func TestNPM(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"unscoped", "/lodash/-/lodash-4.17.21.tgz", "lodash-4.17.21.tgz"},
+		{"unscoped without leading slash", "lodash/-/lodash-4.17.21.tgz", "lodash-4.17.21.tgz"},
+		{"prerelease", "/react/-/react-19.0.0-rc.1.tgz", "react-19.0.0-rc.1.tgz"},
+		{"scoped", "/@types/node/-/node-20.1.0.tgz", "@types__node__node-20.1.0.tgz"},
+		{"scoped without leading slash", "@babel/core/-/core-7.24.0.tgz", "@babel__core__core-7.24.0.tgz"},
+		{"scopes kept apart", "/@mycorp/node/-/node-20.1.0.tgz", "@mycorp__node__node-20.1.0.tgz"},
+		{"remote tarball", "/pkg/-/remote/https/codeload.github.com/u/r/tar.gz/v1", "~codeload.github.com__u__r__tar.gz__v1"},
+		{"remote tarball of scoped package", "/@scope/pkg/-/remote/https/git.example.com/a/b.tgz", "~git.example.com__a__b.tgz"},
+		{"remote tarball trailing slash", "/pkg/-/remote/http/example.com/x/", "~example.com__x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NPM(tt.path); got != tt.want {
+				t.Errorf("NPM(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPyPI(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"wheel", "/packages/ab/cd/ef01/pkg-1.0-py3-none-any.whl", "packages__ab__cd__ef01__pkg-1.0-py3-none-any.whl"},
+		{"wheel with build tag", "/packages/ab/cd/ef01/pkg-1.0-1-cp312-cp312-manylinux_2_17_x86_64.whl", "packages__ab__cd__ef01__pkg-1.0-1-cp312-cp312-manylinux_2_17_x86_64.whl"},
+		{"wheel with several platforms", "/packages/00/11/2233/numpy-2.0.0-cp312-cp312-manylinux_2_17_x86_64.manylinux2014_x86_64.whl", "packages__00__11__2233__numpy-2.0.0-cp312-cp312-manylinux_2_17_x86_64.manylinux2014_x86_64.whl"},
+		{"sdist", "/packages/ab/cd/ef01/pkg-1.0.tar.gz", "packages__ab__cd__ef01__pkg-1.0.tar.gz"},
+		{"without leading slash", "packages/ab/pkg-1.0.zip", "packages__ab__pkg-1.0.zip"},
+		{"bare file", "/pkg-1.0.tar.gz", "pkg-1.0.tar.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PyPI(tt.path); got != tt.want {
+				t.Errorf("PyPI(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGem(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"ruby platform", "/gems/rake-13.2.1.gem", "rake-13.2.1.gem"},
+		{"platform suffix", "/gems/nokogiri-1.16.0-x86_64-linux.gem", "nokogiri-1.16.0-x86_64-linux.gem"},
+		{"java platform", "/gems/jruby-openssl-0.14.5-java.gem", "jruby-openssl-0.14.5-java.gem"},
+		{"darwin platform", "/gems/ffi-1.17.0-arm64-darwin.gem", "ffi-1.17.0-arm64-darwin.gem"},
+		{"quick gemspec", "/quick/Marshal.4.8/rake-13.2.1.gemspec.rz", "rake-13.2.1.gemspec.rz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Gem(tt.path); got != tt.want {
+				t.Errorf("Gem(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFor(t *testing.T) {
+	tests := []struct {
+		registry, path, want string
+	}{
+		{models.RegistryNPM, "/@types/node/-/node-20.1.0.tgz", "@types__node__node-20.1.0.tgz"},
+		{models.RegistryPyPI, "/packages/ab/pkg-1.0.tar.gz", "packages__ab__pkg-1.0.tar.gz"},
+		{models.RegistryRubyGems, "/gems/rake-13.2.1.gem", "rake-13.2.1.gem"},
+		{"maven", "/org/x/1.0/x-1.0.jar", ""},
+	}
+	for _, tt := range tests {
+		if got := For(tt.registry, tt.path); got != tt.want {
+			t.Errorf("For(%q, %q) = %q, want %q", tt.registry, tt.path, got, tt.want)
+		}
+	}
+}
+
+// resetClaims forgets every claim, so tests do not see each other's.
+func resetClaims(t *testing.T) {
+	t.Helper()
+	claims.Lock()
+	claims.paths = make(map[string]string)
+	claims.Unlock()
+}
+
+func TestClaim(t *testing.T) {
+	tests := []struct {
+		name      string
+		registry  string
+		first     string
+		second    string
+		collision bool
+	}{
+		{"same path", models.RegistryNPM, "/lodash/-/lodash-4.17.21.tgz", "/lodash/-/lodash-4.17.21.tgz", false},
+		{"equivalent spelling", models.RegistryNPM, "/lodash/-/lodash-4.17.21.tgz", "lodash//-/./lodash-4.17.21.tgz", false},
+		{"npm scope mangled into the name", models.RegistryNPM, "/@types/node/-/node-20.1.0.tgz", "/@types__node/-/node-20.1.0.tgz", true},
+		{"npm tarball of another package", models.RegistryNPM, "/a/-/shared-1.0.0.tgz", "/b/-/shared-1.0.0.tgz", true},
+		{"npm remote host path", models.RegistryNPM, "/p/-/remote/https/example.com/a/b.tgz", "/p/-/remote/https/example.com/a__b.tgz", true},
+		{"pypi directory mangled into the name", models.RegistryPyPI, "/packages/a/b/pkg-1.0.whl", "/packages/a__b/pkg-1.0.whl", true},
+		{"gem of another directory", models.RegistryRubyGems, "/gems/rake-13.2.1.gem", "/downloads/rake-13.2.1.gem", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetClaims(t)
+			firstKey, secondKey := For(tt.registry, tt.first), For(tt.registry, tt.second)
+			if firstKey != secondKey {
+				t.Fatalf("keys differ: %q and %q", firstKey, secondKey)
+			}
+			if err := Claim(tt.registry, firstKey, tt.first); err != nil {
+				t.Fatalf("first Claim: %v", err)
+			}
+			if err := Collides(tt.registry, secondKey, tt.second); (err != nil) != tt.collision {
+				t.Errorf("Collides = %v, want collision %v", err, tt.collision)
+			}
+			err := Claim(tt.registry, secondKey, tt.second)
+			if !tt.collision {
+				if err != nil {
+					t.Errorf("second Claim: %v", err)
+				}
+				return
+			}
+			var collision *CollisionError
+			if !errors.As(err, &collision) {
+				t.Fatalf("second Claim = %v, want a *CollisionError", err)
+			}
+			if collision.Key != firstKey || collision.Claimed != canonicalPath(tt.first) || collision.Path != canonicalPath(tt.second) {
+				t.Errorf("collision = %+v", collision)
+			}
+			// The first path keeps its key
+			if err := Claim(tt.registry, firstKey, tt.first); err != nil {
+				t.Errorf("Claim of the first path again: %v", err)
+			}
+		})
+	}
+}
+
+func TestClaimRegistriesApart(t *testing.T) {
+	resetClaims(t)
+	if err := Claim(models.RegistryNPM, "x-1.0.tgz", "/x/-/x-1.0.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Claim(models.RegistryRubyGems, "x-1.0.tgz", "/gems/x-1.0.tgz"); err != nil {
+		t.Errorf("claim of another registry: %v", err)
+	}
+}
+
+func TestClaimBounded(t *testing.T) {
+	resetClaims(t)
+	for i := 0; i <= maxClaims; i++ {
+		key := "k" + strconv.Itoa(i)
+		if err := Claim(models.RegistryNPM, key, "/"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	claims.Lock()
+	n := len(claims.paths)
+	claims.Unlock()
+	if n > maxClaims {
+		t.Errorf("%d claims remembered, want at most %d", n, maxClaims)
+	}
+}
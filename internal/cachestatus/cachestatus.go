@@ -0,0 +1,138 @@
+// Package cachestatus tells clients what the proxy did for a response: the
+// X-PkgBin-Cache header says whether it came from the cache, and
+// X-PkgBin-Upstream-Time how long upstream took, so a slow install can be
+// explained without the server logs.
+package cachestatus
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header and UpstreamTimeHeader carry what the proxy did to the client.
+const (
+	Header             = "X-PkgBin-Cache"
+	UpstreamTimeHeader = "X-PkgBin-Upstream-Time"
+)
+
+// The statuses of a response, from the least to the most telling: a
+// response built from a fresh miss and a cached document is a MISS, and
+// one served stale because upstream failed is STALE whatever else it used.
+const (
+	Hit   = "HIT"
+	Miss  = "MISS"
+	Stale = "STALE"
+)
+
+var rank = map[string]int{Hit: 1, Miss: 2, Stale: 3}
+
+type contextKey struct{}
+
+// recorder collects what the proxy did for one request.
+type recorder struct {
+	mu     sync.Mutex
+	status string
+	// upstream sums the upstream requests done, and inFlight holds when
+	// those still running started
+	upstream time.Duration
+	inFlight map[*time.Time]struct{}
+}
+
+// Handler records what the proxy does for every request and reports it in
+// the response headers. Responses that neither used the cache nor went
+// upstream, such as the dashboard, get no headers.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &recorder{}
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, rec: rec}, r.WithContext(context.WithValue(r.Context(), contextKey{}, rec)))
+	})
+}
+
+// Set records status for the request of ctx, unless a more telling one was.
+func Set(ctx context.Context, status string) {
+	rec, ok := ctx.Value(contextKey{}).(*recorder)
+	if !ok {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rank[status] > rank[rec.status] {
+		rec.status = status
+	}
+}
+
+// BeginUpstream starts timing an upstream request made for the request of
+// ctx, and returns the function ending it.
+func BeginUpstream(ctx context.Context) (done func()) {
+	rec, ok := ctx.Value(contextKey{}).(*recorder)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	rec.mu.Lock()
+	if rec.inFlight == nil {
+		rec.inFlight = make(map[*time.Time]struct{})
+	}
+	rec.inFlight[&start] = struct{}{}
+	rec.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			delete(rec.inFlight, &start)
+			rec.upstream += time.Since(start)
+		})
+	}
+}
+
+// setHeaders reports the status and upstream time recorded so far in h.
+// Upstream requests still running, such as a download streamed through,
+// count for as long as they have taken. Without a status, a response that
+// went upstream is a MISS.
+func (rec *recorder) setHeaders(h http.Header) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	upstream := rec.upstream
+	for start := range rec.inFlight {
+		upstream += time.Since(*start)
+	}
+	status := rec.status
+	if status == "" && (upstream > 0 || len(rec.inFlight) > 0) {
+		status = Miss
+	}
+	if status == "" {
+		return
+	}
+	h.Set(Header, status)
+	h.Set(UpstreamTimeHeader, upstream.Round(time.Millisecond).String())
+}
+
+// responseWriter adds the headers of its recorder to the response as it
+// starts.
+type responseWriter struct {
+	http.ResponseWriter
+	rec         *recorder
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.rec.setHeaders(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,108 @@
+// Package cluster coordinates pkgbin instances that share their cache
+// directories and database behind a load balancer, through Redis when
+// configured or Postgres advisory locks otherwise.
+package cluster
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+const (
+	// minLockPoll and maxLockPoll bound how often a node waiting for a lock
+	// held by another one tries again.
+	minLockPoll = 50 * time.Millisecond
+	maxLockPoll = time.Second
+)
+
+// heldLock is a lock this node holds across the cluster.
+type heldLock struct {
+	release func()
+	// held reports whether the lock is still held, which it no longer is
+	// once the connection or key holding it is lost.
+	held func(ctx context.Context) bool
+}
+
+// tryLock takes the lock of key if no other node holds it, returning nil
+// when one does; nil without clustering.
+var tryLock func(ctx context.Context, key string) (*heldLock, error)
+
+// Init sets up the coordination configured for the cluster, connecting to
+// Redis or checking that the database can hold the locks.
+func Init() error {
+	cfg := config.Server.Cluster
+	tryLock = nil
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Redis.Address != "" {
+		if err := initRedis(cfg.Redis); err != nil {
+			return err
+		}
+		tryLock = redisTryLock
+		log.Printf("Coordinating the cluster through Redis at %s", cfg.Redis.Address)
+		return nil
+	}
+	if err := checkPostgres(); err != nil {
+		return err
+	}
+	if err := openLockPool(cfg.LockConnections); err != nil {
+		return err
+	}
+	tryLock = postgresTryLock
+	log.Printf("Coordinating the cluster through Postgres advisory locks on up to %d connections", cfg.LockConnections)
+	return nil
+}
+
+// Lock holds key across the cluster until the returned func is called,
+// waiting while another node holds it. Without clustering it returns at
+// once. Should the lock store fail, the error is logged and the caller
+// carries on uncoordinated, as a duplicate download is better than a
+// failed one; only the end of ctx is returned as an error.
+func Lock(ctx context.Context, key string) (unlock func(), err error) {
+	noop := func() {}
+	if tryLock == nil {
+		return noop, nil
+	}
+	poll := minLockPoll
+	for {
+		lock, err := tryLock(ctx, key)
+		if lock != nil {
+			return lock.release, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Failed to take cluster lock %s, continuing without it: %v", key, err)
+			return noop, nil
+		}
+		select {
+		case <-time.After(poll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		poll = min(2*poll, maxLockPoll)
+	}
+}
+
+// TryLock takes key across the cluster if no other node holds it, for
+// periodic work a single node should do. ok is false when another node
+// holds it; without clustering it is always true.
+func TryLock(key string) (unlock func(), ok bool) {
+	if tryLock == nil {
+		return func() {}, true
+	}
+	lock, err := tryLock(context.Background(), key)
+	if err != nil {
+		log.Printf("Failed to take cluster lock %s, continuing without it: %v", key, err)
+		return func() {}, true
+	}
+	if lock == nil {
+		return nil, false
+	}
+	return lock.release, true
+}
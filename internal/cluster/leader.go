@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// leaderCheckInterval is how often a node checks that it still leads, or
+// tries to take the lead.
+const leaderCheckInterval = 10 * time.Second
+
+var (
+	// leading maps each registry to whether this node won its election
+	leading   = make(map[string]bool)
+	leadingMu sync.RWMutex
+)
+
+// StartLeaderElection has one node of the cluster lead registry: only the
+// leader runs the background maintenance of the shared cache and database.
+// The first round of the election is over when it returns. When the leader
+// stops or loses its lock, another node takes the lead within
+// leaderCheckInterval. Read-only replicas take no part.
+func StartLeaderElection(registry string) {
+	if tryLock == nil || config.Server.ReplicaOf != "" {
+		return
+	}
+	e := &election{key: "leader/" + registry, registry: registry}
+	e.check()
+	go func() {
+		for range time.Tick(leaderCheckInterval) {
+			e.check()
+		}
+	}()
+}
+
+// election is the part a node takes in the election of a registry leader.
+type election struct {
+	key, registry string
+	lock          *heldLock
+}
+
+// check gives up a lead that was lost, and tries to take the lead when
+// this node does not have it.
+func (e *election) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaderCheckInterval)
+	defer cancel()
+	if e.lock != nil && !e.lock.held(ctx) {
+		log.Printf("Lost the lead of the %s cluster", e.registry)
+		e.lock.release()
+		e.lock = nil
+		setLeading(e.registry, false)
+	}
+	if e.lock != nil {
+		return
+	}
+	lock, err := tryLock(ctx, e.key)
+	if err != nil {
+		log.Printf("Failed to take part in the %s leader election: %v", e.registry, err)
+		return
+	}
+	if lock != nil {
+		log.Printf("Leading the %s cluster", e.registry)
+		e.lock = lock
+		setLeading(e.registry, true)
+	}
+}
+
+// setLeading records whether this node leads registry.
+func setLeading(registry string, lead bool) {
+	leadingMu.Lock()
+	defer leadingMu.Unlock()
+	leading[registry] = lead
+}
+
+// IsLeader reports whether this node runs the background maintenance of
+// registry in the cluster, which a node that is not clustered always does,
+// unless it is a read-only replica.
+func IsLeader(registry string) bool {
+	if config.Server.ReplicaOf != "" {
+		return false
+	}
+	if tryLock == nil {
+		return true
+	}
+	leadingMu.RLock()
+	defer leadingMu.RUnlock()
+	return leading[registry]
+}
+
+// LeadsAny reports whether this node runs the background maintenance of
+// at least one registry, which the maintenance shared by every registry
+// is left to.
+func LeadsAny() bool {
+	if config.Server.ReplicaOf != "" {
+		return false
+	}
+	if tryLock == nil {
+		return true
+	}
+	leadingMu.RLock()
+	defer leadingMu.RUnlock()
+	for _, lead := range leading {
+		if lead {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"hash/fnv"
+	"log"
+
+	"github.com/pkgb-in/pkgbin/initializers"
+)
+
+// checkPostgres returns an error when the database cannot hold advisory
+// locks.
+func checkPostgres() error {
+	if initializers.DB == nil {
+		return errors.New("database is not initialized")
+	}
+	if name := initializers.DB.Dialector.Name(); name != "postgres" {
+		return errors.New("clustering requires Redis or a Postgres database, not " + name)
+	}
+	return nil
+}
+
+// lockPool holds the connections of the advisory locks. Locks are held
+// through whole downloads, so they get a pool of their own rather than
+// taking the connections of the queries.
+var lockPool *sql.DB
+
+// openLockPool opens the pool of at most n connections the advisory locks
+// are taken on, replacing any previous one.
+func openLockPool(n int) error {
+	if n <= 0 {
+		return errors.New("cluster lock_connections must be positive")
+	}
+	pool, err := initializers.OpenPool(n)
+	if err != nil {
+		return err
+	}
+	if lockPool != nil {
+		lockPool.Close()
+	}
+	lockPool = pool
+	return nil
+}
+
+// lockID maps key to the 64-bit advisory lock identifier Postgres expects.
+func lockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// postgresTryLock takes the advisory lock of key on a connection of its
+// own, held until unlock: session locks belong to the connection they were
+// taken on. It waits for a free connection of the lock pool while all are
+// holding locks.
+func postgresTryLock(ctx context.Context, key string) (*heldLock, error) {
+	conn, err := lockPool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID(key)).Scan(&locked); err != nil {
+		discard(conn)
+		return nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, nil
+	}
+	return &heldLock{
+		release: func() { postgresUnlock(conn, key) },
+		// The lock lives as long as the session
+		held: func(ctx context.Context) bool { return conn.PingContext(ctx) == nil },
+	}, nil
+}
+
+// postgresUnlock gives up the lock of key held on conn.
+func postgresUnlock(conn *sql.Conn, key string) {
+	// The context of the caller may be over already
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID(key)); err != nil {
+		log.Printf("Failed to release cluster lock %s: %v", key, err)
+		// Closing the session is the other way to release it
+		discard(conn)
+		return
+	}
+	conn.Close()
+}
+
+// discard closes the connection under conn instead of returning it to the
+// pool, along with any lock it holds.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
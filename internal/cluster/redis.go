@@ -0,0 +1,167 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/redis"
+)
+
+// redisLockTTL is how long a Redis lock outlives a node that died holding
+// it. Held locks are extended every third of it.
+const redisLockTTL = 30 * time.Second
+
+// initTimeout bounds the connection check at startup.
+const initTimeout = 5 * time.Second
+
+var (
+	rdb       *redis.Client
+	keyPrefix string
+)
+
+const (
+	// renewScript extends a lock that is still held with this token.
+	renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+	// releaseScript deletes a lock that is still held with this token.
+	releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+	// addScript increments the fields of the hash KEYS[1] by the deltas
+	// following them in ARGV, returning their totals.
+	addScript = `local totals = {} for i = 1, #ARGV, 2 do totals[#totals + 1] = redis.call("HINCRBY", KEYS[1], ARGV[i], ARGV[i + 1]) end return totals`
+	// allowScript takes a token from the bucket in KEYS[1], refilled at
+	// ARGV[1] per second up to ARGV[2], at time ARGV[3] in milliseconds. It
+	// returns 0 when a token was taken, or how many milliseconds until one
+	// is available.
+	allowScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "time")
+local tokens, last = tonumber(state[1]) or burst, tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate / 1000)
+local wait = 0
+if tokens >= 1 then tokens = tokens - 1 else wait = math.ceil((1 - tokens) * 1000 / rate) end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "time", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return wait`
+)
+
+// initRedis connects to the Redis server of cfg.
+func initRedis(cfg config.Redis) error {
+	password, err := cfg.Password.Value()
+	if err != nil {
+		return fmt.Errorf("redis password: %w", err)
+	}
+	client := redis.New(cfg.Address, password, cfg.DB)
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		return fmt.Errorf("redis at %s: %w", cfg.Address, err)
+	}
+	rdb, keyPrefix = client, cfg.KeyPrefix
+	return nil
+}
+
+// Shared reports whether state is shared with the other nodes through
+// Redis.
+func Shared() bool {
+	return rdb != nil
+}
+
+// redisTryLock sets the lock of key unless another node holds it, and keeps
+// extending it until unlock.
+func redisTryLock(ctx context.Context, key string) (*heldLock, error) {
+	var b [16]byte
+	rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+	lockKey := keyPrefix + "lock:" + key
+	reply, err := rdb.Do(ctx, "SET", lockKey, token, "NX", "PX", redisLockTTL.Milliseconds())
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(redisLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				held, err := redis.Int(rdb.Do(context.Background(), "EVAL", renewScript, 1, lockKey, token, redisLockTTL.Milliseconds()))
+				if err != nil {
+					log.Printf("Failed to extend cluster lock %s: %v", key, err)
+				} else if held == 0 {
+					log.Printf("Lost cluster lock %s", key)
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return &heldLock{
+		release: func() {
+			close(stop)
+			if _, err := rdb.Do(context.Background(), "EVAL", releaseScript, 1, lockKey, token); err != nil {
+				log.Printf("Failed to release cluster lock %s: %v", key, err)
+			}
+		},
+		held: func(ctx context.Context) bool {
+			value, err := rdb.Do(ctx, "GET", lockKey)
+			return err == nil && value == token
+		},
+	}, nil
+}
+
+// Allow takes a token from the bucket of key shared by the cluster,
+// refilled at rate per second up to burst. When none is left, it returns
+// false and how long until one is.
+func Allow(ctx context.Context, key string, rate, burst float64) (ok bool, retryAfter time.Duration, err error) {
+	wait, err := redis.Int(rdb.Do(ctx, "EVAL", allowScript, 1, keyPrefix+"ratelimit:"+key, rate, burst, time.Now().UnixMilli()))
+	if err != nil {
+		return false, 0, err
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
+
+// SetFlag records key across the cluster for ttl.
+func SetFlag(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := rdb.Do(ctx, "SET", keyPrefix+key, "1", "PX", ttl.Milliseconds())
+	return err
+}
+
+// HasFlag reports whether key was recorded with SetFlag and has not
+// expired.
+func HasFlag(ctx context.Context, key string) (bool, error) {
+	n, err := redis.Int(rdb.Do(ctx, "EXISTS", keyPrefix+key))
+	return n > 0, err
+}
+
+// AddCounts adds deltas to the counters of the hash key shared by the
+// cluster, at once, and returns their totals.
+func AddCounts(ctx context.Context, key string, deltas map[string]int64) (map[string]int64, error) {
+	fields := slices.Sorted(maps.Keys(deltas))
+	args := []any{"EVAL", addScript, 1, keyPrefix + key}
+	for _, field := range fields {
+		args = append(args, field, deltas[field])
+	}
+	reply, err := rdb.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != len(fields) {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+	totals := make(map[string]int64, len(fields))
+	for i, field := range fields {
+		if totals[field], err = redis.Int(values[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return totals, nil
+}
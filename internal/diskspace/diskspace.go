@@ -0,0 +1,23 @@
+// Package diskspace reports how much space is left on the filesystem
+// holding a cache directory.
+package diskspace
+
+// Usage is the space of a filesystem, counting only what unprivileged users
+// may use, like df.
+type Usage struct {
+	Used      uint64
+	Available uint64
+}
+
+// Total returns the space usable by unprivileged users.
+func (u Usage) Total() uint64 {
+	return u.Used + u.Available
+}
+
+// UsedPercent returns how full the filesystem is, in percent.
+func (u Usage) UsedPercent() float64 {
+	if u.Total() == 0 {
+		return 0
+	}
+	return float64(u.Used) * 100 / float64(u.Total())
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package diskspace
+
+import "errors"
+
+// Stat is only implemented for Linux and macOS.
+func Stat(path string) (Usage, error) {
+	return Usage{}, errors.ErrUnsupported
+}
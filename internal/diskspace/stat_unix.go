@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package diskspace
+
+import "syscall"
+
+// Stat returns the usage of the filesystem holding path.
+func Stat(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		Used:      (uint64(st.Blocks) - uint64(st.Bfree)) * uint64(st.Bsize),
+		Available: uint64(st.Bavail) * uint64(st.Bsize),
+	}, nil
+}
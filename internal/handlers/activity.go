@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+const (
+	// dashboardActivityLimit is how many events the dashboard lists.
+	dashboardActivityLimit = 25
+	// Events returned by the API by default and at most
+	apiDefaultActivityLimit = 50
+	apiMaxActivityLimit     = 500
+)
+
+// Kinds of activity
+const (
+	ActivityDownload = "download"
+	ActivityPurge    = "purge"
+)
+
+// APIActivity is a download or a purge of a cached file.
+type APIActivity struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Registry    string    `json:"registry"`
+	FileName    string    `json:"file_name"`
+	PackageName string    `json:"package_name"`
+	Version     string    `json:"version"`
+	Client      string    `json:"client"`
+	// CacheHit and BytesServed are only set for downloads.
+	CacheHit    bool  `json:"cache_hit,omitempty"`
+	BytesServed int64 `json:"bytes_served,omitempty"`
+}
+
+// DashboardActivity is one row of the activity feed.
+type DashboardActivity struct {
+	Time        string
+	Type        string
+	Registry    string
+	FileName    string
+	PackageName string
+	CacheHit    bool
+	Bytes       string
+	Client      string
+}
+
+// recentActivity returns the latest downloads and purges of registry,
+// newest first. Downloads show up once the history is flushed.
+func recentActivity(registry string, limit int) ([]APIActivity, error) {
+	activity := []APIActivity{}
+	if repositories.DownloadEventRepo != nil {
+		downloads, err := repositories.DownloadEventRepo.Recent(registry, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range downloads {
+			activity = append(activity, APIActivity{
+				Type:        ActivityDownload,
+				Time:        e.CreatedAt,
+				Registry:    e.Registry,
+				FileName:    e.FileName,
+				PackageName: e.PackageName,
+				Version:     e.Version,
+				Client:      e.Client,
+				CacheHit:    e.CacheHit,
+				BytesServed: e.BytesServed,
+			})
+		}
+	}
+	if repositories.PurgeEventRepo != nil {
+		purges, err := repositories.PurgeEventRepo.Recent(registry, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range purges {
+			activity = append(activity, APIActivity{
+				Type:        ActivityPurge,
+				Time:        e.CreatedAt,
+				Registry:    e.Registry,
+				FileName:    e.FileName,
+				PackageName: e.PackageName,
+				Version:     e.Version,
+				Client:      e.Client,
+			})
+		}
+	}
+	slices.SortStableFunc(activity, func(a, b APIActivity) int {
+		return b.Time.Compare(a.Time)
+	})
+	return activity[:min(len(activity), limit)], nil
+}
+
+// dashboardActivity returns the activity feed of the dashboard.
+func dashboardActivity(registry string) []DashboardActivity {
+	activity, err := recentActivity(registry, dashboardActivityLimit)
+	if err != nil {
+		log.Printf("Failed to load activity for dashboard: %v", err)
+		return nil
+	}
+	var rows []DashboardActivity
+	for _, a := range activity {
+		row := DashboardActivity{
+			Time:        a.Time.Format("Jan 02, 2006 15:04:05"),
+			Type:        a.Type,
+			Registry:    a.Registry,
+			FileName:    a.FileName,
+			PackageName: a.PackageName,
+			CacheHit:    a.CacheHit,
+			Client:      a.Client,
+		}
+		if a.Type == ActivityDownload {
+			row.Bytes = stats.FormatBytes(a.BytesServed)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// recordPurges adds the files purged from registry by client to the
+// activity history.
+func recordPurges(client, registry string, fileNames []string) {
+	if repositories.PurgeEventRepo == nil || len(fileNames) == 0 {
+		return
+	}
+	now := time.Now()
+	events := make([]models.PurgeEvent, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		e := models.PurgeEvent{Registry: registry, FileName: fileName, Client: client, CreatedAt: now}
+		e.PackageName, e.Version = parseCachedFileName(registry, fileName)
+		events = append(events, e)
+	}
+	if err := repositories.PurgeEventRepo.InsertEvents(events); err != nil {
+		log.Printf("Failed to record %d purge event(s): %v", len(events), err)
+	}
+}
+
+func (reg apiRegistry) activity(w http.ResponseWriter, r *http.Request) {
+	limit := apiDefaultActivityLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > apiMaxActivityLimit {
+			writeAPIError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(apiMaxActivityLimit))
+			return
+		}
+		limit = n
+	}
+	activity, err := recentActivity(reg.registry, limit)
+	if err != nil {
+		log.Printf("Failed to load activity for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load activity")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, activity)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// adminToken is a configured admin token with its resolved value.
+type adminToken struct {
+	name        string
+	value       string
+	permissions map[string]bool
+}
+
+var adminTokens []adminToken
+
+// InitAdminTokens resolves the configured admin tokens. Without any, the
+// admin endpoints stay unauthenticated and a warning is logged.
+func InitAdminTokens() error {
+	tokens, err := resolveAdminTokens(config.Admin)
+	if err != nil {
+		return err
+	}
+	adminTokens = tokens
+	if len(adminTokens) == 0 && !ssoEnabled() {
+		log.Printf("WARNING: no admin tokens configured, admin endpoints are unauthenticated")
+	}
+	return nil
+}
+
+// resolveAdminTokens returns the tokens of cfg with their values and
+// permissions.
+func resolveAdminTokens(cfg config.AdminConfig) ([]adminToken, error) {
+	var tokens []adminToken
+	for _, t := range cfg.Tokens {
+		value, err := t.Token.Value()
+		if err != nil {
+			return nil, fmt.Errorf("admin token %s: %w", t.Name, err)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("admin token %s is empty", t.Name)
+		}
+		permissions := make(map[string]bool)
+		for _, p := range t.Permissions {
+			switch p {
+			case config.PermissionPurge, config.PermissionRefresh, config.PermissionPublish, config.PermissionPrefetch, config.PermissionAll:
+				permissions[p] = true
+			default:
+				return nil, fmt.Errorf("admin token %s: unknown permission %q", t.Name, p)
+			}
+		}
+		tokens = append(tokens, adminToken{name: t.Name, value: value, permissions: permissions})
+	}
+	return tokens, nil
+}
+
+// presentedAdminToken returns the token sent as "Authorization: Bearer" or
+// in the X-API-Key header.
+func presentedAdminToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// adminTokenFor returns the configured token matching the one presented
+// with r, comparing every candidate in constant time.
+func adminTokenFor(r *http.Request) (adminToken, bool) {
+	presented := presentedAdminToken(r)
+	var match adminToken
+	found := false
+	for _, t := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(t.value)) == 1 {
+			match, found = t, true
+		}
+	}
+	return match, found && presented != ""
+}
+
+// adminAuthorized reports whether r carries a token with permission.
+func adminAuthorized(r *http.Request, permission string) bool {
+	t, ok := adminTokenFor(r)
+	return ok && (t.permissions[permission] || t.permissions[config.PermissionAll])
+}
+
+// RequireAdmin wraps an admin endpoint so it only runs for requests
+// carrying a token with permission, or from a single sign-on admin, once
+// admin tokens or single sign-on are configured. Read-only replicas refuse
+// every admin endpoint but prefetches. Every request run or refused is
+// recorded to the audit log.
+func RequireAdmin(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := clientIdentity(r)
+		if s, ok := currentSession(r); ok && presentedAdminToken(r) == "" {
+			actor = "sso:" + s.Name
+			if s.Role != roleAdmin {
+				log.Printf("Single sign-on user %s denied %s on %s", s.Name, permission, r.URL.Path)
+				auditAccessDenied(r, actor, "no admin role")
+				writeAdminError(w, http.StatusForbidden, "Your account lacks the admin role")
+				return
+			}
+			log.Printf("Single sign-on user %s used %s %s", s.Name, r.Method, r.URL.Path)
+		} else if len(adminTokens) > 0 || ssoEnabled() {
+			t, ok := adminTokenFor(r)
+			if !ok {
+				auditAccessDenied(r, actor, "missing or invalid admin token")
+				writeAdminError(w, http.StatusUnauthorized, "Missing or invalid admin token")
+				return
+			}
+			actor = "token:" + t.name
+			if !t.permissions[permission] && !t.permissions[config.PermissionAll] {
+				log.Printf("Admin token %s denied %s on %s", t.name, permission, r.URL.Path)
+				auditAccessDenied(r, actor, "no "+permission+" permission")
+				writeAdminError(w, http.StatusForbidden, "Token lacks the "+permission+" permission")
+				return
+			}
+			log.Printf("Admin token %s used for %s %s", t.name, r.Method, r.URL.Path)
+		}
+		// Prefetches are downloads, which a replica has its writer cache
+		if permission != config.PermissionPrefetch && refuseReplicaWrite(w, r) {
+			return
+		}
+		auditAdminRequest(w, r, actor, next)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pkgbin"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"success": false, "message": message})
+}
@@ -0,0 +1,611 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"github.com/pkgb-in/pkgbin/internal/blocklist"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+	"gorm.io/gorm"
+)
+
+// APIPrefix is the path the admin API is served under.
+const APIPrefix = "/api/v1/"
+
+const (
+	apiDefaultPageSize = 50
+	apiMaxPageSize     = 500
+	// maxPrefetchFiles bounds the files fetched by one prefetch request.
+	maxPrefetchFiles = 100
+)
+
+// apiRegistry is what the API needs to know about the registry of the
+// proxy serving it.
+type apiRegistry struct {
+	registry string
+	purge    http.HandlerFunc
+	purgeAll http.HandlerFunc
+	refresh  http.HandlerFunc
+	// config returns the settings of the repository r was made to.
+	config func(r *http.Request) any
+	// cacheDir returns the cache directory of the repository r was made
+	// to.
+	cacheDir func(r *http.Request) string
+	// explainTarget makes out what the request r for a registry path is.
+	explainTarget func(r *http.Request) explainTarget
+}
+
+// APIPackage is a cached file as returned by the API.
+type APIPackage struct {
+	Name            string             `json:"name"`
+	Registry        string             `json:"registry"`
+	PackageName     string             `json:"package_name"`
+	Version         string             `json:"version"`
+	CacheHit        int64              `json:"cache_hit"`
+	CacheMiss       int64              `json:"cache_miss"`
+	SizeBytes       int64              `json:"size_bytes"`
+	SHA256          string             `json:"sha256,omitempty"`
+	SHA512          string             `json:"sha512,omitempty"`
+	LastAccessedAt  *time.Time         `json:"last_accessed_at"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+	Vulnerabilities []APIVulnerability `json:"vulnerabilities,omitempty"`
+	// YankedAt is set once revalidation found the version yanked or
+	// unpublished upstream, for YankedReason.
+	YankedAt     *time.Time `json:"yanked_at,omitempty"`
+	YankedReason string     `json:"yanked_reason,omitempty"`
+}
+
+// APIVulnerability is a recorded vulnerability finding.
+type APIVulnerability struct {
+	ID       string `json:"id"`
+	Summary  string `json:"summary"`
+	Severity string `json:"severity"`
+}
+
+// APIPackageList is a page of cached files.
+type APIPackageList struct {
+	Packages []APIPackage `json:"packages"`
+	Page     int          `json:"page"`
+	PerPage  int          `json:"per_page"`
+	Total    int          `json:"total"`
+}
+
+// APIStats summarizes the cache and its downloads.
+type APIStats struct {
+	Files            int64                   `json:"files"`
+	CacheSizeBytes   int64                   `json:"cache_size_bytes"`
+	PackagesServed   int64                   `json:"packages_served"`
+	UpdatedAt        *time.Time              `json:"updated_at"`
+	UnusedPackages   int64                   `json:"unused_packages"`
+	BlocklistEntries int                     `json:"blocklist_entries"`
+	BlockedRequests  int64                   `json:"blocked_requests"`
+	TopPackages      []APIPackageSummary     `json:"top_packages"`
+	DailyDownloads   []APIDailyDownloads     `json:"daily_downloads"`
+	TopClients       []APIClient             `json:"top_clients"`
+	Circuits         []upstream.BreakerState `json:"circuits"`
+	LastReconcile    *ReconcileReport        `json:"last_reconcile"`
+	LastScrub        *ScrubReport            `json:"last_scrub"`
+	TopMisses        []APIPackageSummary     `json:"top_misses"`
+	// HitRatio is the share of downloads served from cache, from 0 to 1,
+	// and BytesSaved the upstream traffic cache hits avoided
+	HitRatio        float64             `json:"hit_ratio"`
+	BytesSaved      int64               `json:"bytes_saved"`
+	LargestPackages []APIPackageSummary `json:"largest_packages"`
+	// CostSaved prices BytesSaved in Currency when cost_per_gb is set
+	CostSaved      *float64            `json:"cost_saved,omitempty"`
+	Currency       string              `json:"currency,omitempty"`
+	MonthlySavings []APIMonthlySavings `json:"monthly_savings"`
+}
+
+// APIPackageSummary sums the cached versions of one package.
+type APIPackageSummary struct {
+	PackageName string `json:"package_name"`
+	Versions    int64  `json:"versions"`
+	CacheHit    int64  `json:"cache_hit"`
+	CacheMiss   int64  `json:"cache_miss"`
+	SizeBytes   int64  `json:"size_bytes"`
+}
+
+// APIDailyDownloads sums the downloads of one day.
+type APIDailyDownloads struct {
+	Day         string `json:"day"`
+	CacheHit    int64  `json:"cache_hit"`
+	CacheMiss   int64  `json:"cache_miss"`
+	BytesServed int64  `json:"bytes_served"`
+}
+
+// APIClient sums the downloads of one client.
+type APIClient struct {
+	Client      string    `json:"client"`
+	UserAgent   string    `json:"user_agent"`
+	CacheHit    int64     `json:"cache_hit"`
+	CacheMiss   int64     `json:"cache_miss"`
+	BytesServed int64     `json:"bytes_served"`
+	Packages    int64     `json:"packages"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// APIPrefetchResult reports the outcome of prefetching one file.
+type APIPrefetchResult struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Cached bool   `json:"cached"`
+}
+
+// NPMAPIHandler serves the admin API of the npm proxy. prefetch serves
+// registry requests, e.g. the proxy's root handler.
+func NPMAPIHandler(prefetch http.Handler) http.HandlerFunc {
+	return apiHandler(prefetch, apiRegistry{
+		registry: models.RegistryNPM,
+		purge:    NPMPurgeHandler,
+		purgeAll: NPMPurgeAllHandler,
+		refresh:  NPMRefreshHandler,
+		config:   func(r *http.Request) any { return NPMRepository(r) },
+		cacheDir: func(r *http.Request) string { return NPMRepository(r).CacheDir },
+
+		explainTarget: npmExplainTarget,
+	})
+}
+
+// PyPIAPIHandler serves the admin API of the PyPI proxy.
+func PyPIAPIHandler(prefetch http.Handler) http.HandlerFunc {
+	return apiHandler(prefetch, apiRegistry{
+		registry: models.RegistryPyPI,
+		purge:    PyPIPurgeHandler,
+		purgeAll: PyPIPurgeAllHandler,
+		refresh:  PyPIRefreshHandler,
+		config:   func(r *http.Request) any { return PyPIRepository(r) },
+		cacheDir: func(r *http.Request) string { return PyPIRepository(r).CacheDir },
+
+		explainTarget: pypiExplainTarget,
+	})
+}
+
+// RubyAPIHandler serves the admin API of the RubyGems proxy.
+func RubyAPIHandler(prefetch http.Handler) http.HandlerFunc {
+	return apiHandler(prefetch, apiRegistry{
+		registry: models.RegistryRubyGems,
+		purge:    RubyPurgeHandler,
+		purgeAll: RubyPurgeAllHandler,
+		refresh:  RubyRefreshHandler,
+		config:   func(r *http.Request) any { return RubyGemsRepository(r) },
+		cacheDir: func(r *http.Request) string { return RubyGemsRepository(r).CacheDir },
+
+		explainTarget: gemExplainTarget,
+	})
+}
+
+func apiHandler(prefetch http.Handler, reg apiRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/")
+		switch {
+		case route == "health":
+			apiMethod(w, r, http.MethodGet, apiHealthHandler)
+		case route == "packages":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.listPackages))
+		case strings.HasPrefix(route, "packages/"):
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.getPackageDetail))
+		case strings.HasPrefix(route, "files/") && strings.HasSuffix(route, "/content"):
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.getFileContent))
+		case strings.HasPrefix(route, "files/"):
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.getFile))
+		case route == "stats":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.stats))
+		case route == "platforms":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.platformStats))
+		case route == "history":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.history))
+		case route == "activity":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.activity))
+		case route == "audit":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.audit))
+		case route == "upstreams":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(func(w http.ResponseWriter, r *http.Request) {
+				writeAPIJSON(w, http.StatusOK, upstream.HealthStates())
+			}))
+		case route == "export":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(func(w http.ResponseWriter, r *http.Request) {
+				exportPackagesHandler(w, r, reg.registry)
+			}))
+		case route == "config":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.showConfig))
+		case route == "explain":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.explain))
+		case route == "purge":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionPurge, reg.purge))
+		case route == "backup":
+			apiMethod(w, r, http.MethodGet, RequireAdmin(config.PermissionRefresh, reg.backup))
+		case route == "restore-backup":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionRefresh, reg.restoreBackup))
+		case route == "trash":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.trash))
+		case route == "restore":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionPurge, reg.restore))
+		case route == "purge-all":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionPurge, reg.purgeAll))
+		case route == "refresh":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionRefresh, reg.refresh))
+		case route == "reload":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionRefresh, reg.reloadConfig))
+		case route == "import":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionRefresh, reg.importCache))
+		case route == "seed":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionRefresh, reg.seedFile))
+		case route == "projects":
+			apiMethod(w, r, http.MethodGet, requireAPIViewer(reg.listProjects))
+		case strings.HasPrefix(route, "projects/") && r.Method == http.MethodDelete:
+			RequireAdmin(config.PermissionPurge, reg.deleteProject)(w, r)
+		case strings.HasPrefix(route, "projects/"):
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionRefresh, reg.registerProject))
+		case route == "gc":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionPurge, reg.collectGarbage))
+		case route == "prefetch":
+			apiMethod(w, r, http.MethodPost, RequireAdmin(config.PermissionPrefetch, func(w http.ResponseWriter, r *http.Request) {
+				apiPrefetchHandler(w, r, prefetch)
+			}))
+		default:
+			writeAPIError(w, http.StatusNotFound, "Unknown API endpoint")
+		}
+	}
+}
+
+// apiMethod runs next for requests using method and answers 405 otherwise.
+func apiMethod(w http.ResponseWriter, r *http.Request, method string, next http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	next(w, r)
+}
+
+// requireAPIViewer lets read-only API requests through for dashboard
+// viewers and for any admin token. Unlike RequireViewer it answers 401
+// instead of redirecting to the login page.
+func requireAPIViewer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(adminTokens) > 0 || ssoEnabled() {
+			s, hasSession := currentSession(r)
+			_, hasToken := adminTokenFor(r)
+			if !hasToken && !(hasSession && s.Role != "") {
+				writeAdminError(w, http.StatusUnauthorized, "Missing or invalid admin token")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// apiTopPackages lists the package summaries returned by top.
+func apiTopPackages(top func(registry string, limit int) ([]models.PackageSummary, error), registry string) []APIPackageSummary {
+	summaries, err := top(registry, topPackagesLimit)
+	if err != nil {
+		log.Printf("Failed to load package statistics for API: %v", err)
+		return nil
+	}
+	var pkgs []APIPackageSummary
+	for _, p := range summaries {
+		pkgs = append(pkgs, APIPackageSummary{
+			PackageName: p.PackageName,
+			Versions:    p.Versions,
+			CacheHit:    p.CacheHit,
+			CacheMiss:   p.CacheMiss,
+			SizeBytes:   p.SizeBytes,
+		})
+	}
+	return pkgs
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]any{"success": false, "message": message})
+}
+
+// apiHealthHandler reports whether the database is reachable and which
+// upstreams are failing. It is unauthenticated so load balancers can use
+// it.
+func apiHealthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	status, database := http.StatusOK, "ok"
+	if err := initializers.PingDatabase(ctx); err != nil {
+		log.Printf("Health check failed to reach the database: %v", err)
+		status, database = http.StatusServiceUnavailable, "unavailable"
+	}
+	health := "ok"
+	if status != http.StatusOK {
+		health = "unavailable"
+	}
+	writeAPIJSON(w, status, map[string]any{
+		"status":   health,
+		"database": database,
+		"circuits": upstream.BreakerStates(),
+	})
+}
+
+func (reg apiRegistry) listPackages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := repositories.PackageQuery{
+		Registry: reg.registry,
+		Filter:   q.Get("filter"),
+		Page:     1,
+		PageSize: apiDefaultPageSize,
+	}
+	if p := q.Get("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			writeAPIError(w, http.StatusBadRequest, "page must be a positive integer")
+			return
+		}
+		query.Page = n
+	}
+	if p := q.Get("per_page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > apiMaxPageSize {
+			writeAPIError(w, http.StatusBadRequest, "per_page must be between 1 and "+strconv.Itoa(apiMaxPageSize))
+			return
+		}
+		query.PageSize = n
+	}
+	if sort := q.Get("sort"); sort != "" {
+		if _, ok := repositories.PackageSorts[strings.TrimPrefix(sort, "-")]; !ok {
+			writeAPIError(w, http.StatusBadRequest, "unknown sort key "+sort)
+			return
+		}
+		query.Sort = sort
+	}
+	if since := q.Get("updated_since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "updated_since must be an RFC 3339 time")
+			return
+		}
+		query.UpdatedSince = t
+	}
+
+	pkgs, total, err := repositories.PackageRepo.ListPackages(query)
+	if err != nil {
+		log.Printf("Failed to list packages for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load packages")
+		return
+	}
+	list := APIPackageList{Packages: []APIPackage{}, Page: query.Page, PerPage: query.PageSize, Total: total}
+	for _, pkg := range pkgs {
+		list.Packages = append(list.Packages, newAPIPackage(pkg))
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+func (reg apiRegistry) getFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "files/")
+	pkg, err := repositories.PackageRepo.GetPackageByName(reg.registry, name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeAPIError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load file %s for API: %v", name, err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load file")
+		return
+	}
+
+	detail := newAPIPackage(pkg)
+	for _, v := range vulnerabilitiesByFileName([]models.Package{pkg})[pkg.Name] {
+		detail.Vulnerabilities = append(detail.Vulnerabilities, APIVulnerability{ID: v.VulnID, Summary: v.Summary, Severity: v.Severity})
+	}
+	writeAPIJSON(w, http.StatusOK, detail)
+}
+
+// getFileContent sends a cached file as it is stored, for the standby
+// instances syncing from this one; it is not counted as a download.
+func (reg apiRegistry) getFileContent(w http.ResponseWriter, r *http.Request) {
+	route := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/")
+	name := strings.TrimSuffix(strings.TrimPrefix(route, "files/"), "/content")
+	if name == "" || filepath.Base(name) != name {
+		writeAPIError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	path := filepath.Join(reg.cacheDir(r), name)
+	file, err := os.Open(path)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !janitor.IsArtifact(path, info) {
+		writeAPIError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if repositories.PackageRepo != nil {
+		if _, contentType, err := repositories.PackageRepo.GetServeHeaders(reg.registry, name); err == nil && contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+func newAPIPackage(pkg models.Package) APIPackage {
+	return APIPackage{
+		Name:           pkg.Name,
+		Registry:       pkg.Registry,
+		PackageName:    pkg.PackageName,
+		Version:        pkg.Version,
+		CacheHit:       pkg.CacheHit,
+		CacheMiss:      pkg.CacheMiss,
+		SizeBytes:      pkg.SizeBytes,
+		SHA256:         pkg.SHA256,
+		SHA512:         pkg.SHA512,
+		LastAccessedAt: pkg.LastAccessedAt,
+		CreatedAt:      pkg.CreatedAt,
+		UpdatedAt:      pkg.UpdatedAt,
+		YankedAt:       pkg.YankedAt,
+		YankedReason:   pkg.YankedReason,
+	}
+}
+
+func (reg apiRegistry) stats(w http.ResponseWriter, r *http.Request) {
+	var s APIStats
+	if cached := stats.For(reg.registry); cached != nil {
+		var lastUpdated time.Time
+		s.Files, s.CacheSizeBytes, s.PackagesServed, lastUpdated = cached.Get()
+		if !lastUpdated.IsZero() {
+			s.UpdatedAt = &lastUpdated
+		}
+	}
+	s.UnusedPackages = unusedPackages(reg.registry)
+	s.BlocklistEntries, s.BlockedRequests = blocklist.Totals(blocklistURLs(reg.registry)...)
+	s.Circuits = upstream.BreakerStates()
+	if report := LastReconcile(reg.registry); !report.Time.IsZero() {
+		s.LastReconcile = &report
+	}
+	if report := LastScrub(reg.registry); !report.Time.IsZero() {
+		s.LastScrub = &report
+	}
+
+	s.TopPackages = apiTopPackages(repositories.PackageRepo.TopPackages, reg.registry)
+	s.TopMisses = apiTopPackages(repositories.PackageRepo.TopMissedPackages, reg.registry)
+	s.LargestPackages = apiTopPackages(repositories.PackageRepo.LargestPackages, reg.registry)
+	totals := cacheTotals(reg.registry)
+	if served := totals.CacheHit + totals.CacheMiss; served > 0 {
+		s.HitRatio = float64(totals.CacheHit) / float64(served)
+	}
+	s.BytesSaved = totals.BytesSaved
+	if s.CostSaved = costSaved(totals.BytesSaved); s.CostSaved != nil {
+		s.Currency = requestSettings(r.Context()).Server.Currency
+	}
+	s.MonthlySavings = apiMonthlySavings(reg.registry)
+	if repositories.DownloadEventRepo != nil {
+		since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(recentDownloadDays - 1))
+		if daily, err := repositories.DownloadEventRepo.DailyDownloads(reg.registry, since); err != nil {
+			log.Printf("Failed to load download history for API: %v", err)
+		} else {
+			for _, d := range daily {
+				s.DailyDownloads = append(s.DailyDownloads, APIDailyDownloads(d))
+			}
+		}
+	}
+	if repositories.ClientDownloadRepo != nil {
+		if clients, err := repositories.ClientDownloadRepo.TopClients(reg.registry, topClientsLimit); err != nil {
+			log.Printf("Failed to load client statistics for API: %v", err)
+		} else {
+			for _, c := range clients {
+				s.TopClients = append(s.TopClients, APIClient(c))
+			}
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, s)
+}
+
+// showConfig returns the effective server settings and those of the
+// repository the request was made to. Credentials are only referenced by
+// the configuration, so none are returned.
+func (reg apiRegistry) showConfig(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, map[string]any{
+		"server":     requestSettings(r.Context()).Server,
+		reg.registry: reg.config(r),
+	})
+}
+
+// apiPrefetchHandler downloads the registry paths listed in the request
+// into the cache by passing them to handler as GET requests, so prefetches
+// go through the same policy checks, routing and verification as clients.
+func apiPrefetchHandler(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Paths) == 0 || len(req.Paths) > maxPrefetchFiles {
+		writeAPIError(w, http.StatusBadRequest, "paths must list between 1 and "+strconv.Itoa(maxPrefetchFiles)+" files")
+		return
+	}
+
+	results := make([]APIPrefetchResult, 0, len(req.Paths))
+	cached := 0
+	for _, p := range req.Paths {
+		if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, APIPrefix) {
+			results = append(results, APIPrefetchResult{Path: p, Status: http.StatusBadRequest})
+			continue
+		}
+		fetch, err := http.NewRequestWithContext(r.Context(), http.MethodGet, p, nil)
+		if err != nil {
+			results = append(results, APIPrefetchResult{Path: p, Status: http.StatusBadRequest})
+			continue
+		}
+		// Attributed to the caller, as seen through trusted proxies
+		fetch.RemoteAddr = r.RemoteAddr
+		fetch.Header["X-Forwarded-For"] = r.Header.Values("X-Forwarded-For")
+		fetch.Host = r.Host
+		fetch.Header.Set("User-Agent", "pkgbin-prefetch")
+
+		sink := &discardResponseWriter{header: make(http.Header)}
+		handler.ServeHTTP(sink, fetch)
+		result := APIPrefetchResult{Path: p, Status: sink.status(), Cached: sink.status() == http.StatusOK}
+		if result.Cached {
+			cached++
+		}
+		results = append(results, result)
+	}
+	log.Printf("Prefetched %d of %d files", cached, len(req.Paths))
+
+	writeAPIJSON(w, http.StatusOK, map[string]any{
+		"success": cached == len(req.Paths),
+		"message": strconv.Itoa(cached) + " of " + strconv.Itoa(len(req.Paths)) + " files cached",
+		"results": results,
+	})
+}
+
+// discardResponseWriter records the status of a response and drops its
+// body.
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (d *discardResponseWriter) Header() http.Header { return d.header }
+
+func (d *discardResponseWriter) Write(p []byte) (int, error) {
+	if d.code == 0 {
+		d.code = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(code int) {
+	if d.code == 0 {
+		d.code = code
+	}
+}
+
+func (d *discardResponseWriter) status() int {
+	if d.code == 0 {
+		return http.StatusOK
+	}
+	return d.code
+}
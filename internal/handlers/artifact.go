@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// errArtifactTooLarge is wrapped by the fetchError of artifacts over the
+// maximum size of their repository.
+var errArtifactTooLarge = errors.New("artifact exceeds the maximum size")
+
+// errNotFoundUpstream is wrapped by the fetchError of artifacts upstream
+// has no file for.
+var errNotFoundUpstream = errors.New("not found upstream")
+
+// maxFetchAttempts bounds how many times an artifact is re-downloaded after a
+// checksum mismatch before the request is failed.
+const maxFetchAttempts = 2
+
+// fetchError carries the HTTP status and client-facing message for a failed
+// artifact download.
+type fetchError struct {
+	Status  int
+	Message string
+	Err     error
+	// Overloaded tells the client to retry later, see setRetryAfter.
+	Overloaded bool
+}
+
+func (e *fetchError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *fetchError) Unwrap() error { return e.Err }
+
+// writeFetchError reports a failed artifact download to the client.
+func writeFetchError(w http.ResponseWriter, r *http.Request, fileName string, err error) {
+	id := requestid.FromContext(r.Context())
+	if fe, ok := err.(*fetchError); ok {
+		log.Printf("Failed to cache %s [%s]: %v", fileName, id, fe)
+		if fe.Overloaded {
+			setRetryAfter(w.Header())
+		}
+		http.Error(w, fe.Message, fe.Status)
+		return
+	}
+	log.Printf("Failed to cache %s [%s]: %v", fileName, id, err)
+	http.Error(w, "Download failed", http.StatusInternalServerError)
+}
+
+var (
+	// fetchSlots bounds the artifact downloads running against the upstreams
+	// of each registry at once; registries without an entry are unlimited.
+	fetchSlots   = make(map[string]chan struct{})
+	fetchSlotsMu sync.RWMutex
+)
+
+// InitFetchLimit caps the simultaneous upstream artifact downloads of
+// registry. Further cache misses queue until a download finishes. When the
+// limit changes on a configuration reload, downloads already running keep
+// and release the slots of the previous one.
+func InitFetchLimit(registry string, n int) {
+	fetchSlotsMu.Lock()
+	defer fetchSlotsMu.Unlock()
+	if n <= 0 {
+		delete(fetchSlots, registry)
+		return
+	}
+	fetchSlots[registry] = make(chan struct{}, n)
+	log.Printf("Limiting upstream downloads of %s to %d at a time", registry, n)
+}
+
+// acquireFetchSlot waits for a free upstream download slot of registry,
+// giving up when the client goes away while queued or when the queue is
+// full.
+func acquireFetchSlot(ctx context.Context, registry, fileName string) (release func(), err error) {
+	fetchSlotsMu.RLock()
+	slots := fetchSlots[registry]
+	fetchSlotsMu.RUnlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		leave, ok := enterFetchQueue()
+		if !ok {
+			return nil, &fetchError{Status: http.StatusServiceUnavailable, Message: "Upstream download queue full", Overloaded: true}
+		}
+		defer leave()
+		log.Printf("Upstream download limit reached, queuing %s", fileName)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, &fetchError{Status: http.StatusServiceUnavailable, Message: "Upstream download queue abandoned", Err: ctx.Err()}
+		}
+	}
+	return func() { <-slots }, nil
+}
+
+// cachedArtifact describes a file fetchArtifact committed to the cache.
+type cachedArtifact struct {
+	Size        int64
+	SHA256      string
+	SHA512      string
+	ContentType string
+	// UpstreamCacheStatus is the cache status an upstream pkgbin reported.
+	UpstreamCacheStatus string
+}
+
+// recordArtifact stores the registry, size, digests and Content-Type of a
+// freshly cached file with its package row.
+func recordArtifact(registry, fileName string, artifact *cachedArtifact) {
+	if repositories.PackageRepo == nil {
+		return
+	}
+	if err := repositories.PackageRepo.RecordArtifact(registry, fileName, artifact.Size, artifact.SHA256, artifact.SHA512, artifact.ContentType); err != nil {
+		log.Printf("Failed to record details of %s: %v", fileName, err)
+	}
+}
+
+// fetchArtifact downloads upstreamURL into localPath through a temporary file.
+// When expected is non-nil the downloaded bytes must match it before the file
+// is committed to the cache; mismatches are retried up to maxFetchAttempts.
+// The download waits for an upstream slot of registry while ctx is alive, and
+// carries its request ID upstream. Artifacts larger than maxSize bytes, unless
+// zero, are not cached and fail with errArtifactTooLarge.
+func fetchArtifact(ctx context.Context, registry string, client *http.Client, upstreamURL, localPath string, expected *expectedDigest, maxSize int64) (*cachedArtifact, error) {
+	fileName := filepath.Base(localPath)
+
+	if knownNotFound(ctx, upstreamURL) {
+		return nil, notFoundUpstream(upstreamURL)
+	}
+
+	release, err := acquireFetchSlot(ctx, registry, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var artifact *cachedArtifact
+	for attempt := 1; attempt <= maxFetchAttempts; attempt++ {
+		artifact, err = fetchArtifactOnce(ctx, client, upstreamURL, localPath, expected, maxSize)
+		if err == nil {
+			return artifact, nil
+		}
+		if errors.Is(err, errNotFoundUpstream) {
+			rememberNotFound(ctx, upstreamURL)
+		}
+		if !errors.Is(err, errChecksumMismatch) {
+			return nil, err
+		}
+		log.Printf("Checksum mismatch for %s (attempt %d/%d)", fileName, attempt, maxFetchAttempts)
+	}
+	return nil, err
+}
+
+func fetchArtifactOnce(ctx context.Context, client *http.Client, upstreamURL, localPath string, expected *expectedDigest, maxSize int64) (*cachedArtifact, error) {
+	fileName := filepath.Base(localPath)
+
+	// The file is still cached for other clients if this one goes away
+	resp, err := getUpstreamArtifact(context.WithoutCancel(ctx), client, upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		if resp.ContentLength > maxSize {
+			return nil, artifactTooLarge(maxSize)
+		}
+		// Upstream may not announce the size
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+
+	// Use temporary file for atomic write
+	tempPath := localPath + janitor.TempSuffix
+	defer janitor.Track(tempPath)()
+	outFile, err := os.Create(tempPath)
+	if err != nil {
+		return nil, &fetchError{Status: http.StatusInternalServerError, Message: "File creation failed", Err: err}
+	}
+
+	// Download completely to temp file first, hashing with every algorithm
+	// an upstream registry may publish
+	hasher := newArtifactHasher()
+	multiWriter := io.MultiWriter(outFile, hasher)
+	bytesWritten, err := io.Copy(multiWriter, body)
+	outFile.Close()
+
+	if err != nil {
+		os.Remove(tempPath)
+		return nil, &fetchError{Status: http.StatusInternalServerError, Message: "Download failed", Err: err}
+	}
+	if maxSize > 0 && bytesWritten > maxSize {
+		os.Remove(tempPath)
+		return nil, artifactTooLarge(maxSize)
+	}
+
+	// Verify file was written completely
+	if stat, err := os.Stat(tempPath); err != nil || stat.Size() != bytesWritten {
+		os.Remove(tempPath)
+		return nil, &fetchError{
+			Status:  http.StatusInternalServerError,
+			Message: "File write verification failed",
+			Err:     fmt.Errorf("size mismatch: expected %d bytes", bytesWritten),
+		}
+	}
+
+	// Compare against the digest declared by the upstream registry
+	if err := hasher.verify(expected); err != nil {
+		os.Remove(tempPath)
+		return nil, &fetchError{Status: http.StatusBadGateway, Message: "Checksum verification failed", Err: err}
+	}
+
+	// Atomically move temp file to final location
+	if err := os.Rename(tempPath, localPath); err != nil {
+		os.Remove(tempPath)
+		return nil, &fetchError{Status: http.StatusInternalServerError, Message: "File move failed", Err: err}
+	}
+
+	// Log the file hash for debugging
+	fileHash := hex.EncodeToString(hasher.Sum("sha512"))
+	verified := "unverified"
+	if expected != nil {
+		verified = "verified " + expected.Algorithm
+	}
+	log.Printf("Cached %s (size: %d bytes, sha512: %s, %s)", fileName, bytesWritten, fileHash[:16]+"...", verified)
+	return &cachedArtifact{
+		Size:                bytesWritten,
+		SHA256:              hex.EncodeToString(hasher.Sum("sha256")),
+		SHA512:              fileHash,
+		ContentType:         resp.Header.Get("Content-Type"),
+		UpstreamCacheStatus: resp.Header.Get(cacheStatusHeader),
+	}, nil
+}
+
+// artifactTooLarge returns the error of an artifact over maxSize bytes.
+func artifactTooLarge(maxSize int64) error {
+	return &fetchError{
+		Status:  http.StatusForbidden,
+		Message: fmt.Sprintf("Artifact exceeds the maximum size of %d bytes", maxSize),
+		Err:     errArtifactTooLarge,
+	}
+}
+
+// notFoundUpstream returns the error of an artifact upstream has no file
+// for at upstreamURL.
+func notFoundUpstream(upstreamURL string) error {
+	return &fetchError{
+		Status:  http.StatusNotFound,
+		Message: "Not found upstream",
+		Err:     fmt.Errorf("%w: %s", errNotFoundUpstream, upstreamURL),
+	}
+}
+
+// getUpstreamArtifact requests upstreamURL, returning the response of a
+// successful download or a fetchError.
+func getUpstreamArtifact(ctx context.Context, client *http.Client, upstreamURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return nil, &fetchError{Status: http.StatusInternalServerError, Message: "Invalid upstream URL", Err: err}
+	}
+	resp, err := client.Do(req)
+	if errors.Is(err, upstream.ErrCircuitOpen) {
+		return nil, &fetchError{Status: http.StatusServiceUnavailable, Message: "Upstream temporarily unavailable", Err: err}
+	}
+	if err != nil {
+		return nil, &fetchError{Status: http.StatusBadGateway, Message: "Upstream fetch failed", Err: err}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, notFoundUpstream(upstreamURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &fetchError{
+			Status:  http.StatusBadGateway,
+			Message: "Upstream fetch failed",
+			Err:     fmt.Errorf("upstream returned status %d for %s", resp.StatusCode, upstreamURL),
+		}
+	}
+	return resp, nil
+}
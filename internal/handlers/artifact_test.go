@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+)
+
+func TestFetchLimitPerRegistry(t *testing.T) {
+	InitFetchLimit(models.RegistryNPM, 1)
+	t.Cleanup(func() { InitFetchLimit(models.RegistryNPM, 0) })
+
+	release, err := acquireFetchSlot(context.Background(), models.RegistryNPM, "a-1.0.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// The other registries have slots of their own, or none at all
+	other, err := acquireFetchSlot(context.Background(), models.RegistryPyPI, "a-1.0.tar.gz")
+	if err != nil {
+		t.Fatalf("PyPI download waited for the npm limit: %v", err)
+	}
+	other()
+
+	// The npm download queues until its client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := acquireFetchSlot(ctx, models.RegistryNPM, "b-1.0.0.tgz"); err == nil {
+		t.Error("second npm download got a slot beyond the limit of 1")
+	}
+}
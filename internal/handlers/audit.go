@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+)
+
+// Audited actions
+const (
+	AuditPurge    = "purge"
+	AuditPurgeAll = "purge_all"
+	AuditRestore  = "restore"
+	AuditRefresh  = "refresh"
+	AuditImport   = "import"
+	AuditSeed     = "seed"
+	AuditPrefetch = "prefetch"
+	AuditBackup   = "backup"
+	// AuditProjectRegister and AuditProjectDelete are a project registered
+	// with its lockfile, or its lockfile replaced, and a project removed.
+	AuditProjectRegister = "project_register"
+	AuditProjectDelete   = "project_delete"
+	// AuditGC is a garbage collection of the files no project pins.
+	AuditGC = "gc"
+	// AuditRestoreBackup is a backup restored over the rows of a registry.
+	AuditRestoreBackup = "restore_backup"
+	// AuditAccessDenied is an admin endpoint refused for a missing or
+	// insufficient token or role.
+	AuditAccessDenied = "access_denied"
+	AuditLogin        = "login"
+	// AuditLoginDenied is a single sign-on user signing in without a
+	// pkgbin role, or with an ID token that was rejected.
+	AuditLoginDenied = "login_denied"
+	AuditLogout      = "logout"
+	// AuditConfigChanged is the configuration found changed at startup or
+	// on a reload, with its digest as detail.
+	AuditConfigChanged = "config_changed"
+	// AuditPolicyChanged is the policies or blocklists of the repositories
+	// found changed at startup or on a reload, with their digest as detail.
+	AuditPolicyChanged = "policy_changed"
+	// AuditReload is a reload of the configuration asked for through the
+	// API.
+	AuditReload = "reload"
+	// AuditUpstreamDeletionKept is a cached file found gone upstream and
+	// kept, as upstream_deletions is keep.
+	AuditUpstreamDeletionKept = "upstream_deletion_kept"
+	// AuditUpstreamDeletionPurged is a cached file found gone upstream and
+	// purged, as upstream_deletions is purge.
+	AuditUpstreamDeletionPurged = "upstream_deletion_purged"
+)
+
+// auditSystemActor is who changes found at startup, and reloads on SIGHUP
+// or a change of the file, are attributed to.
+const auditSystemActor = "system"
+
+// maxAuditFieldLength is the size of the actor and detail columns.
+const maxAuditFieldLength = 255
+
+// dashboardAuditLimit is how many audit events the dashboard lists.
+const dashboardAuditLimit = 25
+
+// adminRouteActions maps the last path segment of the admin endpoints to
+// the action they are audited as.
+var adminRouteActions = map[string]string{
+	"purge":          AuditPurge,
+	"purge-all":      AuditPurgeAll,
+	"restore":        AuditRestore,
+	"refresh":        AuditRefresh,
+	"refresh-db":     AuditRefresh,
+	"import":         AuditImport,
+	"seed":           AuditSeed,
+	"prefetch":       AuditPrefetch,
+	"backup":         AuditBackup,
+	"restore-backup": AuditRestoreBackup,
+	"gc":             AuditGC,
+	"reload":         AuditReload,
+}
+
+// auditNoteKey is the context key of the auditNote of an admin request.
+type auditNoteKey struct{}
+
+// auditNote is what an admin request did, as its handler describes it.
+type auditNote struct {
+	detail string
+}
+
+// APIAuditEvent is an action taken on a cached file or on pkgbin itself,
+// and by whom.
+type APIAuditEvent struct {
+	Time        time.Time `json:"time"`
+	Registry    string    `json:"registry"`
+	Action      string    `json:"action"`
+	FileName    string    `json:"file_name"`
+	PackageName string    `json:"package_name"`
+	Version     string    `json:"version"`
+	Actor       string    `json:"actor"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+// InitAuditLog records the configuration and the policies of registry as
+// changed when their digests differ from those last recorded. Read-only
+// replicas leave it to their writer.
+func InitAuditLog(registry string) {
+	if repositories.AuditEventRepo == nil || readOnlyReplica() {
+		return
+	}
+	auditConfigChanges(registry, auditSystemActor)
+}
+
+// auditConfigChanges records the configuration and the policies of
+// registry as changed by actor when their digests differ from those last
+// recorded.
+func auditConfigChanges(registry, actor string) {
+	settings, policies := auditedConfig(registry)
+	auditConfigDigest(registry, actor, AuditConfigChanged, settings)
+	auditConfigDigest(registry, actor, AuditPolicyChanged, policies)
+}
+
+// auditedConfig returns the configuration of this process serving
+// registry, and the policies and blocklists of its repositories by name.
+func auditedConfig(registry string) (settings, policies map[string]any) {
+	s := config.Current()
+	settings = map[string]any{
+		"server":      s.Server,
+		"admin":       s.Admin,
+		"oidc":        s.OIDC,
+		"http_client": s.HTTP,
+		"alerts":      s.Alerts,
+	}
+	policies = make(map[string]any)
+	repos := make(map[string]any)
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&s.NPM}, s.NPM.Repositories...) {
+			repos[repo.Name] = repo
+			policies[repo.Name] = []any{repo.Policy, repo.Blocklist}
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&s.PyPI}, s.PyPI.Repositories...) {
+			repos[repo.Name] = repo
+			policies[repo.Name] = []any{repo.Policy, repo.Blocklist}
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&s.RubyGems}, s.RubyGems.Repositories...) {
+			repos[repo.Name] = repo
+			policies[repo.Name] = []any{repo.Policy, repo.Blocklist}
+		}
+	}
+	settings[registry] = repos
+	return settings, policies
+}
+
+// auditConfigDigest records action by actor when the SHA-256 digest of v
+// differs from the detail of the latest action recorded for registry.
+func auditConfigDigest(registry, actor, action string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode configuration for the audit log: %v", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	latest, err := repositories.AuditEventRepo.Latest(registry, action)
+	if err != nil {
+		log.Printf("Failed to load the latest %s audit event: %v", action, err)
+		return
+	}
+	if latest != nil && latest.Detail == digest {
+		return
+	}
+	log.Printf("Recording %s, now %s", action, digest)
+	recordAuditEvent(models.AuditEvent{Registry: registry, Action: action, Actor: actor, Detail: digest})
+}
+
+// recordAudit adds the action actor took on the file of registry to the
+// audit log, with detail on why.
+func recordAudit(actor, registry, action, fileName, detail string) {
+	e := models.AuditEvent{
+		Registry: registry,
+		Action:   action,
+		FileName: fileName,
+		Actor:    actor,
+		Detail:   detail,
+	}
+	e.PackageName, e.Version = parseCachedFileName(registry, fileName)
+	recordAuditEvent(e)
+}
+
+// recordAdminAudit adds the action actor took on pkgbin itself through r to
+// the audit log of the registry r was made to, with detail on what it did.
+func recordAdminAudit(r *http.Request, actor, action, detail string) {
+	recordAuditEvent(models.AuditEvent{Registry: requestRegistry(r), Action: action, Actor: actor, Detail: detail})
+}
+
+// recordAuditEvent stores e, timestamped now. The audit table is
+// append-only, so events are never updated once stored.
+func recordAuditEvent(e models.AuditEvent) {
+	if repositories.AuditEventRepo == nil || readOnlyReplica() {
+		log.Printf("Audit: %s by %s %s %s", e.Action, e.Actor, e.FileName, e.Detail)
+		return
+	}
+	e.Actor = strings.ToValidUTF8(truncate(e.Actor, maxAuditFieldLength), "")
+	e.Detail = strings.ToValidUTF8(truncate(e.Detail, maxAuditFieldLength), "")
+	e.CreatedAt = time.Now()
+	if err := repositories.AuditEventRepo.InsertEvents([]models.AuditEvent{e}); err != nil {
+		log.Printf("Failed to record audit event %s by %s: %v", e.Action, e.Actor, err)
+	}
+}
+
+// noteAudit describes what the admin request r did, for its audit event.
+func noteAudit(r *http.Request, format string, args ...any) {
+	if note, ok := r.Context().Value(auditNoteKey{}).(*auditNote); ok {
+		note.detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// auditAdminRequest runs the admin endpoint next for r, made by actor, and
+// records it to the audit log with the status it answered and what its
+// handler noted.
+func auditAdminRequest(w http.ResponseWriter, r *http.Request, actor string, next http.HandlerFunc) {
+	note := &auditNote{}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	next(cw, r.WithContext(context.WithValue(r.Context(), auditNoteKey{}, note)))
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	detail := fmt.Sprintf("%d %s %s", status, r.Method, r.URL.Path)
+	if note.detail != "" {
+		detail += ": " + note.detail
+	}
+	recordAdminAudit(r, actor, adminRouteAction(r), detail)
+}
+
+// adminRouteAction returns the action the admin endpoint of r is audited
+// as.
+func adminRouteAction(r *http.Request) string {
+	// Projects are named by the last segment
+	if strings.Contains(r.URL.Path, APIPrefix+"projects/") {
+		if r.Method == http.MethodDelete {
+			return AuditProjectDelete
+		}
+		return AuditProjectRegister
+	}
+	base := path.Base(r.URL.Path)
+	if action, ok := adminRouteActions[base]; ok {
+		return action
+	}
+	return base
+}
+
+// auditAccessDenied records that actor was refused the admin endpoint of r
+// for reason.
+func auditAccessDenied(r *http.Request, actor, reason string) {
+	recordAdminAudit(r, actor, AuditAccessDenied, fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, reason))
+}
+
+// DashboardAuditEvent is a row of the audit log on the dashboard.
+type DashboardAuditEvent struct {
+	Time        string
+	Registry    string
+	Action      string
+	FileName    string
+	PackageName string
+	Actor       string
+	Detail      string
+}
+
+// dashboardAudit returns the latest audit events of registry for the
+// dashboard.
+func dashboardAudit(registry string) []DashboardAuditEvent {
+	if repositories.AuditEventRepo == nil {
+		return nil
+	}
+	events, err := repositories.AuditEventRepo.Recent(registry, dashboardAuditLimit)
+	if err != nil {
+		log.Printf("Failed to load audit events for dashboard: %v", err)
+		return nil
+	}
+	var rows []DashboardAuditEvent
+	for _, e := range events {
+		rows = append(rows, DashboardAuditEvent{
+			Time:        e.CreatedAt.Format("Jan 02, 2006 15:04:05"),
+			Registry:    e.Registry,
+			Action:      e.Action,
+			FileName:    e.FileName,
+			PackageName: e.PackageName,
+			Actor:       e.Actor,
+			Detail:      e.Detail,
+		})
+	}
+	return rows
+}
+
+func (reg apiRegistry) audit(w http.ResponseWriter, r *http.Request) {
+	limit := apiDefaultActivityLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > apiMaxActivityLimit {
+			writeAPIError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(apiMaxActivityLimit))
+			return
+		}
+		limit = n
+	}
+	events := []APIAuditEvent{}
+	if repositories.AuditEventRepo != nil {
+		recent, err := repositories.AuditEventRepo.Recent(reg.registry, limit)
+		if err != nil {
+			log.Printf("Failed to load audit events for API: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "Failed to load audit events")
+			return
+		}
+		for _, e := range recent {
+			events = append(events, APIAuditEvent{
+				Time:        e.CreatedAt,
+				Registry:    e.Registry,
+				Action:      e.Action,
+				FileName:    e.FileName,
+				PackageName: e.PackageName,
+				Version:     e.Version,
+				Actor:       e.Actor,
+				Detail:      e.Detail,
+			})
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, events)
+}
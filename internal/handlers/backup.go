@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+)
+
+const (
+	// backupFormat and backupVersion identify backup files.
+	backupFormat  = "pkgbin-backup"
+	backupVersion = 1
+	// backupBatchSize is how many rows are loaded or inserted at once.
+	backupBatchSize = 1000
+	// maxBackupLine bounds one line of a backup being restored.
+	maxBackupLine = 1 << 20
+)
+
+// backupHeader is the first line of a backup.
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	Registry  string    `json:"registry"`
+	CreatedAt time.Time `json:"created_at"`
+	// Files is set when the backup has a manifest of the cached files.
+	Files bool `json:"files"`
+}
+
+// backupLine is one of the lines after the header: a row of a table, or a
+// cached file of the manifest.
+type backupLine struct {
+	Table string          `json:"table,omitempty"`
+	Row   json.RawMessage `json:"row,omitempty"`
+	File  *backupFile     `json:"file,omitempty"`
+}
+
+// backupFile is a cached file listed in the manifest of a backup.
+type backupFile struct {
+	Dir    string `json:"dir"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// APIBackupRestore reports the outcome of restoring a backup.
+type APIBackupRestore struct {
+	CreatedAt time.Time      `json:"created_at"`
+	Rows      map[string]int `json:"rows"`
+	// Skipped lists the append-only tables left alone, as they already had
+	// rows of the registry.
+	Skipped []string `json:"skipped,omitempty"`
+	// Files compares the cached files with the manifest of the backup.
+	Files *APIBackupFiles `json:"files,omitempty"`
+}
+
+// APIBackupFiles compares the cached files with those of a manifest.
+type APIBackupFiles struct {
+	Checked    int `json:"checked"`
+	Missing    int `json:"missing"`
+	Mismatched int `json:"mismatched"`
+}
+
+// backupTable is a table whose rows of a registry are backed up.
+type backupTable struct {
+	name string
+	// model is a model of the table
+	model any
+	// appendOnly tables only get the rows of a backup while they have none
+	// of the registry, as their rows cannot be deleted
+	appendOnly bool
+	// each calls fn with every row of registry
+	each func(registry string, fn func(row any) error) error
+	// rows collects the rows of the table restored through x
+	rows func(x *repositories.BackupRestore) backupRows
+}
+
+// backupRows collects the rows of a table being restored, inserting them in
+// batches.
+type backupRows interface {
+	add(row json.RawMessage) error
+	flush() error
+}
+
+// typedBackupRows collects the restored rows of the models T.
+type typedBackupRows[T any] struct {
+	x       *repositories.BackupRestore
+	clearID func(*T)
+	batch   []T
+}
+
+func (t *typedBackupRows[T]) add(data json.RawMessage) error {
+	var row T
+	if err := json.Unmarshal(data, &row); err != nil {
+		return err
+	}
+	// Rows get new IDs, as the sequences go on from the current ones
+	t.clearID(&row)
+	t.batch = append(t.batch, row)
+	if len(t.batch) >= backupBatchSize {
+		return t.flush()
+	}
+	return nil
+}
+
+func (t *typedBackupRows[T]) flush() error {
+	if len(t.batch) == 0 {
+		return nil
+	}
+	err := t.x.Insert(&t.batch)
+	t.batch = t.batch[:0]
+	return err
+}
+
+// backupTableOf describes the table of the models T, whose ID clearID
+// resets.
+func backupTableOf[T any](name string, appendOnly bool, clearID func(*T)) backupTable {
+	return backupTable{
+		name:       name,
+		model:      new(T),
+		appendOnly: appendOnly,
+		each: func(registry string, fn func(row any) error) error {
+			var batch []T
+			return repositories.BackupRepo.EachRow(&batch, registry, backupBatchSize, func() error {
+				for i := range batch {
+					if err := fn(&batch[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		rows: func(x *repositories.BackupRestore) backupRows {
+			return &typedBackupRows[T]{x: x, clearID: clearID}
+		},
+	}
+}
+
+// backupTables lists the tables backed up, with the hit and miss counters,
+// digests and download history of the cached files and the registered
+// projects. Vulnerabilities are found again by the next scans.
+var backupTables = []backupTable{
+	backupTableOf("packages", false, func(r *models.Package) { r.ID = 0 }),
+	backupTableOf("client_downloads", false, func(r *models.ClientDownload) { r.ID = 0 }),
+	backupTableOf("download_events", false, func(r *models.DownloadEvent) { r.ID = 0 }),
+	backupTableOf("cache_snapshots", false, func(r *models.CacheSnapshot) { r.ID = 0 }),
+	backupTableOf("purge_events", false, func(r *models.PurgeEvent) { r.ID = 0 }),
+	backupTableOf("audit_events", true, func(r *models.AuditEvent) { r.ID = 0 }),
+	backupTableOf("projects", false, func(r *models.Project) { r.ID = 0 }),
+}
+
+// writeBackup writes a gzip-compressed backup of the rows of registry to
+// w, one JSON document per line, with a manifest of its cached files and
+// their SHA-256 digests when files is set.
+func writeBackup(w io.Writer, registry string, files bool) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	header := backupHeader{Format: backupFormat, Version: backupVersion, Registry: registry, CreatedAt: time.Now(), Files: files}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, table := range backupTables {
+		err := table.each(registry, func(row any) error {
+			data, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(backupLine{Table: table.name, Row: data})
+		})
+		if err != nil {
+			return fmt.Errorf("backing up %s: %w", table.name, err)
+		}
+	}
+	if files {
+		for _, dir := range reconcileDirs(registry) {
+			var walkErr error
+			janitor.WalkArtifacts(dir, func(path string, info os.FileInfo) {
+				if walkErr != nil {
+					return
+				}
+				var pkg models.Package
+				if err := hashCachedFile(path, &pkg); err != nil {
+					log.Printf("Failed to hash %s for the backup: %v", path, err)
+					return
+				}
+				walkErr = enc.Encode(backupLine{File: &backupFile{Dir: dir, Name: filepath.Base(path), Size: info.Size(), SHA256: pkg.SHA256}})
+			})
+			if walkErr != nil {
+				return walkErr
+			}
+		}
+	}
+	return gz.Close()
+}
+
+// restoreBackup replaces the rows of registry with those of the backup read
+// from r, in one transaction, and compares the cached files with its
+// manifest. Append-only tables are only restored while empty.
+func restoreBackup(r io.Reader, registry string) (APIBackupRestore, error) {
+	var result APIBackupRestore
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return result, fmt.Errorf("not a gzip-compressed backup: %w", err)
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBackupLine)
+	var header backupHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Format != backupFormat {
+		return result, errors.New("not a pkgbin backup")
+	}
+	if header.Version != backupVersion {
+		return result, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+	if header.Registry != registry {
+		return result, fmt.Errorf("backup of %s, not %s", header.Registry, registry)
+	}
+	result.CreatedAt = header.CreatedAt
+	result.Rows = make(map[string]int)
+
+	x, err := repositories.BackupRepo.BeginRestore(registry)
+	if err != nil {
+		return result, err
+	}
+	defer x.Rollback()
+	rows := make(map[string]backupRows, len(backupTables))
+	for _, table := range backupTables {
+		if table.appendOnly {
+			n, err := x.Count(table.model)
+			if err != nil {
+				return result, fmt.Errorf("counting %s: %w", table.name, err)
+			}
+			if n > 0 {
+				result.Skipped = append(result.Skipped, table.name)
+				continue
+			}
+		} else if err := x.Clear(table.model); err != nil {
+			return result, fmt.Errorf("clearing %s: %w", table.name, err)
+		}
+		rows[table.name] = table.rows(x)
+		result.Rows[table.name] = 0
+	}
+
+	if header.Files {
+		result.Files = &APIBackupFiles{}
+	}
+	for scanner.Scan() {
+		var line backupLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return result, fmt.Errorf("invalid backup line: %w", err)
+		}
+		if line.File != nil {
+			if result.Files != nil {
+				checkBackupFile(line.File, result.Files)
+			}
+			continue
+		}
+		table, ok := rows[line.Table]
+		if !ok {
+			continue
+		}
+		if err := table.add(line.Row); err != nil {
+			return result, fmt.Errorf("restoring %s: %w", line.Table, err)
+		}
+		result.Rows[line.Table]++
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("reading backup: %w", err)
+	}
+	for name, table := range rows {
+		if err := table.flush(); err != nil {
+			return result, fmt.Errorf("restoring %s: %w", name, err)
+		}
+	}
+	return result, x.Commit()
+}
+
+// checkBackupFile compares a cached file with its entry in a manifest.
+func checkBackupFile(f *backupFile, report *APIBackupFiles) {
+	report.Checked++
+	path := filepath.Join(f.Dir, filepath.Base(f.Name))
+	info, err := os.Stat(path)
+	if err != nil {
+		report.Missing++
+		return
+	}
+	var pkg models.Package
+	if info.Size() != f.Size || hashCachedFile(path, &pkg) != nil || pkg.SHA256 != f.SHA256 {
+		log.Printf("Cached file %s differs from the backup manifest", path)
+		report.Mismatched++
+	}
+}
+
+// backup streams a backup of the rows of the registry, with a manifest of
+// its cached files with files=true.
+func (reg apiRegistry) backup(w http.ResponseWriter, r *http.Request) {
+	files, _ := strconv.ParseBool(r.URL.Query().Get("files"))
+	fileName := "pkgbin-" + reg.registry + "-" + time.Now().UTC().Format("20060102T150405Z") + ".jsonl.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	// The response is under way, so the backup can only end early
+	if err := writeBackup(w, reg.registry, files); err != nil {
+		log.Printf("Backup of %s failed: %v", reg.registry, err)
+	}
+}
+
+// restoreBackup replaces the rows of the registry with those of the backup
+// sent as the request body, unless a refresh is rebuilding them.
+func (reg apiRegistry) restoreBackup(w http.ResponseWriter, r *http.Request) {
+	refreshMutex.Lock()
+	if refreshInProgress {
+		refreshMutex.Unlock()
+		writeAPIError(w, http.StatusConflict, "A refresh operation is in progress. Please wait.")
+		return
+	}
+	refreshInProgress = true
+	refreshMutex.Unlock()
+	defer func() {
+		refreshMutex.Lock()
+		refreshInProgress = false
+		refreshMutex.Unlock()
+	}()
+	unlock, ok := cluster.TryLock(refreshLockKey(reg.registry))
+	if !ok {
+		writeAPIError(w, http.StatusConflict, "A refresh operation is in progress on another node. Please wait.")
+		return
+	}
+	defer unlock()
+
+	result, err := restoreBackup(r.Body, reg.registry)
+	if err != nil {
+		log.Printf("Restoring a %s backup failed: %v", reg.registry, err)
+		writeAPIError(w, http.StatusUnprocessableEntity, "Restore failed: "+err.Error())
+		return
+	}
+	loadYanked(reg.registry)
+	log.Printf("Restored the %s backup of %s: %d packages", reg.registry, result.CreatedAt.Format(time.RFC3339), result.Rows["packages"])
+	noteAudit(r, "backup of %s, %d packages", result.CreatedAt.Format(time.RFC3339), result.Rows["packages"])
+	writeAPIJSON(w, http.StatusOK, result)
+}
+
+// StartBackups periodically writes a backup of the rows of registry to the
+// backup directory, within the maintenance windows, keeping the latest
+// ones. The leader of a cluster backs up for every node, and read-only
+// replicas leave it to their writer. A zero interval disables it.
+func StartBackups(registry string) {
+	cfg := config.Server.Backup
+	if cfg.Interval.Duration <= 0 || readOnlyReplica() || repositories.BackupRepo == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			maintenance.Wait(config.MaintenanceBackup)
+			if cluster.IsLeader(registry) {
+				runBackup(registry, cfg)
+			}
+		}
+	}()
+}
+
+// runBackup writes one backup of registry to the backup directory and
+// removes the oldest beyond cfg.Keep.
+func runBackup(registry string, cfg config.Backup) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		log.Printf("Failed to create backup directory %s: %v", cfg.Dir, err)
+		return
+	}
+	start := time.Now()
+	path := filepath.Join(cfg.Dir, "pkgbin-"+registry+"-"+start.UTC().Format("20060102T150405Z")+".jsonl.gz")
+	temp := path + janitor.TempSuffix
+	f, err := os.Create(temp)
+	if err != nil {
+		log.Printf("Failed to create backup %s: %v", path, err)
+		return
+	}
+	err = writeBackup(f, registry, cfg.Files)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		log.Printf("Backup of %s failed: %v", registry, err)
+		return
+	}
+	log.Printf("Backed up %s to %s in %s", registry, path, time.Since(start).Round(time.Second))
+
+	if cfg.Keep <= 0 {
+		return
+	}
+	// Timestamps in the names sort them oldest first
+	backups, _ := filepath.Glob(filepath.Join(cfg.Dir, "pkgbin-"+registry+"-*.jsonl.gz"))
+	sort.Strings(backups)
+	for len(backups) > cfg.Keep {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("Failed to remove old backup %s: %v", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
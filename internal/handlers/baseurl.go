@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// baseURLKey carries the client-facing base URL of a request that is being
+// forwarded upstream.
+type baseURLKey struct{}
+
+// forwardedParam returns a parameter of the first element of an RFC 7239
+// Forwarded header, e.g. proto or host.
+func forwardedParam(r *http.Request, name string) string {
+	first, _, _ := strings.Cut(r.Header.Get("Forwarded"), ",")
+	for _, pair := range strings.Split(first, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header set
+// by a chain of reverse proxies, which is the one closest to the client.
+func firstHeaderValue(r *http.Request, name string) string {
+	first, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(first)
+}
+
+// RequestScheme returns the scheme the client used to reach pkgbin, as
+// reported by a reverse proxy in front of it or else by the connection.
+func RequestScheme(r *http.Request) string {
+	for _, proto := range []string{forwardedParam(r, "proto"), firstHeaderValue(r, "X-Forwarded-Proto")} {
+		if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RequestHost returns the host (and port) the client used to reach pkgbin.
+func RequestHost(r *http.Request) string {
+	if host := forwardedParam(r, "host"); host != "" {
+		return host
+	}
+	if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+		return host
+	}
+	if r.Host != "" {
+		return r.Host
+	}
+	return r.URL.Host
+}
+
+// ExternalBaseURL is the base URL clients reach the repository of r at,
+// used when rewriting metadata so artifact URLs point back at pkgbin. The
+// URL a downstream pkgbin reaches this one at comes first, then a
+// configured external_url, then the request's address. Requests made to a
+// transparent host keep the registry's own address.
+func ExternalBaseURL(r *http.Request) string {
+	if base, ok := r.Context().Value(baseURLKey{}).(string); ok {
+		return base
+	}
+	if base := downstreamBaseURL(r); base != "" {
+		return base
+	}
+	if transparentRequest(r) {
+		return RequestScheme(r) + "://" + RequestHost(r)
+	}
+	if base := repositoryExternalURL(r); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	return RequestScheme(r) + "://" + RequestHost(r) + RepositoryPathPrefix(r)
+}
+
+// downstreamBaseURL returns the URL a downstream pkgbin using this one as
+// its upstream reaches the repository at, as it tells in
+// upstream.BaseURLHeader, or "" for other clients.
+func downstreamBaseURL(r *http.Request) string {
+	base := r.Header.Get(upstream.BaseURLHeader)
+	if base == "" {
+		return ""
+	}
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/")
+}
+
+// externalBasePath is the path part of ExternalBaseURL, for links and
+// redirects within pkgbin.
+func externalBasePath(r *http.Request) string {
+	u, err := url.Parse(ExternalBaseURL(r))
+	if err != nil {
+		return RepositoryPathPrefix(r)
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// RememberBaseURL records the client-facing base URL on a request about to
+// be forwarded upstream, so its response can still be rewritten once the
+// Host has been changed to the upstream's.
+func RememberBaseURL(req *http.Request) {
+	*req = *req.WithContext(context.WithValue(req.Context(), baseURLKey{}, ExternalBaseURL(req)))
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+// historyRanges are the periods the history charts can cover, in the order
+// the dashboard offers them.
+var historyRanges = []struct {
+	Key    string
+	Period time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// defaultHistoryRange is the range shown when none is asked for.
+const defaultHistoryRange = "7d"
+
+const (
+	// historyPoints bounds the points of a chart line; older snapshots are
+	// thinned out to fit.
+	historyPoints = 120
+	// Size of the box chart lines are drawn in
+	historyChartWidth  = 600
+	historyChartHeight = 120
+)
+
+// DashboardHistory holds the history charts of one range.
+type DashboardHistory struct {
+	Range  string
+	Ranges []string
+	Charts []DashboardChart
+}
+
+// DashboardChart is a line chart of cache metrics over time.
+type DashboardChart struct {
+	Title string
+	// Latest value, or the total over the range for downloads
+	Latest string
+	Lines  []DashboardChartLine
+}
+
+// DashboardChartLine is one series of a chart, as SVG polyline points.
+type DashboardChartLine struct {
+	Label  string
+	Color  string
+	Points string
+}
+
+// APISnapshot is a recorded state of the cache.
+type APISnapshot struct {
+	Time      time.Time `json:"time"`
+	Files     int64     `json:"files"`
+	SizeBytes int64     `json:"size_bytes"`
+	CacheHit  int64     `json:"cache_hit"`
+	CacheMiss int64     `json:"cache_miss"`
+}
+
+// historyPeriod returns the period of the range called key, and false for
+// unknown ranges.
+func historyPeriod(key string) (time.Duration, bool) {
+	for _, r := range historyRanges {
+		if r.Key == key {
+			return r.Period, true
+		}
+	}
+	return 0, false
+}
+
+// cacheSnapshots returns the snapshots of registry taken during period.
+func cacheSnapshots(registry string, period time.Duration) ([]models.CacheSnapshot, error) {
+	if repositories.CacheSnapshotRepo == nil {
+		return nil, nil
+	}
+	return repositories.CacheSnapshotRepo.ListSince(registry, time.Now().Add(-period))
+}
+
+// cacheHistory builds the dashboard charts of registry over the range
+// called key, falling back to the default range.
+func cacheHistory(registry, key string) DashboardHistory {
+	period, ok := historyPeriod(key)
+	if !ok {
+		key = defaultHistoryRange
+		period, _ = historyPeriod(key)
+	}
+	history := DashboardHistory{Range: key}
+	for _, r := range historyRanges {
+		history.Ranges = append(history.Ranges, r.Key)
+	}
+
+	snapshots, err := cacheSnapshots(registry, period)
+	if err != nil {
+		log.Printf("Failed to load cache history for dashboard: %v", err)
+		return history
+	}
+	if len(snapshots) == 0 {
+		return history
+	}
+	// Keep every nth snapshot and the latest one
+	if step := (len(snapshots) + historyPoints - 1) / historyPoints; step > 1 {
+		var thinned []models.CacheSnapshot
+		for i := 0; i < len(snapshots)-1; i += step {
+			thinned = append(thinned, snapshots[i])
+		}
+		snapshots = append(thinned, snapshots[len(snapshots)-1])
+	}
+
+	until := time.Now()
+	since := until.Add(-period)
+	times := make([]time.Time, len(snapshots))
+	sizes := make([]float64, len(snapshots))
+	files := make([]float64, len(snapshots))
+	hits := make([]float64, len(snapshots))
+	misses := make([]float64, len(snapshots))
+	var totalHits, totalMisses int64
+	for i, s := range snapshots {
+		times[i] = s.CreatedAt
+		sizes[i] = float64(s.SizeBytes)
+		files[i] = float64(s.FileCount)
+		// Downloads between two snapshots; purges and refreshes lower the
+		// counters, which is not a negative number of downloads
+		if i > 0 {
+			hit := max(s.CacheHit-snapshots[i-1].CacheHit, 0)
+			miss := max(s.CacheMiss-snapshots[i-1].CacheMiss, 0)
+			hits[i], misses[i] = float64(hit), float64(miss)
+			totalHits += hit
+			totalMisses += miss
+		}
+	}
+	latest := snapshots[len(snapshots)-1]
+
+	history.Charts = []DashboardChart{
+		{
+			Title:  "Cache Size",
+			Latest: stats.FormatBytes(latest.SizeBytes),
+			Lines:  chartLines(times, since, until, chartSeries{"Size", "#0d6efd", sizes}),
+		},
+		{
+			Title:  "Files",
+			Latest: strconv.FormatInt(latest.FileCount, 10),
+			Lines:  chartLines(times, since, until, chartSeries{"Files", "#6f42c1", files}),
+		},
+		{
+			Title:  "Downloads",
+			Latest: strconv.FormatInt(totalHits, 10) + " hits, " + strconv.FormatInt(totalMisses, 10) + " misses",
+			Lines: chartLines(times, since, until,
+				chartSeries{"Hits", "#198754", hits},
+				chartSeries{"Misses", "#dc3545", misses}),
+		},
+	}
+	return history
+}
+
+// chartSeries is one line of values to draw, one per snapshot time.
+type chartSeries struct {
+	label  string
+	color  string
+	values []float64
+}
+
+// chartLines scales series into the chart box, sharing the vertical scale
+// so the lines of one chart compare.
+func chartLines(times []time.Time, since, until time.Time, series ...chartSeries) []DashboardChartLine {
+	var top float64
+	for _, s := range series {
+		for _, v := range s.values {
+			top = max(top, v)
+		}
+	}
+	span := until.Sub(since).Seconds()
+
+	var lines []DashboardChartLine
+	for _, s := range series {
+		points := make([]string, len(s.values))
+		for i, v := range s.values {
+			x := times[i].Sub(since).Seconds() / span * historyChartWidth
+			y := float64(historyChartHeight)
+			if top > 0 {
+				y -= v / top * historyChartHeight
+			}
+			points[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+		}
+		lines = append(lines, DashboardChartLine{Label: s.label, Color: s.color, Points: strings.Join(points, " ")})
+	}
+	return lines
+}
+
+func (reg apiRegistry) history(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("range")
+	if key == "" {
+		key = defaultHistoryRange
+	}
+	period, ok := historyPeriod(key)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "range must be 24h, 7d or 30d")
+		return
+	}
+	snapshots, err := cacheSnapshots(reg.registry, period)
+	if err != nil {
+		log.Printf("Failed to load cache history for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load cache history")
+		return
+	}
+	list := []APISnapshot{}
+	for _, s := range snapshots {
+		list = append(list, APISnapshot{
+			Time:      s.CreatedAt,
+			Files:     s.FileCount,
+			SizeBytes: s.SizeBytes,
+			CacheHit:  s.CacheHit,
+			CacheMiss: s.CacheMiss,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+)
+
+// cacheKeyTaken reports whether another path claimed fileName as its cache
+// key, logging it: the cached file is then another package's, and the
+// download r asks for must be streamed through without touching the cache.
+func cacheKeyTaken(r *http.Request, registry, fileName string) bool {
+	if err := cachekey.Collides(registry, fileName, r.URL.Path); err != nil {
+		log.Printf("Not caching %s: %v", r.URL.Path, err)
+		return true
+	}
+	return false
+}
+
+// claimCacheKey claims fileName as the cache key of the download r asks
+// for, once its file is cached. Downloads that fail or are not cached
+// claim nothing, so they never keep the path owning the key from the cache.
+func claimCacheKey(r *http.Request, registry, fileName string) {
+	if err := cachekey.Claim(registry, fileName, r.URL.Path); err != nil {
+		log.Printf("Failed to claim the cache key of %s: %v", r.URL.Path, err)
+	}
+}
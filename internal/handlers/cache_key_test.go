@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+)
+
+func TestFailedDownloadClaimsNoCacheKey(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	saved := config.NPMConfig
+	t.Cleanup(func() { config.NPMConfig = saved })
+	config.NPMConfig.Upstream = notFound.URL
+	config.NPMConfig.CacheDir = t.TempDir()
+	config.NPMConfig.LocalDir = ""
+
+	// A path of another package mapping onto the key of lodash's tarball
+	w := httptest.NewRecorder()
+	HandleTarballDownload(w, httptest.NewRequest(http.MethodGet, "/evil/-/lodash-4.17.21.tgz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("download answered %d, want 404", w.Code)
+	}
+	if err := cachekey.Collides(models.RegistryNPM, "lodash-4.17.21.tgz", "/lodash/-/lodash-4.17.21.tgz"); err != nil {
+		t.Errorf("a download that failed kept the cache key: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// errChecksumMismatch is returned when a downloaded artifact does not match
+// the digest declared by its upstream registry.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// metadataClient is used for the small metadata lookups needed to find the
+// digest an upstream registry declares for an artifact.
+var metadataClient = &http.Client{Timeout: 30 * time.Second, Transport: upstream.Transport}
+
+// expectedDigest is a hash published by an upstream registry for an artifact.
+type expectedDigest struct {
+	Algorithm string // "sha1", "sha256" or "sha512"
+	Value     []byte
+}
+
+// artifactHasher hashes a download with every algorithm the supported
+// registries publish, so one pass over the body is enough to verify it.
+type artifactHasher struct {
+	hashes map[string]hash.Hash
+}
+
+func newArtifactHasher() *artifactHasher {
+	return &artifactHasher{hashes: map[string]hash.Hash{
+		"sha1":   sha1.New(),
+		"sha256": sha256.New(),
+		"sha512": sha512.New(),
+	}}
+}
+
+func (h *artifactHasher) Write(p []byte) (int, error) {
+	for _, hh := range h.hashes {
+		hh.Write(p)
+	}
+	return len(p), nil
+}
+
+// Sum returns the digest for the given algorithm, or nil if it is not tracked.
+func (h *artifactHasher) Sum(algorithm string) []byte {
+	hh, ok := h.hashes[algorithm]
+	if !ok {
+		return nil
+	}
+	return hh.Sum(nil)
+}
+
+// verify compares the hashed bytes against expected. A nil expected digest
+// means the upstream declared none and the artifact is accepted as-is.
+func (h *artifactHasher) verify(expected *expectedDigest) error {
+	if expected == nil {
+		return nil
+	}
+	actual := h.Sum(expected.Algorithm)
+	if actual == nil {
+		return fmt.Errorf("unsupported digest algorithm %q", expected.Algorithm)
+	}
+	if !bytes.Equal(actual, expected.Value) {
+		return fmt.Errorf("%w: %s expected %s, got %s", errChecksumMismatch, expected.Algorithm,
+			hex.EncodeToString(expected.Value), hex.EncodeToString(actual))
+	}
+	return nil
+}
+
+// fetchMetadata performs a GET against an upstream metadata endpoint on
+// behalf of the request of ctx.
+func fetchMetadata(ctx context.Context, url, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream returned status %d for %s", resp.StatusCode, url)
+	}
+	return resp, nil
+}
+
+// npmPackument is the subset of an (abbreviated) npm packument needed to
+// find the integrity of a tarball and its registry signatures.
+type npmPackument struct {
+	Versions map[string]struct {
+		Dist npmDist `json:"dist"`
+	} `json:"versions"`
+}
+
+// npmDist is the dist object of a version in a packument.
+type npmDist struct {
+	Tarball    string         `json:"tarball"`
+	Shasum     string         `json:"shasum"`
+	Integrity  string         `json:"integrity"`
+	Signatures []npmSignature `json:"signatures"`
+}
+
+// npmExpectedDigest looks up the integrity (or legacy shasum) declared in the
+// packument for the tarball at urlPath, e.g. /@types/node/-/node-20.0.0.tgz.
+// Tarballs of other hosts are looked up by their full URL. With
+// verifySignature, the registry signature of the version must verify too.
+func npmExpectedDigest(ctx context.Context, registry, urlPath string, verifySignature bool) (*expectedDigest, error) {
+	pkgName, _, found := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/-/")
+	if !found || pkgName == "" {
+		return nil, fmt.Errorf("cannot determine package name from %s", urlPath)
+	}
+
+	resp, err := fetchMetadata(ctx, registry+"/"+pkgName, "application/vnd.npm.install-v1+json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var doc npmPackument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding packument for %s: %w", pkgName, err)
+	}
+
+	tarballName := path.Base(urlPath)
+	listed := func(tarball string) bool { return path.Base(tarball) == tarballName }
+	if remoteURL, ok := npmRemoteTarballURL(urlPath); ok {
+		tarballName = remoteURL
+		listed = func(tarball string) bool { return tarball == remoteURL }
+	}
+	for version, v := range doc.Versions {
+		if !listed(v.Dist.Tarball) {
+			continue
+		}
+		if verifySignature {
+			if err := verifyNPMSignature(ctx, registry, pkgName, version, v.Dist); err != nil {
+				return nil, err
+			}
+		}
+		if d := parseSRI(v.Dist.Integrity); d != nil {
+			return d, nil
+		}
+		if v.Dist.Shasum != "" {
+			value, err := hex.DecodeString(v.Dist.Shasum)
+			if err != nil {
+				return nil, fmt.Errorf("invalid shasum for %s: %w", tarballName, err)
+			}
+			return &expectedDigest{Algorithm: "sha1", Value: value}, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("tarball %s not listed in packument for %s", tarballName, pkgName)
+}
+
+// parseSRI extracts the strongest supported digest from a Subresource
+// Integrity string such as "sha512-<base64>".
+func parseSRI(integrity string) *expectedDigest {
+	var best *expectedDigest
+	for _, entry := range strings.Fields(integrity) {
+		algorithm, encoded, found := strings.Cut(entry, "-")
+		if !found {
+			continue
+		}
+		// Drop any SRI options ("?foo") after the digest
+		encoded, _, _ = strings.Cut(encoded, "?")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		switch algorithm {
+		case "sha512":
+			return &expectedDigest{Algorithm: algorithm, Value: value}
+		case "sha256", "sha1":
+			if best == nil || algorithm == "sha256" {
+				best = &expectedDigest{Algorithm: algorithm, Value: value}
+			}
+		}
+	}
+	return best
+}
+
+// pypiNameSeparators matches the runs of characters PEP 503 collapses.
+var pypiNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalizePyPIName applies PEP 503 project name normalization.
+func normalizePyPIName(name string) string {
+	return strings.ToLower(pypiNameSeparators.ReplaceAllString(name, "-"))
+}
+
+// pypiProjectFromFilename extracts the project name from a distribution
+// filename. Wheels and eggs separate the name with the first dash while
+// sdists use the last one, because sdist names may themselves contain dashes.
+func pypiProjectFromFilename(fileName string) string {
+	lower := strings.ToLower(fileName)
+	if strings.HasSuffix(lower, ".whl") || strings.HasSuffix(lower, ".egg") {
+		name, _, _ := strings.Cut(fileName, "-")
+		return name
+	}
+	if i := strings.LastIndex(fileName, "-"); i > 0 {
+		return fileName[:i]
+	}
+	return ""
+}
+
+// pypiSimpleProject is the subset of a PEP 691 JSON project page needed to
+// find the hashes of a distribution file.
+type pypiSimpleProject struct {
+	Files []struct {
+		Filename string            `json:"filename"`
+		Hashes   map[string]string `json:"hashes"`
+	} `json:"files"`
+}
+
+// pypiExpectedDigest looks up the sha256 PyPI declares for the distribution
+// file at urlPath using the JSON Simple API.
+func pypiExpectedDigest(ctx context.Context, registry, urlPath string) (*expectedDigest, error) {
+	fileName := path.Base(urlPath)
+	project := pypiProjectFromFilename(fileName)
+	if project == "" {
+		return nil, fmt.Errorf("cannot determine project name from %s", fileName)
+	}
+
+	resp, err := fetchMetadata(ctx, registry+"/simple/"+normalizePyPIName(project)+"/", "application/vnd.pypi.simple.v1+json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var doc pypiSimpleProject
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding simple index for %s: %w", project, err)
+	}
+
+	for _, f := range doc.Files {
+		if f.Filename != fileName {
+			continue
+		}
+		if sum, ok := f.Hashes["sha256"]; ok {
+			value, err := hex.DecodeString(sum)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sha256 for %s: %w", fileName, err)
+			}
+			return &expectedDigest{Algorithm: "sha256", Value: value}, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("file %s not listed in simple index for %s", fileName, project)
+}
+
+// gemNameVersionPattern splits a gem filename into its name and its
+// version-platform part; the version is the first dash-separated segment
+// starting with a digit, e.g. nokogiri-1.15.0-x86_64-linux.
+var gemNameVersionPattern = regexp.MustCompile(`^(.+?)-([0-9][^-]*(?:-.+)?)$`)
+
+// gemExpectedDigest looks up the sha256 RubyGems declares for the gem at
+// urlPath using the compact index info file for that gem.
+func gemExpectedDigest(ctx context.Context, registry, urlPath string) (*expectedDigest, error) {
+	fileName := path.Base(urlPath)
+	m := gemNameVersionPattern.FindStringSubmatch(strings.TrimSuffix(fileName, ".gem"))
+	if m == nil {
+		return nil, fmt.Errorf("cannot determine gem name from %s", fileName)
+	}
+	gemName, version := m[1], m[2]
+
+	resp, err := fetchMetadata(ctx, registry+"/info/"+gemName, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Each line is "<version>[-<platform>] <deps>|<requirements>", where the
+	// requirements include "checksum:<sha256>"
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineVersion, rest, found := strings.Cut(line, " ")
+		if !found || lineVersion != version {
+			continue
+		}
+		_, requirements, _ := strings.Cut(rest, "|")
+		for _, req := range strings.Split(requirements, ",") {
+			if sum, ok := strings.CutPrefix(req, "checksum:"); ok {
+				value, err := hex.DecodeString(sum)
+				if err != nil {
+					return nil, fmt.Errorf("invalid checksum for %s: %w", fileName, err)
+				}
+				return &expectedDigest{Algorithm: "sha256", Value: value}, nil
+			}
+		}
+		return nil, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("version %s not listed in compact index for %s", version, gemName)
+}
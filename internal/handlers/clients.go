@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cachestatus"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+// maxClientFieldLength matches the client and user_agent column sizes.
+const maxClientFieldLength = 255
+
+// clientIdentity attributes a request to a client: the admin token name or
+// a fingerprint of the bearer token when one is sent, the basic auth user,
+// or else the client IP, as forwarded by trusted proxies. Raw tokens are
+// never recorded.
+func clientIdentity(r *http.Request) string {
+	if t, ok := adminTokenFor(r); ok {
+		return "token:" + t.name
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:6])
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return truncate("user:"+user, maxClientFieldLength)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For is believed.
+var trustedProxies []*net.IPNet
+
+// InitTrustedProxies reads the trusted reverse proxies from the server
+// config.
+func InitTrustedProxies() error {
+	networks, err := parseNetworks("trusted proxy", config.Current().Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// clientIP returns the address the request came from. Behind trusted
+// proxies, it is the last address of X-Forwarded-For that is not one of
+// them: the entries are walked from the right, as those further left were
+// written by the client or proxies not trusted to tell the truth.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !inNetworks(trustedProxies, net.ParseIP(host)) {
+		return host
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// What a trusted proxy appended is an address, so the
+			// entries from here on cannot be told apart from forgeries
+			break
+		}
+		host = ip.String()
+		if !inNetworks(trustedProxies, ip) {
+			break
+		}
+	}
+	return host
+}
+
+// setArtifactHeaders sets the headers of a cached file recorded in the
+// packages table: the Content-Type upstream served it with, instead of the
+// guess http.ServeFile makes from the extension, and a strong ETag of its
+// SHA-256, which http.ServeFile compares with If-None-Match. Files of
+// unknown type are sent as application/octet-stream.
+func setArtifactHeaders(h http.Header, registry, fileName string) {
+	var sum, contentType string
+	if repositories.PackageRepo != nil {
+		var err error
+		if sum, contentType, err = repositories.PackageRepo.GetServeHeaders(registry, fileName); err != nil {
+			log.Printf("Failed to look up the headers of %s: %v", fileName, err)
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	if sum != "" {
+		h.Set("ETag", `"sha256-`+sum+`"`)
+	}
+}
+
+// cacheStatusHeader tells whether an artifact was served from the cache.
+// Behind a chain of pkgbin proxies, each adds its own status after those of
+// its upstreams, so an edge miss served from a regional hit is "HIT, MISS".
+const cacheStatusHeader = "X-Cache"
+
+// setCacheStatus adds the cache status of this proxy to h, after the
+// statuses an upstream pkgbin reported for the artifact, if any, and
+// records it as the X-PkgBin-Cache status of r.
+func setCacheStatus(r *http.Request, h http.Header, hit bool) {
+	status := cachestatus.Miss
+	if hit {
+		status = cachestatus.Hit
+	}
+	cachestatus.Set(r.Context(), status)
+	if upstreamStatus := h.Get(cacheStatusHeader); upstreamStatus != "" {
+		status = upstreamStatus + ", " + status
+	}
+	h.Set(cacheStatusHeader, status)
+}
+
+// setUpstreamCacheStatus passes on the cache statuses an upstream pkgbin
+// reported for an artifact, for setCacheStatus to add to.
+func setUpstreamCacheStatus(h http.Header, upstreamStatus string) {
+	if upstreamStatus != "" {
+		h.Set(cacheStatusHeader, upstreamStatus)
+	}
+}
+
+// clientUserAgent returns the leading product of the User-Agent, e.g.
+// "npm/10.2.4" or "pip/24.0", which identifies the tool without the noise.
+func clientUserAgent(r *http.Request) string {
+	fields := strings.Fields(r.Header.Get("User-Agent"))
+	if len(fields) == 0 {
+		return ""
+	}
+	return truncate(fields[0], maxClientFieldLength)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// countingResponseWriter counts the body bytes sent to the client and
+// keeps the response status.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+func (c *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// serveArtifact serves a file cached from registry, adds the download to
+// the history and the live feed, and attributes it and the bytes sent to
+// the requesting client.
+func serveArtifact(w http.ResponseWriter, r *http.Request, registry, fileName, localPath string, hit bool) {
+	// Misses are listed as in progress from their upstream fetch on
+	if hit {
+		defer beginLiveDownload(r, registry, fileName, true)()
+	}
+	setArtifactHeaders(w.Header(), registry, fileName)
+	setCacheStatus(r, w.Header(), hit)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeFile(cw, r, localPath)
+	// Revalidations of a copy the client already has are not downloads
+	if cw.status == http.StatusNotModified {
+		return
+	}
+	recordServed(r, registry, fileName, hit, cw.written)
+}
+
+// recordServed adds a download of fileName from registry to the history and
+// the live feed, and attributes it and the bytes sent to the requesting
+// client. Read-only replicas only add it to the live feed.
+func recordServed(r *http.Request, registry, fileName string, hit bool, written int64) {
+	client := clientIdentity(r)
+	pkgName, version := parseCachedFileName(registry, fileName)
+	event := models.DownloadEvent{
+		Registry:    registry,
+		FileName:    fileName,
+		PackageName: pkgName,
+		Version:     version,
+		CacheHit:    hit,
+		BytesServed: written,
+		Client:      client,
+	}
+	recordLiveDownload(registry, event)
+
+	if readOnlyReplica() {
+		return
+	}
+	stats.RecordDownload(event)
+	if repositories.ClientDownloadRepo == nil {
+		return
+	}
+	if err := repositories.ClientDownloadRepo.RecordDownload(registry, fileName, client, clientUserAgent(r), hit, written); err != nil {
+		log.Printf("Failed to record client download of %s: %v", fileName, err)
+	}
+}
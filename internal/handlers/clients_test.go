@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	networks, err := parseNetworks("trusted proxy", []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = networks
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer's header ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.1.2.3:5000", nil, "10.1.2.3"},
+		{"chain of trusted proxies", "10.1.2.3:5000", []string{"198.51.100.1, 192.168.1.10, 10.9.9.9"}, "198.51.100.1"},
+		{"forged entries left of the client", "10.1.2.3:5000", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"several headers", "10.1.2.3:5000", []string{"1.1.1.1", "198.51.100.1, 10.0.0.5"}, "198.51.100.1"},
+		{"garbage stops the walk", "10.1.2.3:5000", []string{"198.51.100.1, nonsense, 10.0.0.5"}, "10.0.0.5"},
+		{"only trusted proxies", "10.1.2.3:5000", []string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1"},
+		{"ipv6", "[fd00::1]:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"single trusted address", "192.168.1.10:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"neighbour of a trusted address", "192.168.1.11:5000", []string{"198.51.100.1"}, "192.168.1.11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/lodash", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIdentityBehindTrustedProxy(t *testing.T) {
+	networks, err := parseNetworks("trusted proxy", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = networks
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"forwarded by the load balancer", "10.0.0.2:4000", "198.51.100.1", "ip:198.51.100.1"},
+		{"another client of the load balancer", "10.0.0.2:4000", "198.51.100.2", "ip:198.51.100.2"},
+		{"forged by a direct client", "203.0.113.7:4000", "198.51.100.1", "ip:203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/lodash/-/lodash-4.17.21.tgz", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+			if got := clientIdentity(r); got != tt.want {
+				t.Errorf("clientIdentity = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
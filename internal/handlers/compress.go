@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metadataGzipMinSize is the smallest metadata body worth compressing.
+const metadataGzipMinSize = 1024
+
+// acceptsGzip reports whether the Accept-Encoding of h allows gzip, either
+// by name or through "*".
+func acceptsGzip(h http.Header) bool {
+	accepted := false
+	for _, field := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(field, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip":
+				return q > 0
+			case "*":
+				accepted = q > 0
+			}
+		}
+	}
+	return accepted
+}
+
+// CompressMetadata gzips a rewritten metadata body for clients of r that
+// accept it, setting the Content-Encoding of h. Small bodies and other
+// clients get body unchanged.
+func CompressMetadata(r *http.Request, h http.Header, body []byte) []byte {
+	var buf bytes.Buffer
+	w, closeW := metadataWriter(r, h, &buf, int64(len(body)))
+	if _, isGzip := w.(*gzip.Writer); !isGzip {
+		return body
+	}
+	w.Write(body)
+	if err := closeW(); err != nil {
+		h.Del("Content-Encoding")
+		return body
+	}
+	return buf.Bytes()
+}
+
+// metadataWriter returns where to write a metadata document of size bytes
+// (-1 if unknown) for the client of r: a gzip writer on top of w when the
+// client accepts it, setting the Content-Encoding of h, or w itself. close
+// flushes what the gzip writer holds. Bodies are rewritten for every
+// request, so compression favors speed over size.
+func metadataWriter(r *http.Request, h http.Header, w io.Writer, size int64) (io.Writer, func() error) {
+	if !strings.Contains(strings.ToLower(strings.Join(h.Values("Vary"), ",")), "accept-encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if (size >= 0 && size < metadataGzipMinSize) || r == nil || !acceptsGzip(r.Header) {
+		return w, func() error { return nil }
+	}
+	gw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	h.Set("Content-Encoding", "gzip")
+	return gw, gw.Close
+}
@@ -1,20 +1,92 @@
 package handlers
 
 import (
+	"cmp"
 	"html/template"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkgb-in/pkgbin/db/models"
 	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/blocklist"
 	"github.com/pkgb-in/pkgbin/internal/stats"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+	"github.com/pkgb-in/pkgbin/internal/vulnscan"
 )
 
 type DashboardPackage struct {
 	Name      string
 	CacheHit  int64
 	CacheMiss int64
+	Size      string
+	// When the file was last served, or "-" if unknown
+	LastAccessed string
+	// Known vulnerabilities recorded for the cached version
+	Vulnerabilities int
+	MaxSeverity     string
+	SeverityClass   string
+	VulnIDs         string
+	// Why upstream no longer serves the version, if it was found yanked
+	Yanked string
+	// Package the file is a version of, linking to its detail page
+	PackageName string
+	Registry    string
+}
+
+// DashboardPackageSummary sums the downloads of all cached versions of a
+// package.
+type DashboardPackageSummary struct {
+	Name      string
+	Versions  int64
+	CacheHit  int64
+	CacheMiss int64
+	Size      string
+	Registry  string
+	SizeBytes int64
+	// Share of the cache size taken by the package, e.g. "12.5%", and its
+	// rounded percentage
+	Share        string
+	SharePercent int
+}
+
+// DashboardDay is one bar of the recent downloads chart.
+type DashboardDay struct {
+	Day       string
+	Downloads int64
+	CacheHit  int64
+	// Width of the bar relative to the busiest day, in percent
+	Percent int
+}
+
+// DashboardClient summarizes the downloads attributed to one client.
+type DashboardClient struct {
+	Client    string
+	UserAgent string
+	CacheHit  int64
+	CacheMiss int64
+	Bandwidth string
+	Packages  int64
+	LastSeen  string
+}
+
+// DashboardRegistry sums the cached files of one registry on the combined
+// dashboard.
+type DashboardRegistry struct {
+	Key       string
+	Name      string
+	Files     int64
+	Size      string
+	CacheHit  int64
+	CacheMiss int64
+	HitRatio  string
+	// Upstream traffic saved, and what it would have cost with cost_per_gb
+	BandwidthSaved string
+	CostSaved      string
 }
 
 type DashboardData struct {
@@ -26,61 +98,200 @@ type DashboardData struct {
 	CacheSize      string
 	PackagesServed int64
 	LastUpdated    string
+	// Blocklist feed size and requests refused because of it
+	BlocklistEntries int
+	BlockedRequests  int64
+	// Packages with the most downloads across their versions
+	TopPackages []DashboardPackageSummary
+	// Downloads per day over the last week, and packages not downloaded
+	// for unusedPackageAge
+	RecentDownloads []DashboardDay
+	UnusedPackages  int64
+	// Drift found by the last run of the background reconciler, and
+	// corrupted files found by the last scrub
+	LastReconcile ReconcileReport
+	LastScrub     ScrubReport
+	// Clients that were served the most bytes
+	Clients []DashboardClient
+	// Upstreams currently failing, with their circuit breaker state
+	Circuits []upstream.BreakerState
+	// Packages with the most cache misses across their versions
+	TopMissed []DashboardPackageSummary
+	// Share of downloads served from cache, e.g. "93.5%" or "-" before any
+	// download, its rounded percentage, and the upstream traffic saved
+	HitRatio        string
+	HitRatioPercent int
+	BandwidthSaved  string
+	// What the bandwidth saved would have cost, with cost_per_gb set
+	CostSaved string
+	// Downloads served from cache and bandwidth saved per month
+	Savings []DashboardMonth
+	// Charts of the cache size, files and downloads over time
+	History DashboardHistory
+	// Latest downloads and purges
+	Activity []DashboardActivity
+	// Latest admin actions, sign-ins and configuration changes
+	Audit []DashboardAuditEvent
+	// Totals of each registry, on the combined dashboard only
+	Registries []DashboardRegistry
+	// Packages taking the most disk space
+	DiskUsage []DashboardPackageSummary
+	// Latency and availability of the configured upstreams
+	Upstreams []upstream.UpstreamHealth
+}
+
+// registryNames are the display names of the registries, in the order the
+// combined dashboard lists them.
+var registryNames = []struct {
+	Key  string
+	Name string
+}{
+	{models.RegistryNPM, "NPM"},
+	{models.RegistryRubyGems, "RubyGems"},
+	{models.RegistryPyPI, "PyPI"},
+}
+
+// registryName returns the display name of registry, and false for unknown
+// registries.
+func registryName(registry string) (string, bool) {
+	for _, r := range registryNames {
+		if r.Key == registry {
+			return r.Name, true
+		}
+	}
+	return registry, false
 }
 
 func NPMDashboardHandler(w http.ResponseWriter, r *http.Request) {
-	dashboardHandler(w, r, "Package Bin for NPM")
+	dashboardHandler(w, r, "Package Bin for NPM", models.RegistryNPM, false)
 }
 
 func RubyDashboardHandler(w http.ResponseWriter, r *http.Request) {
-	dashboardHandler(w, r, "Package Bin for RubyGems")
+	dashboardHandler(w, r, "Package Bin for RubyGems", models.RegistryRubyGems, false)
 }
 
 func PyPIDashboardHandler(w http.ResponseWriter, r *http.Request) {
-	dashboardHandler(w, r, "Package Bin for PyPI")
+	dashboardHandler(w, r, "Package Bin for PyPI", models.RegistryPyPI, false)
 }
 
+// DashboardHandler renders the combined dashboard of every registry
+// sharing the database, narrowed to one by the registry query parameter.
 func DashboardHandler(w http.ResponseWriter, r *http.Request) {
-	dashboardHandler(w, r, "Package Dashboard")
+	registry := r.URL.Query().Get("registry")
+	if _, ok := registryName(registry); !ok {
+		registry = ""
+	}
+	dashboardHandler(w, r, "Package Bin", registry, true)
 }
 
-func dashboardHandler(w http.ResponseWriter, r *http.Request, title string) {
-	const pageSize = 20
+// dashboardPageSizes are the page sizes the dashboard offers; the first is
+// the default.
+var dashboardPageSizes = []int{20, 50, 100}
+
+// dashboardSorts are the sort keys of the columns the dashboard sorts by.
+var dashboardSorts = []string{"name", "cache_hit", "cache_miss", "size", "last_accessed"}
+
+// dashboardHandler renders the dashboard for the packages of registry, or
+// of every registry if it is empty. The combined dashboard reads its
+// statistics from the database and leaves out the actions, which only
+// apply to the cache of this proxy.
+func dashboardHandler(w http.ResponseWriter, r *http.Request, title, registry string, combined bool) {
+	q := r.URL.Query()
 	page := 1
-	if p := r.URL.Query().Get("page"); p != "" {
+	if p := q.Get("page"); p != "" {
 		if n, err := strconv.Atoi(p); err == nil && n > 0 {
 			page = n
 		}
 	}
-
-	filter := r.URL.Query().Get("filter")
-	var pkgs []models.Package
-	var total int
-	var err error
-	if filter != "" {
-		pkgs, total, err = repositories.PackageRepo.ListPackagesByNamePaginated(filter, page, pageSize)
-	} else {
-		pkgs, total, err = repositories.PackageRepo.ListPackagesPaginated(page, pageSize)
+	pageSize := dashboardPageSizes[0]
+	if n, err := strconv.Atoi(q.Get("per_page")); err == nil && slices.Contains(dashboardPageSizes, n) {
+		pageSize = n
 	}
+	sort := q.Get("sort")
+	if !slices.Contains(dashboardSorts, strings.TrimPrefix(sort, "-")) {
+		sort = ""
+	}
+
+	filter := q.Get("filter")
+	pkgs, total, err := repositories.PackageRepo.ListPackages(repositories.PackageQuery{
+		Registry: registry,
+		Filter:   filter,
+		Sort:     sort,
+		Page:     page,
+		PageSize: pageSize,
+	})
 	if err != nil {
 		http.Error(w, "Failed to load packages", http.StatusInternalServerError)
 		return
 	}
 
+	findings := vulnerabilitiesByFileName(pkgs)
+
 	var dashPkgs []DashboardPackage
 	for _, pkg := range pkgs {
-		dashPkgs = append(dashPkgs, DashboardPackage{
-			Name:      pkg.Name,
-			CacheHit:  pkg.CacheHit,
-			CacheMiss: pkg.CacheMiss,
-		})
+		dashPkg := DashboardPackage{
+			Name:         pkg.Name,
+			PackageName:  cmp.Or(pkg.PackageName, pkg.Name),
+			Registry:     pkg.Registry,
+			CacheHit:     pkg.CacheHit,
+			CacheMiss:    pkg.CacheMiss,
+			Size:         "-",
+			LastAccessed: "-",
+		}
+		if pkg.YankedAt != nil {
+			dashPkg.Yanked = pkg.YankedReason
+		}
+		if pkg.SizeBytes > 0 {
+			dashPkg.Size = stats.FormatBytes(pkg.SizeBytes)
+		}
+		if pkg.LastAccessedAt != nil {
+			dashPkg.LastAccessed = pkg.LastAccessedAt.Format("Jan 02, 2006 15:04")
+		}
+		if vulns := findings[pkg.Name]; len(vulns) > 0 {
+			var ids []string
+			dashPkg.MaxSeverity = "UNKNOWN"
+			for _, v := range vulns {
+				ids = append(ids, v.VulnID+" ("+v.Severity+")")
+				if vulnscan.SeverityRank(v.Severity) > vulnscan.SeverityRank(dashPkg.MaxSeverity) {
+					dashPkg.MaxSeverity = v.Severity
+				}
+			}
+			dashPkg.Vulnerabilities = len(vulns)
+			dashPkg.SeverityClass = severityBadgeClass(dashPkg.MaxSeverity)
+			dashPkg.VulnIDs = strings.Join(ids, ", ")
+		}
+		dashPkgs = append(dashPkgs, dashPkg)
 	}
 
 	// Get cache statistics
 	var fileCount, totalSizeBytes, packagesServed int64
 	var lastUpdated time.Time
-	if stats.GlobalStats != nil {
-		fileCount, totalSizeBytes, packagesServed, lastUpdated = stats.GlobalStats.Get()
+	var registries []DashboardRegistry
+	if combined {
+		for _, t := range registryTotals() {
+			if registry != "" && t.Registry != registry {
+				continue
+			}
+			fileCount += t.Files
+			totalSizeBytes += t.SizeBytes
+			packagesServed += t.CacheHit + t.CacheMiss
+			name, _ := registryName(t.Registry)
+			ratio, _ := formatHitRatio(t.CacheHit, t.CacheMiss)
+			registries = append(registries, DashboardRegistry{
+				Key:            t.Registry,
+				Name:           cmp.Or(name, "Unassigned"),
+				Files:          t.Files,
+				Size:           stats.FormatBytes(t.SizeBytes),
+				CacheHit:       t.CacheHit,
+				CacheMiss:      t.CacheMiss,
+				HitRatio:       ratio,
+				BandwidthSaved: stats.FormatBytes(t.BytesSaved),
+				CostSaved:      formatCostSaved(t.BytesSaved),
+			})
+		}
+		lastUpdated = time.Now()
+	} else if s := stats.For(registry); s != nil {
+		fileCount, totalSizeBytes, packagesServed, lastUpdated = s.Get()
 	}
 
 	// Format last updated time
@@ -89,10 +300,92 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request, title string) {
 		lastUpdatedStr = lastUpdated.Format("Jan 02, 2006 15:04:05")
 	}
 
-	tmpl := template.Must(template.New("dashboard").Funcs(template.FuncMap{"add": add, "minus": minus}).Parse(dashboardHTML))
+	blocklistEntries, blockedRequests := blocklist.Totals(blocklistURLs(registry)...)
+
+	totals := cacheTotals(registry)
+	hitRatio, hitRatioPercent := formatHitRatio(totals.CacheHit, totals.CacheMiss)
+
+	// Links keep the filter, sort and page size of the current view
+	pageURL := func(page int, sort string) string {
+		v := url.Values{}
+		for _, key := range []string{"registry", "filter", "range"} {
+			if q.Get(key) != "" {
+				v.Set(key, q.Get(key))
+			}
+		}
+		if sort != "" {
+			v.Set("sort", sort)
+		}
+		if pageSize != dashboardPageSizes[0] {
+			v.Set("per_page", strconv.Itoa(pageSize))
+		}
+		if page > 1 {
+			v.Set("page", strconv.Itoa(page))
+		}
+		return "?" + v.Encode()
+	}
+	basePath := externalBasePath(r)
+	funcs := template.FuncMap{
+		"add":   add,
+		"minus": minus,
+		"packageURL": func(pkgRegistry, name string) string {
+			if combined {
+				return basePath + "/dashboard/all/package?" + url.Values{"registry": {pkgRegistry}, "name": {name}}.Encode()
+			}
+			return basePath + "/dashboard/package?name=" + url.QueryEscape(name)
+		},
+		"registryName": func(registry string) string {
+			name, _ := registryName(registry)
+			return name
+		},
+		"percent": func(ratio float64) string {
+			return strconv.FormatFloat(ratio*100, 'f', 1, 64) + "%"
+		},
+		"pageURL": func(page int) string {
+			return pageURL(page, sort)
+		},
+		// Sorting by a column toggles its direction; numbers and dates
+		// sort descending first
+		"sortURL": func(key string) string {
+			switch {
+			case sort == key:
+				return pageURL(1, "-"+key)
+			case sort == "-"+key || key == "name":
+				return pageURL(1, key)
+			}
+			return pageURL(1, "-"+key)
+		},
+		"rangeURL": func(key string) string {
+			v := r.URL.Query()
+			v.Set("range", key)
+			return "?" + v.Encode()
+		},
+		"sortMark": func(key string) string {
+			switch sort {
+			case key:
+				return " ▲"
+			case "-" + key:
+				return " ▼"
+			}
+			return ""
+		},
+	}
+
+	tmpl := parseTemplate("dashboard.html", funcs)
 	tmpl.Execute(w, struct {
 		DashboardData
-		Filter string
+		Filter    string
+		BasePath  string
+		Registry  string
+		Sort      string
+		PerPage   int
+		PageSizes []int
+		Combined  bool
+		// Registries the combined dashboard can be narrowed to
+		RegistryTabs []struct {
+			Key  string
+			Name string
+		}
 	}{
 		DashboardData: DashboardData{
 			Title:          title,
@@ -103,417 +396,237 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request, title string) {
 			CacheSize:      stats.FormatBytes(totalSizeBytes),
 			PackagesServed: packagesServed,
 			LastUpdated:    lastUpdatedStr,
+
+			BlocklistEntries: blocklistEntries,
+			BlockedRequests:  blockedRequests,
+
+			TopPackages:     topPackages(repositories.PackageRepo.TopPackages, registry),
+			RecentDownloads: recentDownloads(registry),
+			UnusedPackages:  unusedPackages(registry),
+			LastReconcile:   LastReconcile(registry),
+			LastScrub:       LastScrub(registry),
+			Clients:         topClients(registry),
+			Circuits:        upstream.BreakerStates(),
+
+			TopMissed:       topPackages(repositories.PackageRepo.TopMissedPackages, registry),
+			HitRatio:        hitRatio,
+			HitRatioPercent: hitRatioPercent,
+			BandwidthSaved:  stats.FormatBytes(totals.BytesSaved),
+			CostSaved:       formatCostSaved(totals.BytesSaved),
+			Savings:         monthlySavings(registry),
+			History:         cacheHistory(registry, q.Get("range")),
+			Activity:        dashboardActivity(registry),
+			Audit:           dashboardAudit(registry),
+			Registries:      registries,
+			DiskUsage:       diskUsage(registry, totalSizeBytes),
+			Upstreams:       upstream.HealthStates(),
 		},
-		Filter: filter,
+		Filter:    filter,
+		BasePath:  basePath,
+		Registry:  q.Get("registry"),
+		Sort:      sort,
+		PerPage:   pageSize,
+		PageSizes: dashboardPageSizes,
+		Combined:  combined,
+
+		RegistryTabs: registryNames,
 	})
 }
 
-const dashboardHTML = `<!DOCTYPE html>
-<html lang="en">
-<head>
-  <meta charset="UTF-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
-  <title>{{.Title}}</title>
-  <style>
-    .header-container {
-      display: flex;
-      justify-content: flex-start;
-      align-items: center;
-      gap: 6px;
-      margin-bottom: 30px;
-    }
-    .header-container img {
-      height: 96px;
-      width: auto;
-    }
-    .stats-card {
-      border: 1px solid #e0e0e0;
-      border-radius: 8px;
-      padding: 20px;
-      background: #ffffff;
-      box-shadow: 0 2px 4px rgba(0,0,0,0.04);
-      transition: box-shadow 0.3s ease;
-    }
-    .stats-card:hover {
-      box-shadow: 0 4px 12px rgba(0,0,0,0.08);
-    }
-    .stats-subtitle {
-      font-size: 0.875rem;
-      font-weight: 500;
-      color: #6c757d;
-      text-transform: uppercase;
-      letter-spacing: 0.5px;
-      margin-bottom: 8px;
-    }
-    .stats-value {
-      font-size: 2rem;
-      font-weight: 600;
-      color: #212529;
-      margin: 0;
-    }
-  </style>
-</head>
-<body>
-<div class="container mt-5">
-  <div class="header-container">
-    <img src="/static/logo.svg" alt="PkgBin Logo">
-    <h1 class="mb-0">{{.Title}}</h1>
-  </div>
-  
-  <!-- Cache Statistics -->
-  <div class="row mb-4">
-    <div class="col-md-4 mb-3 mb-md-0">
-      <div class="stats-card">
-        <div class="stats-subtitle">Files in Cache</div>
-        <h3 class="stats-value">{{.FileCount}}</h3>
-      </div>
-    </div>
-    <div class="col-md-4 mb-3 mb-md-0">
-      <div class="stats-card">
-        <div class="stats-subtitle">Total Cache Size</div>
-        <h3 class="stats-value">{{.CacheSize}}</h3>
-      </div>
-    </div>
-    <div class="col-md-4">
-      <div class="stats-card">
-        <div class="stats-subtitle">Total Downloads</div>
-        <h3 class="stats-value">{{.PackagesServed}}</h3>
-      </div>
-    </div>
-  </div>
-  <div class="row mb-3">
-    <div class="col-12">
-      <p class="text-muted small mb-0">Statistics updated: {{.LastUpdated}}</p>
-    </div>
-  </div>
-  
-  <form class="mb-3" method="get" action="/dashboard">
-    <div class="input-group">
-      <input type="text" class="form-control" name="filter" placeholder="Filter by package name" value="{{.Filter}}">
-      <button class="btn btn-primary" type="submit">Filter</button>
-    </div>
-  </form>
-  <div class="mb-3">
-    <div class="dropdown">
-      <button class="btn btn-secondary dropdown-toggle" type="button" id="actionsDropdown" data-bs-toggle="dropdown" aria-expanded="false">
-        Actions
-      </button>
-      <ul class="dropdown-menu" aria-labelledby="actionsDropdown">
-        <li><a class="dropdown-item" href="#" onclick="purgeAll(); return false;" data-bs-toggle="tooltip" data-bs-placement="right" title="Feel free to purge a package if you think it needs a refresh.">Purge all</a></li>
-        <li><a class="dropdown-item" href="#" onclick="purgeSelected(); return false;" data-bs-toggle="tooltip" data-bs-placement="right" title="Feel free to purge a package if you think it needs a refresh.">Purge selected</a></li>
-        <li><hr class="dropdown-divider"></li>
-        <li><a class="dropdown-item" href="#" onclick="refreshDatabase(); return false;">Refresh Database</a></li>
-        <li><a class="dropdown-item" href="#" onclick="showAbout(); return false;">About</a></li>
-      </ul>
-    </div>
-  </div>
-  <table class="table table-striped">
-    <thead><tr><th><input type="checkbox" id="selectAll" onclick="toggleSelectAll()" data-bs-toggle="tooltip" data-bs-placement="top" title="Maximum 10 items can be selected"></th><th>Name</th><th>Cache Hit</th><th>Cache Miss</th></tr></thead>
-    <tbody>
-    {{range .Packages}}
-      <tr>
-        <td><input type="checkbox" class="package-checkbox" value="{{.Name}}" onclick="limitSelection()"></td>
-        <td>{{.Name}}</td>
-        <td>{{.CacheHit}}</td>
-        <td>{{.CacheMiss}}</td>
-      </tr>
-    {{end}}
-    </tbody>
-  </table>
-  <nav>
-    <ul class="pagination">
-      {{if gt .CurrentPage 1}}
-        <li class="page-item"><a class="page-link" href="?page={{minus .CurrentPage 1}}&filter={{.Filter}}">Previous</a></li>
-      {{end}}
-      <li class="page-item active"><span class="page-link">Page {{.CurrentPage}} of {{.TotalPages}}</span></li>
-      {{if lt .CurrentPage .TotalPages}}
-        <li class="page-item"><a class="page-link" href="?page={{add .CurrentPage 1}}&filter={{.Filter}}">Next</a></li>
-      {{end}}
-    </ul>
-  </nav>
-</div>
-
-<!-- About Modal -->
-<div class="modal fade" id="aboutModal" tabindex="-1" aria-labelledby="aboutModalLabel" aria-hidden="true">
-  <div class="modal-dialog modal-dialog-centered modal-lg">
-    <div class="modal-content">
-      <div class="modal-header bg-info text-white">
-        <h5 class="modal-title" id="aboutModalLabel">About PkgBin</h5>
-        <button type="button" class="btn-close btn-close-white" data-bs-dismiss="modal" aria-label="Close"></button>
-      </div>
-      <div class="modal-body">
-        <p><strong>PkgBin</strong> is a package caching service.</p>
-        
-        <h6 class="mt-3"><strong>Configuration Instructions</strong></h6>
-        <p>Please update your package manager to retrieve packages from this PkgBin installation:</p>
-        
-        <div class="mb-3">
-          <strong>For Ruby Applications:</strong>
-          <p class="mb-1">Modify your <code>Gemfile</code> to use:</p>
-          <pre class="bg-light p-2 rounded"><code>source "{{"{{"}}pkgbin_for_rubygems_hostname{{"}}"}}"</code></pre>
-        </div>
-        
-        <div class="mb-3">
-          <strong>For NodeJS Applications (NPM):</strong>
-          <p class="mb-1">Create a file named <code>.npmrc</code> at the root of your project with:</p>
-          <pre class="bg-light p-2 rounded"><code>registry={{"{{"}}pkgbin_for_npm_hostname{{"}}"}}</code></pre>
-        </div>
-        
-        <hr>
-        <p><strong>Cache Purging Guidelines</strong></p>
-        <p>You can purge individual packages using the "Purge selected" option. For full cache purging, please contact the site administrator.</p>
-        <p class="text-muted mb-0"><small>Note: Purging the cache will delete cached files and remove database entries. Use with caution.</small></p>
-        <p class="mb-0">Please feel free to share your feedback at <a href="mailto:pkgbin@proton.me">pkgbin@proton.me</a></p>
-      </div>
-      <div class="modal-footer">
-        <button type="button" class="btn btn-primary" data-bs-dismiss="modal">Close</button>
-      </div>
-    </div>
-  </div>
-</div>
-
-<!-- Purge All Modal -->
-<div class="modal fade" id="purgeAllModal" tabindex="-1" aria-labelledby="purgeAllModalLabel" aria-hidden="true">
-  <div class="modal-dialog modal-dialog-centered">
-    <div class="modal-content">
-      <div class="modal-header">
-        <h5 class="modal-title" id="purgeAllModalLabel">Cache Purge Request</h5>
-        <button type="button" class="btn-close" data-bs-dismiss="modal" aria-label="Close"></button>
-      </div>
-      <div class="modal-body">
-        <p>To proceed with purging the entire cache, please contact the site administrator.</p>
-        <p class="text-muted mb-0"><small>Note: Individual package purging can be done using "Purge selected" option.</small></p>
-      </div>
-      <div class="modal-footer">
-        <button type="button" class="btn btn-secondary" data-bs-dismiss="modal">Close</button>
-      </div>
-    </div>
-  </div>
-</div>
-
-<!-- Selection Limit Modal -->
-<div class="modal fade" id="selectionLimitModal" tabindex="-1" aria-labelledby="selectionLimitModalLabel" aria-hidden="true">
-  <div class="modal-dialog modal-dialog-centered modal-sm">
-    <div class="modal-content">
-      <div class="modal-header">
-        <h5 class="modal-title" id="selectionLimitModalLabel">Selection Limit Reached</h5>
-        <button type="button" class="btn-close" data-bs-dismiss="modal" aria-label="Close"></button>
-      </div>
-      <div class="modal-body">
-        <p class="mb-0">You can select a maximum of 10 items at a time.</p>
-      </div>
-      <div class="modal-footer">
-        <button type="button" class="btn btn-primary" data-bs-dismiss="modal">OK</button>
-      </div>
-    </div>
-  </div>
-</div>
-
-<!-- Purge Confirmation Modal -->
-<div class="modal fade" id="purgeConfirmModal" tabindex="-1" aria-labelledby="purgeConfirmModalLabel" aria-hidden="true">
-  <div class="modal-dialog modal-dialog-centered">
-    <div class="modal-content">
-      <div class="modal-header bg-danger text-white">
-        <h5 class="modal-title" id="purgeConfirmModalLabel">Confirm Package Purge</h5>
-        <button type="button" class="btn-close btn-close-white" data-bs-dismiss="modal" aria-label="Close"></button>
-      </div>
-      <div class="modal-body">
-        <p><strong>Are you sure you want to purge <span id="purgePackageCount"></span> selected package(s)?</strong></p>
-        <p>This will:</p>
-        <ul>
-          <li>Delete packages from cache directory</li>
-          <li>Remove packages from database</li>
-        </ul>
-        <p class="text-danger mb-0"><strong>This action cannot be undone.</strong></p>
-      </div>
-      <div class="modal-footer">
-        <button type="button" class="btn btn-secondary" data-bs-dismiss="modal">Cancel</button>
-        <button type="button" class="btn btn-danger" id="confirmPurgeBtn">Purge Packages</button>
-      </div>
-    </div>
-  </div>
-</div>
-
-<!-- Purge Success Modal -->
-<div class="modal fade" id="purgeSuccessModal" tabindex="-1" aria-labelledby="purgeSuccessModalLabel" aria-hidden="true">
-  <div class="modal-dialog modal-dialog-centered">
-    <div class="modal-content">
-      <div class="modal-header bg-success text-white">
-        <h5 class="modal-title" id="purgeSuccessModalLabel">Purge Successful</h5>
-        <button type="button" class="btn-close btn-close-white" data-bs-dismiss="modal" aria-label="Close"></button>
-      </div>
-      <div class="modal-body">
-        <p class="mb-0"><strong>Successfully purged <span id="purgedCount"></span> package(s).</strong></p>
-      </div>
-      <div class="modal-footer">
-        <button type="button" class="btn btn-primary" data-bs-dismiss="modal" onclick="window.location.reload()">OK</button>
-      </div>
-    </div>
-  </div>
-</div>
-
-<!-- Purge Error Modal -->
-<div class="modal fade" id="purgeErrorModal" tabindex="-1" aria-labelledby="purgeErrorModalLabel" aria-hidden="true">
-  <div class="modal-dialog modal-dialog-centered">
-    <div class="modal-content">
-      <div class="modal-header bg-danger text-white">
-        <h5 class="modal-title" id="purgeErrorModalLabel">Purge Failed</h5>
-        <button type="button" class="btn-close btn-close-white" data-bs-dismiss="modal" aria-label="Close"></button>
-      </div>
-      <div class="modal-body">
-        <p class="mb-0"><span id="purgeErrorMessage"></span></p>
-      </div>
-      <div class="modal-footer">
-        <button type="button" class="btn btn-secondary" data-bs-dismiss="modal">Close</button>
-      </div>
-    </div>
-  </div>
-</div>
-
-<script src="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/js/bootstrap.bundle.min.js"></script>
-<script>
-  // Initialize Bootstrap tooltips
-  document.addEventListener('DOMContentLoaded', function() {
-    var tooltipTriggerList = [].slice.call(document.querySelectorAll('[data-bs-toggle="tooltip"]'));
-    var tooltipList = tooltipTriggerList.map(function (tooltipTriggerEl) {
-      return new bootstrap.Tooltip(tooltipTriggerEl);
-    });
-  });
-
-  function toggleSelectAll() {
-    const selectAll = document.getElementById('selectAll');
-    const checkboxes = document.querySelectorAll('.package-checkbox');
-    const isChecked = selectAll.checked;
-    
-    // Uncheck all first
-    checkboxes.forEach(cb => cb.checked = false);
-    
-    // If selecting, check only top 10 items
-    if (isChecked) {
-      checkboxes.forEach((cb, index) => {
-        if (index < 10) {
-          cb.checked = true;
-        }
-      });
-    }
-  }
-
-  function limitSelection() {
-    const checkboxes = document.querySelectorAll('.package-checkbox');
-    const checked = Array.from(checkboxes).filter(cb => cb.checked);
-    if (checked.length > 10) {
-      event.target.checked = false;
-      const modal = new bootstrap.Modal(document.getElementById('selectionLimitModal'));
-      modal.show();
-    }
-    updateSelectAllState();
-  }
-
-  function updateSelectAllState() {
-    const selectAll = document.getElementById('selectAll');
-    const checkboxes = document.querySelectorAll('.package-checkbox');
-    const checked = Array.from(checkboxes).filter(cb => cb.checked);
-    
-    // Check if top 10 are all selected and others are not
-    let isTop10Selected = true;
-    checkboxes.forEach((cb, index) => {
-      if (index < 10 && !cb.checked) isTop10Selected = false;
-      if (index >= 10 && cb.checked) isTop10Selected = false;
-    });
-    
-    selectAll.checked = isTop10Selected && checked.length === Math.min(10, checkboxes.length);
-  }
-
-  function purgeAll() {
-    const modal = new bootstrap.Modal(document.getElementById('purgeAllModal'));
-    modal.show();
-  }
-
-  function showAbout() {
-    const modal = new bootstrap.Modal(document.getElementById('aboutModal'));
-    modal.show();
-  }
-
-  function refreshDatabase() {
-    if (!confirm('This will rebuild the entire database from cache files. This may take several minutes. Continue?')) {
-      return;
-    }
-    
-    // Send refresh request to backend
-    fetch('/refresh-db', {
-      method: 'POST',
-      headers: {
-        'Content-Type': 'application/json',
-      }
-    })
-    .then(response => response.json())
-    .then(data => {
-      if (data.success) {
-        alert(data.message);
-        // Wait a moment then reload to show updated data
-        setTimeout(() => window.location.reload(), 2000);
-      } else {
-        alert('Refresh failed: ' + data.message);
-      }
-    })
-    .catch(error => {
-      alert('Failed to refresh database: ' + error.message);
-    });
-  }
-
-  function purgeSelected() {
-    const checkboxes = document.querySelectorAll('.package-checkbox:checked');
-    if (checkboxes.length === 0) {
-      return; // Do nothing if no checkboxes are checked
-    }
-    
-    const packages = Array.from(checkboxes).map(cb => cb.value);
-    
-    // Update modal content
-    document.getElementById('purgePackageCount').textContent = packages.length;
-    
-    // Show the confirmation modal
-    const modal = new bootstrap.Modal(document.getElementById('purgeConfirmModal'));
-    modal.show();
-    
-    // Set up the confirm button click handler
-    document.getElementById('confirmPurgeBtn').onclick = function() {
-      modal.hide();
-      executePurge(packages);
-    };
-  }
-  
-  function executePurge(packages) {
-    // Send purge request to backend
-    fetch('/purge', {
-      method: 'POST',
-      headers: {
-        'Content-Type': 'application/json',
-      },
-      body: JSON.stringify({ packages: packages })
-    })
-    .then(response => response.json())
-    .then(data => {
-      if (data.success) {
-        document.getElementById('purgedCount').textContent = (data.deleted ? data.deleted.length : 0);
-        const successModal = new bootstrap.Modal(document.getElementById('purgeSuccessModal'));
-        successModal.show();
-      } else {
-        document.getElementById('purgeErrorMessage').textContent = 'Error: ' + data.message;
-        const errorModal = new bootstrap.Modal(document.getElementById('purgeErrorModal'));
-        errorModal.show();
-      }
-    })
-    .catch(error => {
-      document.getElementById('purgeErrorMessage').textContent = 'Failed to purge packages: ' + error.message;
-      const errorModal = new bootstrap.Modal(document.getElementById('purgeErrorModal'));
-      errorModal.show();
-    });
-  }
-</script>
-</body>
-</html>`
+// vulnerabilitiesByFileName groups the recorded findings for the packages
+// on the current page by cached file name.
+func vulnerabilitiesByFileName(pkgs []models.Package) map[string][]models.Vulnerability {
+	grouped := make(map[string][]models.Vulnerability)
+	if repositories.VulnerabilityRepo == nil {
+		return grouped
+	}
+	var names []string
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name)
+	}
+	vulns, err := repositories.VulnerabilityRepo.ListByFileNames(names)
+	if err != nil {
+		log.Printf("Failed to load vulnerabilities for dashboard: %v", err)
+		return grouped
+	}
+	for _, v := range vulns {
+		grouped[v.FileName] = append(grouped[v.FileName], v)
+	}
+	return grouped
+}
+
+// topPackagesLimit is how many packages the dashboard summarizes.
+const topPackagesLimit = 10
+
+// topPackages lists the package summaries returned by top, such as the
+// most downloaded packages.
+func topPackages(top func(registry string, limit int) ([]models.PackageSummary, error), registry string) []DashboardPackageSummary {
+	if repositories.PackageRepo == nil {
+		return nil
+	}
+	summaries, err := top(registry, topPackagesLimit)
+	if err != nil {
+		log.Printf("Failed to load package statistics for dashboard: %v", err)
+		return nil
+	}
+	var pkgs []DashboardPackageSummary
+	for _, p := range summaries {
+		pkgs = append(pkgs, DashboardPackageSummary{
+			Name:      p.PackageName,
+			Versions:  p.Versions,
+			CacheHit:  p.CacheHit,
+			CacheMiss: p.CacheMiss,
+			Size:      stats.FormatBytes(p.SizeBytes),
+			Registry:  p.Registry,
+			SizeBytes: p.SizeBytes,
+		})
+	}
+	return pkgs
+}
+
+// diskUsage returns the packages of registry taking the most disk space,
+// with their share of the cacheSize bytes cached.
+func diskUsage(registry string, cacheSize int64) []DashboardPackageSummary {
+	pkgs := topPackages(repositories.PackageRepo.LargestPackages, registry)
+	for i, p := range pkgs {
+		if cacheSize <= 0 {
+			break
+		}
+		share := min(float64(p.SizeBytes)*100/float64(cacheSize), 100)
+		pkgs[i].Share = strconv.FormatFloat(share, 'f', 1, 64) + "%"
+		pkgs[i].SharePercent = int(share + 0.5)
+	}
+	return pkgs
+}
+
+// formatHitRatio returns the share of downloads served from cache, e.g.
+// "93.5%" or "-" before any download, and its rounded percentage.
+func formatHitRatio(hit, miss int64) (string, int) {
+	if hit+miss == 0 {
+		return "-", 0
+	}
+	ratio := float64(hit) * 100 / float64(hit+miss)
+	return strconv.FormatFloat(ratio, 'f', 1, 64) + "%", int(ratio + 0.5)
+}
+
+// registryTotals sums the cached files of every registry.
+func registryTotals() []models.RegistryTotals {
+	if repositories.PackageRepo == nil {
+		return nil
+	}
+	totals, err := repositories.PackageRepo.RegistryTotals()
+	if err != nil {
+		log.Printf("Failed to load registry totals for dashboard: %v", err)
+	}
+	return totals
+}
+
+// cacheTotals sums the downloads of registry.
+func cacheTotals(registry string) models.CacheTotals {
+	if repositories.PackageRepo == nil {
+		return models.CacheTotals{}
+	}
+	totals, err := repositories.PackageRepo.GetCacheTotals(registry)
+	if err != nil {
+		log.Printf("Failed to load cache totals for dashboard: %v", err)
+	}
+	return totals
+}
+
+// recentDownloadDays is how many days the downloads chart covers.
+const recentDownloadDays = 7
+
+// recentDownloads returns the downloads of each of the last
+// recentDownloadDays days (UTC), including days without any.
+func recentDownloads(registry string) []DashboardDay {
+	if repositories.DownloadEventRepo == nil {
+		return nil
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -(recentDownloadDays - 1))
+	daily, err := repositories.DownloadEventRepo.DailyDownloads(registry, since)
+	if err != nil {
+		log.Printf("Failed to load download history for dashboard: %v", err)
+		return nil
+	}
+	byDay := make(map[string]int, len(daily))
+	for i, d := range daily {
+		byDay[d.Day] = i
+	}
+
+	days := make([]DashboardDay, 0, recentDownloadDays)
+	var busiest int64
+	for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		entry := DashboardDay{Day: day.Format("Mon Jan 02")}
+		if i, ok := byDay[day.Format("2006-01-02")]; ok {
+			entry.CacheHit = daily[i].CacheHit
+			entry.Downloads = daily[i].CacheHit + daily[i].CacheMiss
+		}
+		busiest = max(busiest, entry.Downloads)
+		days = append(days, entry)
+	}
+	for i := range days {
+		if busiest > 0 {
+			days[i].Percent = int(days[i].Downloads * 100 / busiest)
+		}
+	}
+	return days
+}
+
+// unusedPackageAge is how long a package must go without downloads to be
+// reported as unused.
+const unusedPackageAge = 30 * 24 * time.Hour
+
+// unusedPackages counts the cached packages nobody downloaded lately.
+func unusedPackages(registry string) int64 {
+	if repositories.PackageRepo == nil {
+		return 0
+	}
+	count, err := repositories.PackageRepo.CountUnusedSince(registry, time.Now().Add(-unusedPackageAge))
+	if err != nil {
+		log.Printf("Failed to count unused packages for dashboard: %v", err)
+		return 0
+	}
+	return count
+}
+
+// topClientsLimit is how many clients the dashboard lists.
+const topClientsLimit = 10
+
+// topClients returns the clients driving the most traffic.
+func topClients(registry string) []DashboardClient {
+	if repositories.ClientDownloadRepo == nil {
+		return nil
+	}
+	summaries, err := repositories.ClientDownloadRepo.TopClients(registry, topClientsLimit)
+	if err != nil {
+		log.Printf("Failed to load client statistics for dashboard: %v", err)
+		return nil
+	}
+	var clients []DashboardClient
+	for _, c := range summaries {
+		clients = append(clients, DashboardClient{
+			Client:    c.Client,
+			UserAgent: c.UserAgent,
+			CacheHit:  c.CacheHit,
+			CacheMiss: c.CacheMiss,
+			Bandwidth: stats.FormatBytes(c.BytesServed),
+			Packages:  c.Packages,
+			LastSeen:  c.LastSeen.Format("Jan 02, 2006 15:04:05"),
+		})
+	}
+	return clients
+}
+
+func severityBadgeClass(severity string) string {
+	switch severity {
+	case "CRITICAL", "HIGH":
+		return "bg-danger"
+	case "MEDIUM":
+		return "bg-warning text-dark"
+	}
+	return "bg-secondary"
+}
 
 // Helper functions for template
 func add(x, y int) int   { return x + y }
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/pkgb-in/pkgbin/internal/metacache"
+)
+
+// The lock maps keep one mutex for every file or package ever requested.
+// Their sizes are published as expvar variables so their growth can be
+// watched on the debug listener, along with the load shedding counters.
+func init() {
+	expvar.Publish("download_locks", expvar.Func(func() any {
+		return map[string]int{
+			"npm":         lockCount(&downloadLocksMutex, downloadLocks),
+			"npm_publish": lockCount(&npmPublishLocksMutex, npmPublishLocks),
+			"rubygems":    lockCount(&gemDownloadLocksMutex, gemDownloadLocks),
+			"pypi":        lockCount(&pypiDownloadLocksMutex, pypiDownloadLocks),
+		}
+	}))
+	expvar.Publish("load_shedding", expvar.Func(func() any {
+		return map[string]int64{
+			"downloads_in_flight": downloadsInFlight.Load(),
+			"fetches_queued":      fetchesQueued.Load(),
+			"downloads_shed":      downloadsShed.Load(),
+		}
+	}))
+	expvar.Publish("metadata_locks", expvar.Func(func() any {
+		return map[string]int{
+			"npm":      storeLockCount(npmMetadataStores),
+			"rubygems": storeLockCount(gemMetadataStores),
+		}
+	}))
+}
+
+func lockCount(mu *sync.Mutex, locks map[string]*sync.Mutex) int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(locks)
+}
+
+// storeLockCount sums the locks of stores, which are only added at startup.
+func storeLockCount(stores map[string]*metacache.Store) int {
+	n := 0
+	for _, store := range stores {
+		n += store.LockCount()
+	}
+	return n
+}
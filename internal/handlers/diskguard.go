@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/diskspace"
+)
+
+// evictionBatchSize bounds how many least recently used files one eviction
+// considers.
+const evictionBatchSize = 1000
+
+// evictionClient is who evictions are attributed to in the activity feed.
+const evictionClient = "eviction"
+
+// evictionMu keeps concurrent cache misses from evicting for the same
+// shortfall.
+var evictionMu sync.Mutex
+
+// spaceShortfall returns how many bytes must be freed on the volume of
+// cacheDir for the disk guard thresholds to be met, zero or less when they
+// are.
+func spaceShortfall(cfg config.DiskGuard, cacheDir string) (int64, error) {
+	usage, err := diskspace.Stat(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+	available := int64(usage.Available)
+	shortfall := cfg.MinFreeBytes - available
+	if cfg.MinFreePercent > 0 {
+		shortfall = max(shortfall, int64(cfg.MinFreePercent*float64(usage.Total())/100)-available)
+	}
+	return shortfall, nil
+}
+
+// cacheHasSpace reports whether a missed artifact of registry may be cached
+// in cacheDir under the disk guard, evicting the least recently used files
+// of registry first when the volume is short on space and eviction is
+// enabled. Volumes whose space cannot be checked are assumed to have room.
+func cacheHasSpace(r *http.Request, registry, cacheDir string) bool {
+	cfg := requestSettings(r.Context()).Server.DiskGuard
+	if cfg.MinFreeBytes <= 0 && cfg.MinFreePercent <= 0 {
+		return true
+	}
+	shortfall, err := spaceShortfall(cfg, cacheDir)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Failed to check free space of %s: %v", cacheDir, err)
+		}
+		return true
+	}
+	if shortfall <= 0 {
+		return true
+	}
+
+	if cfg.Evict {
+		evictionMu.Lock()
+		// So do the nodes of a cluster sharing the volume
+		unlock, lockErr := cluster.Lock(r.Context(), "evict/"+registry)
+		if lockErr != nil {
+			evictionMu.Unlock()
+			return false
+		}
+		// Another miss may have evicted while this one waited
+		if shortfall, err = spaceShortfall(cfg, cacheDir); err == nil && shortfall > 0 {
+			evictLeastRecentlyUsed(r, registry, cacheDir, shortfall)
+			shortfall, err = spaceShortfall(cfg, cacheDir)
+		}
+		unlock()
+		evictionMu.Unlock()
+		if err != nil || shortfall <= 0 {
+			return true
+		}
+	}
+	log.Printf("Cache volume of %s is %d bytes short of free space, not caching", cacheDir, shortfall)
+	return false
+}
+
+// evictLeastRecentlyUsed removes cached files of registry from cacheDir,
+// those accessed longest ago first, until about need bytes are freed.
+func evictLeastRecentlyUsed(r *http.Request, registry, cacheDir string, need int64) {
+	if repositories.PackageRepo == nil {
+		return
+	}
+	pkgs, err := repositories.PackageRepo.LeastRecentlyUsed(registry, evictionBatchSize)
+	if err != nil {
+		log.Printf("Failed to list files to evict: %v", err)
+		return
+	}
+	var evicted []string
+	var freed int64
+	for _, pkg := range pkgs {
+		if freed >= need {
+			break
+		}
+		// Files of named repositories cached in another directory stay
+		if err := os.Remove(filepath.Join(cacheDir, pkg.Name)); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to evict %s: %v", pkg.Name, err)
+			}
+			continue
+		}
+		evicted = append(evicted, pkg.Name)
+		freed += pkg.SizeBytes
+		invalidatePurgedMetadata(r, registry, pkg.Name)
+	}
+	if len(evicted) == 0 {
+		log.Printf("No cached file could be evicted to free %d bytes", need)
+		return
+	}
+	if err := repositories.PackageRepo.DeletePackagesByNames(registry, evicted); err != nil {
+		log.Printf("Failed to delete %d evicted file(s) from database: %v", len(evicted), err)
+	}
+	log.Printf("Evicted %d least recently used file(s), %d bytes", len(evicted), freed)
+	recordPurges(evictionClient, registry, evicted)
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/policy"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+	"github.com/pkgb-in/pkgbin/internal/vulnscan"
+	"gorm.io/gorm"
+)
+
+// explainLockTimeout bounds how long an explanation waits for the download
+// lock of a file being fetched.
+const explainLockTimeout = 2 * time.Second
+
+// What a request for a path is
+const (
+	explainArtifact = "artifact"
+	explainMetadata = "metadata"
+	explainOther    = "other"
+)
+
+// APIExplanation explains how the proxy would handle a request for a path,
+// without making it.
+type APIExplanation struct {
+	Path string `json:"path"`
+	// Kind is "artifact", "metadata" or "other" (proxied upstream as is)
+	Kind    string `json:"kind"`
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	// FileName is the cache file name artifacts are stored and recorded
+	// under, and CachePath where the cache is checked for it
+	FileName  string `json:"file_name,omitempty"`
+	CachePath string `json:"cache_path,omitempty"`
+	// Upstream is the upstream serving the package, Routed whether a route
+	// picked it, and UpstreamURL what a cache miss is fetched from
+	Upstream    string `json:"upstream"`
+	Routed      bool   `json:"routed"`
+	UpstreamURL string `json:"upstream_url,omitempty"`
+	// Steps are the checks made, in the order a request makes them
+	Steps []APIExplainStep `json:"steps"`
+	// Decision is what the request would get: denied, blocked, local, hit,
+	// not_found, replica, stream, miss, metadata or proxied
+	Decision string `json:"decision"`
+}
+
+// APIExplainStep is one check made for a request.
+type APIExplainStep struct {
+	Check string `json:"check"`
+	// Result is "pass", "fail" or "skip"
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// explainTarget is what a registry makes of a request path.
+type explainTarget struct {
+	kind             string
+	pkgName, version string
+	// decision is the verdict of the blocklist, yanked versions and policy
+	decision policy.Decision
+	// urlPath is the path asked for, and fileName its cache key
+	urlPath      string
+	fileName     string
+	cacheDir     string
+	upstreamBase string
+	defaultBase  string
+	upstreamURL  string
+	// localPath is where a locally published copy would be
+	localPath string
+	scan      config.VulnerabilityScan
+	target    vulnscan.Target
+	noStore   config.NoStore
+	// platforms are those PyPI wheels are cached for
+	platforms config.WheelPlatforms
+	maxSize   int64
+	// metadataTTL is how long cached metadata is served without asking
+	// upstream
+	metadataTTL time.Duration
+}
+
+// npmExplainTarget makes out the npm request r.
+func npmExplainTarget(r *http.Request) explainTarget {
+	repo := NPMRepository(r)
+	t := explainTarget{
+		kind:         explainOther,
+		cacheDir:     repo.CacheDir,
+		upstreamBase: NPMUpstreamForPath(repo, r.URL.Path),
+		defaultBase:  repo.Upstream,
+		scan:         repo.Vulnerabilities,
+		noStore:      repo.NoStore,
+		maxSize:      repo.MaxArtifactSize,
+		metadataTTL:  repo.MetadataTTL.Duration,
+		decision:     policy.Decision{Allowed: true},
+	}
+	if pkgName, ok := npmPackageFromPath(r.URL.Path); ok {
+		t.pkgName, t.version = pkgName, npmVersionFromPath(pkgName, r.URL.Path)
+		t.decision = evaluatePackage(models.RegistryNPM, repo.Policy, repo.Blocklist, t.pkgName, t.version)
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".tgz") || IsNPMRemoteTarballRequest(r):
+		t.kind = explainArtifact
+		t.fileName = cachekey.NPM(r.URL.Path)
+		t.upstreamURL = upstream.Join(t.upstreamBase, r.URL.Path)
+		if remoteURL, ok := npmRemoteTarballURL(r.URL.EscapedPath()); IsNPMRemoteTarballRequest(r) {
+			t.upstreamURL = remoteURL
+			if u, err := url.Parse(remoteURL); !ok || err != nil || !npmTarballHostAllowed(repo, u.Hostname()) {
+				t.decision = policy.Decision{Message: "the tarball host is not in tarball_hosts"}
+			}
+		}
+		t.target = npmScanTarget(r, t.fileName)
+		if repo.LocalDir != "" {
+			t.localPath = npmLocalTarballPath(repo, t.fileName)
+		}
+	case IsNPMDetachedSignatureRequest(r) || IsNPMMetadataRequest(r):
+		t.kind = explainMetadata
+	}
+	return t
+}
+
+// pypiExplainTarget makes out the PyPI request r.
+func pypiExplainTarget(r *http.Request) explainTarget {
+	repo := PyPIRepository(r)
+	t := explainTarget{
+		kind:         explainOther,
+		cacheDir:     repo.CacheDir,
+		upstreamBase: PyPIUpstreamForPath(repo, r.URL.Path),
+		defaultBase:  repo.Upstream,
+		scan:         repo.Vulnerabilities,
+		noStore:      repo.NoStore,
+		platforms:    repo.WheelPlatforms,
+		maxSize:      repo.MaxArtifactSize,
+		decision:     policy.Decision{Allowed: true},
+	}
+	if project, ok := pypiProjectFromPath(r.URL.Path); ok {
+		t.pkgName = normalizePyPIName(project)
+		if isPyPIDistributionPath(r.URL.Path) {
+			t.version = pypiVersionFromFilename(path.Base(strings.TrimSuffix(r.URL.Path, ".metadata")))
+		}
+		t.decision = evaluatePackage(models.RegistryPyPI, repo.Policy, repo.Blocklist, t.pkgName, t.version)
+	}
+	switch {
+	case isPyPIDistributionPath(r.URL.Path) && !strings.HasSuffix(r.URL.Path, ".metadata"):
+		t.kind = explainArtifact
+		t.fileName = cachekey.PyPI(r.URL.Path)
+		t.upstreamURL = pypiArtifactURL(repo, t.upstreamBase, r.URL.Path)
+		t.target = pypiScanTarget(r, t.fileName)
+	case IsPyPIDetachedSignatureRequest(r) || IsPyPIProvenanceRequest(r):
+		t.kind = explainMetadata
+		t.metadataTTL = repo.ProvenanceTTL.Duration
+	}
+	return t
+}
+
+// gemExplainTarget makes out the RubyGems request r.
+func gemExplainTarget(r *http.Request) explainTarget {
+	repo := RubyGemsRepository(r)
+	t := explainTarget{
+		kind:         explainOther,
+		cacheDir:     repo.CacheDir,
+		upstreamBase: GemUpstreamForPath(repo, r.URL.Path),
+		defaultBase:  repo.Upstream,
+		scan:         repo.Vulnerabilities,
+		noStore:      repo.NoStore,
+		maxSize:      repo.MaxArtifactSize,
+		metadataTTL:  repo.MetadataTTL.Duration,
+		decision:     policy.Decision{Allowed: true},
+	}
+	if gemName, ok := gemNameFromPath(r.URL.Path); ok {
+		t.pkgName = gemName
+		if !strings.HasPrefix(r.URL.Path, "/info/") {
+			t.version = gemVersionFromPath(r.URL.Path)
+		}
+		t.decision = evaluatePackage(models.RegistryRubyGems, repo.Policy, repo.Blocklist, t.pkgName, t.version)
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/gems/") && strings.HasSuffix(r.URL.Path, ".gem"):
+		t.kind = explainArtifact
+		t.fileName = cachekey.Gem(r.URL.Path)
+		t.upstreamURL = upstream.Join(t.upstreamBase, r.URL.Path)
+		t.target = gemScanTarget(r, t.fileName)
+	case IsGemDetachedSignatureRequest(r) || IsGemCompactIndexPath(r.URL.Path) || IsGemSpecsPath(r.URL.Path):
+		t.kind = explainMetadata
+	}
+	return t
+}
+
+// explain tells how the repository would handle a GET of the path given
+// as path (or a full URL), going through the checks its download handler
+// makes without fetching or caching anything.
+func (reg apiRegistry) explain(w http.ResponseWriter, r *http.Request) {
+	raw := r.URL.Query().Get("path")
+	if u, err := url.Parse(raw); err == nil && u.Path != "" {
+		raw = u.Path
+	}
+	if !strings.HasPrefix(raw, "/") {
+		writeAPIError(w, http.StatusBadRequest, "path must be a registry path such as /lodash/-/lodash-4.17.21.tgz, or its URL")
+		return
+	}
+	if strings.HasPrefix(raw, "/~") {
+		writeAPIError(w, http.StatusBadRequest, "path must not name a repository; ask the API of that repository instead")
+		return
+	}
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.URL = &url.URL{Path: raw}
+	t := reg.explainTarget(req)
+	t.urlPath = raw
+	e := explainRequest(r.Context(), reg.registry, t)
+	e.Path = raw
+	writeAPIJSON(w, http.StatusOK, e)
+}
+
+// explainRequest runs the checks of a download of t from registry.
+func explainRequest(ctx context.Context, registry string, t explainTarget) APIExplanation {
+	e := APIExplanation{
+		Kind:        t.kind,
+		Package:     t.pkgName,
+		Version:     t.version,
+		FileName:    t.fileName,
+		Upstream:    t.upstreamBase,
+		Routed:      t.upstreamBase != t.defaultBase,
+		UpstreamURL: t.upstreamURL,
+		Steps:       []APIExplainStep{},
+	}
+	step := func(check, result, format string, args ...any) {
+		e.Steps = append(e.Steps, APIExplainStep{Check: check, Result: result, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case t.pkgName == "":
+		step("policy", "skip", "the path names no package")
+	case !t.decision.Allowed:
+		step("policy", "fail", "%s", t.decision.Message)
+		e.Decision = "denied"
+		return e
+	default:
+		step("policy", "pass", "%s is allowed by the blocklist and policy", strings.TrimSpace(t.pkgName+" "+t.version))
+	}
+	if t.kind == explainMetadata {
+		step("metadata", "pass", "served from the metadata cache, revalidated upstream once older than %s", t.metadataTTL)
+		e.Decision = "metadata"
+		return e
+	}
+	if t.kind != explainArtifact {
+		step("proxy", "pass", "not cached, forwarded to %s", t.upstreamBase)
+		e.Decision = "proxied"
+		return e
+	}
+
+	if t.localPath != "" {
+		if info, err := os.Stat(t.localPath); err == nil && info.Size() > 0 {
+			step("local", "pass", "published locally at %s", t.localPath)
+			e.Decision = "local"
+			return e
+		}
+		step("local", "skip", "not published locally at %s", t.localPath)
+	}
+
+	if message, blocked := vulnerabilityDenial(t.scan, t.target); blocked {
+		step("vulnerabilities", "fail", "%s", message)
+		e.Decision = "blocked"
+		return e
+	} else if t.scan.Enabled && t.scan.BlockSeverity != "" {
+		step("vulnerabilities", "pass", "no known vulnerability at or above %s", t.scan.BlockSeverity)
+	}
+
+	if err := cachekey.Collides(registry, t.fileName, t.urlPath); err != nil {
+		step("cache key", "fail", "%v, the download is streamed through", err)
+		e.Decision = "stream"
+		return e
+	}
+
+	e.CachePath = filepath.Join(t.cacheDir, t.fileName)
+	explainCacheLookup(registry, t, e.CachePath, step)
+	if info, err := os.Stat(e.CachePath); err == nil && info.Size() > 0 {
+		e.Decision = "hit"
+		return e
+	}
+
+	if readOnlyReplica() {
+		step("replica", "pass", "read-only replica, the miss is fetched from its writer")
+		e.Decision = "replica"
+		return e
+	}
+	explainLockWait(registry, t.fileName, step)
+
+	if requestSettings(ctx).Server.NegativeCacheTTL.Duration > 0 && lookupNotFound(ctx, t.upstreamURL) {
+		step("negative cache", "fail", "upstream answered 404 for %s within negative_cache_ttl", t.upstreamURL)
+		e.Decision = "not_found"
+		return e
+	}
+	if noStore(t.noStore, registry, t.fileName) {
+		step("no_store", "fail", "configured to be streamed through without caching")
+		e.Decision = "stream"
+		return e
+	}
+	if wheelPlatformRefused(t.platforms, t.fileName) {
+		tags, _ := parseWheelTags(t.fileName)
+		step("wheel_platforms", "fail", "wheels for %s are streamed through without caching", tags.platform)
+		e.Decision = "stream"
+		return e
+	}
+	if cfg := requestSettings(ctx).Server.DiskGuard; cfg.MinFreeBytes > 0 || cfg.MinFreePercent > 0 {
+		shortfall, err := spaceShortfall(cfg, t.cacheDir)
+		switch {
+		case err != nil:
+			step("disk space", "skip", "free space could not be checked: %v", err)
+		case shortfall > 0 && !cfg.Evict:
+			step("disk space", "fail", "the cache volume is %d bytes short of free space, the miss is streamed through", shortfall)
+			e.Decision = "stream"
+			return e
+		case shortfall > 0:
+			step("disk space", "pass", "the cache volume is %d bytes short of free space, least recently used files are evicted first", shortfall)
+		default:
+			step("disk space", "pass", "enough free space")
+		}
+	}
+	if t.maxSize > 0 {
+		step("size", "pass", "files larger than %d bytes are not cached", t.maxSize)
+	}
+	step("fetch", "pass", "fetched from %s and cached as %s", t.upstreamURL, t.fileName)
+	e.Decision = "miss"
+	return e
+}
+
+// explainCacheLookup reports what the cache holds for t.
+func explainCacheLookup(registry string, t explainTarget, cachePath string, step func(check, result, format string, args ...any)) {
+	info, err := os.Stat(cachePath)
+	switch {
+	case err == nil && info.Size() > 0:
+		step("cache", "pass", "cached at %s, %d bytes, modified %s", cachePath, info.Size(), info.ModTime().Format(time.RFC3339))
+	case err == nil:
+		step("cache", "fail", "%s is empty and would be fetched again", cachePath)
+	default:
+		step("cache", "fail", "not cached at %s", cachePath)
+		if info, err := os.Stat(filepath.Join(t.cacheDir, trashDirName, t.fileName)); err == nil {
+			step("trash", "pass", "purged at %s, restorable until %s", info.ModTime().Format(time.RFC3339),
+				info.ModTime().Add(config.Current().Server.PurgeRetention.Duration).Format(time.RFC3339))
+		}
+	}
+	if repositories.PackageRepo == nil {
+		return
+	}
+	pkg, err := repositories.PackageRepo.GetPackageByName(registry, t.fileName)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		step("database", "skip", "no package row for %s", t.fileName)
+	case err != nil:
+		step("database", "skip", "the package row could not be loaded: %v", err)
+	default:
+		step("database", "pass", "package row with %d hits and %d misses", pkg.CacheHit, pkg.CacheMiss)
+	}
+}
+
+// explainLockWait measures how long a miss of fileName would wait for the
+// locks a download holds on this node, up to explainLockTimeout.
+func explainLockWait(registry, fileName string, step func(check, result, format string, args ...any)) {
+	start := time.Now()
+	if !waitLock(cacheLock.TryRLock, explainLockTimeout) {
+		step("lock", "fail", "a full purge or refresh holds the cache for more than %s", explainLockTimeout)
+		return
+	}
+	defer cacheLock.RUnlock()
+	lock := downloadLock(registry, fileName)
+	if !waitLock(lock.TryLock, explainLockTimeout-time.Since(start)) {
+		step("lock", "fail", "%s is being downloaded for more than %s", fileName, explainLockTimeout)
+		return
+	}
+	lock.Unlock()
+	step("lock", "pass", "waited %s for the download lock", time.Since(start).Round(time.Microsecond))
+}
+
+// waitLock tries to take a lock with tryLock until timeout.
+func waitLock(tryLock func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !tryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+)
+
+// exportBatchSize is how many packages are loaded at once while exporting.
+const exportBatchSize = 1000
+
+// exportColumns are the CSV columns of an export.
+var exportColumns = []string{
+	"name", "registry", "package_name", "version", "cache_hit", "cache_miss",
+	"size_bytes", "sha256", "last_accessed_at", "created_at", "updated_at",
+}
+
+func NPMExportHandler(w http.ResponseWriter, r *http.Request) {
+	exportPackagesHandler(w, r, models.RegistryNPM)
+}
+
+func RubyExportHandler(w http.ResponseWriter, r *http.Request) {
+	exportPackagesHandler(w, r, models.RegistryRubyGems)
+}
+
+func PyPIExportHandler(w http.ResponseWriter, r *http.Request) {
+	exportPackagesHandler(w, r, models.RegistryPyPI)
+}
+
+// exportPackagesHandler streams every package of registry with its
+// counters as CSV, or as a JSON array with format=json.
+func exportPackagesHandler(w http.ResponseWriter, r *http.Request, registry string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	fileName := "pkgbin-" + registry + "-packages-" + time.Now().Format("20060102") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+
+	var err error
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = exportJSON(w, registry)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = exportCSV(w, registry)
+	}
+	// The response is under way, so the export can only end early
+	if err != nil {
+		log.Printf("Failed to export packages: %v", err)
+	}
+}
+
+func exportCSV(w http.ResponseWriter, registry string) error {
+	out := csv.NewWriter(w)
+	out.Write(exportColumns)
+	err := repositories.PackageRepo.EachPackage(registry, exportBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			lastAccessed := ""
+			if pkg.LastAccessedAt != nil {
+				lastAccessed = pkg.LastAccessedAt.UTC().Format(time.RFC3339)
+			}
+			out.Write([]string{
+				pkg.Name,
+				pkg.Registry,
+				pkg.PackageName,
+				pkg.Version,
+				strconv.FormatInt(pkg.CacheHit, 10),
+				strconv.FormatInt(pkg.CacheMiss, 10),
+				strconv.FormatInt(pkg.SizeBytes, 10),
+				pkg.SHA256,
+				lastAccessed,
+				pkg.CreatedAt.UTC().Format(time.RFC3339),
+				pkg.UpdatedAt.UTC().Format(time.RFC3339),
+			})
+		}
+		out.Flush()
+		return out.Error()
+	})
+	out.Flush()
+	return err
+}
+
+func exportJSON(w http.ResponseWriter, registry string) error {
+	w.Write([]byte("["))
+	enc := json.NewEncoder(w)
+	first := true
+	err := repositories.PackageRepo.EachPackage(registry, exportBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			if err := enc.Encode(newAPIPackage(pkg)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	w.Write([]byte("]\n"))
+	return err
+}
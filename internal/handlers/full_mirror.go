@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+	"github.com/pkgb-in/pkgbin/internal/policy"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// fullMirrorUserAgent is who the downloads of the full mirror are
+// attributed to.
+const fullMirrorUserAgent = "pkgbin-mirror"
+
+// mirrorRelease is a release file of a package mirrored in full.
+type mirrorRelease struct {
+	version string
+	// path is the registry path clients download it from
+	path string
+}
+
+// fullMirrorRepo is a repository mirroring packages in full.
+type fullMirrorRepo struct {
+	name     string
+	cacheDir string
+	cfg      config.FullMirror
+	// repo is the configuration its downloads are made to
+	repo any
+	// releases lists the release files of a package upstream
+	releases func(ctx context.Context, name string) ([]mirrorRelease, error)
+}
+
+// fullMirrorRepos returns the repositories of registry in s.
+func fullMirrorRepos(registry string, s *config.Settings) []fullMirrorRepo {
+	var repos []fullMirrorRepo
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&s.NPM}, s.NPM.Repositories...) {
+			repos = append(repos, fullMirrorRepo{repo.Name, repo.CacheDir, repo.FullMirror, repo, func(ctx context.Context, name string) ([]mirrorRelease, error) {
+				return npmMirrorReleases(ctx, repo, name)
+			}})
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&s.PyPI}, s.PyPI.Repositories...) {
+			repos = append(repos, fullMirrorRepo{repo.Name, repo.CacheDir, repo.FullMirror, repo, func(ctx context.Context, name string) ([]mirrorRelease, error) {
+				return pypiMirrorReleases(ctx, repo, name)
+			}})
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&s.RubyGems}, s.RubyGems.Repositories...) {
+			repos = append(repos, fullMirrorRepo{repo.Name, repo.CacheDir, repo.FullMirror, repo, func(ctx context.Context, name string) ([]mirrorRelease, error) {
+				return gemMirrorReleases(ctx, repo, name)
+			}})
+		}
+	}
+	return repos
+}
+
+// fullMirrorNames returns the names of the packages mirror lists, as
+// parsed from the names of cached files.
+func fullMirrorNames(registry string, mirror config.FullMirror) map[string]bool {
+	names := make(map[string]bool, len(mirror.Packages))
+	for _, pkg := range mirror.Packages {
+		if registry == models.RegistryPyPI {
+			names[normalizePyPIName(pkg.Name)] = true
+		} else {
+			names[pkg.Name] = true
+		}
+	}
+	return names
+}
+
+// StartFullMirror downloads the releases of the packages the repositories
+// of registry mirror in full, then checks upstream for new ones every
+// interval, within the maintenance windows. Downloads go through handler as
+// GET requests, so they pass the same policy checks, routing and
+// verification as those of clients. The leader of a cluster mirrors for
+// every node, and read-only replicas leave it to their writer. It returns
+// an error for invalid version ranges.
+func StartFullMirror(registry string, handler http.Handler) error {
+	for _, m := range fullMirrorRepos(registry, config.Current()) {
+		ranges := make([]policy.Range, len(m.cfg.Packages))
+		for i, pkg := range m.cfg.Packages {
+			if pkg.Name == "" {
+				return fmt.Errorf("full_mirror package %d has no name", i+1)
+			}
+			if pkg.Versions == "" {
+				continue
+			}
+			r, err := policy.ParseRange(pkg.Versions)
+			if err != nil {
+				return fmt.Errorf("full_mirror versions of %s: %w", pkg.Name, err)
+			}
+			ranges[i] = r
+		}
+		if len(m.cfg.Packages) == 0 || m.cfg.Interval.Duration <= 0 || readOnlyReplica() {
+			continue
+		}
+		go func() {
+			ticker := time.NewTicker(m.cfg.Interval.Duration)
+			defer ticker.Stop()
+			for {
+				maintenance.Wait(config.MaintenanceFullMirror)
+				if cluster.IsLeader(registry) {
+					mirrorPackages(registry, m.current(registry), ranges, handler)
+				}
+				<-ticker.C
+			}
+		}()
+	}
+	return nil
+}
+
+// current returns m with the settings of its repository now in effect,
+// such as its upstream, and the packages and schedule it started with.
+func (m fullMirrorRepo) current(registry string) fullMirrorRepo {
+	for _, repo := range fullMirrorRepos(registry, config.Current()) {
+		if repo.name == m.name {
+			repo.cfg = m.cfg
+			return repo
+		}
+	}
+	return m
+}
+
+// mirrorPackages downloads the releases of the packages m mirrors that are
+// not cached yet, those in the range of each package where one is set.
+func mirrorPackages(registry string, m fullMirrorRepo, ranges []policy.Range, handler http.Handler) {
+	start := time.Now()
+	ctx := context.Background()
+	fetched, failed := 0, 0
+	for i, pkg := range m.cfg.Packages {
+		if !maintenance.Open(config.MaintenanceFullMirror, time.Now()) {
+			log.Printf("Full mirror of %s stopped, as the maintenance window closed", registry)
+			break
+		}
+		releases, err := m.releases(ctx, pkg.Name)
+		if err != nil {
+			log.Printf("Failed to list the releases of %s to mirror: %v", pkg.Name, err)
+			failed++
+			continue
+		}
+		for _, release := range releases {
+			if pkg.Versions != "" && !ranges[i].Contains(release.version) {
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(m.cacheDir, cachekey.For(registry, release.path))); err == nil && info.Size() > 0 {
+				continue
+			}
+			if status := fetchThrough(ctx, handler, m.repo, release.path); status != http.StatusOK {
+				log.Printf("Failed to mirror %s %s from %s: %d %s", pkg.Name, release.version, release.path, status, http.StatusText(status))
+				failed++
+				continue
+			}
+			fetched++
+		}
+	}
+	repo := registry
+	if m.name != "" {
+		repo += " repository " + m.name
+	}
+	log.Printf("Full mirror of %s: %d packages checked, %d files downloaded, %d failures, in %s",
+		repo, len(m.cfg.Packages), fetched, failed, time.Since(start).Round(time.Millisecond))
+}
+
+// fetchThrough downloads urlPath from the repository repo through handler
+// as a client would, returning the status of the response.
+func fetchThrough(ctx context.Context, handler http.Handler, repo any, urlPath string) int {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, repositoryKey{}, repo), http.MethodGet, urlPath, nil)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	req.Header.Set("User-Agent", fullMirrorUserAgent)
+	sink := &discardResponseWriter{header: make(http.Header)}
+	handler.ServeHTTP(sink, req)
+	return sink.status()
+}
+
+// npmMirrorReleases lists the tarballs of the versions of pkgName in its
+// abbreviated packument. Locally published packages have nothing to
+// mirror, and tarballs of other hosts are only listed when tarball_hosts
+// allows them.
+func npmMirrorReleases(ctx context.Context, repo *config.NPMProxyConfig, pkgName string) ([]mirrorRelease, error) {
+	if _, local, err := readNPMLocalPackument(repo, pkgName); err != nil || local {
+		return nil, err
+	}
+	base := NPMUpstreamFor(repo, pkgName)
+	resp, err := fetchReleaseListing(ctx, upstream.Join(base, "/"+url.PathEscape(pkgName)), npmAbbreviatedMediaType)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("not found upstream")
+	}
+	defer resp.Body.Close()
+	var doc npmPackument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding packument: %w", err)
+	}
+	remote := npmRemoteTarballRewrite(repo, "", pkgName)
+	var releases []mirrorRelease
+	for version, v := range doc.Versions {
+		if p, ok := strings.CutPrefix(v.Dist.Tarball, strings.TrimSuffix(base, "/")); ok && strings.HasPrefix(p, "/") {
+			releases = append(releases, mirrorRelease{version: version, path: p})
+		} else if p, ok := remote(v.Dist.Tarball); ok {
+			releases = append(releases, mirrorRelease{version: version, path: p})
+		}
+	}
+	return releases, nil
+}
+
+// pypiMirrorReleases lists the distribution files of project on its PEP
+// 691 JSON project page, leaving out yanked ones.
+func pypiMirrorReleases(ctx context.Context, repo *config.PyPIProxyConfig, project string) ([]mirrorRelease, error) {
+	base := PyPIUpstreamFor(repo, project)
+	pageURL := upstream.Join(base, "/simple/"+normalizePyPIName(project)+"/")
+	resp, err := fetchReleaseListing(ctx, pageURL, "application/vnd.pypi.simple.v1+json")
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("not found upstream")
+	}
+	defer resp.Body.Close()
+	var doc struct {
+		Files []struct {
+			Filename string `json:"filename"`
+			URL      string `json:"url"`
+			Yanked   any    `json:"yanked"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding simple index: %w", err)
+	}
+	page, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	var releases []mirrorRelease
+	for _, f := range doc.Files {
+		// yanked is false, true or the reason it was
+		if f.Yanked != nil && f.Yanked != false {
+			continue
+		}
+		fileURL, err := page.Parse(f.URL)
+		if err != nil {
+			continue
+		}
+		fileURL.Fragment = ""
+		// Files of the upstream are downloaded under their path below it,
+		// those of its file host such as files.pythonhosted.org under
+		// theirs
+		p, ok := strings.CutPrefix(fileURL.String(), strings.TrimSuffix(base, "/"))
+		if !ok || !strings.HasPrefix(p, "/") {
+			p = fileURL.Path
+		}
+		releases = append(releases, mirrorRelease{version: pypiVersionFromFilename(f.Filename), path: p})
+	}
+	return releases, nil
+}
+
+// gemMirrorReleases lists the gems of every version and platform of
+// gemName in its compact index info file.
+func gemMirrorReleases(ctx context.Context, repo *config.RubyGemsProxyConfig, gemName string) ([]mirrorRelease, error) {
+	resp, err := fetchReleaseListing(ctx, upstream.Join(GemUpstreamFor(repo, gemName), "/info/"+gemName), "")
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("not found upstream")
+	}
+	defer resp.Body.Close()
+	// Each line is "<version>[-<platform>] <deps>|<requirements>", after a
+	// "---" header
+	var releases []mirrorRelease
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		versionPlatform, _, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		version, _, _ := strings.Cut(versionPlatform, "-")
+		releases = append(releases, mirrorRelease{version: version, path: "/gems/" + gemName + "-" + versionPlatform + ".gem"})
+	}
+	return releases, scanner.Err()
+}
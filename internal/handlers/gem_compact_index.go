@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/cachestatus"
+	"github.com/pkgb-in/pkgbin/internal/metacache"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// gemVersionsKey is the metadata cache key of the compact index /versions file.
+const gemVersionsKey = "versions"
+
+// gemMetadataStores cache compact index documents on disk, one store per
+// repository metadata directory
+var gemMetadataStores = make(map[string]*metacache.Store)
+
+// InitGemMetadataCache prepares the on-disk caches used for RubyGems
+// metadata of the default and every named repository.
+func InitGemMetadataCache() error {
+	for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+		store, err := metacache.New(repo.MetadataDir)
+		if err != nil {
+			return err
+		}
+		gemMetadataStores[repo.MetadataDir] = store
+	}
+	return nil
+}
+
+// gemMetadataStore returns the metadata cache of repo.
+func gemMetadataStore(repo *config.RubyGemsProxyConfig) *metacache.Store {
+	return gemMetadataStores[repo.MetadataDir]
+}
+
+// InvalidateGemMetadata drops the cached compact index info of gem and the
+// quick gemspec of one of its releases, given as "<name>-<version>".
+func InvalidateGemMetadata(repo *config.RubyGemsProxyConfig, gem, release string) {
+	store := gemMetadataStore(repo)
+	if store == nil || gem == "" {
+		return
+	}
+	keys := []string{"info/" + gem}
+	if release != "" {
+		keys = append(keys, strings.TrimPrefix(gemQuickSpecPrefix, "/")+release+".gemspec.rz")
+	}
+	for _, key := range keys {
+		unlock := store.Lock(key)
+		if err := store.Invalidate(key); err != nil {
+			log.Printf("Failed to invalidate cached metadata %s: %v", key, err)
+		}
+		unlock()
+	}
+}
+
+// IsGemCompactIndexPath reports whether path is a Bundler compact index
+// endpoint (/versions, /names or /info/<gem>).
+func IsGemCompactIndexPath(path string) bool {
+	return path == "/versions" || path == "/names" ||
+		(strings.HasPrefix(path, "/info/") && len(path) > len("/info/"))
+}
+
+// GemCompactIndexHandler serves compact index documents from the metadata
+// cache, revalidating them against upstream once they are older than the
+// configured TTL. /versions is refreshed incrementally with range requests
+// because it is an append-only file of several megabytes.
+func GemCompactIndexHandler(w http.ResponseWriter, r *http.Request) {
+	repo := RubyGemsRepository(r)
+	store := gemMetadataStore(repo)
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	upstreamURL := upstream.Join(GemUpstreamForPath(repo, r.URL.Path), r.URL.Path)
+	ttl := repo.MetadataTTL.Duration
+
+	var entry metacache.Entry
+	var stale bool
+	var err error
+	if key == gemVersionsKey {
+		entry, stale, err = fetchGemVersions(r.Context(), store, upstreamURL, ttl)
+	} else {
+		entry, stale, err = store.Fetch(r.Context(), metadataClient, key, upstreamURL, nil, ttl)
+	}
+
+	if err != nil {
+		var statusErr *metacache.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Failed to fetch compact index %s [%s]: %v", key, requestid.FromContext(r.Context()), err)
+		http.Error(w, "Failed to fetch metadata from upstream", http.StatusBadGateway)
+		return
+	}
+
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	store.Serve(w, r, entry)
+}
+
+// fetchGemVersions returns the cached /versions file, bringing it up to date
+// by requesting only the bytes appended upstream since the last fetch. The
+// range starts one byte early so the overlap can be checked, mirroring what
+// Bundler itself does.
+func fetchGemVersions(ctx context.Context, store *metacache.Store, upstreamURL string, ttl time.Duration) (metacache.Entry, bool, error) {
+	unlock := store.Lock(gemVersionsKey)
+	defer unlock()
+
+	cached, ok := store.Lookup(gemVersionsKey)
+	if !ok || cached.Size == 0 {
+		entry, err := fetchGemVersionsFull(ctx, store, upstreamURL)
+		return entry, false, err
+	}
+	if cached.Fresh(ttl) {
+		cachestatus.Set(ctx, cachestatus.Hit)
+		return cached, false, nil
+	}
+
+	lastByte, err := readLastByte(store, cached)
+	if err != nil {
+		entry, err := fetchGemVersionsFull(ctx, store, upstreamURL)
+		return entry, false, err
+	}
+
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return metacache.Entry{}, false, err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(cached.Size-1, 10)+"-")
+	if cached.UpstreamETag != "" {
+		req.Header.Set("If-None-Match", cached.UpstreamETag)
+	}
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		log.Printf("Upstream unavailable for compact index versions, serving stale copy: %v", err)
+		cachestatus.Set(ctx, cachestatus.Stale)
+		return cached, true, nil
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		cachestatus.Set(ctx, cachestatus.Hit)
+		entry, err := store.Touch(gemVersionsKey, cached, resp.Header)
+		return entry, false, err
+
+	case http.StatusPartialContent:
+		overlap := make([]byte, 1)
+		if _, err := io.ReadFull(resp.Body, overlap); err != nil || overlap[0] != lastByte {
+			log.Printf("Compact index versions diverged from upstream, fetching full copy")
+			entry, err := fetchGemVersionsFull(ctx, store, upstreamURL)
+			return entry, false, err
+		}
+
+		entry := cached
+		entry.UpstreamETag = resp.Header.Get("ETag")
+		entry.FetchedAt = time.Now()
+		entry.Validated(resp.Header, entry.FetchedAt)
+		entry, err = store.Append(gemVersionsKey, entry, resp.Body)
+		if err != nil {
+			return metacache.Entry{}, false, err
+		}
+
+		// Upstream publishes the digest of the complete file; a mismatch
+		// means the file was rewritten rather than appended to
+		if expected := upstreamSHA256(resp.Header); expected != "" && expected != entry.SHA256 {
+			log.Printf("Compact index versions digest mismatch after append, fetching full copy")
+			entry, err := fetchGemVersionsFull(ctx, store, upstreamURL)
+			return entry, false, err
+		}
+		return entry, false, nil
+
+	case http.StatusOK:
+		entry, err := commitGemVersions(store, upstreamURL, resp)
+		return entry, false, err
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		entry, err := fetchGemVersionsFull(ctx, store, upstreamURL)
+		return entry, false, err
+
+	default:
+		if resp.StatusCode >= http.StatusInternalServerError {
+			log.Printf("Upstream returned %d for compact index versions, serving stale copy", resp.StatusCode)
+			cachestatus.Set(ctx, cachestatus.Stale)
+			return cached, true, nil
+		}
+		return metacache.Entry{}, false, &metacache.StatusError{StatusCode: resp.StatusCode}
+	}
+}
+
+// fetchGemVersionsFull downloads and caches the complete /versions file.
+// Callers must hold the versions lock.
+func fetchGemVersionsFull(ctx context.Context, store *metacache.Store, upstreamURL string) (metacache.Entry, error) {
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return metacache.Entry{}, err
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return metacache.Entry{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return metacache.Entry{}, &metacache.StatusError{StatusCode: resp.StatusCode}
+	}
+	return commitGemVersions(store, upstreamURL, resp)
+}
+
+func commitGemVersions(store *metacache.Store, upstreamURL string, resp *http.Response) (metacache.Entry, error) {
+	entry := metacache.Entry{
+		URL:          upstreamURL,
+		UpstreamETag: resp.Header.Get("ETag"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		FetchedAt:    time.Now(),
+	}
+	entry.Validated(resp.Header, entry.FetchedAt)
+	entry, err := store.Commit(gemVersionsKey, entry, resp.Body)
+	if err != nil {
+		return entry, err
+	}
+	// The published digest covers the encoded representation, so it can only
+	// be checked when the transport did not transparently decompress the body
+	if expected := upstreamSHA256(resp.Header); expected != "" && !resp.Uncompressed && expected != entry.SHA256 {
+		store.Invalidate(gemVersionsKey)
+		return metacache.Entry{}, fmt.Errorf("compact index versions digest mismatch: expected %s, got %s", expected, entry.SHA256)
+	}
+	return entry, nil
+}
+
+func readLastByte(store *metacache.Store, entry metacache.Entry) (byte, error) {
+	f, err := store.Open(entry.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, entry.Size-1); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// upstreamSHA256 extracts the hex sha256 of the full representation from
+// Repr-Digest (RFC 9530) or the older Digest (RFC 3230) header.
+func upstreamSHA256(h http.Header) string {
+	for _, value := range strings.Split(h.Get("Repr-Digest"), ",") {
+		if encoded, ok := strings.CutPrefix(strings.TrimSpace(value), "sha-256="); ok {
+			return decodeBase64Hex(strings.Trim(encoded, ":"))
+		}
+	}
+	for _, value := range strings.Split(h.Get("Digest"), ",") {
+		if encoded, ok := strings.CutPrefix(strings.TrimSpace(value), "sha-256="); ok {
+			return decodeBase64Hex(encoded)
+		}
+	}
+	return ""
+}
+
+func decodeBase64Hex(encoded string) string {
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != sha256.Size {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
@@ -1,17 +1,17 @@
 package handlers
 
 import (
-	"crypto/sha512"
-	"encoding/hex"
-	"io"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
 
-	"github.com/pkgb-in/pkgbin/config"
-	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
 )
 
 // gemDownloadLocks prevents concurrent downloads of the same gem
@@ -19,21 +19,43 @@ var gemDownloadLocks = make(map[string]*sync.Mutex)
 var gemDownloadLocksMutex sync.Mutex
 
 func GemDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := admitDownload(w, r)
+	if !ok {
+		return
+	}
+	defer release()
 
-	Upstream := config.RubyGemsConfig.Upstream
-	CacheDir := config.RubyGemsConfig.CacheDir
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
 
-	gemFileName := filepath.Base(r.URL.Path)
+	repo := RubyGemsRepository(r)
+	Upstream := GemUpstreamForPath(repo, r.URL.Path)
+	CacheDir := repo.CacheDir
+
+	gemFileName := cachekey.Gem(r.URL.Path)
 	localPath := filepath.Join(CacheDir, gemFileName)
 
+	// Refuse versions with known vulnerabilities above the block threshold
+	scanTarget := gemScanTarget(r, gemFileName)
+	if message, blocked := vulnerabilityDenial(repo.Vulnerabilities, scanTarget); blocked {
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+
+	// Paths sharing the key of another never use its cached file
+	if cacheKeyTaken(r, models.RegistryRubyGems, gemFileName) {
+		streamArtifact(w, r, models.RegistryRubyGems, gemFileName, upstream.Join(Upstream, r.URL.Path))
+		return
+	}
+
 	// Check local cache and verify integrity
 	if stat, err := os.Stat(localPath); err == nil && stat.Size() > 0 {
 		// Verify file is readable before serving
 		if file, err := os.Open(localPath); err == nil {
 			file.Close()
 			log.Printf("Serving from cache: %s", gemFileName)
-			repositories.PackageRepo.UpdatePackageAccess(gemFileName, true)
-			http.ServeFile(w, r, localPath)
+			recordAccess(models.RegistryRubyGems, gemFileName, true)
+			serveArtifact(w, r, models.RegistryRubyGems, gemFileName, localPath, true)
 			return
 		} else {
 			// File exists but can't be read - delete it
@@ -42,6 +64,14 @@ func GemDownloadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Read-only replicas have their writer fetch and cache misses
+	if readOnlyReplica() {
+		log.Printf("Cache miss: Fetching %s from the writer", gemFileName)
+		defer beginLiveDownload(r, models.RegistryRubyGems, gemFileName, false)()
+		streamArtifact(w, r, models.RegistryRubyGems, gemFileName, replicaWriterURL(r))
+		return
+	}
+
 	// Get or create a lock for this specific file to prevent concurrent downloads
 	gemDownloadLocksMutex.Lock()
 	lock, exists := gemDownloadLocks[gemFileName]
@@ -55,80 +85,67 @@ func GemDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	lock.Lock()
 	defer lock.Unlock()
 
+	// And across the other nodes of a cluster sharing the cache
+	unlockCluster, err := cluster.Lock(r.Context(), models.RegistryRubyGems+"/"+gemFileName)
+	if err != nil {
+		writeLockUnavailable(w, r, gemFileName, err)
+		return
+	}
+	defer unlockCluster()
+
+	// A path sharing the key may have cached its file in the meantime
+	if cacheKeyTaken(r, models.RegistryRubyGems, gemFileName) {
+		streamArtifact(w, r, models.RegistryRubyGems, gemFileName, upstream.Join(Upstream, r.URL.Path))
+		return
+	}
+
 	// Double-check cache after acquiring lock (another request may have downloaded it)
 	if stat, err := os.Stat(localPath); err == nil && stat.Size() > 0 {
 		if file, err := os.Open(localPath); err == nil {
 			file.Close()
 			log.Printf("Serving from cache (after lock): %s", gemFileName)
-			repositories.PackageRepo.UpdatePackageAccess(gemFileName, true)
-			http.ServeFile(w, r, localPath)
+			recordAccess(models.RegistryRubyGems, gemFileName, true)
+			serveArtifact(w, r, models.RegistryRubyGems, gemFileName, localPath, true)
 			return
 		}
 	}
 
 	// Not in cache, fetch from upstream
 	log.Printf("Cache miss. Fetching from upstream: %s", gemFileName)
-	repositories.PackageRepo.UpdatePackageAccess(gemFileName, false)
-	upstreamURL := Upstream + r.URL.Path
-
-	// Use a client that handles redirects properly (stripping headers for S3)
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) > 0 && req.URL.Host != via[0].URL.Host {
-				req.Header.Del("Authorization")
-			}
-			return nil
-		},
-	}
-
-	resp, err := client.Get(upstreamURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to fetch gem from upstream", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Use temporary file for atomic write
-	tempPath := localPath + ".tmp"
-	outFile, err := os.Create(tempPath)
-	if err != nil {
-		http.Error(w, "File creation failed", http.StatusInternalServerError)
+	recordAccess(models.RegistryRubyGems, gemFileName, false)
+	defer beginLiveDownload(r, models.RegistryRubyGems, gemFileName, false)()
+	upstreamURL := upstream.Join(Upstream, r.URL.Path)
+
+	// Send the file without caching it when configured so or when the
+	// cache volume is full
+	if noStore(repo.NoStore, models.RegistryRubyGems, gemFileName) || !cacheHasSpace(r, models.RegistryRubyGems, CacheDir) {
+		streamArtifact(w, r, models.RegistryRubyGems, gemFileName, upstreamURL)
 		return
 	}
 
-	// Download completely to temp file first with integrity check
-	hash := sha512.New()
-	multiWriter := io.MultiWriter(outFile, hash)
-	bytesWritten, err := io.Copy(multiWriter, resp.Body)
-	outFile.Close()
-
+	// Look up the checksum declared in the compact index so corrupted or
+	// tampered gems never reach the cache
+	expected, err := gemExpectedDigest(r.Context(), Upstream, r.URL.Path)
 	if err != nil {
-		os.Remove(tempPath)
-		http.Error(w, "Download failed", http.StatusInternalServerError)
-		log.Printf("Download error for %s: %v", gemFileName, err)
-		return
+		log.Printf("Could not determine expected checksum for %s, caching unverified: %v", gemFileName, err)
 	}
 
-	// Verify file was written completely
-	if stat, err := os.Stat(tempPath); err != nil || stat.Size() != bytesWritten {
-		os.Remove(tempPath)
-		http.Error(w, "File write verification failed", http.StatusInternalServerError)
-		log.Printf("Size mismatch for %s: expected %d, got %d", gemFileName, bytesWritten, stat.Size())
+	artifact, err := fetchArtifact(r.Context(), models.RegistryRubyGems, upstream.Client, upstreamURL, localPath, expected, repo.MaxArtifactSize)
+	if errors.Is(err, errArtifactTooLarge) && !repo.RejectOversized {
+		log.Printf("Not caching %s, larger than %d bytes", gemFileName, repo.MaxArtifactSize)
+		streamArtifact(w, r, models.RegistryRubyGems, gemFileName, upstreamURL)
 		return
 	}
-
-	// Atomically move temp file to final location
-	if err := os.Rename(tempPath, localPath); err != nil {
-		os.Remove(tempPath)
-		http.Error(w, "File move failed", http.StatusInternalServerError)
-		log.Printf("Failed to move temp file for %s: %v", gemFileName, err)
+	if err != nil {
+		writeFetchError(w, r, gemFileName, err)
 		return
 	}
+	recordArtifact(models.RegistryRubyGems, gemFileName, artifact)
+	claimCacheKey(r, models.RegistryRubyGems, gemFileName)
+	setUpstreamCacheStatus(w.Header(), artifact.UpstreamCacheStatus)
 
-	// Log the file hash for debugging
-	fileHash := hex.EncodeToString(hash.Sum(nil))
-	log.Printf("Cached %s (size: %d bytes, sha512: %s)", gemFileName, bytesWritten, fileHash[:16]+"...")
+	scanOnCacheMiss(repo.Vulnerabilities, scanTarget)
 
 	// Serve the newly cached file
-	http.ServeFile(w, r, localPath)
+	serveArtifact(w, r, models.RegistryRubyGems, gemFileName, localPath, false)
 }
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/metacache"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// gemQuickSpecPrefix is the path of the marshaled per-version gemspecs used
+// by `gem install` and older RubyGems clients.
+const gemQuickSpecPrefix = "/quick/Marshal.4.8/"
+
+// gemQuickSpecTTL is effectively forever: a released gem version's
+// gemspec never changes.
+const gemQuickSpecTTL = 365 * 24 * time.Hour
+
+// gemSpecsIndexes are the full index files older clients download.
+var gemSpecsIndexes = map[string]bool{
+	"/specs.4.8.gz":            true,
+	"/specs.4.8":               true,
+	"/latest_specs.4.8.gz":     true,
+	"/latest_specs.4.8":        true,
+	"/prerelease_specs.4.8.gz": true,
+	"/prerelease_specs.4.8":    true,
+}
+
+// IsGemSpecsPath reports whether path is a quick gemspec or a specs index.
+func IsGemSpecsPath(path string) bool {
+	if gemSpecsIndexes[path] {
+		return true
+	}
+	return strings.HasPrefix(path, gemQuickSpecPrefix) && strings.HasSuffix(path, ".gemspec.rz")
+}
+
+// GemSpecsHandler serves quick gemspecs and specs index files from the
+// metadata cache. Quick gemspecs are immutable and kept indefinitely while
+// the specs indexes are revalidated once older than the configured TTL.
+func GemSpecsHandler(w http.ResponseWriter, r *http.Request) {
+	repo := RubyGemsRepository(r)
+	store := gemMetadataStore(repo)
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	upstreamURL := upstream.Join(GemUpstreamForPath(repo, r.URL.Path), r.URL.Path)
+
+	ttl := repo.SpecsTTL.Duration
+	if strings.HasPrefix(r.URL.Path, gemQuickSpecPrefix) {
+		ttl = gemQuickSpecTTL
+	}
+
+	entry, stale, err := store.Fetch(r.Context(), metadataClient, key, upstreamURL, nil, ttl)
+	if err != nil {
+		var statusErr *metacache.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Failed to fetch %s: %v", key, err)
+		http.Error(w, "Failed to fetch metadata from upstream", http.StatusBadGateway)
+		return
+	}
+
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	store.Serve(w, r, entry)
+}
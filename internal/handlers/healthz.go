@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/initializers"
+	"github.com/pkgb-in/pkgbin/internal/server"
+)
+
+// HealthzHandler answers the healthchecks of containers and orchestrators
+// at /healthz: 200 while the proxy serves with its database reachable, and
+// 503 once it is draining after SIGTERM or when the database is down, so
+// it is taken out of rotation. It is unauthenticated and never logs
+// successes, as it is polled every few seconds.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if server.Draining() {
+		writeAPIJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := initializers.PingDatabase(ctx); err != nil {
+		log.Printf("Healthcheck failed to reach the database: %v", err)
+		writeAPIJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "database": "unavailable"})
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]string{"status": "ok", "database": "ok"})
+}
@@ -0,0 +1,505 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Cache layouts of other repository managers an import reads.
+const (
+	// importArtifactory is an Artifactory repository export, or any tree of
+	// files laid out like the registry paths
+	importArtifactory = "artifactory"
+	// importNexus is a Nexus file blob store, whose .properties files name
+	// the .bytes next to them
+	importNexus = "nexus"
+	// importDevpi is the +files directory of a devpi server
+	importDevpi = "devpi"
+	// importVerdaccio is the storage directory of verdaccio
+	importVerdaccio = "verdaccio"
+)
+
+// importFormats lists the registries whose files each layout can hold.
+var importFormats = map[string][]string{
+	importArtifactory: {models.RegistryNPM, models.RegistryPyPI, models.RegistryRubyGems},
+	importNexus:       {models.RegistryNPM, models.RegistryPyPI, models.RegistryRubyGems},
+	importDevpi:       {models.RegistryPyPI},
+	importVerdaccio:   {models.RegistryNPM},
+}
+
+// pypiDistributionExts are the extensions of the PyPI distribution files an
+// import takes.
+var pypiDistributionExts = []string{".whl", ".egg", ".tar.gz", ".tar.bz2", ".zip"}
+
+// ImportRequest is the body of an import API request. Path is a directory
+// on the proxy's host laid out in Format.
+type ImportRequest struct {
+	Format string `json:"format"`
+	Path   string `json:"path"`
+}
+
+// importReport counts what an import found.
+type importReport struct {
+	imported, existing, failed int
+	bytes                      int64
+}
+
+// importCache starts importing the cache of another repository
+// manager into the cache of the repository r was made to. Like a database
+// refresh, the import runs in the background and excludes refreshes and
+// reconciliations.
+func (reg apiRegistry) importCache(w http.ResponseWriter, r *http.Request) {
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid import request")
+		return
+	}
+	registries, ok := importFormats[req.Format]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "Unknown import format "+req.Format)
+		return
+	}
+	if !slices.Contains(registries, reg.registry) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("A %s cache holds no %s files", req.Format, reg.registry))
+		return
+	}
+	if !filepath.IsAbs(req.Path) {
+		writeAPIError(w, http.StatusBadRequest, "The import path must be absolute")
+		return
+	}
+	if info, err := os.Stat(req.Path); err != nil || !info.IsDir() {
+		writeAPIError(w, http.StatusBadRequest, "The import path is not a directory")
+		return
+	}
+
+	refreshMutex.Lock()
+	if refreshInProgress {
+		refreshMutex.Unlock()
+		writeAPIError(w, http.StatusConflict, "A refresh or import is already in progress")
+		return
+	}
+	unlock, ok := cluster.TryLock(refreshLockKey(reg.registry))
+	if !ok {
+		refreshMutex.Unlock()
+		writeAPIError(w, http.StatusConflict, "A refresh or import is already in progress on another node")
+		return
+	}
+	refreshInProgress = true
+	refreshMutex.Unlock()
+
+	cacheDir := reg.cacheDir(r)
+	repo, _ := reg.config(r).(*config.NPMProxyConfig)
+	go func() {
+		defer unlock()
+		defer func() {
+			refreshMutex.Lock()
+			refreshInProgress = false
+			refreshMutex.Unlock()
+		}()
+		runImport(reg.registry, cacheDir, repo, req)
+	}()
+
+	log.Printf("Importing the %s cache at %s into %s", req.Format, req.Path, cacheDir)
+	noteAudit(r, "%s cache at %s", req.Format, req.Path)
+	writeAPIJSON(w, http.StatusAccepted, map[string]any{
+		"success": true,
+		"message": "Import started in background, see the proxy log for its progress.",
+	})
+}
+
+// runImport copies the registry files of the cache laid out in
+// req.Format at req.Path into cacheDir, recording their package rows.
+// Files already cached are left alone. repo is the npm repository imported
+// into, nil for other registries.
+func runImport(registry, cacheDir string, repo *config.NPMProxyConfig, req ImportRequest) {
+	// Packages published to verdaccio itself go to the local package store
+	// rather than the cache
+	var localDirs map[string]bool
+	if req.Format == importVerdaccio && repo != nil {
+		localDirs = importVerdaccioLocal(repo, req.Path)
+	}
+
+	var report importReport
+	each := func(src, rel string, info fs.FileInfo) {
+		if localDirs[path.Dir(rel)] {
+			return
+		}
+		name, ok := importCacheFileName(registry, rel)
+		if !ok {
+			return
+		}
+		imported, err := importFile(registry, cacheDir, src, name, info)
+		switch {
+		case err != nil:
+			log.Printf("Failed to import %s: %v", src, err)
+			report.failed++
+		case imported:
+			report.imported++
+			report.bytes += info.Size()
+			if report.imported%100 == 0 {
+				log.Printf("Imported %d files...", report.imported)
+			}
+		default:
+			report.existing++
+		}
+	}
+
+	var err error
+	if req.Format == importNexus {
+		err = walkNexusBlobs(req.Path, each)
+	} else {
+		err = walkImportTree(req.Path, each)
+	}
+	if err != nil {
+		log.Printf("Import of %s stopped: %v", req.Path, err)
+	}
+	log.Printf("Import of %s completed: %d files imported (%d bytes), %d already cached, %d failed",
+		req.Path, report.imported, report.bytes, report.existing, report.failed)
+}
+
+// importVerdaccioLocal imports the packages published to the verdaccio
+// storage at root, those with no uplink, into the local package store of
+// repo, and returns the storage directories they were found in, relative
+// to root.
+func importVerdaccioLocal(repo *config.NPMProxyConfig, root string) map[string]bool {
+	dirs := make(map[string]bool)
+	if repo.LocalDir == "" {
+		log.Printf("No local_dir to import the packages published to verdaccio into, caching their tarballs instead")
+		return dirs
+	}
+	manifests, _ := filepath.Glob(filepath.Join(root, "*", "package.json"))
+	scoped, _ := filepath.Glob(filepath.Join(root, "@*", "*", "package.json"))
+	var packages, versions int
+	for _, manifest := range append(manifests, scoped...) {
+		dir := filepath.Dir(manifest)
+		pkgName, imported, err := importVerdaccioPackage(repo, dir)
+		if err != nil {
+			log.Printf("Failed to import the local package at %s: %v", dir, err)
+			continue
+		}
+		if pkgName == "" {
+			continue
+		}
+		rel, _ := filepath.Rel(root, dir)
+		dirs[filepath.ToSlash(rel)] = true
+		packages++
+		versions += imported
+	}
+	if packages > 0 {
+		log.Printf("Imported %d version(s) of %d package(s) published to verdaccio", versions, packages)
+	}
+	return dirs
+}
+
+// importVerdaccioPackage adds the versions of the package whose verdaccio
+// storage is dir to its local packument, with their tarballs, and returns
+// the package name and how many versions it added. Packages verdaccio
+// proxies, which have uplinks, are left to the cache import and return no
+// name. Versions already published locally are kept.
+func importVerdaccioPackage(repo *config.NPMProxyConfig, dir string) (string, int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return "", 0, err
+	}
+	var doc struct {
+		Name     string                     `json:"name"`
+		Versions map[string]json.RawMessage `json:"versions"`
+		DistTags map[string]string          `json:"dist-tags"`
+		Time     map[string]string          `json:"time"`
+		Uplinks  map[string]json.RawMessage `json:"_uplinks"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", 0, fmt.Errorf("invalid package.json: %w", err)
+	}
+	if len(doc.Uplinks) > 0 {
+		return "", 0, nil
+	}
+	if _, ok := parseNPMPackagePath(doc.Name); !ok || strings.Contains(doc.Name, "..") {
+		return "", 0, fmt.Errorf("invalid package name %q", doc.Name)
+	}
+
+	lock := npmPublishLock(doc.Name)
+	lock.Lock()
+	defer lock.Unlock()
+	local, err := loadNPMLocalPackument(repo, doc.Name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	tarball := func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, name))
+	}
+	var imported int
+	for version, raw := range doc.Versions {
+		if _, exists := local.versions[version]; exists {
+			continue
+		}
+		stored, err := storeNPMPublishedVersion(repo, doc.Name, raw, tarball)
+		if err != nil {
+			log.Printf("Failed to import %s@%s: %v", doc.Name, version, err)
+			continue
+		}
+		local.versions[version] = stored
+		local.times[version] = now
+		if published, ok := doc.Time[version]; ok {
+			local.times[version] = published
+		}
+		imported++
+	}
+	for tag, version := range doc.DistTags {
+		if _, ok := local.versions[version]; ok {
+			local.distTags[tag] = version
+		}
+	}
+	if created, ok := doc.Time["created"]; ok {
+		if _, known := local.times["created"]; !known {
+			local.times["created"] = created
+		}
+	}
+	if err := local.save(repo, doc.Name, now); err != nil {
+		return "", 0, err
+	}
+	InvalidateNPMMetadata(repo, doc.Name)
+	return doc.Name, imported, nil
+}
+
+// walkImportTree calls fn with every regular file under root and its path
+// relative to root, skipping hidden files and directories such as the
+// .artifactory-metadata of exports.
+func walkImportTree(root string, fn func(src, rel string, info fs.FileInfo)) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		fn(p, filepath.ToSlash(rel), info)
+		return nil
+	})
+}
+
+// walkNexusBlobs calls fn with the content of every blob of the Nexus blob
+// store at root that is not deleted, and the path it was stored under.
+func walkNexusBlobs(root string, fn func(src, rel string, info fs.FileInfo)) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".properties") {
+			return nil
+		}
+		props, err := readProperties(p)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", p, err)
+			return nil
+		}
+		name := props["@BlobStore.blob-name"]
+		if name == "" || props["deleted"] == "true" {
+			return nil
+		}
+		src := strings.TrimSuffix(p, ".properties") + ".bytes"
+		info, err := os.Stat(src)
+		if err != nil {
+			log.Printf("Failed to find the content of %s: %v", name, err)
+			return nil
+		}
+		fn(src, strings.TrimPrefix(name, "/"), info)
+		return nil
+	})
+}
+
+// readProperties reads the key=value lines of a Java properties file, as
+// Nexus writes them.
+func readProperties(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			props[key] = strings.ReplaceAll(value, `\:`, ":")
+		}
+	}
+	return props, scanner.Err()
+}
+
+// importFile copies the file at src into cacheDir as name, prefixed with
+// its digest path for PyPI, unless it is already cached, and reports
+// whether it did.
+func importFile(registry, cacheDir, src, name string, info fs.FileInfo) (bool, error) {
+	if registry == models.RegistryPyPI {
+		digest, err := pypiFileDigest(src)
+		if err != nil {
+			return false, err
+		}
+		name = pypiDigestFileName(digest, name)
+	}
+
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	lock := downloadLock(registry, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	localPath := filepath.Join(cacheDir, name)
+	if _, err := os.Stat(localPath); err == nil {
+		return false, nil
+	}
+	artifact, err := copyArtifact(src, localPath)
+	if err != nil {
+		return false, err
+	}
+	// Keep when the file was cached, for eviction and purges by age
+	if err := os.Chtimes(localPath, info.ModTime(), info.ModTime()); err != nil {
+		log.Printf("Failed to keep the modification time of %s: %v", name, err)
+	}
+	recordImport(registry, name, artifact, info.ModTime())
+	return true, nil
+}
+
+// importCacheFileName returns the name a file stored as rel by another
+// repository manager is cached under for registry, false for files of no
+// interest to registry. For PyPI the digest directories are added by
+// importFile.
+func importCacheFileName(registry, rel string) (string, bool) {
+	base := path.Base(rel)
+	switch registry {
+	case models.RegistryNPM:
+		if !strings.HasSuffix(base, ".tgz") {
+			return "", false
+		}
+		// Scoped tarballs sit under @scope/name/, with or without the -/
+		// of registry paths
+		parts := strings.Split(rel, "/")
+		for i := len(parts) - 3; i >= 0; i-- {
+			if strings.HasPrefix(parts[i], "@") {
+				return cachekey.NPM("/" + parts[i] + "/" + parts[i+1] + "/-/" + base), true
+			}
+		}
+		return base, true
+	case models.RegistryPyPI:
+		for _, ext := range pypiDistributionExts {
+			if strings.HasSuffix(strings.ToLower(base), ext) && pypiProjectFromFilename(base) != "" {
+				return base, true
+			}
+		}
+	case models.RegistryRubyGems:
+		if strings.HasSuffix(base, ".gem") {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+// pypiFileDigest returns the hex BLAKE2b-256 digest of the file at p.
+func pypiFileDigest(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h, _ := blake2b.New256(nil)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pypiDigestFileName returns the cache file name of the PyPI distribution
+// fileName, which PyPI serves under the hex BLAKE2b-256 digest of its
+// content.
+func pypiDigestFileName(digest, fileName string) string {
+	return cachekey.PyPI("/packages/" + digest[:2] + "/" + digest[2:4] + "/" + digest[4:] + "/" + fileName)
+}
+
+// copyArtifact copies src to localPath through a temporary file, hashing
+// it on the way.
+func copyArtifact(src, localPath string) (*cachedArtifact, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	tempPath := localPath + janitor.TempSuffix
+	defer janitor.Track(tempPath)()
+	out, err := os.Create(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	hasher := newArtifactHasher()
+	size, err := io.Copy(io.MultiWriter(out, hasher), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, localPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+	return &cachedArtifact{
+		Size:   size,
+		SHA256: hex.EncodeToString(hasher.Sum("sha256")),
+		SHA512: hex.EncodeToString(hasher.Sum("sha512")),
+	}, nil
+}
+
+// recordImport creates the package row of an imported file, last accessed
+// when the other repository manager cached it.
+func recordImport(registry, fileName string, artifact *cachedArtifact, cachedAt time.Time) {
+	if repositories.PackageRepo == nil {
+		return
+	}
+	access := repositories.PackageAccess{Name: fileName, Registry: registry, LastAccess: cachedAt}
+	access.PackageName, access.Version = parseCachedFileName(registry, fileName)
+	if err := repositories.PackageRepo.RecordPackageAccesses([]repositories.PackageAccess{access}); err != nil {
+		log.Printf("Failed to record imported %s: %v", fileName, err)
+		return
+	}
+	recordArtifact(registry, fileName, artifact)
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+)
+
+const (
+	// liveRecentDownloads bounds the recent activity feed.
+	liveRecentDownloads = 20
+	// liveUpdateInterval is how often live streams look for changes.
+	liveUpdateInterval = time.Second
+	// liveKeepAliveInterval is how often an idle stream sends a comment, so
+	// proxies in between keep it open.
+	liveKeepAliveInterval = 15 * time.Second
+)
+
+// LiveDownload is a download in progress, or one that finished recently.
+type LiveDownload struct {
+	FileName    string `json:"file_name"`
+	PackageName string `json:"package_name"`
+	Version     string `json:"version"`
+	CacheHit    bool   `json:"cache_hit"`
+	Client      string `json:"client"`
+	// BytesServed is only known once the download finished.
+	BytesServed int64 `json:"bytes_served,omitempty"`
+	// Time the download started, or finished for recent downloads
+	Time time.Time `json:"time"`
+}
+
+// LiveUpdate is the state of a registry pushed to the dashboard. Counters
+// cover the downloads since the proxy started or, when shared by a cluster
+// through Redis, those of every node since the shared counters were
+// created.
+type LiveUpdate struct {
+	CacheHit    int64          `json:"cache_hit"`
+	CacheMiss   int64          `json:"cache_miss"`
+	BytesServed int64          `json:"bytes_served"`
+	InProgress  []LiveDownload `json:"in_progress"`
+	Recent      []LiveDownload `json:"recent"`
+}
+
+// liveRegistry tracks the downloads of one registry. version changes with
+// every update so streams only send what changed.
+type liveRegistry struct {
+	version uint64
+	update  LiveUpdate
+	nextID  uint64
+	active  map[uint64]LiveDownload
+
+	// shared holds the counters of the cluster once known; sharedLocal is
+	// how much of the local counters has been added to them.
+	shared      *liveCounts
+	sharedLocal liveCounts
+}
+
+// liveCounts are the download counters of a LiveUpdate.
+type liveCounts struct {
+	hit, miss, bytes int64
+}
+
+var (
+	liveRegistries = make(map[string]*liveRegistry)
+	liveMu         sync.Mutex
+	liveStop       = make(chan struct{})
+	liveStopOnce   sync.Once
+)
+
+// liveState returns the tracker of registry; liveMu must be held.
+func liveState(registry string) *liveRegistry {
+	l, ok := liveRegistries[registry]
+	if !ok {
+		l = &liveRegistry{active: make(map[uint64]LiveDownload)}
+		liveRegistries[registry] = l
+	}
+	return l
+}
+
+// beginLiveDownload lists a download of fileName from registry as in
+// progress until the returned func is called.
+func beginLiveDownload(r *http.Request, registry, fileName string, hit bool) (done func()) {
+	d := LiveDownload{FileName: fileName, CacheHit: hit, Client: clientIdentity(r), Time: time.Now()}
+	d.PackageName, d.Version = parseCachedFileName(registry, fileName)
+
+	liveMu.Lock()
+	l := liveState(registry)
+	l.nextID++
+	id := l.nextID
+	l.active[id] = d
+	l.version++
+	liveMu.Unlock()
+
+	return func() {
+		liveMu.Lock()
+		delete(l.active, id)
+		l.version++
+		liveMu.Unlock()
+	}
+}
+
+// recordLiveDownload counts a finished download and adds it to the recent
+// activity feed.
+func recordLiveDownload(registry string, event models.DownloadEvent) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	l := liveState(registry)
+	if event.CacheHit {
+		l.update.CacheHit++
+	} else {
+		l.update.CacheMiss++
+	}
+	l.update.BytesServed += event.BytesServed
+	d := LiveDownload{
+		FileName:    event.FileName,
+		PackageName: event.PackageName,
+		Version:     event.Version,
+		CacheHit:    event.CacheHit,
+		Client:      event.Client,
+		BytesServed: event.BytesServed,
+		Time:        time.Now(),
+	}
+	l.update.Recent = append([]LiveDownload{d}, l.update.Recent[:min(len(l.update.Recent), liveRecentDownloads-1)]...)
+	l.version++
+}
+
+// liveSnapshot returns the current state of registry and its version.
+func liveSnapshot(registry string) (LiveUpdate, uint64) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	l := liveState(registry)
+	update := l.update
+	if l.shared != nil {
+		update.CacheHit, update.CacheMiss, update.BytesServed = l.shared.hit, l.shared.miss, l.shared.bytes
+	}
+	update.Recent = slices.Clone(update.Recent)
+	if update.Recent == nil {
+		update.Recent = []LiveDownload{}
+	}
+	update.InProgress = make([]LiveDownload, 0, len(l.active))
+	for _, d := range l.active {
+		update.InProgress = append(update.InProgress, d)
+	}
+	slices.SortFunc(update.InProgress, func(a, b LiveDownload) int {
+		return a.Time.Compare(b.Time)
+	})
+	return update, l.version
+}
+
+// DownloadCounts returns the cache hits and misses served for registry
+// since the proxy started, or by the whole cluster when it shares its
+// counters.
+func DownloadCounts(registry string) (hits, misses int64) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	l := liveState(registry)
+	if l.shared != nil {
+		return l.shared.hit, l.shared.miss
+	}
+	return l.update.CacheHit, l.update.CacheMiss
+}
+
+// ShareDownloadCounts adds the downloads of registry to the counters the
+// nodes of a cluster share through Redis every liveUpdateInterval, and
+// reports the totals in their place. Nothing runs without Redis.
+func ShareDownloadCounts(registry string) {
+	if !cluster.Shared() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(liveUpdateInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			shareDownloadCounts(registry)
+		}
+	}()
+}
+
+// shareDownloadCounts adds the downloads counted since the last call to
+// the shared counters.
+func shareDownloadCounts(registry string) {
+	liveMu.Lock()
+	l := liveState(registry)
+	local := liveCounts{l.update.CacheHit, l.update.CacheMiss, l.update.BytesServed}
+	deltas := map[string]int64{
+		"cache_hit":    local.hit - l.sharedLocal.hit,
+		"cache_miss":   local.miss - l.sharedLocal.miss,
+		"bytes_served": local.bytes - l.sharedLocal.bytes,
+	}
+	liveMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), liveUpdateInterval)
+	defer cancel()
+	totals, err := cluster.AddCounts(ctx, "downloads:"+registry, deltas)
+	if err != nil {
+		log.Printf("Failed to share download counts: %v", err)
+		return
+	}
+
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	l.sharedLocal = local
+	shared := liveCounts{totals["cache_hit"], totals["cache_miss"], totals["bytes_served"]}
+	if l.shared == nil || *l.shared != shared {
+		l.shared = &shared
+		l.version++
+	}
+}
+
+// StopLiveUpdates ends the live streams, which would otherwise keep the
+// server from draining.
+func StopLiveUpdates() {
+	liveStopOnce.Do(func() { close(liveStop) })
+}
+
+func NPMLiveHandler(w http.ResponseWriter, r *http.Request) {
+	liveHandler(w, r, models.RegistryNPM)
+}
+
+func RubyLiveHandler(w http.ResponseWriter, r *http.Request) {
+	liveHandler(w, r, models.RegistryRubyGems)
+}
+
+func PyPILiveHandler(w http.ResponseWriter, r *http.Request) {
+	liveHandler(w, r, models.RegistryPyPI)
+}
+
+// liveHandler streams the live state of registry as server-sent events: an
+// "update" event whenever it changes, at most once per liveUpdateInterval.
+func liveHandler(w http.ResponseWriter, r *http.Request, registry string) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(liveUpdateInterval)
+	defer ticker.Stop()
+	var sent uint64
+	var lastWrite time.Time
+	for {
+		var msg string
+		if update, version := liveSnapshot(registry); lastWrite.IsZero() || version != sent {
+			data, _ := json.Marshal(update)
+			msg = fmt.Sprintf("event: update\ndata: %s\n\n", data)
+			sent = version
+		} else if time.Since(lastWrite) >= liveKeepAliveInterval {
+			msg = ": keep-alive\n\n"
+		}
+		if msg != "" {
+			if _, err := io.WriteString(w, msg); err != nil || rc.Flush() != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-liveStop:
+			return
+		}
+	}
+}
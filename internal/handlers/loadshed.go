@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+)
+
+var (
+	// downloadsInFlight counts the artifact downloads being served, from
+	// the cache or upstream.
+	downloadsInFlight atomic.Int64
+	// fetchesQueued counts the cache misses waiting for an upstream
+	// download slot.
+	fetchesQueued atomic.Int64
+	// downloadsShed counts the downloads refused under overload.
+	downloadsShed atomic.Int64
+)
+
+// admitDownload counts an artifact download as in flight until release is
+// called, or refuses it with a 503 when the configured number of downloads
+// are already in flight.
+func admitDownload(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	n := downloadsInFlight.Add(1)
+	release = func() { downloadsInFlight.Add(-1) }
+	if limit := requestSettings(r.Context()).Server.LoadShedding.MaxInFlightDownloads; limit > 0 && n > int64(limit) {
+		release()
+		writeOverloaded(w, r, "Too many downloads in progress")
+		return nil, false
+	}
+	return release, true
+}
+
+// enterFetchQueue counts a cache miss as waiting for an upstream download
+// slot until leave is called. It fails when the queue is full.
+func enterFetchQueue() (leave func(), ok bool) {
+	n := fetchesQueued.Add(1)
+	leave = func() { fetchesQueued.Add(-1) }
+	if limit := config.Current().Server.LoadShedding.MaxQueuedFetches; limit > 0 && n > int64(limit) {
+		leave()
+		downloadsShed.Add(1)
+		return nil, false
+	}
+	return leave, true
+}
+
+// writeOverloaded refuses a request the proxy has no capacity for, telling
+// the client when to retry.
+func writeOverloaded(w http.ResponseWriter, r *http.Request, message string) {
+	downloadsShed.Add(1)
+	log.Printf("Shedding %s [%s]: %s", r.URL.Path, requestid.FromContext(r.Context()), message)
+	setRetryAfter(w.Header())
+	http.Error(w, message, http.StatusServiceUnavailable)
+}
+
+// writeLockUnavailable answers a download of fileName that stopped waiting
+// for its cluster lock, held by another node fetching the file, with a 503
+// telling the client when to retry. The request is still counted in flight
+// until the deferred release of admitDownload, and was never queued for an
+// upstream download slot.
+func writeLockUnavailable(w http.ResponseWriter, r *http.Request, fileName string, err error) {
+	log.Printf("Failed to take the cluster lock of %s [%s]: %v", fileName, requestid.FromContext(r.Context()), err)
+	setRetryAfter(w.Header())
+	http.Error(w, "The file is being downloaded by another node", http.StatusServiceUnavailable)
+}
+
+// setRetryAfter sets the configured Retry-After of overload responses.
+func setRetryAfter(h http.Header) {
+	if retryAfter := config.Current().Server.LoadShedding.RetryAfter.Duration; retryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+}
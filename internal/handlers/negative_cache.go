@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/cachestatus"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+)
+
+// negativeCachePruneSize is how many entries the negative cache holds before
+// expired ones are dropped.
+const negativeCachePruneSize = 10000
+
+// negativeCache holds when the upstream URLs of artifacts upstream has no
+// file for may be asked for again. In a cluster sharing Redis, the entries
+// are looked up there first.
+var (
+	negativeCache   = make(map[string]time.Time)
+	negativeCacheMu sync.Mutex
+)
+
+// knownNotFound reports whether upstream answered upstreamURL with a 404
+// within the negative cache TTL. Such 404s are cache hits.
+func knownNotFound(ctx context.Context, upstreamURL string) bool {
+	if requestSettings(ctx).Server.NegativeCacheTTL.Duration <= 0 {
+		return false
+	}
+	found := lookupNotFound(ctx, upstreamURL)
+	if found {
+		cachestatus.Set(ctx, cachestatus.Hit)
+	}
+	return found
+}
+
+func lookupNotFound(ctx context.Context, upstreamURL string) bool {
+	if cluster.Shared() {
+		found, err := cluster.HasFlag(ctx, "notfound:"+upstreamURL)
+		if err == nil {
+			return found
+		}
+		log.Printf("Failed to look up negative cache entry in Redis: %v", err)
+	}
+	negativeCacheMu.Lock()
+	defer negativeCacheMu.Unlock()
+	expires, ok := negativeCache[upstreamURL]
+	if ok && time.Now().After(expires) {
+		delete(negativeCache, upstreamURL)
+		return false
+	}
+	return ok
+}
+
+// rememberNotFound records that upstream answered upstreamURL with a 404.
+func rememberNotFound(ctx context.Context, upstreamURL string) {
+	ttl := requestSettings(ctx).Server.NegativeCacheTTL.Duration
+	if ttl <= 0 {
+		return
+	}
+	if cluster.Shared() {
+		if err := cluster.SetFlag(ctx, "notfound:"+upstreamURL, ttl); err != nil {
+			log.Printf("Failed to store negative cache entry in Redis: %v", err)
+		}
+	}
+	negativeCacheMu.Lock()
+	defer negativeCacheMu.Unlock()
+	now := time.Now()
+	if len(negativeCache) >= negativeCachePruneSize {
+		for url, expires := range negativeCache {
+			if now.After(expires) {
+				delete(negativeCache, url)
+			}
+		}
+	}
+	negativeCache[upstreamURL] = now.Add(ttl)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// streamArtifact sends upstreamURL to the client without caching it, for
+// cache misses the cache volume has no room for and artifacts configured
+// not to be cached. The download still counts as a cache miss.
+func streamArtifact(w http.ResponseWriter, r *http.Request, registry, fileName, upstreamURL string) {
+	release, err := acquireFetchSlot(r.Context(), registry, fileName)
+	if err != nil {
+		writeFetchError(w, r, fileName, err)
+		return
+	}
+	defer release()
+
+	resp, err := getUpstreamArtifact(r.Context(), upstream.Client, upstreamURL)
+	if err != nil {
+		writeFetchError(w, r, fileName, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	setUpstreamCacheStatus(w.Header(), resp.Header.Get(cacheStatusHeader))
+	setCacheStatus(r, w.Header(), false)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	if _, err := io.Copy(cw, resp.Body); err != nil {
+		log.Printf("Failed to stream %s: %v", fileName, err)
+	}
+	recordServed(r, registry, fileName, false, cw.written)
+}
+
+// noStore reports whether the artifact fileName of registry is configured
+// to be streamed through rather than cached.
+func noStore(cfg config.NoStore, registry, fileName string) bool {
+	if cfg.All {
+		return true
+	}
+	name, version := parseCachedFileName(registry, fileName)
+	if name != "" && matchesAny(cfg.Packages, name) {
+		return true
+	}
+	return version != "" && matchesAny(cfg.Versions, version)
+}
+
+// matchesAny reports whether s matches one of the path.Match patterns.
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// maxAuditRequestSize bounds the request bodies buffered for audits.
+const maxAuditRequestSize = 32 << 20
+
+// npmEmptyAuditResponses are returned when upstream cannot be consulted.
+// They report no advisories so `npm install` and `npm audit` keep working
+// in air-gapped networks.
+var npmEmptyAuditResponses = map[string]string{
+	"/-/npm/v1/security/advisories/bulk": `{}`,
+	"/-/npm/v1/security/audits":          `{"actions":[],"advisories":{},"muted":[],"metadata":{"vulnerabilities":{"info":0,"low":0,"moderate":0,"high":0,"critical":0},"dependencies":0,"devDependencies":0,"optionalDependencies":0,"totalDependencies":0}}`,
+	"/-/npm/v1/security/audits/quick":    `{"actions":[],"advisories":{},"muted":[],"metadata":{"vulnerabilities":{"info":0,"low":0,"moderate":0,"high":0,"critical":0},"dependencies":0,"devDependencies":0,"optionalDependencies":0,"totalDependencies":0}}`,
+}
+
+type auditCacheEntry struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+var (
+	auditCache   = make(map[string]auditCacheEntry)
+	auditCacheMu sync.Mutex
+)
+
+// IsNPMAuditRequest reports whether r is a security audit or bulk advisory
+// request.
+func IsNPMAuditRequest(r *http.Request) bool {
+	_, ok := npmEmptyAuditResponses[r.URL.Path]
+	return ok && r.Method == http.MethodPost
+}
+
+// NPMAuditHandler forwards audit requests upstream, caching responses for
+// identical request bodies with the same credentials for a short time. When upstream is unreachable
+// or offline mode is enabled, an empty advisory set is returned instead.
+func NPMAuditHandler(w http.ResponseWriter, r *http.Request) {
+	emptyResponse := npmEmptyAuditResponses[r.URL.Path]
+	repo := NPMRepository(r)
+
+	if repo.AuditOffline {
+		writeAuditResponse(w, http.StatusOK, "application/json", []byte(emptyResponse))
+		return
+	}
+
+	// One byte past the limit tells a body at the limit from a larger one
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditRequestSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxAuditRequestSize {
+		http.Error(w, "Audit request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Upstream may answer each credential differently, so cached responses
+	// are only served to the one they were fetched with
+	sum := sha256.Sum256(append([]byte(repo.Upstream+r.URL.Path+"\n"+r.Header.Get("Content-Encoding")+"\n"+r.Header.Get("Authorization")+"\n"), body...))
+	cacheKey := hex.EncodeToString(sum[:])
+	ttl := repo.AuditCacheTTL.Duration
+
+	if ttl > 0 {
+		auditCacheMu.Lock()
+		cached, ok := auditCache[cacheKey]
+		auditCacheMu.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			writeAuditResponse(w, cached.status, cached.contentType, cached.body)
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstream.Join(repo.Upstream, r.URL.Path), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Failed to build upstream request", http.StatusInternalServerError)
+		return
+	}
+	for _, name := range []string{"Content-Type", "Content-Encoding", "Authorization", "User-Agent", "Npm-Command", "Npm-Session"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		log.Printf("Audit upstream unavailable, returning empty advisory set: %v", err)
+		writeAuditResponse(w, http.StatusOK, "application/json", []byte(emptyResponse))
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		log.Printf("Audit upstream failed (status %d), returning empty advisory set", resp.StatusCode)
+		writeAuditResponse(w, http.StatusOK, "application/json", []byte(emptyResponse))
+		return
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if ttl > 0 && resp.StatusCode == http.StatusOK {
+		now := time.Now()
+		auditCacheMu.Lock()
+		for key, entry := range auditCache {
+			if now.After(entry.expires) {
+				delete(auditCache, key)
+			}
+		}
+		auditCache[cacheKey] = auditCacheEntry{
+			status:      resp.StatusCode,
+			contentType: contentType,
+			body:        respBody,
+			expires:     now.Add(ttl),
+		}
+		auditCacheMu.Unlock()
+	}
+
+	writeAuditResponse(w, resp.StatusCode, contentType, respBody)
+}
+
+func writeAuditResponse(w http.ResponseWriter, status int, contentType string, body []byte) {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// auditUpstream answers audits with the Authorization they were sent with,
+// counting them.
+func auditUpstream(t *testing.T) (*atomic.Int32, func()) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth":"` + r.Header.Get("Authorization") + `"}`))
+	}))
+	previous := config.NPMConfig
+	config.NPMConfig.Upstream = srv.URL
+	config.NPMConfig.AuditOffline = false
+	config.NPMConfig.AuditCacheTTL = config.Duration{Duration: time.Minute}
+	return &calls, func() {
+		config.NPMConfig = previous
+		srv.Close()
+		auditCacheMu.Lock()
+		auditCache = make(map[string]auditCacheEntry)
+		auditCacheMu.Unlock()
+	}
+}
+
+func TestNPMAuditCacheKeyedByCredential(t *testing.T) {
+	calls, cleanup := auditUpstream(t)
+	defer cleanup()
+
+	tests := []struct {
+		auth      string
+		wantCalls int32
+	}{
+		{"", 1},
+		{"", 1},
+		{"Bearer alice", 2},
+		{"Bearer alice", 2},
+		{"Bearer bob", 3},
+		{"", 3},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/-/npm/v1/security/advisories/bulk", strings.NewReader(`{"lodash":["4.17.20"]}`))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		NPMAuditHandler(w, r)
+		if want := `{"auth":"` + tt.auth + `"}`; w.Body.String() != want {
+			t.Errorf("request %d with %q answered %s, want %s", i, tt.auth, w.Body.String(), want)
+		}
+		if got := calls.Load(); got != tt.wantCalls {
+			t.Errorf("request %d with %q: %d upstream calls, want %d", i, tt.auth, got, tt.wantCalls)
+		}
+	}
+}
+
+func TestNPMAuditRequestTooLarge(t *testing.T) {
+	calls, cleanup := auditUpstream(t)
+	defer cleanup()
+
+	tests := []struct {
+		size int
+		want int
+	}{
+		{maxAuditRequestSize, http.StatusOK},
+		{maxAuditRequestSize + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/-/npm/v1/security/audits/quick", strings.NewReader(strings.Repeat(" ", tt.size)))
+		w := httptest.NewRecorder()
+		NPMAuditHandler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("body of %d bytes answered %d, want %d", tt.size, w.Code, tt.want)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d upstream calls, want only the one within the limit", calls.Load())
+	}
+}
+
+func TestNPMAuditCanceledWithClient(t *testing.T) {
+	calls, cleanup := auditUpstream(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/-/npm/v1/security/audits", strings.NewReader(`{}`))
+	NPMAuditHandler(httptest.NewRecorder(), r)
+	if calls.Load() != 0 {
+		t.Error("audit of a client gone away was sent upstream")
+	}
+}
@@ -1,46 +1,24 @@
 package handlers
 
 import (
-	"crypto/sha512"
-	"encoding/hex"
-	"io"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 
-	"github.com/pkgb-in/pkgbin/config"
-	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
 )
 
 // downloadLocks prevents concurrent downloads of the same file
 var downloadLocks = make(map[string]*sync.Mutex)
 var downloadLocksMutex sync.Mutex
 
-// generateCacheFileName creates a unique filename from npm URL path
-// Handles scoped packages like @types/package-name
-func generateCacheFileName(urlPath string) string {
-	// Remove leading slash
-	urlPath = strings.TrimPrefix(urlPath, "/")
-
-	// For scoped packages like /@types/html-minifier-terser/-/html-minifier-terser-6.1.0.tgz
-	// Extract scope and tarball name
-	if strings.HasPrefix(urlPath, "@") {
-		parts := strings.Split(urlPath, "/-/")
-		if len(parts) == 2 {
-			scope := strings.TrimPrefix(parts[0], "@")
-			scope = strings.ReplaceAll(scope, "/", "__")
-			tarballName := filepath.Base(parts[1])
-			return "@" + scope + "__" + tarballName
-		}
-	}
-
-	// For regular packages, just use the tarball name
-	return filepath.Base(urlPath)
-}
-
 // func HandleMetadata(w http.ResponseWriter, r *http.Request) {
 
 // 	Upstream := config.NPMConfig.Upstream
@@ -99,15 +77,58 @@ func generateCacheFileName(urlPath string) string {
 // }
 
 func HandleTarballDownload(w http.ResponseWriter, r *http.Request) {
+	release, ok := admitDownload(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
 
-	Upstream := config.NPMConfig.Upstream
-	CacheDir := config.NPMConfig.CacheDir
+	repo := NPMRepository(r)
+	Upstream := NPMUpstreamForPath(repo, r.URL.Path)
+	CacheDir := repo.CacheDir
 
 	// Extract unique filename preserving scoped packages
 	// e.g., /@types/html-minifier-terser/-/html-minifier-terser-6.1.0.tgz
 	// becomes: @types__html-minifier-terser-6.1.0.tgz
-	fileName := generateCacheFileName(r.URL.Path)
+	fileName := cachekey.NPM(r.URL.Path)
 	localPath := filepath.Join(CacheDir, fileName)
+	upstreamURL := upstream.Join(Upstream, r.URL.Path)
+
+	// Tarballs of other hosts are fetched from there, when allowed
+	if IsNPMRemoteTarballRequest(r) {
+		remoteURL, ok := npmRemoteTarballURL(r.URL.EscapedPath())
+		if u, err := url.Parse(remoteURL); !ok || err != nil || !npmTarballHostAllowed(repo, u.Hostname()) {
+			writeNPMError(w, http.StatusNotFound, "tarball host is not in tarball_hosts")
+			return
+		}
+		upstreamURL = remoteURL
+	}
+
+	// Locally published packages are never fetched from upstream
+	if publishedPath := npmLocalTarballPath(repo, fileName); repo.LocalDir != "" {
+		if stat, err := os.Stat(publishedPath); err == nil && stat.Size() > 0 {
+			log.Printf("Serving locally published package: %s", fileName)
+			recordAccess(models.RegistryNPM, fileName, true)
+			serveArtifact(w, r, models.RegistryNPM, fileName, publishedPath, true)
+			return
+		}
+	}
+
+	// Refuse versions with known vulnerabilities above the block threshold
+	scanTarget := npmScanTarget(r, fileName)
+	if message, blocked := vulnerabilityDenial(repo.Vulnerabilities, scanTarget); blocked {
+		writeNPMError(w, http.StatusForbidden, message)
+		return
+	}
+
+	// Paths sharing the key of another never use its cached file
+	if cacheKeyTaken(r, models.RegistryNPM, fileName) {
+		streamArtifact(w, r, models.RegistryNPM, fileName, upstreamURL)
+		return
+	}
 
 	// Check local cache and verify integrity
 	if stat, err := os.Stat(localPath); err == nil && stat.Size() > 0 {
@@ -115,8 +136,8 @@ func HandleTarballDownload(w http.ResponseWriter, r *http.Request) {
 		if file, err := os.Open(localPath); err == nil {
 			file.Close()
 			log.Printf("Serving from cache: %s", fileName)
-			repositories.PackageRepo.UpdatePackageAccess(fileName, true)
-			http.ServeFile(w, r, localPath)
+			recordAccess(models.RegistryNPM, fileName, true)
+			serveArtifact(w, r, models.RegistryNPM, fileName, localPath, true)
 			return
 		} else {
 			// File exists but can't be read - delete it
@@ -125,6 +146,14 @@ func HandleTarballDownload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Read-only replicas have their writer fetch and cache misses
+	if readOnlyReplica() {
+		log.Printf("Cache miss: Fetching %s from the writer", fileName)
+		defer beginLiveDownload(r, models.RegistryNPM, fileName, false)()
+		streamArtifact(w, r, models.RegistryNPM, fileName, replicaWriterURL(r))
+		return
+	}
+
 	// Get or create a lock for this specific file to prevent concurrent downloads
 	downloadLocksMutex.Lock()
 	lock, exists := downloadLocks[fileName]
@@ -138,68 +167,78 @@ func HandleTarballDownload(w http.ResponseWriter, r *http.Request) {
 	lock.Lock()
 	defer lock.Unlock()
 
+	// And across the other nodes of a cluster sharing the cache
+	unlockCluster, err := cluster.Lock(r.Context(), models.RegistryNPM+"/"+fileName)
+	if err != nil {
+		writeLockUnavailable(w, r, fileName, err)
+		return
+	}
+	defer unlockCluster()
+
+	// A path sharing the key may have cached its file in the meantime
+	if cacheKeyTaken(r, models.RegistryNPM, fileName) {
+		streamArtifact(w, r, models.RegistryNPM, fileName, upstreamURL)
+		return
+	}
+
 	// Double-check cache after acquiring lock (another request may have downloaded it)
 	if stat, err := os.Stat(localPath); err == nil && stat.Size() > 0 {
 		if file, err := os.Open(localPath); err == nil {
 			file.Close()
 			log.Printf("Serving from cache (after lock): %s", fileName)
-			repositories.PackageRepo.UpdatePackageAccess(fileName, true)
-			http.ServeFile(w, r, localPath)
+			recordAccess(models.RegistryNPM, fileName, true)
+			serveArtifact(w, r, models.RegistryNPM, fileName, localPath, true)
 			return
 		}
 	}
 
 	// Cache miss: Fetch from upstream
 	log.Printf("Cache miss: Fetching %s", fileName)
-	repositories.PackageRepo.UpdatePackageAccess(fileName, false)
-	resp, err := http.Get(Upstream + r.URL.Path)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Upstream fetch failed", http.StatusBadGateway)
+	recordAccess(models.RegistryNPM, fileName, false)
+	defer beginLiveDownload(r, models.RegistryNPM, fileName, false)()
+
+	// Send the file without caching it when configured so or when the
+	// cache volume is full
+	if noStore(repo.NoStore, models.RegistryNPM, fileName) || !cacheHasSpace(r, models.RegistryNPM, CacheDir) {
+		streamArtifact(w, r, models.RegistryNPM, fileName, upstreamURL)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Use temporary file for atomic write
-	tempPath := localPath + ".tmp"
-	outFile, err := os.Create(tempPath)
-	if err != nil {
-		http.Error(w, "File creation failed", http.StatusInternalServerError)
+	// Look up the integrity declared in the packument so corrupted or
+	// tampered tarballs never reach the cache
+	expected, err := npmExpectedDigest(r.Context(), Upstream, r.URL.Path, repo.VerifySignatures)
+	if err != nil && repo.VerifySignatures {
+		log.Printf("Refusing %s, its registry signature could not be verified: %v", fileName, err)
+		writeNPMError(w, http.StatusBadGateway, "registry signature verification failed")
 		return
 	}
-
-	// Download completely to temp file first with integrity check
-	hash := sha512.New()
-	multiWriter := io.MultiWriter(outFile, hash)
-	bytesWritten, err := io.Copy(multiWriter, resp.Body)
-	outFile.Close()
-
-	if err != nil {
-		os.Remove(tempPath)
-		http.Error(w, "Download failed", http.StatusInternalServerError)
-		log.Printf("Download error for %s: %v", fileName, err)
+	// Clients choose the packument a remote tarball is looked up in, so
+	// one it does not list the digest of is never cached
+	if expected == nil && IsNPMRemoteTarballRequest(r) {
+		log.Printf("Not caching remote tarball %s, the packument lists no checksum of it", fileName)
+		streamArtifact(w, r, models.RegistryNPM, fileName, upstreamURL)
 		return
 	}
+	if err != nil {
+		log.Printf("Could not determine expected checksum for %s, caching unverified: %v", fileName, err)
+	}
 
-	// Verify file was written completely
-	if stat, err := os.Stat(tempPath); err != nil || stat.Size() != bytesWritten {
-		os.Remove(tempPath)
-		http.Error(w, "File write verification failed", http.StatusInternalServerError)
-		log.Printf("Size mismatch for %s: expected %d, got %d", fileName, bytesWritten, stat.Size())
+	artifact, err := fetchArtifact(r.Context(), models.RegistryNPM, upstream.Client, upstreamURL, localPath, expected, repo.MaxArtifactSize)
+	if errors.Is(err, errArtifactTooLarge) && !repo.RejectOversized {
+		log.Printf("Not caching %s, larger than %d bytes", fileName, repo.MaxArtifactSize)
+		streamArtifact(w, r, models.RegistryNPM, fileName, upstreamURL)
 		return
 	}
-
-	// Atomically move temp file to final location
-	if err := os.Rename(tempPath, localPath); err != nil {
-		os.Remove(tempPath)
-		http.Error(w, "File move failed", http.StatusInternalServerError)
-		log.Printf("Failed to move temp file for %s: %v", fileName, err)
+	if err != nil {
+		writeFetchError(w, r, fileName, err)
 		return
 	}
+	recordArtifact(models.RegistryNPM, fileName, artifact)
+	claimCacheKey(r, models.RegistryNPM, fileName)
+	setUpstreamCacheStatus(w.Header(), artifact.UpstreamCacheStatus)
 
-	// Log the file hash for debugging
-	fileHash := hex.EncodeToString(hash.Sum(nil))
-	log.Printf("Cached %s (size: %d bytes, sha512: %s)", fileName, bytesWritten, fileHash[:16]+"...")
+	scanOnCacheMiss(repo.Vulnerabilities, scanTarget)
 
 	// Serve the newly cached file
-	http.ServeFile(w, r, localPath)
+	serveArtifact(w, r, models.RegistryNPM, fileName, localPath, false)
 }
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/metacache"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// npmMetadataStores cache packuments on disk keyed by package name, one
+// store per repository metadata directory
+var npmMetadataStores = make(map[string]*metacache.Store)
+
+// npmAbbreviatedMediaType is the Accept/Content-Type of abbreviated
+// ("corgi") packuments, which only carry the fields needed for installs.
+const npmAbbreviatedMediaType = "application/vnd.npm.install-v1+json"
+
+// npmAbbreviatedKeyPrefix keeps abbreviated packuments apart from full ones
+// in the metadata cache.
+const npmAbbreviatedKeyPrefix = "corgi:"
+
+// InitNPMMetadataCache prepares the on-disk caches used for npm packuments
+// of the default and every named repository.
+func InitNPMMetadataCache() error {
+	for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+		store, err := metacache.New(repo.MetadataDir)
+		if err != nil {
+			return err
+		}
+		npmMetadataStores[repo.MetadataDir] = store
+	}
+	return nil
+}
+
+// npmMetadataStore returns the packument cache of repo.
+func npmMetadataStore(repo *config.NPMProxyConfig) *metacache.Store {
+	return npmMetadataStores[repo.MetadataDir]
+}
+
+// NPMProxyAddr is the base URL written into rewritten metadata documents
+// for the repository r was made to.
+func NPMProxyAddr(r *http.Request) string {
+	return ExternalBaseURL(r)
+}
+
+// parseNPMPackagePath returns the package name addressed by a metadata path
+// such as /lodash, /@types/node or /@types%2fnode (already decoded by
+// net/http). Registry API paths under /-/ and version documents are not
+// packuments.
+func parseNPMPackagePath(path string) (string, bool) {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" || strings.HasPrefix(path, "-/") {
+		return "", false
+	}
+	segments := strings.Split(path, "/")
+	if strings.HasPrefix(path, "@") {
+		if len(segments) != 2 || segments[1] == "" {
+			return "", false
+		}
+		return path, true
+	}
+	if len(segments) != 1 {
+		return "", false
+	}
+	return path, true
+}
+
+// npmDistTagsPath matches /-/package/<name>/dist-tags[/<tag>].
+var npmDistTagsPath = regexp.MustCompile(`^/-/package/((?:@[^/]+/)?[^/@][^/]*)/dist-tags(?:/[^/]+)?$`)
+
+// IsNPMMetadataRequest reports whether r is a cacheable metadata read:
+// a packument or the dist-tags listing of a package. Reads made to write
+// the packument back go upstream.
+func IsNPMMetadataRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || IsNPMWriteRequest(r) {
+		return false
+	}
+	if _, ok := parseNPMPackagePath(r.URL.Path); ok {
+		return true
+	}
+	m := npmDistTagsPath.FindStringSubmatch(r.URL.Path)
+	return m != nil && strings.HasSuffix(r.URL.Path, "/dist-tags")
+}
+
+// NPMMetadataHandler serves packuments from the metadata cache, revalidating
+// them upstream with If-None-Match once older than the configured TTL.
+// Dist-tag listings are answered from the same cached packument so they stay
+// consistent with what installs resolve "latest" to.
+func NPMMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	pkgName, isPackument := parseNPMPackagePath(r.URL.Path)
+	if !isPackument {
+		pkgName = npmDistTagsPath.FindStringSubmatch(r.URL.Path)[1]
+	}
+
+	// The dist-tags listing is always taken from the full packument
+	repo := NPMRepository(r)
+	abbreviated := isPackument && wantsAbbreviatedPackument(r)
+	doc, err := loadNPMPackument(r.Context(), repo, pkgName, abbreviated)
+	if err != nil {
+		var statusErr *metacache.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Not found"}`))
+			return
+		}
+		log.Printf("Failed to fetch packument for %s [%s]: %v", pkgName, requestid.FromContext(r.Context()), err)
+		http.Error(w, "Failed to fetch metadata from upstream", http.StatusBadGateway)
+		return
+	}
+
+	if doc.stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	w.Header().Set("Vary", "Accept")
+	if isPackument && doc.body == nil {
+		serveNPMCachedPackument(w, r, repo, pkgName, doc)
+		return
+	}
+
+	body := doc.body
+	contentType := doc.contentType
+	if !isPackument {
+		if body == nil {
+			if body, err = npmMetadataStore(repo).ReadAll(doc.entry.Key); err != nil {
+				http.Error(w, "Cached metadata unavailable", http.StatusInternalServerError)
+				return
+			}
+		}
+		var tags struct {
+			DistTags json.RawMessage `json:"dist-tags"`
+		}
+		if err := json.Unmarshal(body, &tags); err != nil || tags.DistTags == nil {
+			http.Error(w, "Cached packument has no dist-tags", http.StatusBadGateway)
+			return
+		}
+		body = tags.DistTags
+		contentType = "application/json"
+	} else {
+		// Point tarball URLs at this proxy
+		body = RewriteNPMUpstreamURLs(repo, body, NPMProxyAddr(r), pkgName)
+	}
+
+	// The ETag covers the body as sent, after the URL rewriting and
+	// compression, so it changes with the address clients reach the proxy
+	// at and with the content coding
+	sum := md5.Sum(body)
+	etag := hex.EncodeToString(sum[:])
+	w.Header().Set("Content-Type", contentType)
+	body = CompressMetadata(r, w.Header(), body)
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		etag += "-gzip"
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	doc.entry.WriteCacheHeaders(w.Header())
+	http.ServeContent(w, r, "", doc.modTime, bytes.NewReader(body))
+}
+
+// serveNPMCachedPackument streams the cached upstream packument of doc with
+// its tarball URLs pointed at this proxy, without holding it in memory. The
+// ETag is derived from the cached body and what the rewriting depends on, so
+// it matches the one the bytes sent would get.
+func serveNPMCachedPackument(w http.ResponseWriter, r *http.Request, repo *config.NPMProxyConfig, pkgName string, doc npmPackumentDoc) {
+	f, err := npmMetadataStore(repo).Open(doc.entry.Key)
+	if err != nil {
+		http.Error(w, "Cached metadata unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	proxyAddr := NPMProxyAddr(r)
+	w.Header().Set("Content-Type", doc.contentType)
+	out, closeOut := metadataWriter(r, w.Header(), w, doc.entry.Size)
+	sum := md5.Sum([]byte(doc.entry.MD5 + "\x00" + proxyAddr))
+	etag := hex.EncodeToString(sum[:])
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		etag += "-gzip"
+	}
+	etag = `"` + etag + `"`
+	w.Header().Set("ETag", etag)
+	doc.entry.WriteCacheHeaders(w.Header())
+	w.Header().Set("Last-Modified", doc.modTime.UTC().Format(http.TimeFormat))
+
+	if npmETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	rw := NewNPMURLRewriter(repo, out, proxyAddr, pkgName)
+	if _, err := io.Copy(rw, f); err == nil {
+		if err = rw.Close(); err == nil {
+			closeOut()
+		}
+	}
+}
+
+// npmETagMatches reports whether the If-None-Match header value matches
+// etag, weakly as RFC 9110 asks for that header.
+func npmETagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// npmPackumentDoc is a packument ready to be served, either straight from
+// the metadata cache or merged with locally published versions.
+type npmPackumentDoc struct {
+	// body is only set for merged packuments; cached ones are streamed
+	// from the store
+	body        []byte
+	contentType string
+	modTime     time.Time
+	stale       bool
+	// entry is the cached upstream packument served as is, whose caching
+	// headers are forwarded; it is zero for merged packuments
+	entry metacache.Entry
+}
+
+// loadNPMPackument returns the packument for pkgName. Packages with locally
+// published versions are merged over the upstream packument, and served
+// even when upstream does not know the package at all.
+func loadNPMPackument(ctx context.Context, repo *config.NPMProxyConfig, pkgName string, abbreviated bool) (npmPackumentDoc, error) {
+	local, hasLocal, err := readNPMLocalPackument(repo, pkgName)
+	if err != nil {
+		return npmPackumentDoc{}, err
+	}
+
+	// Local versions are only kept in full form, so merged documents are
+	// always full packuments, which every client accepts
+	entry, stale, err := fetchNPMPackument(ctx, repo, pkgName, abbreviated && !hasLocal)
+	if err != nil && !hasLocal {
+		return npmPackumentDoc{}, err
+	}
+
+	if !hasLocal {
+		contentType := entry.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		return npmPackumentDoc{contentType: contentType, modTime: entry.FetchedAt, stale: stale, entry: entry}, nil
+	}
+
+	var upstream []byte
+	if err != nil {
+		var statusErr *metacache.StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			log.Printf("Serving local versions only for %s, upstream packument unavailable: %v", pkgName, err)
+		}
+	} else if upstream, err = npmMetadataStore(repo).ReadAll(entry.Key); err != nil {
+		return npmPackumentDoc{}, err
+	}
+
+	body, err := mergeNPMPackuments(upstream, local)
+	if err != nil {
+		return npmPackumentDoc{}, err
+	}
+	return npmPackumentDoc{
+		body:        body,
+		contentType: "application/json",
+		modTime:     time.Now(),
+		stale:       stale,
+	}, nil
+}
+
+// wantsAbbreviatedPackument reports whether the client asked for the
+// abbreviated packument, as npm, yarn and pnpm do during installs.
+func wantsAbbreviatedPackument(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), npmAbbreviatedMediaType)
+}
+
+// fetchNPMPackument returns the cached full or abbreviated packument for
+// pkgName. The two variants are fetched and cached independently.
+func fetchNPMPackument(ctx context.Context, repo *config.NPMProxyConfig, pkgName string, abbreviated bool) (metacache.Entry, bool, error) {
+	upstreamURL := upstream.Join(NPMUpstreamFor(repo, pkgName), "/"+url.PathEscape(pkgName))
+	key, accept := pkgName, "application/json"
+	if abbreviated {
+		key, accept = npmAbbreviatedKeyPrefix+pkgName, npmAbbreviatedMediaType
+	}
+	header := http.Header{"Accept": []string{accept}}
+	return npmMetadataStore(repo).Fetch(ctx, metadataClient, key, upstreamURL, header, repo.MetadataTTL.Duration)
+}
+
+// InvalidateNPMMetadata drops both cached packument variants for pkgName so
+// the next read goes upstream, e.g. after a dist-tag change, publish or purge.
+func InvalidateNPMMetadata(repo *config.NPMProxyConfig, pkgName string) {
+	store := npmMetadataStore(repo)
+	if store == nil || pkgName == "" {
+		return
+	}
+	for _, key := range []string{pkgName, npmAbbreviatedKeyPrefix + pkgName} {
+		unlock := store.Lock(key)
+		if err := store.Invalidate(key); err != nil {
+			log.Printf("Failed to invalidate cached packument %s: %v", key, err)
+		}
+		unlock()
+	}
+}
+
+// InvalidateNPMMetadataForRequest drops the cached packument a mutating
+// request (publish, unpublish, dist-tag or deprecation change) applies to.
+func InvalidateNPMMetadataForRequest(r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return
+	}
+	repo := NPMRepository(r)
+	if m := npmDistTagsPath.FindStringSubmatch(r.URL.Path); m != nil {
+		InvalidateNPMMetadata(repo, m[1])
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(path, "-/") {
+		return
+	}
+	// Publishes and unpublishes address /<name>[/-rev/<rev>]
+	segments := strings.Split(path, "/")
+	if strings.HasPrefix(path, "@") && len(segments) >= 2 {
+		InvalidateNPMMetadata(repo, segments[0]+"/"+segments[1])
+	} else if len(segments) >= 1 {
+		InvalidateNPMMetadata(repo, segments[0])
+	}
+}
+
+// npmTarballFileName matches cached tarball names such as lodash-4.17.21.tgz
+// or @types__node-20.1.0.tgz; the version is the first dash-separated
+// segment that looks like a semver.
+var npmTarballFileName = regexp.MustCompile(`^(.+?)-(\d+\.\d+\.\d+.*)\.tgz$`)
+
+// npmPackageFromCacheFileName maps a cached tarball filename back to the
+// package name it belongs to.
+func npmPackageFromCacheFileName(fileName string) (string, bool) {
+	m := npmTarballFileName.FindStringSubmatch(fileName)
+	if m == nil {
+		return "", false
+	}
+	name := m[1]
+	if strings.HasPrefix(name, "@") {
+		scope, pkg, found := strings.Cut(name, "__")
+		if !found {
+			return "", false
+		}
+		name = scope + "/" + pkg
+	}
+	return name, true
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+)
+
+// maxPublishRequestSize bounds the JSON document (including base64 encoded
+// tarballs) accepted from `npm publish`.
+const maxPublishRequestSize = 256 << 20
+
+// npmPublishLocks serializes publishes to the same package
+var npmPublishLocks = make(map[string]*sync.Mutex)
+var npmPublishLocksMutex sync.Mutex
+
+// npmPublishDocument is the body `npm publish` sends to PUT /<name>.
+type npmPublishDocument struct {
+	Name        string                     `json:"name"`
+	DistTags    map[string]string          `json:"dist-tags"`
+	Versions    map[string]json.RawMessage `json:"versions"`
+	Attachments map[string]struct {
+		ContentType string `json:"content_type"`
+		Data        string `json:"data"`
+		Length      int64  `json:"length"`
+	} `json:"_attachments"`
+}
+
+// attachment returns the decoded tarball attached as name.
+func (doc *npmPublishDocument) attachment(name string) ([]byte, error) {
+	attachment, ok := doc.Attachments[name]
+	if !ok {
+		return nil, fmt.Errorf("missing attachment %s", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(attachment.Data)
+	if err != nil {
+		return nil, fmt.Errorf("attachment %s is not valid base64", name)
+	}
+	return data, nil
+}
+
+// npmLocalPackument is the packument of the locally published versions of
+// a package, decoded for updating.
+type npmLocalPackument struct {
+	doc      map[string]json.RawMessage
+	versions map[string]json.RawMessage
+	distTags map[string]string
+	times    map[string]string
+}
+
+// loadNPMLocalPackument returns the packument of locally published versions
+// of pkgName, empty when there are none yet.
+func loadNPMLocalPackument(repo *config.NPMProxyConfig, pkgName string) (*npmLocalPackument, error) {
+	p := &npmLocalPackument{
+		doc:      map[string]json.RawMessage{},
+		versions: map[string]json.RawMessage{},
+		distTags: map[string]string{},
+		times:    map[string]string{},
+	}
+	data, ok, err := readNPMLocalPackument(repo, pkgName)
+	if err != nil || !ok {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p.doc); err != nil {
+		return nil, fmt.Errorf("corrupted local packument: %w", err)
+	}
+	json.Unmarshal(p.doc["versions"], &p.versions)
+	json.Unmarshal(p.doc["dist-tags"], &p.distTags)
+	json.Unmarshal(p.doc["time"], &p.times)
+	return p, nil
+}
+
+// save writes the packument of pkgName, modified at now.
+func (p *npmLocalPackument) save(repo *config.NPMProxyConfig, pkgName, now string) error {
+	if _, ok := p.times["created"]; !ok {
+		p.times["created"] = now
+	}
+	p.times["modified"] = now
+
+	p.doc["_id"], _ = json.Marshal(pkgName)
+	p.doc["name"], _ = json.Marshal(pkgName)
+	p.doc["versions"], _ = marshalJSONNoEscape(p.versions)
+	p.doc["dist-tags"], _ = json.Marshal(p.distTags)
+	p.doc["time"], _ = json.Marshal(p.times)
+
+	data, err := marshalJSONNoEscape(p.doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(npmLocalPackumentPath(repo, pkgName), data)
+}
+
+// npmPublishLock returns the lock serializing changes to the local
+// packument of pkgName.
+func npmPublishLock(pkgName string) *sync.Mutex {
+	npmPublishLocksMutex.Lock()
+	defer npmPublishLocksMutex.Unlock()
+	lock, exists := npmPublishLocks[pkgName]
+	if !exists {
+		lock = &sync.Mutex{}
+		npmPublishLocks[pkgName] = lock
+	}
+	return lock
+}
+
+// npmLocalPackumentPath is where the packument of locally published
+// versions of pkgName is stored.
+func npmLocalPackumentPath(repo *config.NPMProxyConfig, pkgName string) string {
+	return filepath.Join(repo.LocalDir, url.PathEscape(pkgName)+".json")
+}
+
+// npmLocalTarballPath is where a locally published tarball is stored; it
+// uses the same naming as the tarball cache.
+func npmLocalTarballPath(repo *config.NPMProxyConfig, fileName string) string {
+	return filepath.Join(repo.LocalDir, "tarballs", fileName)
+}
+
+// readNPMLocalPackument returns the packument of locally published versions
+// of pkgName, if there are any.
+func readNPMLocalPackument(repo *config.NPMProxyConfig, pkgName string) ([]byte, bool, error) {
+	if repo.LocalDir == "" {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(npmLocalPackumentPath(repo, pkgName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// mergeNPMPackuments overlays locally published versions, dist-tags and
+// publish times onto the upstream packument. Local versions win over
+// upstream ones with the same number. upstream may be empty for packages
+// only known locally.
+func mergeNPMPackuments(upstream, local []byte) ([]byte, error) {
+	merged := make(map[string]json.RawMessage)
+	if len(upstream) > 0 {
+		if err := json.Unmarshal(upstream, &merged); err != nil {
+			return nil, fmt.Errorf("decoding upstream packument: %w", err)
+		}
+	}
+	var localDoc map[string]json.RawMessage
+	if err := json.Unmarshal(local, &localDoc); err != nil {
+		return nil, fmt.Errorf("decoding local packument: %w", err)
+	}
+
+	for key, value := range localDoc {
+		switch key {
+		case "versions", "dist-tags", "time":
+			combined, err := mergeJSONObjects(merged[key], value)
+			if err != nil {
+				return nil, fmt.Errorf("merging %s: %w", key, err)
+			}
+			merged[key] = combined
+		default:
+			if _, exists := merged[key]; !exists {
+				merged[key] = value
+			}
+		}
+	}
+	return marshalJSONNoEscape(merged)
+}
+
+// mergeJSONObjects returns base with every key of overlay set on it.
+func mergeJSONObjects(base, overlay json.RawMessage) (json.RawMessage, error) {
+	combined := make(map[string]json.RawMessage)
+	if len(base) > 0 {
+		if err := json.Unmarshal(base, &combined); err != nil {
+			return nil, err
+		}
+	}
+	var extra map[string]json.RawMessage
+	if err := json.Unmarshal(overlay, &extra); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		combined[key] = value
+	}
+	return marshalJSONNoEscape(combined)
+}
+
+// npmPublishAllowed reports whether pkgName may be published locally.
+func npmPublishAllowed(repo *config.NPMProxyConfig, pkgName string) bool {
+	for _, scope := range repo.PublishScopes {
+		if scope == "*" || strings.HasPrefix(pkgName, strings.TrimSuffix(scope, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// npmPublishAuthorized checks the bearer token when publish tokens are
+// configured. Admin tokens with the publish permission are accepted too.
+func npmPublishAuthorized(r *http.Request) bool {
+	tokens := NPMRepository(r).PublishTokens
+	if len(tokens) == 0 {
+		return true
+	}
+	if adminAuthorized(r, config.PermissionPublish) {
+		return true
+	}
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, secret := range tokens {
+		token, err := secret.Value()
+		if err != nil {
+			log.Printf("Failed to resolve npm publish token: %v", err)
+			continue
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNPMPublishRequest reports whether r is an `npm publish` of a package
+// that is hosted locally.
+func IsNPMPublishRequest(r *http.Request) bool {
+	if r.Method != http.MethodPut {
+		return false
+	}
+	pkgName, ok := parseNPMPackagePath(r.URL.Path)
+	return ok && npmPublishAllowed(NPMRepository(r), pkgName)
+}
+
+// NPMPublishHandler stores the versions and tarballs of an `npm publish`
+// in the local package store. Publishing over an existing local version is
+// rejected, like the public registry does.
+func NPMPublishHandler(w http.ResponseWriter, r *http.Request) {
+	pkgName, _ := parseNPMPackagePath(r.URL.Path)
+	repo := NPMRepository(r)
+
+	if !npmPublishAuthorized(r) {
+		writeNPMError(w, http.StatusUnauthorized, "invalid or missing publish token")
+		return
+	}
+	if readOnlyReplica() {
+		writeNPMError(w, http.StatusForbidden, "this instance is a read-only replica, publish to "+config.Server.ReplicaOf)
+		return
+	}
+
+	var doc npmPublishDocument
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPublishRequestSize)).Decode(&doc); err != nil {
+		writeNPMError(w, http.StatusBadRequest, "invalid publish document")
+		return
+	}
+	if doc.Name != pkgName {
+		writeNPMError(w, http.StatusBadRequest, "package name does not match request path")
+		return
+	}
+	if len(doc.Versions) == 0 {
+		writeNPMError(w, http.StatusBadRequest, "no versions to publish")
+		return
+	}
+
+	lock := npmPublishLock(pkgName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	local, err := loadNPMLocalPackument(repo, pkgName)
+	if err != nil {
+		log.Printf("Failed to read local packument for %s: %v", pkgName, err)
+		writeNPMError(w, http.StatusInternalServerError, "failed to read local packument")
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for version, raw := range doc.Versions {
+		if _, exists := local.versions[version]; exists {
+			writeNPMError(w, http.StatusConflict, "cannot publish over previously published version "+version)
+			return
+		}
+		stored, err := storeNPMPublishedVersion(repo, pkgName, raw, doc.attachment)
+		if err != nil {
+			log.Printf("Rejected publish of %s@%s: %v", pkgName, version, err)
+			writeNPMError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		local.versions[version] = stored
+		local.times[version] = now
+	}
+	for tag, version := range doc.DistTags {
+		local.distTags[tag] = version
+	}
+	if err := local.save(repo, pkgName, now); err != nil {
+		log.Printf("Failed to write local packument for %s: %v", pkgName, err)
+		writeNPMError(w, http.StatusInternalServerError, "failed to store local packument")
+		return
+	}
+
+	InvalidateNPMMetadata(repo, pkgName)
+	log.Printf("Published %s locally (%d version(s))", pkgName, len(doc.Versions))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "id": pkgName})
+}
+
+// storeNPMPublishedVersion verifies and writes the tarball of one published
+// version, which tarball returns by name, and returns the version document with its
+// tarball URL pointing at the registry path this proxy serves it from.
+func storeNPMPublishedVersion(repo *config.NPMProxyConfig, pkgName string, raw json.RawMessage, tarball func(name string) ([]byte, error)) (json.RawMessage, error) {
+	var version map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return nil, fmt.Errorf("invalid version document")
+	}
+	var dist struct {
+		Tarball   string `json:"tarball"`
+		Shasum    string `json:"shasum"`
+		Integrity string `json:"integrity"`
+	}
+	if err := json.Unmarshal(version["dist"], &dist); err != nil || dist.Tarball == "" {
+		return nil, fmt.Errorf("version document has no dist.tarball")
+	}
+
+	tarballName := path.Base(dist.Tarball)
+	data, err := tarball(tarballName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the tarball against the integrity the client computed
+	expected := parseSRI(dist.Integrity)
+	if expected == nil && dist.Shasum != "" {
+		if value, err := hex.DecodeString(dist.Shasum); err == nil {
+			expected = &expectedDigest{Algorithm: "sha1", Value: value}
+		}
+	}
+	hasher := newArtifactHasher()
+	hasher.Write(data)
+	if err := hasher.verify(expected); err != nil {
+		return nil, fmt.Errorf("tarball %s failed integrity check", tarballName)
+	}
+
+	registryPath := "/" + pkgName + "/-/" + tarballName
+	fileName := cachekey.NPM(registryPath)
+	if err := writeFileAtomic(npmLocalTarballPath(repo, fileName), data); err != nil {
+		return nil, fmt.Errorf("failed to store tarball %s", tarballName)
+	}
+
+	var distDoc map[string]json.RawMessage
+	json.Unmarshal(version["dist"], &distDoc)
+	// Stored relative to the upstream URL so the usual metadata rewrite
+	// points it at whichever address clients reach this proxy on
+	distDoc["tarball"], _ = json.Marshal(repo.Upstream + registryPath)
+	version["dist"], _ = marshalJSONNoEscape(distDoc)
+	return marshalJSONNoEscape(version)
+}
+
+// writeFileAtomic writes data to path through a temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tempPath := path + janitor.TempSuffix
+	defer janitor.Track(tempPath)()
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// writeNPMError writes an error in the JSON shape npm clients display.
+func writeNPMError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+)
+
+// npmTarballMember starts the dist.tarball members of packuments.
+var npmTarballMember = []byte(`"tarball"`)
+
+// npmMaxTarballValue bounds how much of a tarball member split across
+// writes is held back; longer values are passed through untouched.
+const npmMaxTarballValue = 64 << 10
+
+// IsNPMRemoteTarballRequest reports whether r reads a tarball the proxy
+// fetches from another host than the registry.
+func IsNPMRemoteTarballRequest(r *http.Request) bool {
+	return strings.Contains(r.URL.Path, cachekey.NPMRemoteSegment)
+}
+
+// npmRemoteTarballURL returns the URL of the tarball a remote tarball path
+// such as /pkg/-/remote/https/codeload.github.com/u/r/tar.gz/v1 stands
+// for, false when urlPath is not one.
+func npmRemoteTarballURL(urlPath string) (string, bool) {
+	_, remote, ok := strings.Cut(urlPath, cachekey.NPMRemoteSegment)
+	if !ok {
+		return "", false
+	}
+	scheme, hostPath, _ := strings.Cut(remote, "/")
+	host, _, _ := strings.Cut(hostPath, "/")
+	if (scheme != "https" && scheme != "http") || host == "" {
+		return "", false
+	}
+	return scheme + "://" + hostPath, true
+}
+
+// npmTarballHostAllowed reports whether tarball_hosts of repo lists host.
+func npmTarballHostAllowed(repo *config.NPMProxyConfig, host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range repo.TarballHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// npmRemoteTarballRewrite returns what the dist.tarball URLs of pkgName
+// on the allowed hosts of repo become: the remote tarball paths of this
+// proxy at proxyAddr. URLs of the upstreams are left to the usual rewrite.
+func npmRemoteTarballRewrite(repo *config.NPMProxyConfig, proxyAddr, pkgName string) func(tarball string) (string, bool) {
+	bases := []string{repo.Upstream}
+	for _, route := range repo.Routes {
+		bases = append(bases, route.Upstream)
+	}
+	return func(tarball string) (string, bool) {
+		for _, base := range bases {
+			if strings.HasPrefix(tarball, strings.TrimSuffix(base, "/")+"/") {
+				return "", false
+			}
+		}
+		u, err := url.Parse(tarball)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return "", false
+		}
+		if !npmTarballHostAllowed(repo, u.Hostname()) {
+			return "", false
+		}
+		return proxyAddr + "/" + pkgName + cachekey.NPMRemoteSegment + u.Scheme + "/" + u.Host + u.EscapedPath(), true
+	}
+}
+
+// tarballWriter rewrites the dist.tarball URLs of the packument written
+// through it with rewrite, parsing each as the JSON string it is. Only a
+// tarball member split across writes is held back.
+type tarballWriter struct {
+	w       io.Writer
+	rewrite func(tarball string) (string, bool)
+	buf     []byte
+}
+
+func (tw *tarballWriter) Write(p []byte) (int, error) {
+	tw.buf = append(tw.buf, p...)
+	if err := tw.flush(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes out what was held back. It does not close the underlying
+// writer.
+func (tw *tarballWriter) Close() error {
+	return tw.flush(true)
+}
+
+// flush writes the buffered bytes with their tarball URLs rewritten,
+// keeping back a member that is not complete yet unless final.
+func (tw *tarballWriter) flush(final bool) error {
+	buf := tw.buf
+	start := 0
+	for {
+		i := bytes.Index(buf[start:], npmTarballMember)
+		if i < 0 {
+			break
+		}
+		at := start + i
+		afterKey := at + len(npmTarballMember)
+		valueStart, valueEnd, complete := jsonStringValue(buf[afterKey:])
+		if !complete && !final && len(buf)-afterKey < npmMaxTarballValue {
+			if _, err := tw.w.Write(buf[start:at]); err != nil {
+				return err
+			}
+			tw.buf = append(buf[:0], buf[at:]...)
+			return nil
+		}
+		end := afterKey
+		if complete && valueEnd > 0 {
+			end = afterKey + valueEnd
+			var tarball string
+			if json.Unmarshal(buf[afterKey+valueStart:end], &tarball) == nil {
+				if rewritten, ok := tw.rewrite(tarball); ok {
+					value, _ := json.Marshal(rewritten)
+					if _, err := tw.w.Write(buf[start : afterKey+valueStart]); err != nil {
+						return err
+					}
+					if _, err := tw.w.Write(value); err != nil {
+						return err
+					}
+					start = end
+					continue
+				}
+			}
+		}
+		if _, err := tw.w.Write(buf[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	// The tail may be the start of a tarball member
+	limit := len(buf)
+	if !final {
+		limit = max(start, len(buf)-(len(npmTarballMember)-1))
+	}
+	if _, err := tw.w.Write(buf[start:limit]); err != nil {
+		return err
+	}
+	tw.buf = append(buf[:0], buf[limit:]...)
+	return nil
+}
+
+// jsonStringValue finds the string value following an object key in b,
+// ": "value"", returning where its quoted literal starts and ends. end is
+// 0 when what follows is not a string value, and complete false when b
+// ends before that can be told.
+func jsonStringValue(b []byte) (start, end int, complete bool) {
+	i := skipJSONSpace(b, 0)
+	if i == len(b) {
+		return 0, 0, false
+	}
+	if b[i] != ':' {
+		return 0, 0, true
+	}
+	i = skipJSONSpace(b, i+1)
+	if i == len(b) {
+		return 0, 0, false
+	}
+	if b[i] != '"' {
+		return 0, 0, true
+	}
+	start = i
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return start, i + 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+// skipJSONSpace returns the index of the first byte of b from i that is
+// not JSON whitespace.
+func skipJSONSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// chainedWriteCloser closes the writers of a chain from the first written
+// to, so what each holds back reaches the next.
+type chainedWriteCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (c chainedWriteCloser) Close() error {
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
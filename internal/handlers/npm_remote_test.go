@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+func TestUnlistedRemoteTarballNotCached(t *testing.T) {
+	tarballs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not the tarball of lodash"))
+	}))
+	defer tarballs.Close()
+	// The packument of the package the client chose lists no version
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"evil","versions":{}}`))
+	}))
+	defer registry.Close()
+	u, err := url.Parse(tarballs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config.NPMConfig
+	t.Cleanup(func() { config.NPMConfig = saved })
+	config.NPMConfig.Upstream = registry.URL
+	config.NPMConfig.CacheDir = t.TempDir()
+	config.NPMConfig.LocalDir = ""
+	config.NPMConfig.TarballHosts = []string{u.Hostname()}
+
+	w := httptest.NewRecorder()
+	HandleTarballDownload(w, httptest.NewRequest(http.MethodGet, "/evil/-/remote/http/"+u.Host+"/lodash-4.17.21.tgz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "not the tarball of lodash" {
+		t.Fatalf("download answered %d %q", w.Code, w.Body.String())
+	}
+	entries, err := os.ReadDir(config.NPMConfig.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			t.Errorf("remote tarball without a listed checksum cached as %s", entry.Name())
+		}
+	}
+}
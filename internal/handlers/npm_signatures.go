@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+const (
+	// npmKeysPath is where an npm registry publishes the public keys it
+	// signs versions with.
+	npmKeysPath = "/-/npm/v1/keys"
+	// npmAttestationsPath prefixes the provenance attestations of the
+	// versions of a registry.
+	npmAttestationsPath = "/-/npm/v1/attestations/"
+	// npmKeysTTL is how long the keys of a registry are used before they
+	// are fetched again.
+	npmKeysTTL = time.Hour
+)
+
+// errNPMSignature is returned when the registry signature of a version is
+// missing or does not verify.
+var errNPMSignature = errors.New("registry signature")
+
+// npmSignature is one of the registry signatures in the dist of a version.
+type npmSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// npmKeySet is the signing keys of a registry, by key ID.
+type npmKeySet struct {
+	keys    map[string]*ecdsa.PublicKey
+	fetched time.Time
+}
+
+var (
+	npmKeys   = make(map[string]npmKeySet)
+	npmKeysMu sync.Mutex
+)
+
+// IsNPMSignatureRequest reports whether r reads the signing keys or the
+// provenance attestations of the registry. Their responses come back
+// unmodified, for npm audit signatures to verify.
+func IsNPMSignatureRequest(r *http.Request) bool {
+	return r.URL.Path == npmKeysPath || strings.HasPrefix(r.URL.Path, npmAttestationsPath)
+}
+
+// verifyNPMSignature checks the registry signature of version of pkgName,
+// made over "<name>@<version>:<integrity>", against the keys registry
+// publishes, as npm audit signatures does. Registries publishing no keys
+// sign nothing, so their versions pass. Key expiry is not checked, as the
+// abbreviated packument has no publish times.
+func verifyNPMSignature(ctx context.Context, registry, pkgName, version string, dist npmDist) error {
+	keys, err := npmRegistryKeys(ctx, registry)
+	if err != nil {
+		return fmt.Errorf("fetching signing keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if len(dist.Signatures) == 0 {
+		return fmt.Errorf("%w missing for %s@%s", errNPMSignature, pkgName, version)
+	}
+	digest := sha256.Sum256([]byte(pkgName + "@" + version + ":" + dist.Integrity))
+	for _, s := range dist.Signatures {
+		key := keys[s.KeyID]
+		if key == nil {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && ecdsa.VerifyASN1(key, digest[:], sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w invalid for %s@%s", errNPMSignature, pkgName, version)
+}
+
+// npmRegistryKeys returns the ECDSA P-256 signing keys registry publishes,
+// none when it publishes no keys.
+func npmRegistryKeys(ctx context.Context, registry string) (map[string]*ecdsa.PublicKey, error) {
+	npmKeysMu.Lock()
+	set, ok := npmKeys[registry]
+	npmKeysMu.Unlock()
+	if ok && time.Since(set.fetched) < npmKeysTTL {
+		return set.keys, nil
+	}
+
+	resp, err := fetchReleaseListing(ctx, upstream.Join(registry, npmKeysPath), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Keys []struct {
+			KeyID  string `json:"keyid"`
+			Scheme string `json:"scheme"`
+			Key    string `json:"key"`
+		} `json:"keys"`
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("decoding keys: %w", err)
+		}
+	}
+	keys := make(map[string]*ecdsa.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Scheme != "ecdsa-sha2-nistp256" {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %s: %w", k.KeyID, err)
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing key %s: %w", k.KeyID, err)
+		}
+		if key, ok := pub.(*ecdsa.PublicKey); ok {
+			keys[k.KeyID] = key
+		}
+	}
+
+	npmKeysMu.Lock()
+	npmKeys[registry] = npmKeySet{keys: keys, fetched: time.Now()}
+	npmKeysMu.Unlock()
+	return keys, nil
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// npmWriteRoute is a mutating npm registry API route that is forwarded
+// upstream as sent.
+type npmWriteRoute struct {
+	// command is the npm command that uses the route, for the logs
+	command string
+	methods []string
+	path    *regexp.Regexp
+}
+
+// npmWriteRoutes lists the mutating routes of the npm registry API that
+// are forwarded upstream, with the client's own credentials, body and
+// headers (npm-otp included). Package names in paths are already decoded,
+// so /@scope%2fname reads /@scope/name. Writes to other routes are refused
+// rather than sent upstream.
+var npmWriteRoutes = []npmWriteRoute{
+	// Publishes, deprecations, stars and access changes rewrite the packument
+	{"publish", []string{http.MethodPut}, regexp.MustCompile(`^/(?:@[^/]+/)?[^/@][^/]*$`)},
+	{"unpublish", []string{http.MethodPut, http.MethodDelete}, regexp.MustCompile(`^/(?:@[^/]+/)?[^/@][^/]*/-rev/[^/]+$`)},
+	{"unpublish", []string{http.MethodDelete}, regexp.MustCompile(`^/(?:@[^/]+/)?[^/@][^/]*/-/[^/]+/-rev/[^/]+$`)},
+	{"dist-tag", []string{http.MethodPut, http.MethodPost, http.MethodDelete}, npmDistTagsPath},
+	{"access", []string{http.MethodPut, http.MethodPost}, regexp.MustCompile(`^/-/package/(?:@[^/]+/)?[^/@][^/]*/(?:access|collaborators)$`)},
+	{"adduser", []string{http.MethodPut}, regexp.MustCompile(`^/-/user/org\.couchdb\.user:[^/]+$`)},
+	{"login", []string{http.MethodPost}, regexp.MustCompile(`^/-/v1/login$`)},
+	{"logout", []string{http.MethodDelete}, regexp.MustCompile(`^/-/user/token/[^/]+$`)},
+	{"token", []string{http.MethodPost}, regexp.MustCompile(`^/-/npm/v1/tokens$`)},
+	{"token", []string{http.MethodDelete}, regexp.MustCompile(`^/-/npm/v1/tokens/token/[^/]+$`)},
+	{"profile", []string{http.MethodPost}, regexp.MustCompile(`^/-/npm/v1/user$`)},
+	{"org", []string{http.MethodPut, http.MethodDelete}, regexp.MustCompile(`^/-/org/[^/]+/user$`)},
+	{"team", []string{http.MethodPut}, regexp.MustCompile(`^/-/org/[^/]+/team$`)},
+	{"team", []string{http.MethodDelete}, regexp.MustCompile(`^/-/team/[^/]+/[^/]+$`)},
+	{"team", []string{http.MethodPut, http.MethodDelete}, regexp.MustCompile(`^/-/team/[^/]+/[^/]+/(?:user|package)$`)},
+	{"hook", []string{http.MethodPost}, regexp.MustCompile(`^/-/npm/v1/hooks/hook$`)},
+	{"hook", []string{http.MethodPut, http.MethodDelete}, regexp.MustCompile(`^/-/npm/v1/hooks/hook/[^/]+$`)},
+}
+
+// npmWriteCommand returns the npm command a mutating request is made by,
+// false when its route is not one forwarded upstream.
+func npmWriteCommand(r *http.Request) (string, bool) {
+	for _, route := range npmWriteRoutes {
+		if slices.Contains(route.methods, r.Method) && route.path.MatchString(r.URL.Path) {
+			return route.command, true
+		}
+	}
+	return "", false
+}
+
+// IsNPMWriteRequest reports whether r changes the registry, or reads a
+// packument with ?write=true to change it next, as npm deprecate, owner and
+// unpublish do. Such requests reach upstream and come back unmodified,
+// authenticated as the client only.
+func IsNPMWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return r.URL.Query().Get("write") == "true"
+	case http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// NPMWriteRefused answers 405 to mutating requests whose route is not
+// forwarded upstream, and logs the others. It reports whether r was
+// refused.
+func NPMWriteRefused(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return false
+	}
+	command, ok := npmWriteCommand(r)
+	if !ok {
+		log.Printf("Refused %s %s: not an npm registry write", r.Method, r.URL.Path)
+		writeNPMError(w, http.StatusMethodNotAllowed, "this registry API write is not supported through pkgbin")
+		return true
+	}
+	log.Printf("Forwarding npm %s write %s %s upstream", command, r.Method, r.URL.Path)
+	return false
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNPMWriteCommand(t *testing.T) {
+	tests := []struct {
+		method, target string
+		// command is the route forwarded upstream, "" for refused writes
+		command string
+	}{
+		// Publishes and the packument rewrites of deprecate, owner and star
+		{http.MethodPut, "/lodash", "publish"},
+		{http.MethodPut, "/@mycorp/utils", "publish"},
+		{http.MethodPut, "/@mycorp%2futils", "publish"},
+		{http.MethodPut, "/@mycorp%2Futils", "publish"},
+		// Unpublishes
+		{http.MethodPut, "/lodash/-rev/3-abc", "unpublish"},
+		{http.MethodDelete, "/lodash/-rev/3-abc", "unpublish"},
+		{http.MethodDelete, "/@mycorp%2futils/-rev/3-abc", "unpublish"},
+		{http.MethodDelete, "/lodash/-/lodash-1.0.0.tgz/-rev/3-abc", "unpublish"},
+		{http.MethodDelete, "/@mycorp/utils/-/utils-1.0.0.tgz/-rev/3-abc", "unpublish"},
+		// Dist-tags
+		{http.MethodPut, "/-/package/lodash/dist-tags/beta", "dist-tag"},
+		{http.MethodDelete, "/-/package/lodash/dist-tags/beta", "dist-tag"},
+		{http.MethodPut, "/-/package/@mycorp%2futils/dist-tags/next", "dist-tag"},
+		{http.MethodDelete, "/-/package/@mycorp/utils/dist-tags/next", "dist-tag"},
+		{http.MethodPost, "/-/package/lodash/dist-tags", "dist-tag"},
+		// Access and collaborators
+		{http.MethodPost, "/-/package/@mycorp%2futils/access", "access"},
+		{http.MethodPut, "/-/package/lodash/collaborators", "access"},
+		// Accounts, tokens, orgs, teams and hooks
+		{http.MethodPut, "/-/user/org.couchdb.user:alice", "adduser"},
+		{http.MethodPost, "/-/v1/login", "login"},
+		{http.MethodDelete, "/-/user/token/abc123", "logout"},
+		{http.MethodPost, "/-/npm/v1/tokens", "token"},
+		{http.MethodDelete, "/-/npm/v1/tokens/token/abc123", "token"},
+		{http.MethodPost, "/-/npm/v1/user", "profile"},
+		{http.MethodPut, "/-/org/mycorp/user", "org"},
+		{http.MethodDelete, "/-/org/mycorp/user", "org"},
+		{http.MethodPut, "/-/org/mycorp/team", "team"},
+		{http.MethodDelete, "/-/team/mycorp/devs", "team"},
+		{http.MethodPut, "/-/team/mycorp/devs/user", "team"},
+		{http.MethodDelete, "/-/team/mycorp/devs/package", "team"},
+		{http.MethodPost, "/-/npm/v1/hooks/hook", "hook"},
+		{http.MethodDelete, "/-/npm/v1/hooks/hook/h1", "hook"},
+
+		// Refused: wrong methods on known routes
+		{http.MethodPost, "/lodash", ""},
+		{http.MethodDelete, "/lodash", ""},
+		{http.MethodPatch, "/lodash", ""},
+		{http.MethodPost, "/lodash/-rev/3-abc", ""},
+		{http.MethodGet, "/-/v1/login", ""},
+		{http.MethodDelete, "/-/package/lodash/access", ""},
+		// Refused: tarballs, nested paths and unknown routes
+		{http.MethodPut, "/lodash/-/lodash-1.0.0.tgz", ""},
+		{http.MethodDelete, "/lodash/-/lodash-1.0.0.tgz", ""},
+		{http.MethodPut, "/lodash/1.0.0", ""},
+		{http.MethodPut, "/@mycorp/utils/extra", ""},
+		{http.MethodPut, "/@mycorp", ""},
+		{http.MethodPut, "/@mycorp/@utils", ""},
+		{http.MethodPut, "/", ""},
+		{http.MethodPost, "/-/npm/v1/security/advisories/bulk", ""},
+		{http.MethodPut, "/-/package/lodash/dist-tags/beta/extra", ""},
+		{http.MethodPut, "/-/user/alice", ""},
+		{http.MethodDelete, "/-/npm/v1/tokens", ""},
+		{http.MethodPut, "/-/org/mycorp/user/extra", ""},
+		{http.MethodPost, "/-/npm/v1/hooks", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			command, ok := npmWriteCommand(r)
+			if ok != (tt.command != "") || command != tt.command {
+				t.Errorf("npmWriteCommand = %q, %v, want %q", command, ok, tt.command)
+			}
+		})
+	}
+}
+
+func TestIsNPMWriteRequest(t *testing.T) {
+	tests := []struct {
+		method, target string
+		want           bool
+	}{
+		{http.MethodGet, "/lodash", false},
+		{http.MethodHead, "/lodash", false},
+		{http.MethodGet, "/lodash/-/lodash-1.0.0.tgz", false},
+		{http.MethodOptions, "/lodash", false},
+		// Reads of the packument to write it back
+		{http.MethodGet, "/lodash?write=true", true},
+		{http.MethodGet, "/@mycorp%2futils?write=true", true},
+		{http.MethodHead, "/lodash?write=true", true},
+		{http.MethodGet, "/lodash?write=false", false},
+		{http.MethodGet, "/lodash?write=1", false},
+		{http.MethodPut, "/lodash", true},
+		{http.MethodDelete, "/lodash/-rev/1-a", true},
+		{http.MethodPost, "/-/v1/login", true},
+		// Unknown writes are write requests too, refused by NPMWriteRefused
+		{http.MethodPatch, "/lodash", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if got := IsNPMWriteRequest(r); got != tt.want {
+			t.Errorf("IsNPMWriteRequest(%s %s) = %v, want %v", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestNPMWriteRefused(t *testing.T) {
+	tests := []struct {
+		method, target string
+		refused        bool
+	}{
+		{http.MethodGet, "/lodash", false},
+		{http.MethodGet, "/lodash?write=true", false},
+		{http.MethodHead, "/lodash", false},
+		{http.MethodOptions, "/anything/at/all", false},
+		{http.MethodPut, "/@mycorp%2futils", false},
+		{http.MethodPut, "/-/package/@mycorp%2futils/dist-tags/latest", false},
+		{http.MethodDelete, "/-/package/lodash/dist-tags/beta", false},
+		{http.MethodPut, "/lodash/-/lodash-1.0.0.tgz", true},
+		{http.MethodPost, "/lodash", true},
+		{http.MethodPatch, "/lodash", true},
+		{http.MethodDelete, "/-/npm/v1/tokens", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if got := NPMWriteRefused(w, r); got != tt.refused {
+				t.Fatalf("NPMWriteRefused = %v, want %v", got, tt.refused)
+			}
+			if tt.refused && w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+			}
+			if !tt.refused && w.Body.Len() != 0 {
+				t.Errorf("forwarded request answered %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+// errPackageNotCached is returned for packages without any cached file.
+var errPackageNotCached = errors.New("package not cached")
+
+// APIPackageDetail sums the cached files of one package and lists them.
+type APIPackageDetail struct {
+	PackageName    string       `json:"package_name"`
+	Registry       string       `json:"registry"`
+	CacheHit       int64        `json:"cache_hit"`
+	CacheMiss      int64        `json:"cache_miss"`
+	SizeBytes      int64        `json:"size_bytes"`
+	FirstCachedAt  time.Time    `json:"first_cached_at"`
+	LastAccessedAt *time.Time   `json:"last_accessed_at"`
+	Files          []APIPackage `json:"files"`
+}
+
+// packageDetail loads the cached files of the package of registry called
+// name, with their vulnerability findings.
+func packageDetail(registry, name string) (APIPackageDetail, error) {
+	if registry == models.RegistryPyPI {
+		name = normalizePyPIName(name)
+	}
+	detail := APIPackageDetail{PackageName: name, Registry: registry, Files: []APIPackage{}}
+
+	pkgs, err := repositories.PackageRepo.ListPackageFiles(registry, name)
+	if err != nil {
+		return detail, err
+	}
+	if len(pkgs) == 0 {
+		return detail, errPackageNotCached
+	}
+
+	findings := vulnerabilitiesByFileName(pkgs)
+	for _, pkg := range pkgs {
+		file := newAPIPackage(pkg)
+		for _, v := range findings[pkg.Name] {
+			file.Vulnerabilities = append(file.Vulnerabilities, APIVulnerability{ID: v.VulnID, Summary: v.Summary, Severity: v.Severity})
+		}
+		detail.Files = append(detail.Files, file)
+
+		detail.CacheHit += pkg.CacheHit
+		detail.CacheMiss += pkg.CacheMiss
+		detail.SizeBytes += pkg.SizeBytes
+		if detail.FirstCachedAt.IsZero() || pkg.CreatedAt.Before(detail.FirstCachedAt) {
+			detail.FirstCachedAt = pkg.CreatedAt
+		}
+		if pkg.LastAccessedAt != nil && (detail.LastAccessedAt == nil || pkg.LastAccessedAt.After(*detail.LastAccessedAt)) {
+			detail.LastAccessedAt = pkg.LastAccessedAt
+		}
+	}
+	return detail, nil
+}
+
+func (reg apiRegistry) getPackageDetail(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "packages/")
+	detail, err := packageDetail(reg.registry, name)
+	if errors.Is(err, errPackageNotCached) {
+		writeAPIError(w, http.StatusNotFound, "Package not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load package %s for API: %v", name, err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load package")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, detail)
+}
+
+func NPMPackageDetailHandler(w http.ResponseWriter, r *http.Request) {
+	packageDetailHandler(w, r, "Package Bin for NPM", models.RegistryNPM, false)
+}
+
+func RubyPackageDetailHandler(w http.ResponseWriter, r *http.Request) {
+	packageDetailHandler(w, r, "Package Bin for RubyGems", models.RegistryRubyGems, false)
+}
+
+func PyPIPackageDetailHandler(w http.ResponseWriter, r *http.Request) {
+	packageDetailHandler(w, r, "Package Bin for PyPI", models.RegistryPyPI, false)
+}
+
+// PackageDetailHandler renders the package page of the combined dashboard,
+// for the registry given by the registry query parameter.
+func PackageDetailHandler(w http.ResponseWriter, r *http.Request) {
+	registry := r.URL.Query().Get("registry")
+	if _, ok := registryName(registry); !ok {
+		http.Error(w, "Unknown registry", http.StatusBadRequest)
+		return
+	}
+	packageDetailHandler(w, r, "Package Bin", registry, true)
+}
+
+// packageDetailHandler renders the dashboard page listing the cached files
+// of the package given by the name query parameter. Files can only be
+// purged from the dashboard of their own proxy, not the combined one.
+func packageDetailHandler(w http.ResponseWriter, r *http.Request, title, registry string, combined bool) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
+	}
+	detail, err := packageDetail(registry, name)
+	if errors.Is(err, errPackageNotCached) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load package %s for dashboard: %v", name, err)
+		http.Error(w, "Failed to load package", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := parseTemplate("package.html", template.FuncMap{
+		"bytes":         stats.FormatBytes,
+		"severityClass": severityBadgeClass,
+		"short": func(digest string) string {
+			return digest[:min(len(digest), 12)]
+		},
+		"time": func(t time.Time) string {
+			return t.Format("Jan 02, 2006 15:04")
+		},
+	})
+	tmpl.Execute(w, struct {
+		APIPackageDetail
+		Title    string
+		BasePath string
+		Combined bool
+	}{
+		APIPackageDetail: detail,
+		Title:            title,
+		BasePath:         externalBasePath(r),
+		Combined:         combined,
+	})
+}
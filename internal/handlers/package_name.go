@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+// npmTarballPattern splits a tarball name into the unscoped package name
+// and its semver version, e.g. base64-js-1.5.1.tgz.
+var npmTarballPattern = regexp.MustCompile(`^(.+?)-(\d+\.\d+\.\d+(?:[-+][0-9A-Za-z.+-]*)?)\.tgz$`)
+
+// parseNPMCacheFileName returns the package and version of a cached
+// tarball, reversing cachekey.NPM: @types__node-20.0.0.tgz is
+// @types/node 20.0.0.
+func parseNPMCacheFileName(fileName string) (name, version string) {
+	scope, tarball := "", fileName
+	if rest, ok := strings.CutPrefix(fileName, "@"); ok {
+		var found bool
+		scope, tarball, found = strings.Cut(rest, "__")
+		if !found {
+			return "", ""
+		}
+	}
+	m := npmTarballPattern.FindStringSubmatch(tarball)
+	if m == nil {
+		return "", ""
+	}
+	if scope != "" {
+		return "@" + scope + "/" + m[1], m[2]
+	}
+	return m[1], m[2]
+}
+
+// parseCachedFileName returns the canonical package name and version of a
+// file cached from registry, or empty strings when it cannot be parsed.
+// PyPI names are PEP 503 normalized and gem versions exclude the platform.
+func parseCachedFileName(registry, fileName string) (name, version string) {
+	switch registry {
+	case models.RegistryNPM:
+		return parseNPMCacheFileName(fileName)
+	case models.RegistryPyPI:
+		fileName = pypiDistributionName(fileName)
+		project := pypiProjectFromFilename(fileName)
+		if project == "" {
+			return "", ""
+		}
+		return normalizePyPIName(project), pypiVersionFromFilename(fileName)
+	case models.RegistryRubyGems:
+		m := gemNameVersionPattern.FindStringSubmatch(strings.TrimSuffix(fileName, ".gem"))
+		if m == nil {
+			return "", ""
+		}
+		version, _, _ := strings.Cut(m[2], "-")
+		return m[1], version
+	}
+	return "", ""
+}
+
+// pypiDistributionName returns the name of the distribution file cached as
+// fileName, under its flattened download path.
+func pypiDistributionName(fileName string) string {
+	if i := strings.LastIndex(fileName, "__"); i >= 0 {
+		return fileName[i+len("__"):]
+	}
+	return fileName
+}
+
+// recordAccess counts a cache hit or miss of a file cached from registry.
+// Read-only replicas do not count theirs.
+func recordAccess(registry, fileName string, hit bool) {
+	if readOnlyReplica() {
+		return
+	}
+	access := repositories.PackageAccess{Name: fileName, Registry: registry, Misses: 1, LastAccess: time.Now()}
+	if hit {
+		access.Hits, access.Misses = 1, 0
+	}
+	access.PackageName, access.Version = parseCachedFileName(registry, fileName)
+	stats.RecordAccess(access)
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/blocklist"
+	"github.com/pkgb-in/pkgbin/internal/policy"
+)
+
+// npmVersionFromPath returns the version of the tarball a registry path
+// such as /@types/node/-/node-20.1.0.tgz refers to.
+func npmVersionFromPath(pkgName, urlPath string) string {
+	if !strings.Contains(urlPath, "/-/") || !strings.HasSuffix(urlPath, ".tgz") {
+		return ""
+	}
+	shortName := pkgName[strings.LastIndex(pkgName, "/")+1:]
+	version, ok := strings.CutPrefix(strings.TrimSuffix(path.Base(urlPath), ".tgz"), shortName+"-")
+	if !ok {
+		return ""
+	}
+	return version
+}
+
+// pypiVersionFromFilename returns the version of a distribution file:
+// the second dash-separated field of wheels and eggs, or what follows the
+// last dash of an sdist.
+func pypiVersionFromFilename(fileName string) string {
+	lower := strings.ToLower(fileName)
+	if strings.HasSuffix(lower, ".whl") || strings.HasSuffix(lower, ".egg") {
+		fields := strings.Split(fileName, "-")
+		if len(fields) < 2 {
+			return ""
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(fields[1], ".egg"), ".EGG")
+	}
+	i := strings.LastIndex(fileName, "-")
+	if i < 0 {
+		return ""
+	}
+	version := fileName[i+1:]
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(version), ext) {
+			return version[:len(version)-len(ext)]
+		}
+	}
+	return ""
+}
+
+// gemVersionFromPath returns the version of a gem file or quick gemspec,
+// without its platform suffix.
+func gemVersionFromPath(urlPath string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(path.Base(urlPath), ".gem"), ".gemspec.rz")
+	m := gemNameVersionPattern.FindStringSubmatch(base)
+	if m == nil {
+		return ""
+	}
+	version, _, _ := strings.Cut(m[2], "-")
+	return version
+}
+
+// evaluatePackage checks a package of registry against the blocklist feed,
+// the versions found yanked upstream when the policy of the repository
+// refuses them, and then that policy.
+func evaluatePackage(registry string, p config.Policy, feed config.Blocklist, name, version string) policy.Decision {
+	if blocklist.For(feed.URL).Blocked(name, version) {
+		return policy.Decision{Allowed: false, Message: name + " is on the blocklist of known malicious packages"}
+	}
+	if p.Yanked == "deny" && version != "" {
+		if reason, ok := yankedReason(registry, name, version); ok {
+			return policy.Decision{Allowed: false, Message: name + " " + version + " was " + reason}
+		}
+	}
+	return policy.Evaluate(p, name, version)
+}
+
+// InitNPMBlocklists starts syncing the blocklist feeds of the default and
+// every named npm repository.
+func InitNPMBlocklists() error {
+	s := config.Current()
+	for _, repo := range append([]*config.NPMProxyConfig{&s.NPM}, s.NPM.Repositories...) {
+		if _, err := blocklist.Start(repo.Blocklist, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitPyPIBlocklists starts syncing the blocklist feeds of the default and
+// every named PyPI repository. Feed entries are matched by normalized name.
+func InitPyPIBlocklists() error {
+	s := config.Current()
+	for _, repo := range append([]*config.PyPIProxyConfig{&s.PyPI}, s.PyPI.Repositories...) {
+		if _, err := blocklist.Start(repo.Blocklist, normalizePyPIName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitRubyGemsBlocklists starts syncing the blocklist feeds of the default
+// and every named RubyGems repository.
+func InitRubyGemsBlocklists() error {
+	s := config.Current()
+	for _, repo := range append([]*config.RubyGemsProxyConfig{&s.RubyGems}, s.RubyGems.Repositories...) {
+		if _, err := blocklist.Start(repo.Blocklist, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blocklistURLs returns the blocklist feeds of the default and every named
+// repository of registry.
+func blocklistURLs(registry string) []string {
+	s := config.Current()
+	var urls []string
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&s.NPM}, s.NPM.Repositories...) {
+			urls = append(urls, repo.Blocklist.URL)
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&s.PyPI}, s.PyPI.Repositories...) {
+			urls = append(urls, repo.Blocklist.URL)
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&s.RubyGems}, s.RubyGems.Repositories...) {
+			urls = append(urls, repo.Blocklist.URL)
+		}
+	}
+	return urls
+}
+
+// NPMPolicyDenied checks the package r refers to against the blocklist and
+// policy of its repository and answers 403 when it is denied. Denied
+// packages never reach the cache.
+func NPMPolicyDenied(w http.ResponseWriter, r *http.Request) bool {
+	pkgName, ok := npmPackageFromPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	repo := NPMRepository(r)
+	decision := evaluatePackage(models.RegistryNPM, repo.Policy, repo.Blocklist, pkgName, npmVersionFromPath(pkgName, r.URL.Path))
+	if decision.Allowed {
+		return false
+	}
+	log.Printf("Refused %s: %s", r.URL.Path, decision.Message)
+	writeNPMError(w, http.StatusForbidden, decision.Message)
+	return true
+}
+
+// PyPIPolicyDenied checks the project r refers to against the blocklist and
+// policy of its repository and answers 403 when it is denied.
+func PyPIPolicyDenied(w http.ResponseWriter, r *http.Request) bool {
+	project, ok := pypiProjectFromPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	version := ""
+	if isPyPIDistributionPath(r.URL.Path) {
+		version = pypiVersionFromFilename(path.Base(strings.TrimSuffix(r.URL.Path, ".metadata")))
+	}
+	repo := PyPIRepository(r)
+	decision := evaluatePackage(models.RegistryPyPI, repo.Policy, repo.Blocklist, normalizePyPIName(project), version)
+	if decision.Allowed {
+		return false
+	}
+	log.Printf("Refused %s: %s", r.URL.Path, decision.Message)
+	http.Error(w, decision.Message, http.StatusForbidden)
+	return true
+}
+
+// RubyGemsPolicyDenied checks the gem r refers to against the blocklist and
+// policy of its repository and answers 403 when it is denied.
+func RubyGemsPolicyDenied(w http.ResponseWriter, r *http.Request) bool {
+	gemName, ok := gemNameFromPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	version := ""
+	if !strings.HasPrefix(r.URL.Path, "/info/") {
+		version = gemVersionFromPath(r.URL.Path)
+	}
+	repo := RubyGemsRepository(r)
+	decision := evaluatePackage(models.RegistryRubyGems, repo.Policy, repo.Blocklist, gemName, version)
+	if decision.Allowed {
+		return false
+	}
+	log.Printf("Refused %s: %s", r.URL.Path, decision.Message)
+	http.Error(w, decision.Message, http.StatusForbidden)
+	return true
+}
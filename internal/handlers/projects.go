@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/lockfile"
+)
+
+// maxLockfileSize bounds the lockfiles projects are registered with.
+const maxLockfileSize = 32 << 20
+
+// APIProject is a registered project as returned by the API.
+type APIProject struct {
+	Name string `json:"name"`
+	// Packages is how many package versions its lockfile pins
+	Packages  int       `json:"packages"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GCRequest asks for a garbage collection; DryRun only reports the files
+// that would be purged.
+type GCRequest struct {
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// projectPackages returns the "<name> <version>" lines of the packages of
+// registry pins, PyPI names PEP 503 normalized like those parsed from
+// cached files.
+func projectPackages(registry string, pins []lockfile.Package) string {
+	lines := make([]string, 0, len(pins))
+	for _, pin := range pins {
+		name := pin.Name
+		if registry == models.RegistryPyPI {
+			name = normalizePyPIName(name)
+		}
+		lines = append(lines, name+" "+pin.Version)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func newAPIProject(p models.Project) APIProject {
+	packages := 0
+	if p.Packages != "" {
+		packages = strings.Count(p.Packages, "\n") + 1
+	}
+	return APIProject{Name: p.Name, Packages: packages, CreatedAt: p.CreatedAt, UpdatedAt: p.UpdatedAt}
+}
+
+// listProjects answers GET /api/v1/projects with the registered projects.
+func (reg apiRegistry) listProjects(w http.ResponseWriter, r *http.Request) {
+	if repositories.ProjectRepo == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "Database not available")
+		return
+	}
+	projects, err := repositories.ProjectRepo.ListProjects(reg.registry)
+	if err != nil {
+		log.Printf("Failed to list projects: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to list projects")
+		return
+	}
+	list := make([]APIProject, 0, len(projects))
+	for _, p := range projects {
+		list = append(list, newAPIProject(p))
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// registerProject answers POST /api/v1/projects/<name>, registering the
+// project with the lockfile sent as the body, or replacing its lockfile.
+func (reg apiRegistry) registerProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLockfileSize))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Failed to read the lockfile sent")
+		return
+	}
+	pins, err := lockfile.Parse(reg.registry, data)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Invalid lockfile: %v", err))
+		return
+	}
+	project := models.Project{Registry: reg.registry, Name: name, Packages: projectPackages(reg.registry, pins)}
+	if err := repositories.ProjectRepo.SaveProject(&project); err != nil {
+		log.Printf("Failed to save project %s: %v", name, err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to save the project")
+		return
+	}
+	noteAudit(r, "%s pins %d package versions", name, len(pins))
+	writeAPIJSON(w, http.StatusOK, newAPIProject(project))
+}
+
+// deleteProject answers DELETE /api/v1/projects/<name>. The versions only
+// it pinned are purged by the next garbage collection.
+func (reg apiRegistry) deleteProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+	found, err := repositories.ProjectRepo.DeleteProject(reg.registry, name)
+	if err != nil {
+		log.Printf("Failed to delete project %s: %v", name, err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to delete the project")
+		return
+	}
+	if !found {
+		writeAPIError(w, http.StatusNotFound, "Project not registered")
+		return
+	}
+	noteAudit(r, "%s unregistered", name)
+	writeAPIJSON(w, http.StatusOK, map[string]string{"message": "Project " + name + " unregistered"})
+}
+
+// projectName returns the project named by the path of r, answering 400
+// and false when it is not a valid name.
+func projectName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if repositories.ProjectRepo == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "Database not available")
+		return "", false
+	}
+	_, name, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "/")
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, "\n\r") {
+		writeAPIError(w, http.StatusBadRequest, "Invalid project name")
+		return "", false
+	}
+	return name, true
+}
+
+// collectGarbage answers POST /api/v1/gc, purging the files cached by the
+// repository of r whose version no registered project pins. Files whose
+// name cannot be parsed and the packages mirrored in full are kept, and
+// purged files go to the trash like those of /purge.
+func (reg apiRegistry) collectGarbage(w http.ResponseWriter, r *http.Request) {
+	if repositories.ProjectRepo == nil || repositories.PackageRepo == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "Database not available")
+		return
+	}
+	var req GCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	projects, err := repositories.ProjectRepo.ListProjects(reg.registry)
+	if err != nil {
+		log.Printf("Failed to list projects: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to list projects")
+		return
+	}
+	// Without a project everything would go
+	if len(projects) == 0 {
+		writeAPIError(w, http.StatusConflict, "No project is registered, so garbage collection would purge the whole cache")
+		return
+	}
+	pinned := make(map[string]bool)
+	for _, p := range projects {
+		for _, line := range strings.Split(p.Packages, "\n") {
+			pinned[line] = true
+		}
+	}
+
+	cacheDir := reg.cacheDir(r)
+	names, size, err := unreferencedFiles(reg.registry, cacheDir, pinned, fullMirrorNames(reg.registry, repositoryFullMirror(reg.config(r))))
+	if err != nil {
+		log.Printf("Failed to select unreferenced files: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to select unreferenced files")
+		return
+	}
+	if len(names) == 0 {
+		writeAPIJSON(w, http.StatusOK, PurgeResponse{Success: true, Message: "Every cached file is pinned by a project"})
+		return
+	}
+	if req.DryRun {
+		writeAPIJSON(w, http.StatusOK, PurgeResponse{
+			Success: true,
+			Message: fmt.Sprintf("%d files referenced by no project would be purged", len(names)),
+			Matched: names,
+			Bytes:   size,
+		})
+		return
+	}
+
+	var deleted, failed, stale []string
+	for _, name := range names {
+		if err := removeCachedFile(filepath.Join(cacheDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to purge %s: %v", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		deleted = append(deleted, name)
+		invalidatePurgedMetadata(r, reg.registry, name)
+		// The row stays while another repository still caches the file
+		if !cachedElsewhere(reg.registry, cacheDir, name) {
+			stale = append(stale, name)
+		}
+	}
+	for len(stale) > 0 {
+		batch := stale[:min(len(stale), 500)]
+		stale = stale[len(batch):]
+		if err := repositories.PackageRepo.DeletePackagesByNames(reg.registry, batch); err != nil {
+			log.Printf("Failed to delete %d collected file(s) from database: %v", len(batch), err)
+		}
+	}
+	log.Printf("Garbage collection purged %d files referenced by no project", len(deleted))
+	recordPurges(clientIdentity(r), reg.registry, deleted)
+	noteAudit(r, "%d purged, referenced by none of %d projects", len(deleted), len(projects))
+
+	response := PurgeResponse{
+		Success: true,
+		Message: fmt.Sprintf("%d files referenced by no project purged", len(deleted)),
+		Deleted: deleted,
+		Bytes:   size,
+	}
+	if len(failed) > 0 {
+		response.Failed = failed
+		response.Message = "Some files failed to purge"
+	}
+	writeAPIJSON(w, http.StatusOK, response)
+}
+
+// unreferencedFiles returns the files of registry cached in cacheDir whose
+// "<name> <version>" is not pinned, and their total size. Files whose
+// name cannot be parsed and the packages in mirrored are left out.
+func unreferencedFiles(registry, cacheDir string, pinned, mirrored map[string]bool) ([]string, int64, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Rows are shared by the repositories of the registry, and locally
+	// published npm packages live in another directory
+	cached := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), janitor.TempSuffix) {
+			cached[entry.Name()] = true
+		}
+	}
+	var names []string
+	var size int64
+	err = repositories.PackageRepo.EachPackage(registry, evictionBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			if pkg.PackageName == "" || pkg.Version == "" || !cached[pkg.Name] || mirrored[pkg.PackageName] {
+				continue
+			}
+			if pinned[pkg.PackageName+" "+pkg.Version] {
+				continue
+			}
+			names = append(names, pkg.Name)
+			size += pkg.SizeBytes
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, size, err
+}
+
+// repositoryFullMirror returns the packages the repository repo mirrors in
+// full.
+func repositoryFullMirror(repo any) config.FullMirror {
+	switch repo := repo.(type) {
+	case *config.NPMProxyConfig:
+		return repo.FullMirror
+	case *config.PyPIProxyConfig:
+		return repo.FullMirror
+	case *config.RubyGemsProxyConfig:
+		return repo.FullMirror
+	}
+	return config.FullMirror{}
+}
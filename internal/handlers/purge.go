@@ -2,17 +2,39 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
 	"github.com/pkgb-in/pkgbin/db/repositories"
 )
 
+// PurgeRequest lists cached files to purge by name and/or selects them by
+// criteria; files must match every criterion given. DryRun only reports
+// the files that would be purged.
 type PurgeRequest struct {
 	Packages []string `json:"packages"`
+	// Pattern is a shell-style glob matched against the package name (e.g.
+	// "@types/*") or the cached file name.
+	Pattern string `json:"pattern,omitempty"`
+	// NotAccessedDays selects files not downloaded for that many days.
+	NotAccessedDays int `json:"not_accessed_days,omitempty"`
+	// LargerThanMB selects files larger than that many megabytes.
+	LargerThanMB float64 `json:"larger_than_mb,omitempty"`
+	// Platform is a glob matched against the platform tags of PyPI wheels,
+	// e.g. "win*"; RefusedPlatforms selects the wheels the wheel_platforms
+	// of the repository now stream through.
+	Platform         string `json:"platform,omitempty"`
+	RefusedPlatforms bool   `json:"refused_platforms,omitempty"`
+	DryRun           bool   `json:"dry_run,omitempty"`
 }
 
 type PurgeResponse struct {
@@ -20,21 +42,75 @@ type PurgeResponse struct {
 	Message string   `json:"message"`
 	Deleted []string `json:"deleted,omitempty"`
 	Failed  []string `json:"failed,omitempty"`
+	// Matched lists the files a dry run would purge, and Bytes their size.
+	Matched []string `json:"matched,omitempty"`
+	Bytes   int64    `json:"bytes,omitempty"`
+}
+
+// hasSelectors reports whether req selects files by criteria.
+func (req PurgeRequest) hasSelectors() bool {
+	return req.Pattern != "" || req.NotAccessedDays > 0 || req.LargerThanMB > 0 || req.Platform != "" || req.RefusedPlatforms
+}
+
+// selectPurgeCandidates returns the cached files of registry matching the
+// criteria of req, and their total size, leaving out those only other
+// repositories than the one caching in cacheDir hold. platforms are those
+// the repository caches PyPI wheels for.
+func selectPurgeCandidates(registry, cacheDir string, req PurgeRequest, platforms config.WheelPlatforms) ([]string, int64, error) {
+	var accessedBefore time.Time
+	if req.NotAccessedDays > 0 {
+		accessedBefore = time.Now().AddDate(0, 0, -req.NotAccessedDays)
+	}
+	pkgs, err := repositories.PackageRepo.FindPurgeCandidates(registry, accessedBefore, int64(req.LargerThanMB*1024*1024))
+	if err != nil {
+		return nil, 0, err
+	}
+	var names []string
+	var size int64
+	for _, pkg := range pkgs {
+		if req.Pattern != "" {
+			byPackage, _ := path.Match(req.Pattern, pkg.PackageName)
+			byFile, _ := path.Match(req.Pattern, pkg.Name)
+			if !byPackage && !byFile {
+				continue
+			}
+		}
+		if req.Platform != "" && !wheelPlatformMatches(req.Platform, pkg.Name) {
+			continue
+		}
+		if req.RefusedPlatforms && !wheelPlatformRefused(platforms, pkg.Name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, pkg.Name)); err != nil && cachedElsewhere(registry, cacheDir, pkg.Name) {
+			continue
+		}
+		names = append(names, pkg.Name)
+		size += pkg.SizeBytes
+	}
+	return names, size, nil
+}
+
+// purgedRows returns the names of the purged files whose row goes with
+// them, as no other repository of registry holds them.
+func purgedRows(registry, cacheDir string, names []string) []string {
+	return slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+		return cachedElsewhere(registry, cacheDir, name)
+	})
 }
 
 func NPMPurgeHandler(w http.ResponseWriter, r *http.Request) {
-	purgeHandler(w, r, config.NPMConfig.CacheDir, "npm")
+	purgeHandler(w, r, NPMRepository(r).CacheDir, models.RegistryNPM)
 }
 
 func RubyPurgeHandler(w http.ResponseWriter, r *http.Request) {
-	purgeHandler(w, r, config.RubyGemsConfig.CacheDir, "gem")
+	purgeHandler(w, r, RubyGemsRepository(r).CacheDir, models.RegistryRubyGems)
 }
 
 func PyPIPurgeHandler(w http.ResponseWriter, r *http.Request) {
-	purgeHandler(w, r, config.PyPIConfig.CacheDir, "pypi")
+	purgeHandler(w, r, PyPIRepository(r).CacheDir, models.RegistryPyPI)
 }
 
-func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType string) {
+func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, registry string) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -45,6 +121,58 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.NotAccessedDays < 0 || req.LargerThanMB < 0 {
+		http.Error(w, "not_accessed_days and larger_than_mb must not be negative", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(req.Pattern, ""); err != nil {
+		http.Error(w, "Invalid pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(req.Platform, ""); err != nil {
+		http.Error(w, "Invalid platform: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var platforms config.WheelPlatforms
+	if registry == models.RegistryPyPI {
+		platforms = PyPIRepository(r).WheelPlatforms
+	}
+
+	if req.hasSelectors() {
+		names, size, err := selectPurgeCandidates(registry, cacheDir, req, platforms)
+		if err != nil {
+			log.Printf("Error selecting packages to purge: %v", err)
+			http.Error(w, "Failed to select packages", http.StatusInternalServerError)
+			return
+		}
+		// Listed packages narrow the selection down further
+		if len(req.Packages) > 0 {
+			listed := make(map[string]bool, len(req.Packages))
+			for _, name := range req.Packages {
+				listed[name] = true
+			}
+			names = slices.DeleteFunc(names, func(name string) bool { return !listed[name] })
+		}
+		req.Packages = names
+		if req.DryRun {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(PurgeResponse{
+				Success: true,
+				Message: fmt.Sprintf("%d packages would be purged", len(names)),
+				Matched: names,
+				Bytes:   size,
+			})
+			return
+		}
+	} else if req.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PurgeResponse{
+			Success: true,
+			Message: fmt.Sprintf("%d packages would be purged", len(req.Packages)),
+			Matched: req.Packages,
+		})
+		return
+	}
 
 	if len(req.Packages) == 0 {
 		json.NewEncoder(w).Encode(PurgeResponse{
@@ -59,7 +187,7 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 
 	// Delete from cache directory
 	for _, pkgName := range req.Packages {
-		if packageType == "npm" {
+		if registry == models.RegistryNPM {
 			// NPM packages are stored as tarballs: package-version.tgz
 			// We need to find all files matching the package name pattern
 			pattern := filepath.Join(cacheDir, pkgName)
@@ -72,7 +200,7 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 
 			deletedFiles := false
 			for _, match := range matches {
-				if err := os.Remove(match); err != nil {
+				if err := removeCachedFile(match); err != nil {
 					log.Printf("Error deleting NPM cache file %s: %v", match, err)
 				} else {
 					log.Printf("Deleted NPM cache file: %s", match)
@@ -83,6 +211,8 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 			if !deletedFiles && len(matches) == 0 {
 				log.Printf("No NPM cache files found for package: %s", pkgName)
 			}
+
+			invalidatePurgedMetadata(r, registry, pkgName)
 		} else {
 			// Ruby gems are stored as: package-version.gem
 			pattern := filepath.Join(cacheDir, pkgName)
@@ -95,7 +225,7 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 
 			deletedFiles := false
 			for _, match := range matches {
-				if err := os.Remove(match); err != nil {
+				if err := removeCachedFile(match); err != nil {
 					log.Printf("Error deleting gem cache file %s: %v", match, err)
 				} else {
 					log.Printf("Deleted gem cache file: %s", match)
@@ -106,11 +236,13 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 			if !deletedFiles && len(matches) == 0 {
 				log.Printf("No gem cache files found for package: %s", pkgName)
 			}
+
+			invalidatePurgedMetadata(r, registry, pkgName)
 		}
 	}
 
-	// Delete from database
-	if err := repositories.PackageRepo.DeletePackagesByNames(req.Packages); err != nil {
+	// Delete from database, keeping the rows other repositories still need
+	if err := repositories.PackageRepo.DeletePackagesByNames(registry, purgedRows(registry, cacheDir, req.Packages)); err != nil {
 		log.Printf("Error deleting packages from database: %v", err)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(PurgeResponse{
@@ -122,6 +254,8 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 
 	deleted = req.Packages
 	log.Printf("Successfully purged %d packages", len(deleted))
+	recordPurges(clientIdentity(r), registry, deleted)
+	noteAudit(r, "%d purged: %s", len(deleted), strings.Join(deleted, ", "))
 
 	w.Header().Set("Content-Type", "application/json")
 	response := PurgeResponse{
@@ -137,3 +271,25 @@ func purgeHandler(w http.ResponseWriter, r *http.Request, cacheDir, packageType
 
 	json.NewEncoder(w).Encode(response)
 }
+
+// invalidatePurgedMetadata drops the cached metadata that still references
+// a purged file, so clients do not resolve it against rewritten documents
+// that went stale. PyPI simple pages are not cached.
+func invalidatePurgedMetadata(r *http.Request, registry, fileName string) {
+	invalidateRepositoryMetadata(NPMRepository(r), RubyGemsRepository(r), registry, fileName)
+}
+
+// invalidateRepositoryMetadata drops the metadata cached by the npm or
+// RubyGems repository that references a purged file.
+func invalidateRepositoryMetadata(npmRepo *config.NPMProxyConfig, gemRepo *config.RubyGemsProxyConfig, registry, fileName string) {
+	switch registry {
+	case models.RegistryNPM:
+		if name, ok := npmPackageFromCacheFileName(fileName); ok {
+			InvalidateNPMMetadata(npmRepo, name)
+		}
+	case models.RegistryRubyGems:
+		if name, _ := parseCachedFileName(registry, fileName); name != "" {
+			InvalidateGemMetadata(gemRepo, name, strings.TrimSuffix(fileName, ".gem"))
+		}
+	}
+}
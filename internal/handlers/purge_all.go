@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+// purgeAllTokenTTL is how long a full purge may be confirmed after it was
+// requested.
+const purgeAllTokenTTL = 2 * time.Minute
+
+// cacheLock is held for reading while a download serves or fills the cache,
+// and for writing while a full purge empties it.
+var cacheLock sync.RWMutex
+
+// purgeAllConfirmation is a full purge waiting to be confirmed.
+type purgeAllConfirmation struct {
+	registry string
+	cacheDir string
+	expires  time.Time
+}
+
+var (
+	purgeAllTokens   = make(map[string]purgeAllConfirmation)
+	purgeAllTokensMu sync.Mutex
+)
+
+// PurgeAllRequest confirms a full purge with the token returned when it was
+// requested. Without a token, the purge is only requested.
+type PurgeAllRequest struct {
+	ConfirmationToken string `json:"confirmation_token"`
+}
+
+type PurgeAllResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	// ConfirmationToken must be sent back before ExpiresAt to run the purge.
+	ConfirmationToken string     `json:"confirmation_token,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	// Files and Bytes are what would be or was deleted.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func NPMPurgeAllHandler(w http.ResponseWriter, r *http.Request) {
+	purgeAllHandler(w, r, NPMRepository(r).CacheDir, models.RegistryNPM)
+}
+
+func RubyPurgeAllHandler(w http.ResponseWriter, r *http.Request) {
+	purgeAllHandler(w, r, RubyGemsRepository(r).CacheDir, models.RegistryRubyGems)
+}
+
+func PyPIPurgeAllHandler(w http.ResponseWriter, r *http.Request) {
+	purgeAllHandler(w, r, PyPIRepository(r).CacheDir, models.RegistryPyPI)
+}
+
+// purgeAllHandler empties the cache directory of a repository in two steps:
+// a request without a token reports what would be deleted and returns a
+// confirmation token, and a request with that token deletes it.
+func purgeAllHandler(w http.ResponseWriter, r *http.Request, cacheDir, registry string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PurgeAllRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ConfirmationToken == "" {
+		files, size := listCacheFiles(cacheDir)
+		token := randomToken()
+		expires := time.Now().Add(purgeAllTokenTTL)
+
+		purgeAllTokensMu.Lock()
+		for t, c := range purgeAllTokens {
+			if time.Now().After(c.expires) {
+				delete(purgeAllTokens, t)
+			}
+		}
+		purgeAllTokens[token] = purgeAllConfirmation{registry: registry, cacheDir: cacheDir, expires: expires}
+		purgeAllTokensMu.Unlock()
+
+		noteAudit(r, "confirmation requested for %d files (%s)", len(files), stats.FormatBytes(size))
+		writePurgeAllResponse(w, http.StatusOK, PurgeAllResponse{
+			Success: true,
+			Message: fmt.Sprintf("Purging %d files (%s) must be confirmed within %s",
+				len(files), stats.FormatBytes(size), purgeAllTokenTTL),
+			ConfirmationToken: token,
+			ExpiresAt:         &expires,
+			Files:             len(files),
+			Bytes:             size,
+		})
+		return
+	}
+
+	// Tokens are single use and only confirm a purge of the same cache
+	purgeAllTokensMu.Lock()
+	confirmation, ok := purgeAllTokens[req.ConfirmationToken]
+	delete(purgeAllTokens, req.ConfirmationToken)
+	purgeAllTokensMu.Unlock()
+	if !ok || time.Now().After(confirmation.expires) ||
+		confirmation.registry != registry || confirmation.cacheDir != cacheDir {
+		writePurgeAllResponse(w, http.StatusBadRequest, PurgeAllResponse{
+			Success: false,
+			Message: "Invalid or expired confirmation token",
+		})
+		return
+	}
+
+	// Keep the refresh and the reconciler from rebuilding rows meanwhile
+	refreshMutex.Lock()
+	if refreshInProgress {
+		refreshMutex.Unlock()
+		writePurgeAllResponse(w, http.StatusConflict, PurgeAllResponse{
+			Success: false,
+			Message: "A refresh operation is in progress. Please wait.",
+		})
+		return
+	}
+	refreshInProgress = true
+	refreshMutex.Unlock()
+	defer func() {
+		refreshMutex.Lock()
+		refreshInProgress = false
+		refreshMutex.Unlock()
+	}()
+
+	// Wait for downloads in progress and hold new ones until the cache is empty
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	files, _ := listCacheFiles(cacheDir)
+	var deleted []string
+	var size int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if err := removeCachedFile(file); err != nil {
+			log.Printf("Error deleting cache file %s: %v", file, err)
+			continue
+		}
+		fileName := filepath.Base(file)
+		deleted = append(deleted, fileName)
+		size += info.Size()
+		invalidatePurgedMetadata(r, registry, fileName)
+	}
+
+	// Only rows of deleted files no other repository of the registry holds
+	// go, as they share the table
+	for names := purgedRows(registry, cacheDir, deleted); len(names) > 0; {
+		batch := names[:min(len(names), 500)]
+		names = names[len(batch):]
+		if err := repositories.PackageRepo.DeletePackagesByNames(registry, batch); err != nil {
+			log.Printf("Error deleting packages from database: %v", err)
+			writePurgeAllResponse(w, http.StatusInternalServerError, PurgeAllResponse{
+				Success: false,
+				Message: "Cache files deleted but failed to delete packages from database",
+				Files:   len(deleted),
+				Bytes:   size,
+			})
+			return
+		}
+	}
+	log.Printf("Purged the whole cache of %s: %d files, %s", registry, len(deleted), stats.FormatBytes(size))
+	recordPurges(clientIdentity(r), registry, deleted)
+	noteAudit(r, "purged %d files (%s)", len(deleted), stats.FormatBytes(size))
+
+	response := PurgeAllResponse{
+		Success: true,
+		Message: fmt.Sprintf("Purged %d files (%s)", len(deleted), stats.FormatBytes(size)),
+		Files:   len(deleted),
+		Bytes:   size,
+	}
+	if len(deleted) < len(files) {
+		response.Message = fmt.Sprintf("Purged %d of %d files; see the server log for errors", len(deleted), len(files))
+	}
+	writePurgeAllResponse(w, http.StatusOK, response)
+}
+
+// listCacheFiles returns the paths of the files cached in cacheDir and
+// their total size, leaving out downloads in progress and hidden files.
+func listCacheFiles(cacheDir string) ([]string, int64) {
+	var files []string
+	var size int64
+	janitor.WalkArtifacts(cacheDir, func(path string, info os.FileInfo) {
+		files = append(files, path)
+		size += info.Size()
+	})
+	return files, size
+}
+
+func writePurgeAllResponse(w http.ResponseWriter, status int, response PurgeAllResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
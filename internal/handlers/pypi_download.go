@@ -1,9 +1,7 @@
 package handlers
 
 import (
-	"crypto/sha512"
-	"encoding/hex"
-	"io"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -12,55 +10,55 @@ import (
 	"sync"
 
 	"github.com/pkgb-in/pkgbin/config"
-	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
 )
 
 // pypiDownloadLocks prevents concurrent downloads of the same package
 var pypiDownloadLocks = make(map[string]*sync.Mutex)
 var pypiDownloadLocksMutex sync.Mutex
 
-// generatePyPICacheFileName creates a unique filename from PyPI URL path
-// PyPI URLs can be complex: /packages/source/p/package/package-1.0.0.tar.gz
-// or /packages/py3/p/package/package-1.0.0-py3-none-any.whl
-// We preserve the structure by replacing slashes with double underscores
-func generatePyPICacheFileName(urlPath string) string {
-	// Remove leading slash
-	urlPath = strings.TrimPrefix(urlPath, "/")
-
-	// For PyPI packages like /packages/source/p/package/package-1.0.0.tar.gz
-	// Convert to: packages__source__p__package__package-1.0.0.tar.gz
-	// This ensures uniqueness across different package structures
-
-	// Replace all slashes except the last one (filename)
-	parts := strings.Split(urlPath, "/")
-	if len(parts) > 1 {
-		// Join all directory parts with __ and keep the filename
-		dirParts := parts[:len(parts)-1]
-		fileName := parts[len(parts)-1]
-		return strings.Join(dirParts, "__") + "__" + fileName
+func PyPIDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := admitDownload(w, r)
+	if !ok {
+		return
 	}
+	defer release()
 
-	// Fallback to just the filename
-	return filepath.Base(urlPath)
-}
-
-func PyPIDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
 
-	Upstream := config.PyPIConfig.Upstream
-	CacheDir := config.PyPIConfig.CacheDir
+	repo := PyPIRepository(r)
+	Upstream := PyPIUpstreamForPath(repo, r.URL.Path)
+	CacheDir := repo.CacheDir
 
 	// Generate unique cache filename preserving PyPI structure
-	fileName := generatePyPICacheFileName(r.URL.Path)
+	fileName := cachekey.PyPI(r.URL.Path)
 	localPath := filepath.Join(CacheDir, fileName)
 
+	// Refuse versions with known vulnerabilities above the block threshold
+	scanTarget := pypiScanTarget(r, fileName)
+	if message, blocked := vulnerabilityDenial(repo.Vulnerabilities, scanTarget); blocked {
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+
+	// Paths sharing the key of another never use its cached file
+	if cacheKeyTaken(r, models.RegistryPyPI, fileName) {
+		streamArtifact(w, r, models.RegistryPyPI, fileName, pypiArtifactURL(repo, Upstream, r.URL.Path))
+		return
+	}
+
 	// Check local cache and verify integrity
 	if stat, err := os.Stat(localPath); err == nil && stat.Size() > 0 {
 		// Verify file is readable before serving
 		if file, err := os.Open(localPath); err == nil {
 			file.Close()
 			log.Printf("Serving from cache: %s", fileName)
-			repositories.PackageRepo.UpdatePackageAccess(fileName, true)
-			http.ServeFile(w, r, localPath)
+			recordAccess(models.RegistryPyPI, fileName, true)
+			serveArtifact(w, r, models.RegistryPyPI, fileName, localPath, true)
 			return
 		} else {
 			// File exists but can't be read - delete it
@@ -69,6 +67,14 @@ func PyPIDownloadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Read-only replicas have their writer fetch and cache misses
+	if readOnlyReplica() {
+		log.Printf("Cache miss: Fetching %s from the writer", fileName)
+		defer beginLiveDownload(r, models.RegistryPyPI, fileName, false)()
+		streamArtifact(w, r, models.RegistryPyPI, fileName, replicaWriterURL(r))
+		return
+	}
+
 	// Get or create a lock for this specific file to prevent concurrent downloads
 	pypiDownloadLocksMutex.Lock()
 	lock, exists := pypiDownloadLocks[fileName]
@@ -82,96 +88,84 @@ func PyPIDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	lock.Lock()
 	defer lock.Unlock()
 
+	// And across the other nodes of a cluster sharing the cache
+	unlockCluster, err := cluster.Lock(r.Context(), models.RegistryPyPI+"/"+fileName)
+	if err != nil {
+		writeLockUnavailable(w, r, fileName, err)
+		return
+	}
+	defer unlockCluster()
+
+	// A path sharing the key may have cached its file in the meantime
+	if cacheKeyTaken(r, models.RegistryPyPI, fileName) {
+		streamArtifact(w, r, models.RegistryPyPI, fileName, pypiArtifactURL(repo, Upstream, r.URL.Path))
+		return
+	}
+
 	// Double-check cache after acquiring lock (another request may have downloaded it)
 	if stat, err := os.Stat(localPath); err == nil && stat.Size() > 0 {
 		if file, err := os.Open(localPath); err == nil {
 			file.Close()
 			log.Printf("Serving from cache (after lock): %s", fileName)
-			repositories.PackageRepo.UpdatePackageAccess(fileName, true)
-			http.ServeFile(w, r, localPath)
+			recordAccess(models.RegistryPyPI, fileName, true)
+			serveArtifact(w, r, models.RegistryPyPI, fileName, localPath, true)
 			return
 		}
 	}
 
 	// Cache miss: Fetch from upstream
 	log.Printf("Cache miss: Fetching %s from %s", fileName, r.URL.Path)
-	repositories.PackageRepo.UpdatePackageAccess(fileName, false)
+	recordAccess(models.RegistryPyPI, fileName, false)
+	defer beginLiveDownload(r, models.RegistryPyPI, fileName, false)()
 
-	// PyPI packages are hosted on files.pythonhosted.org CDN
-	// The URL path contains the full package location
-	var upstreamURL string
-	if strings.HasPrefix(r.URL.Path, "/packages/") {
-		// Direct package file request - use CDN
-		upstreamURL = "https://files.pythonhosted.org" + r.URL.Path
-	} else {
-		// Fallback to main PyPI
-		upstreamURL = Upstream + r.URL.Path
-	}
+	upstreamURL := pypiArtifactURL(repo, Upstream, r.URL.Path)
 
 	log.Printf("Fetching from upstream: %s", upstreamURL)
 
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// Follow redirects to CDN
-			return nil
-		},
+	// Send the file without caching it when configured so, when it is a
+	// wheel for a platform not cached or when the cache volume is full
+	if noStore(repo.NoStore, models.RegistryPyPI, fileName) || wheelPlatformRefused(repo.WheelPlatforms, fileName) ||
+		!cacheHasSpace(r, models.RegistryPyPI, CacheDir) {
+		streamArtifact(w, r, models.RegistryPyPI, fileName, upstreamURL)
+		return
 	}
 
-	resp, err := client.Get(upstreamURL)
+	// Look up the sha256 declared in the simple index so corrupted or
+	// tampered distributions never reach the cache
+	expected, err := pypiExpectedDigest(r.Context(), Upstream, r.URL.Path)
 	if err != nil {
-		http.Error(w, "Upstream fetch failed", http.StatusBadGateway)
-		log.Printf("Failed to fetch from upstream: %s (error: %v)", upstreamURL, err)
-		return
+		log.Printf("Could not determine expected checksum for %s, caching unverified: %v", fileName, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "Upstream fetch failed", http.StatusBadGateway)
-		log.Printf("Failed to fetch from upstream: %s (status: %d)", upstreamURL, resp.StatusCode)
+	artifact, err := fetchArtifact(r.Context(), models.RegistryPyPI, upstream.Client, upstreamURL, localPath, expected, repo.MaxArtifactSize)
+	if errors.Is(err, errArtifactTooLarge) && !repo.RejectOversized {
+		log.Printf("Not caching %s, larger than %d bytes", fileName, repo.MaxArtifactSize)
+		streamArtifact(w, r, models.RegistryPyPI, fileName, upstreamURL)
 		return
 	}
-
-	// Use temporary file for atomic write
-	tempPath := localPath + ".tmp"
-	outFile, err := os.Create(tempPath)
 	if err != nil {
-		http.Error(w, "File creation failed", http.StatusInternalServerError)
+		writeFetchError(w, r, fileName, err)
 		return
 	}
+	recordArtifact(models.RegistryPyPI, fileName, artifact)
+	claimCacheKey(r, models.RegistryPyPI, fileName)
+	setUpstreamCacheStatus(w.Header(), artifact.UpstreamCacheStatus)
 
-	// Download completely to temp file first with integrity check
-	hash := sha512.New()
-	multiWriter := io.MultiWriter(outFile, hash)
-	bytesWritten, err := io.Copy(multiWriter, resp.Body)
-	outFile.Close()
-
-	if err != nil {
-		os.Remove(tempPath)
-		http.Error(w, "Download failed", http.StatusInternalServerError)
-		log.Printf("Download error for %s: %v", fileName, err)
-		return
-	}
+	scanOnCacheMiss(repo.Vulnerabilities, scanTarget)
 
-	// Verify file was written completely
-	if stat, err := os.Stat(tempPath); err != nil || stat.Size() != bytesWritten {
-		os.Remove(tempPath)
-		http.Error(w, "File write verification failed", http.StatusInternalServerError)
-		log.Printf("Size mismatch for %s: expected %d, got %d", fileName, bytesWritten, stat.Size())
-		return
-	}
+	// Serve the newly cached file
+	serveArtifact(w, r, models.RegistryPyPI, fileName, localPath, false)
+}
 
-	// Atomically move temp file to final location
-	if err := os.Rename(tempPath, localPath); err != nil {
-		os.Remove(tempPath)
-		http.Error(w, "File move failed", http.StatusInternalServerError)
-		log.Printf("Failed to move temp file for %s: %v", fileName, err)
-		return
+// pypiArtifactURL returns the upstream URL of the distribution file at
+// urlPath, served by upstreamBase. PyPI packages are hosted on the
+// files.pythonhosted.org CDN, and the URL path contains the full package
+// location.
+func pypiArtifactURL(repo *config.PyPIProxyConfig, upstreamBase, urlPath string) string {
+	if strings.HasPrefix(urlPath, "/packages/") && upstreamBase == repo.Upstream {
+		// Direct package file request - use CDN
+		return "https://files.pythonhosted.org" + urlPath
 	}
-
-	// Log the file hash for debugging
-	fileHash := hex.EncodeToString(hash.Sum(nil))
-	log.Printf("Cached %s (size: %d bytes, sha512: %s)", fileName, bytesWritten, fileHash[:16]+"...")
-
-	// Serve the newly cached file
-	http.ServeFile(w, r, localPath)
+	// Fallback to main PyPI
+	return upstream.Join(upstreamBase, urlPath)
 }
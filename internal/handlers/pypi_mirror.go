@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+)
+
+// mirrorBatchSize is how many package rows are loaded at once to find the
+// digests of the mirrored files.
+const mirrorBatchSize = 1000
+
+// pypiMirrorPage is a PEP 503 project page of the static mirror, linking
+// to the files relative to it as bandersnatch does.
+var pypiMirrorPage = template.Must(template.New("project").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.0">
+    <title>Links for {{.Project}}</title>
+  </head>
+  <body>
+    <h1>Links for {{.Project}}</h1>
+{{- range .Files}}
+    <a href="../../{{.Path}}{{if .SHA256}}#sha256={{.SHA256}}{{end}}">{{.Name}}</a><br/>
+{{- end}}
+  </body>
+</html>
+`))
+
+// pypiMirrorIndex is the root PEP 503 page of the static mirror.
+var pypiMirrorIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.0">
+    <title>Simple Index</title>
+  </head>
+  <body>
+{{- range .}}
+    <a href="{{.}}/">{{.}}</a><br/>
+{{- end}}
+  </body>
+</html>
+`))
+
+// pypiMirrorFile is a distribution file of the static mirror.
+type pypiMirrorFile struct {
+	Name string
+	// Path is where the file is under the mirror, packages/... like the
+	// upstream file URL
+	Path   string
+	SHA256 string
+}
+
+// pypiMirrorDigests remembers the digests of the files hashed by earlier
+// passes, for cached files with no digest recorded.
+var (
+	pypiMirrorDigests   = make(map[string]pypiMirrorDigest)
+	pypiMirrorDigestsMu sync.Mutex
+)
+
+type pypiMirrorDigest struct {
+	modTime time.Time
+	sha256  string
+}
+
+// StartPyPIMirrors periodically brings the static mirror of every PyPI
+// repository with a mirror interval up to date with its cache, within the
+// maintenance windows. The leader of a cluster writes them for every node,
+// and read-only replicas leave them to their writer.
+func StartPyPIMirrors() {
+	if readOnlyReplica() {
+		return
+	}
+	for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+		cfg := repo.Mirror
+		if cfg.Interval.Duration <= 0 || cfg.Dir == "" {
+			continue
+		}
+		cacheDir := repo.CacheDir
+		go func() {
+			ticker := time.NewTicker(cfg.Interval.Duration)
+			defer ticker.Stop()
+			for range ticker.C {
+				maintenance.Wait(config.MaintenanceMirror)
+				if cluster.IsLeader(models.RegistryPyPI) {
+					if err := writePyPIMirror(cacheDir, cfg.Dir); err != nil {
+						log.Printf("Failed to update the PyPI mirror in %s: %v", cfg.Dir, err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// writePyPIMirror lays the distributions cached in cacheDir out in dir:
+// each file linked (or copied) under packages/, a page per project under
+// simple/, and simple/index.html listing them. Files and projects no longer
+// cached are removed, and pages are replaced atomically, so the mirror can
+// be served while it is updated.
+func writePyPIMirror(cacheDir, dir string) error {
+	start := time.Now()
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	digests := pypiRecordedDigests()
+
+	projects := make(map[string][]pypiMirrorFile)
+	keep := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), janitor.TempSuffix) {
+			continue
+		}
+		file, project, ok := pypiMirrorEntry(entry.Name())
+		if !ok {
+			continue
+		}
+		src, dst := filepath.Join(cacheDir, entry.Name()), filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := mirrorFile(src, dst); err != nil {
+			log.Printf("Failed to mirror %s: %v", entry.Name(), err)
+			continue
+		}
+		if file.SHA256 = digests[entry.Name()]; file.SHA256 == "" {
+			if file.SHA256, err = pypiMirrorSHA256(src); err != nil {
+				log.Printf("Failed to hash %s: %v", entry.Name(), err)
+			}
+		}
+		keep[dst] = true
+		projects[project] = append(projects[project], file)
+	}
+
+	names := make([]string, 0, len(projects))
+	for project, files := range projects {
+		names = append(names, project)
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		var page bytes.Buffer
+		if err := pypiMirrorPage.Execute(&page, struct {
+			Project string
+			Files   []pypiMirrorFile
+		}{project, files}); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, "simple", project, "index.html"), page.Bytes()); err != nil {
+			return err
+		}
+	}
+	sort.Strings(names)
+	var index bytes.Buffer
+	if err := pypiMirrorIndex.Execute(&index, names); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "simple", "index.html"), index.Bytes()); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "last-modified"), []byte(start.UTC().Format("20060102T15:04:05")+"\n")); err != nil {
+		return err
+	}
+
+	removed := prunePyPIMirror(dir, projects, keep)
+	log.Printf("PyPI mirror in %s updated: %d projects, %d files, %d removed, in %s",
+		dir, len(projects), len(keep), removed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// pypiMirrorEntry returns the mirror file of the distribution cached as
+// fileName and its normalized project, false for files that are not
+// distributions.
+func pypiMirrorEntry(fileName string) (pypiMirrorFile, string, bool) {
+	name := pypiDistributionName(fileName)
+	if !isPyPIDistributionPath(name) || strings.HasSuffix(name, ".metadata") {
+		return pypiMirrorFile{}, "", false
+	}
+	project := pypiProjectFromFilename(name)
+	if project == "" {
+		return pypiMirrorFile{}, "", false
+	}
+	// The cache key flattens the upstream path, packages/ab/cd/...
+	dirs := strings.TrimSuffix(strings.TrimSuffix(fileName, name), "__")
+	filePath := "packages/" + name
+	if dirs != "" {
+		filePath = strings.ReplaceAll(dirs, "__", "/") + "/" + name
+		if !strings.HasPrefix(filePath, "packages/") {
+			filePath = "packages/" + filePath
+		}
+	}
+	return pypiMirrorFile{Name: name, Path: filePath}, normalizePyPIName(project), true
+}
+
+// mirrorFile makes dst a copy of src, a hard link where the file system
+// allows it. dst is left alone when it already is the same file or a copy
+// of the same size and time.
+func mirrorFile(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil {
+		if os.SameFile(srcInfo, dstInfo) || (dstInfo.Size() == srcInfo.Size() && dstInfo.ModTime().Equal(srcInfo.ModTime())) {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	temp := dst + janitor.TempSuffix
+	defer janitor.Track(temp)()
+	os.Remove(temp)
+	if err := os.Link(src, temp); err != nil {
+		if err := copyMirrorFile(src, temp, srcInfo.ModTime()); err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+	if err := os.Rename(temp, dst); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// copyMirrorFile copies src to dst, keeping its modification time.
+func copyMirrorFile(src, dst string, modTime time.Time) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, modTime, modTime)
+}
+
+// pypiRecordedDigests returns the SHA-256 digests recorded for the cached
+// PyPI files, by cache file name.
+func pypiRecordedDigests() map[string]string {
+	digests := make(map[string]string)
+	if repositories.PackageRepo == nil {
+		return digests
+	}
+	err := repositories.PackageRepo.EachPackage(models.RegistryPyPI, mirrorBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			if pkg.SHA256 != "" {
+				digests[pkg.Name] = pkg.SHA256
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to load the digests of cached PyPI files: %v", err)
+	}
+	return digests
+}
+
+// pypiMirrorSHA256 hashes the file at path, or returns the digest of an
+// earlier pass when it was not modified since.
+func pypiMirrorSHA256(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	pypiMirrorDigestsMu.Lock()
+	d, ok := pypiMirrorDigests[path]
+	pypiMirrorDigestsMu.Unlock()
+	if ok && d.modTime.Equal(info.ModTime()) {
+		return d.sha256, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	pypiMirrorDigestsMu.Lock()
+	pypiMirrorDigests[path] = pypiMirrorDigest{modTime: info.ModTime(), sha256: sum}
+	pypiMirrorDigestsMu.Unlock()
+	return sum, nil
+}
+
+// prunePyPIMirror removes from dir the files under packages/ other than
+// keep and the pages of projects no longer mirrored, returning how many
+// files it removed.
+func prunePyPIMirror(dir string, projects map[string][]pypiMirrorFile, keep map[string]bool) int {
+	removed := 0
+	packages := filepath.Join(dir, "packages")
+	filepath.WalkDir(packages, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || keep[path] || strings.HasSuffix(path, janitor.TempSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err == nil {
+			removed++
+		}
+		return nil
+	})
+	removeEmptyDirs(packages)
+
+	pages, err := os.ReadDir(filepath.Join(dir, "simple"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to list the PyPI mirror pages in %s: %v", dir, err)
+	}
+	for _, page := range pages {
+		if _, ok := projects[page.Name()]; page.IsDir() && !ok {
+			os.RemoveAll(filepath.Join(dir, "simple", page.Name()))
+		}
+	}
+	return removed
+}
+
+// removeEmptyDirs removes the empty directories under root, deepest first.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/metacache"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// pypiProvenanceMediaType is the media type of PEP 740 provenance objects.
+const pypiProvenanceMediaType = "application/vnd.pypi.integrity.v1+json"
+
+// pypiProvenancePath matches the PEP 740 provenance URLs of PyPI,
+// /integrity/<project>/<version>/<file>/provenance.
+var pypiProvenancePath = regexp.MustCompile(`^/integrity/([^/]+)/[^/]+/[^/]+/provenance$`)
+
+// pypiMetadataStores cache provenance on disk, one store per repository
+// metadata directory
+var pypiMetadataStores = make(map[string]*metacache.Store)
+
+// InitPyPIMetadataCache prepares the on-disk caches used for the
+// provenance of the default and every named PyPI repository.
+func InitPyPIMetadataCache() error {
+	for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+		store, err := metacache.New(repo.MetadataDir)
+		if err != nil {
+			return err
+		}
+		pypiMetadataStores[repo.MetadataDir] = store
+	}
+	return nil
+}
+
+// IsPyPIProvenanceRequest reports whether r reads the provenance of a
+// distribution file, at the URL the rewritten Simple API pages link.
+func IsPyPIProvenanceRequest(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && pypiProvenancePath.MatchString(r.URL.Path)
+}
+
+// PyPIProvenanceHandler serves the provenance of a distribution file from
+// the metadata cache, fetching it from the upstream of its project. The
+// attestations are served as sent, for installers to verify against
+// Sigstore.
+func PyPIProvenanceHandler(w http.ResponseWriter, r *http.Request) {
+	project := pypiProvenancePath.FindStringSubmatch(r.URL.Path)[1]
+	repo := PyPIRepository(r)
+	store := pypiMetadataStores[repo.MetadataDir]
+	upstreamURL := upstream.Join(PyPIUpstreamFor(repo, project), r.URL.EscapedPath())
+	header := http.Header{"Accept": {pypiProvenanceMediaType + ", application/json;q=0.9"}}
+	entry, stale, err := store.Fetch(r.Context(), metadataClient, strings.TrimPrefix(r.URL.Path, "/"), upstreamURL, header, repo.ProvenanceTTL.Duration)
+	if err != nil {
+		var statusErr *metacache.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			http.Error(w, "Provenance not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to fetch provenance %s [%s]: %v", r.URL.Path, requestid.FromContext(r.Context()), err)
+		http.Error(w, "Failed to fetch provenance from upstream", http.StatusBadGateway)
+		return
+	}
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	store.Serve(w, r, entry)
+}
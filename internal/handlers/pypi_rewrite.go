@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"golang.org/x/net/html"
+)
+
+// pypiFilesHost is the CDN host PyPI serves distribution files from.
+const pypiFilesHost = "files.pythonhosted.org"
+
+// RewritePyPISimple rewrites distribution URLs in a Simple API response
+// (PEP 503 HTML or PEP 691 JSON) read from r so they point at proxyURL,
+// writing the result to w as it goes. Only the scheme and host of each file
+// URL change; paths, #sha256= fragments and all other attributes or fields
+// (data-requires-python, data-dist-info-metadata, hashes, yanked, ...) are
+// preserved as sent by upstream. PEP 740 provenance URLs are pointed at the
+// proxy the same way, which caches the provenance.
+func RewritePyPISimple(repo *config.PyPIProxyConfig, w io.Writer, r io.Reader, contentType, proxyURL string) error {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %q: %w", proxyURL, err)
+	}
+	bw := bufio.NewWriter(w)
+	if strings.Contains(contentType, "json") {
+		err = rewritePyPISimpleJSON(repo, bw, r, proxy)
+	} else {
+		err = rewritePyPISimpleHTML(repo, bw, r, proxy)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// rewritePyPIFileURL points a files.pythonhosted.org URL at the proxy,
+// leaving any other URL (including relative ones) untouched.
+func rewritePyPIFileURL(repo *config.PyPIProxyConfig, raw string, proxy *url.URL) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || !isPyPIFileHost(repo, u.Host) {
+		return raw, false
+	}
+	u.Scheme = proxy.Scheme
+	u.Host = proxy.Host
+	u.Path = strings.TrimSuffix(proxy.Path, "/") + u.Path
+	if u.RawPath != "" {
+		u.RawPath = strings.TrimSuffix(proxy.EscapedPath(), "/") + u.RawPath
+	}
+	return u.String(), true
+}
+
+// isPyPIFileHost reports whether host serves distribution files that should
+// go through the proxy: PyPI's CDN, or the host of any upstream of repo.
+// pypi.org is no exception when it is an upstream: it links its files on
+// the CDN, but whatever it links on its own host is fetched from it through
+// the proxy too, like the files other indexes link on theirs.
+func isPyPIFileHost(repo *config.PyPIProxyConfig, host string) bool {
+	if strings.EqualFold(host, pypiFilesHost) {
+		return true
+	}
+	upstreams := []string{repo.Upstream}
+	for _, route := range repo.Routes {
+		upstreams = append(upstreams, route.Upstream)
+	}
+	for _, upstreamURL := range upstreams {
+		if u, err := url.Parse(upstreamURL); err == nil && strings.EqualFold(host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewritePyPISimpleHTML rewrites href attributes token by token. Tokens that
+// need no change are copied byte for byte from the original document.
+func rewritePyPISimpleHTML(repo *config.PyPIProxyConfig, w *bufio.Writer, r io.Reader, proxy *url.URL) error {
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return err
+			}
+			return nil
+		}
+
+		raw := z.Raw()
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			w.Write(raw)
+			continue
+		}
+
+		// z.Raw is only valid until the next call, so copy it before
+		// materializing the token
+		raw = append([]byte(nil), raw...)
+		token := z.Token()
+		changed := false
+		for i, attr := range token.Attr {
+			if attr.Key != "href" && attr.Key != "data-provenance" {
+				continue
+			}
+			if rewritten, ok := rewritePyPIFileURL(repo, attr.Val, proxy); ok {
+				token.Attr[i].Val = rewritten
+				changed = true
+			}
+		}
+		if changed {
+			w.WriteString(token.String())
+		} else {
+			w.Write(raw)
+		}
+	}
+}
+
+// jsonContainer is an object or array being copied by
+// rewritePyPISimpleJSON, with the key of the current member for objects.
+type jsonContainer struct {
+	object bool
+	// n counts the members written, keys and values alike for objects
+	n   int
+	key string
+}
+
+// rewritePyPISimpleJSON rewrites the url and provenance of every file in a
+// PEP 691 project page, copying the document token by token so unknown keys
+// survive and only the current token is held in memory. The output is
+// compact.
+func rewritePyPISimpleJSON(repo *config.PyPIProxyConfig, w *bufio.Writer, r io.Reader, proxy *url.URL) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var stack []jsonContainer
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				stack[len(stack)-1].n++
+			}
+			w.WriteByte(byte(delim))
+			continue
+		}
+
+		var parent *jsonContainer
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+			if parent.n > 0 && (!parent.object || parent.n%2 == 0) {
+				w.WriteByte(',')
+			}
+		}
+		if parent != nil && parent.object && parent.n%2 == 0 {
+			// Keys are always strings
+			parent.key = tok.(string)
+			parent.n++
+			if err := writeJSONNoEscape(w, parent.key); err != nil {
+				return err
+			}
+			w.WriteByte(':')
+			continue
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			w.WriteByte(byte(v))
+			stack = append(stack, jsonContainer{object: v == '{'})
+			// The parent counts the container once it is closed
+			continue
+		case string:
+			// Only the url and provenance of the members of the top-level
+			// files array
+			if len(stack) == 3 && stack[0].key == "files" && !stack[1].object && (stack[2].key == "url" || stack[2].key == "provenance") {
+				if rewritten, ok := rewritePyPIFileURL(repo, v, proxy); ok {
+					tok = rewritten
+				}
+			}
+		}
+		if err := writeJSONNoEscape(w, tok); err != nil {
+			return err
+		}
+		if parent != nil {
+			parent.n++
+		}
+	}
+}
+
+// writeJSONNoEscape writes the encoding of v to w, see marshalJSONNoEscape.
+func writeJSONNoEscape(w io.Writer, v any) error {
+	encoded, err := marshalJSONNoEscape(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+// marshalJSONNoEscape encodes v without escaping <, > and &, which appear in
+// requires-python specifiers and must stay readable to clients.
+func marshalJSONNoEscape(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
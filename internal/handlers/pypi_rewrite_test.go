@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+func TestIsPyPIFileHost(t *testing.T) {
+	pypi := &config.PyPIProxyConfig{Upstream: "https://pypi.org"}
+	mirror := &config.PyPIProxyConfig{
+		Upstream: "https://pypi.internal.example.com/root/pypi",
+		Routes:   []config.UpstreamRoute{{Upstream: "https://gitlab.example.com/api/v4/projects/1/packages/pypi"}},
+	}
+	tests := []struct {
+		name string
+		repo *config.PyPIProxyConfig
+		host string
+		want bool
+	}{
+		{"cdn", pypi, "files.pythonhosted.org", true},
+		{"cdn in capitals", pypi, "Files.PythonHosted.org", true},
+		{"pypi.org as the upstream", pypi, "pypi.org", true},
+		{"pypi.org when not an upstream", mirror, "pypi.org", false},
+		{"cdn of a mirror", mirror, "files.pythonhosted.org", true},
+		{"upstream of a mirror", mirror, "pypi.internal.example.com", true},
+		{"routed upstream", mirror, "gitlab.example.com", true},
+		{"other host", mirror, "github.com", false},
+		{"relative link", mirror, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPyPIFileHost(tt.repo, tt.host); got != tt.want {
+				t.Errorf("isPyPIFileHost(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
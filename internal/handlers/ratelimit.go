@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/ratelimit"
+)
+
+// throttleChunkSize bounds how many bytes are written per bandwidth token
+// reservation, so throttled clients receive a steady stream.
+const throttleChunkSize = 32 << 10
+
+var (
+	requestLimits   *ratelimit.Keyed
+	bandwidthLimits *ratelimit.Keyed
+	rateLimitExempt []*net.IPNet
+)
+
+// InitRateLimit sets up the per client IP limits from the server config.
+func InitRateLimit() error {
+	requests, bandwidth, exempt, err := newRateLimits(config.Server.RateLimit)
+	if err != nil {
+		return err
+	}
+	requestLimits, bandwidthLimits, rateLimitExempt = requests, bandwidth, exempt
+	return nil
+}
+
+// newRateLimits returns the request and bandwidth limits of cfg, nil when
+// unlimited, and the networks exempted from them.
+func newRateLimits(cfg config.RateLimit) (requests, bandwidth *ratelimit.Keyed, exempt []*net.IPNet, err error) {
+	if exempt, err = parseNetworks("rate limit exemption", cfg.Exempt); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if cfg.RequestsPerSecond < 0 || cfg.BytesPerSecond < 0 {
+		return nil, nil, nil, fmt.Errorf("rate limits must not be negative")
+	}
+	if cfg.RequestsPerSecond > 0 {
+		burst := float64(cfg.Burst)
+		if burst <= 0 {
+			burst = math.Max(1, cfg.RequestsPerSecond)
+		}
+		requests = ratelimit.NewKeyed(cfg.RequestsPerSecond, burst)
+		log.Printf("Rate limiting clients to %.1f requests/s (burst %.0f)", cfg.RequestsPerSecond, burst)
+	}
+	if cfg.BytesPerSecond > 0 {
+		burst := cfg.BurstBytes
+		if burst <= 0 {
+			burst = cfg.BytesPerSecond
+		}
+		// A reservation larger than the burst would never be paid back
+		// within one refill, so chunks are capped at the burst size
+		bandwidth = ratelimit.NewKeyed(float64(cfg.BytesPerSecond), float64(max(burst, throttleChunkSize)))
+		log.Printf("Throttling clients to %d bytes/s", cfg.BytesPerSecond)
+	}
+	return requests, bandwidth, exempt, nil
+}
+
+func rateLimitExempted(ip string) bool {
+	return inNetworks(rateLimitExempt, net.ParseIP(ip))
+}
+
+// parseNetworks parses IP addresses or CIDR ranges of the setting what,
+// single addresses standing for the range of just themselves.
+func parseNetworks(what string, entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %w", what, entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// inNetworks tells whether ip is in one of networks.
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitHandler enforces the per client IP request and bandwidth limits
+// on registry traffic. Requests over the limit get a 429 with Retry-After;
+// responses over the bandwidth limit are slowed down rather than refused.
+func RateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" || r.URL.Path == "/healthz" || strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if (requestLimits == nil && bandwidthLimits == nil) || rateLimitExempted(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if requestLimits != nil {
+			if ok, retryAfter := allowRequest(r, ip); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if bandwidthLimits != nil {
+			w = &throttledResponseWriter{ResponseWriter: w, r: r, bucket: bandwidthLimits.Get(ip)}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowRequest takes a request token of ip, from the buckets shared by the
+// cluster through Redis when there are, or from those of this process.
+func allowRequest(r *http.Request, ip string) (bool, time.Duration) {
+	if cluster.Shared() {
+		rate, burst := requestLimits.Limits()
+		ok, retryAfter, err := cluster.Allow(r.Context(), ip, rate, burst)
+		if err == nil {
+			return ok, retryAfter
+		}
+		log.Printf("Failed to check shared rate limit, using the local one: %v", err)
+	}
+	return requestLimits.Get(ip).Allow()
+}
+
+// throttledResponseWriter paces the body written to a client through a
+// bandwidth bucket.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	bucket *ratelimit.Bucket
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), throttleChunkSize)
+		if err := t.bucket.Wait(t.r.Context(), chunk); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
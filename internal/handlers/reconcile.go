@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+)
+
+// reconcileGracePeriod keeps the reconciler away from files and rows that
+// changed very recently, so it does not race downloads in progress.
+const reconcileGracePeriod = 5 * time.Minute
+
+// ReconcileReport describes the drift found by one reconciliation.
+type ReconcileReport struct {
+	Time time.Time `json:"time"`
+	// Files on disk that had no row, and rows whose file was gone
+	MissingInDB   int `json:"missing_in_db"`
+	MissingOnDisk int `json:"missing_on_disk"`
+	// Discrepancies that were repaired
+	Repaired int `json:"repaired"`
+}
+
+var (
+	// lastReconcile maps each registry to its latest reconciliation report
+	lastReconcile   = make(map[string]ReconcileReport)
+	lastReconcileMu sync.Mutex
+)
+
+// LastReconcile returns the report of the most recent reconciliation of
+// registry; its Time is zero if none ran yet.
+func LastReconcile(registry string) ReconcileReport {
+	lastReconcileMu.Lock()
+	defer lastReconcileMu.Unlock()
+	return lastReconcile[registry]
+}
+
+// reconcileDirs lists the directories holding the artifacts of registry.
+func reconcileDirs(registry string) []string {
+	var dirs []string
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+			dirs = append(dirs, repo.CacheDir)
+			if repo.LocalDir != "" {
+				dirs = append(dirs, filepath.Join(repo.LocalDir, "tarballs"))
+			}
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+			dirs = append(dirs, repo.CacheDir)
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+			dirs = append(dirs, repo.CacheDir)
+		}
+	}
+	return dirs
+}
+
+// StartReconciler periodically compares the cached files of registry with
+// the packages table, adding rows for files that have none and removing
+// rows whose file is gone. A zero interval disables it.
+func StartReconciler(registry string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			maintenance.Wait(config.MaintenanceReconcile)
+			reconcile(registry)
+		}
+	}()
+}
+
+// reconcile runs one reconciliation unless a manual database refresh is
+// rebuilding the table, or another node of a cluster leads.
+func reconcile(registry string) {
+	// The leader of a cluster reconciles for every node
+	if !cluster.IsLeader(registry) {
+		return
+	}
+	refreshMutex.Lock()
+	if refreshInProgress {
+		refreshMutex.Unlock()
+		log.Println("Skipping cache reconciliation while a database refresh is running")
+		return
+	}
+	refreshInProgress = true
+	refreshMutex.Unlock()
+	defer func() {
+		refreshMutex.Lock()
+		refreshInProgress = false
+		refreshMutex.Unlock()
+	}()
+
+	// Nor while one runs on another node of a cluster
+	unlock, ok := cluster.TryLock(refreshLockKey(registry))
+	if !ok {
+		log.Println("Skipping cache reconciliation while a database refresh is running on another node")
+		return
+	}
+	defer unlock()
+
+	report, err := reconcileRegistry(registry, time.Now())
+	if err != nil {
+		log.Printf("Cache reconciliation failed: %v", err)
+		return
+	}
+	if report.MissingInDB > 0 || report.MissingOnDisk > 0 {
+		log.Printf("Cache reconciliation found %d files missing from the database and %d rows without a file; repaired %d",
+			report.MissingInDB, report.MissingOnDisk, report.Repaired)
+	}
+
+	lastReconcileMu.Lock()
+	lastReconcile[registry] = report
+	lastReconcileMu.Unlock()
+}
+
+// reconcileRegistry repairs the drift between the files of registry and
+// its rows, ignoring anything changed after now minus the grace period.
+func reconcileRegistry(registry string, now time.Time) (ReconcileReport, error) {
+	report := ReconcileReport{Time: now}
+	cutoff := now.Add(-reconcileGracePeriod)
+
+	rows, err := repositories.PackageRepo.ListCachedFiles(registry)
+	if err != nil {
+		return report, err
+	}
+	known := make(map[string]models.Package, len(rows))
+	for _, row := range rows {
+		known[row.Name] = row
+	}
+
+	onDisk := make(map[string]bool)
+	for _, dir := range reconcileDirs(registry) {
+		janitor.WalkArtifacts(dir, func(path string, info os.FileInfo) {
+			fileName := filepath.Base(path)
+			onDisk[fileName] = true
+			if _, ok := known[fileName]; ok || info.ModTime().After(cutoff) {
+				return
+			}
+
+			report.MissingInDB++
+			pkg := models.Package{Name: fileName, Registry: registry, SizeBytes: info.Size()}
+			pkg.PackageName, pkg.Version = parseCachedFileName(registry, fileName)
+			if err := hashCachedFile(path, &pkg); err != nil {
+				log.Printf("Error hashing %s: %v", fileName, err)
+			}
+			if err := repositories.PackageRepo.CreatePackage(&pkg); err != nil {
+				log.Printf("Error creating package entry for %s: %v", fileName, err)
+				return
+			}
+			known[fileName] = pkg
+			report.Repaired++
+		})
+	}
+
+	// Rows recorded before the registry was stored may belong to another
+	// registry sharing the database, so only rows of registry are removed
+	var stale []string
+	for name, row := range known {
+		if onDisk[name] || row.Registry != registry || row.UpdatedAt.After(cutoff) {
+			continue
+		}
+		stale = append(stale, name)
+	}
+	report.MissingOnDisk = len(stale)
+	for len(stale) > 0 {
+		batch := stale[:min(len(stale), 500)]
+		stale = stale[len(batch):]
+		if err := repositories.PackageRepo.DeletePackagesByNames(registry, batch); err != nil {
+			return report, err
+		}
+		report.Repaired += len(batch)
+	}
+	return report, nil
+}
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -9,12 +11,17 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pkgb-in/pkgbin/config"
 	"github.com/pkgb-in/pkgbin/db/models"
 	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
 )
 
 var (
-	lastRefreshTime   time.Time
+	// lastRefreshTime maps each registry to when its last refresh started
+	lastRefreshTime   = make(map[string]time.Time)
 	refreshMutex      sync.Mutex
 	refreshInProgress bool
 )
@@ -25,18 +32,21 @@ type RefreshResponse struct {
 }
 
 func NPMRefreshHandler(w http.ResponseWriter, r *http.Request) {
-	refreshHandler(w, r, "./npm_cache_data")
+	refreshHandler(w, r, models.RegistryNPM)
 }
 
 func RubyRefreshHandler(w http.ResponseWriter, r *http.Request) {
-	refreshHandler(w, r, "./gem_cache_data")
+	refreshHandler(w, r, models.RegistryRubyGems)
 }
 
 func PyPIRefreshHandler(w http.ResponseWriter, r *http.Request) {
-	refreshHandler(w, r, "./pypi_cache_data")
+	refreshHandler(w, r, models.RegistryPyPI)
 }
 
-func refreshHandler(w http.ResponseWriter, r *http.Request, cacheDir string) {
+// refreshHandler rebuilds the packages table of registry. The repositories of
+// a registry share its rows, so a refresh through any of them rebuilds the
+// rows of all of them.
+func refreshHandler(w http.ResponseWriter, r *http.Request, registry string) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method != http.MethodPost {
@@ -47,6 +57,14 @@ func refreshHandler(w http.ResponseWriter, r *http.Request, cacheDir string) {
 		return
 	}
 
+	if next := maintenance.Next(config.MaintenanceRefresh, time.Now()); next.After(time.Now()) {
+		json.NewEncoder(w).Encode(RefreshResponse{
+			Success: false,
+			Message: "Refreshes run in maintenance windows; the next one opens at " + next.Format(time.RFC3339) + ".",
+		})
+		return
+	}
+
 	refreshMutex.Lock()
 
 	// Check if a refresh is already in progress
@@ -60,8 +78,8 @@ func refreshHandler(w http.ResponseWriter, r *http.Request, cacheDir string) {
 	}
 
 	// Check if last refresh was within 30 minutes
-	timeSinceLastRefresh := time.Since(lastRefreshTime)
-	if timeSinceLastRefresh < 30*time.Minute && !lastRefreshTime.IsZero() {
+	timeSinceLastRefresh := time.Since(lastRefreshTime[registry])
+	if timeSinceLastRefresh < 30*time.Minute && !lastRefreshTime[registry].IsZero() {
 		refreshMutex.Unlock()
 		remainingTime := 30*time.Minute - timeSinceLastRefresh
 		json.NewEncoder(w).Encode(RefreshResponse{
@@ -71,13 +89,27 @@ func refreshHandler(w http.ResponseWriter, r *http.Request, cacheDir string) {
 		return
 	}
 
+	// Nodes of a cluster rebuild the same table
+	unlock, ok := cluster.TryLock(refreshLockKey(registry))
+	if !ok {
+		refreshMutex.Unlock()
+		json.NewEncoder(w).Encode(RefreshResponse{
+			Success: false,
+			Message: "A refresh operation is already in progress on another node. Please wait.",
+		})
+		return
+	}
+
 	// Mark refresh as in progress
 	refreshInProgress = true
-	lastRefreshTime = time.Now()
+	lastRefreshTime[registry] = time.Now()
 	refreshMutex.Unlock()
 
 	// Start background job
-	go performDatabaseRefresh(cacheDir)
+	go func() {
+		defer unlock()
+		performDatabaseRefresh(registry)
+	}()
 
 	json.NewEncoder(w).Encode(RefreshResponse{
 		Success: true,
@@ -85,7 +117,13 @@ func refreshHandler(w http.ResponseWriter, r *http.Request, cacheDir string) {
 	})
 }
 
-func performDatabaseRefresh(cacheDir string) {
+// refreshLockKey is the cluster lock held while the packages table of
+// registry is rebuilt or reconciled.
+func refreshLockKey(registry string) string {
+	return "refresh/" + registry
+}
+
+func performDatabaseRefresh(registry string) {
 	defer func() {
 		refreshMutex.Lock()
 		refreshInProgress = false
@@ -94,12 +132,12 @@ func performDatabaseRefresh(cacheDir string) {
 
 	log.Println("Starting database refresh operation...")
 
-	// Step 1: Truncate packages table
-	if err := repositories.PackageRepo.TruncatePackagesTable(); err != nil {
-		log.Printf("Error truncating packages table: %v", err)
+	// Step 1: Remove the packages of this registry
+	if err := repositories.PackageRepo.DeleteRegistryPackages(registry); err != nil {
+		log.Printf("Error clearing packages table: %v", err)
 		return
 	}
-	log.Println("Packages table truncated")
+	log.Printf("Removed %s packages from the packages table", registry)
 
 	// Step 2: Reset ID sequence
 	if err := repositories.PackageRepo.ResetSequence(); err != nil {
@@ -108,46 +146,62 @@ func performDatabaseRefresh(cacheDir string) {
 	}
 	log.Println("ID sequence reset")
 
-	// Step 3: Scan cache directory and add packages
+	// Step 3: Scan the cache directories of every repository and add
+	// packages; a file name several repositories hold gets a single row
 	packageCount := 0
-	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+	seen := make(map[string]bool)
+	for _, cacheDir := range reconcileDirs(registry) {
+		err := janitor.WalkArtifacts(cacheDir, func(path string, info os.FileInfo) {
+			// Get just the filename
+			filename := filepath.Base(path)
+			if seen[filename] {
+				return
+			}
+			seen[filename] = true
+
+			// Create package entry with initial stats
+			pkg := models.Package{
+				Name:      filename,
+				CacheHit:  0,
+				CacheMiss: 0,
+				Registry:  registry,
+				SizeBytes: info.Size(),
+			}
+			pkg.PackageName, pkg.Version = parseCachedFileName(registry, filename)
+			if err := hashCachedFile(path, &pkg); err != nil {
+				log.Printf("Error hashing %s: %v", filename, err)
+			}
+
+			if err := repositories.PackageRepo.CreatePackage(&pkg); err != nil {
+				log.Printf("Error creating package entry for %s: %v", filename, err)
+				return
+			}
+
+			packageCount++
+			if packageCount%100 == 0 {
+				log.Printf("Processed %d packages...", packageCount)
+			}
+		})
 		if err != nil {
-			log.Printf("Error accessing path %s: %v", path, err)
-			return nil
-		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
-		// Get just the filename
-		filename := filepath.Base(path)
-
-		// Create package entry with initial stats
-		pkg := models.Package{
-			Name:      filename,
-			CacheHit:  0,
-			CacheMiss: 0,
-		}
-
-		if err := repositories.PackageRepo.CreatePackage(&pkg); err != nil {
-			log.Printf("Error creating package entry for %s: %v", filename, err)
-			return nil
-		}
-
-		packageCount++
-		if packageCount%100 == 0 {
-			log.Printf("Processed %d packages...", packageCount)
+			log.Printf("Error scanning cache directory %s: %v", cacheDir, err)
 		}
+	}
 
-		return nil
-	})
+	log.Printf("Database refresh completed. Added %d packages to database.", packageCount)
+}
 
+// hashCachedFile sets the digests of the cached file at path on pkg.
+func hashCachedFile(path string, pkg *models.Package) error {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Printf("Error scanning cache directory: %v", err)
-		return
+		return err
 	}
-
-	log.Printf("Database refresh completed. Added %d packages to database.", packageCount)
+	defer f.Close()
+	hasher := newArtifactHasher()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	pkg.SHA256 = hex.EncodeToString(hasher.Sum("sha256"))
+	pkg.SHA512 = hex.EncodeToString(hasher.Sum("sha512"))
+	return nil
 }
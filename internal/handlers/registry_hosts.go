@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// RegistryHostHandler serves every request with the handler of the
+// registry its host is mapped to by registry_hosts, or is a transparent
+// host of, so one listener serves several registries. registries maps the
+// registries served to their handler; requests to any other host go to
+// fallback.
+func RegistryHostHandler(registries map[string]http.Handler, fallback http.Handler) http.Handler {
+	hosts := make(map[string]http.Handler)
+	for host, registry := range config.Server.RegistryHosts {
+		handler, ok := registries[registry]
+		if !ok {
+			log.Printf("Not answering for %s, registry %s is not served", host, registry)
+			continue
+		}
+		hosts[host] = handler
+		log.Printf("Answering for %s as %s", host, registry)
+	}
+	for registry, handler := range registries {
+		for _, host := range transparentHosts(registry) {
+			hosts[host] = handler
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := hosts[requestHostname(r)]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
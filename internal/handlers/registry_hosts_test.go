@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+)
+
+// servedBy is a handler answering with the name of the registry it
+// stands for.
+func servedBy(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+func TestRegistryHostHandler(t *testing.T) {
+	server, pypi := config.Server, config.PyPIConfig
+	t.Cleanup(func() { config.Server, config.PyPIConfig = server, pypi })
+	config.Server.RegistryHosts = map[string]string{
+		"npm.proxy.corp":   models.RegistryNPM,
+		"pypi.proxy.corp":  models.RegistryPyPI,
+		"gems.proxy.corp":  models.RegistryRubyGems,
+		"maven.proxy.corp": "maven",
+	}
+	config.PyPIConfig.TransparentHosts = []string{"pypi.org"}
+
+	handler := RegistryHostHandler(map[string]http.Handler{
+		models.RegistryNPM:      servedBy(models.RegistryNPM),
+		models.RegistryPyPI:     servedBy(models.RegistryPyPI),
+		models.RegistryRubyGems: servedBy(models.RegistryRubyGems),
+	}, servedBy("fallback"))
+
+	tests := []struct {
+		host, target, want string
+	}{
+		{"npm.proxy.corp", "/lodash", models.RegistryNPM},
+		{"pypi.proxy.corp", "/simple/requests/", models.RegistryPyPI},
+		{"gems.proxy.corp", "/gems/rake-13.2.1.gem", models.RegistryRubyGems},
+		// The same paths reach the registry of their host
+		{"gems.proxy.corp", "/dashboard", models.RegistryRubyGems},
+		{"npm.proxy.corp", "/dashboard", models.RegistryNPM},
+		// Ports and case are ignored
+		{"npm.proxy.corp:8080", "/lodash", models.RegistryNPM},
+		{"PyPI.Proxy.Corp", "/simple/", models.RegistryPyPI},
+		// Transparent hosts reach their registry
+		{"pypi.org", "/simple/requests/", models.RegistryPyPI},
+		// Unknown hosts and registries that are not served
+		{"10.0.0.5:8080", "/healthz", "fallback"},
+		{"other.proxy.corp", "/lodash", "fallback"},
+		{"maven.proxy.corp", "/org/x/1.0/x-1.0.jar", "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+tt.target, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("served by %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/policy"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+	"github.com/pkgb-in/pkgbin/internal/vulnscan"
+)
+
+// ReloadResponse is the outcome of a configuration reload.
+type ReloadResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	// RestartRequired lists the changed settings only read at startup,
+	// which keep their value until the next restart
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// reloadedRepo is the settings of a repository checked before a reload.
+type reloadedRepo struct {
+	name            string
+	upstream        string
+	auth            config.UpstreamAuth
+	routes          []config.UpstreamRoute
+	policy          config.Policy
+	blocklist       config.Blocklist
+	vulnerabilities config.VulnerabilityScan
+}
+
+// reloadedRepos returns the default and named repositories of registry in
+// s.
+func reloadedRepos(registry string, s *config.Settings) []reloadedRepo {
+	var repos []reloadedRepo
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&s.NPM}, s.NPM.Repositories...) {
+			repos = append(repos, reloadedRepo{repo.Name, repo.Upstream, repo.Auth, repo.Routes, repo.Policy, repo.Blocklist, repo.Vulnerabilities})
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&s.PyPI}, s.PyPI.Repositories...) {
+			repos = append(repos, reloadedRepo{repo.Name, repo.Upstream, repo.Auth, repo.Routes, repo.Policy, repo.Blocklist, repo.Vulnerabilities})
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&s.RubyGems}, s.RubyGems.Repositories...) {
+			repos = append(repos, reloadedRepo{repo.Name, repo.Upstream, repo.Auth, repo.Routes, repo.Policy, repo.Blocklist, repo.Vulnerabilities})
+		}
+	}
+	return repos
+}
+
+// checkReload validates the settings of s this process serving registry
+// puts into effect, as its main does at startup, adding the upstream
+// credentials of its repositories to creds. It changes nothing in effect.
+func checkReload(registry string, s *config.Settings, creds *upstream.Credentials) error {
+	for _, repo := range reloadedRepos(registry, s) {
+		target := "repository " + repo.name
+		if repo.name == "" {
+			target = registry
+		}
+		if err := creds.Add(repo.upstream, repo.auth); err != nil {
+			return fmt.Errorf("upstream credentials for %s: %w", target, err)
+		}
+		if err := creds.AddRoutes(repo.routes); err != nil {
+			return fmt.Errorf("upstream routes for %s: %w", target, err)
+		}
+		if err := policy.Validate(repo.policy); err != nil {
+			return fmt.Errorf("policy for %s: %w", target, err)
+		}
+		if err := vulnscan.ValidateConfig(repo.vulnerabilities); err != nil {
+			return fmt.Errorf("vulnerability scanning for %s: %w", target, err)
+		}
+		if repo.blocklist.URL != "" {
+			if repo.blocklist.Interval.Duration <= 0 {
+				return fmt.Errorf("blocklist %s of %s: interval must be positive", repo.blocklist.URL, target)
+			}
+			if err := creds.Add(repo.blocklist.URL, repo.blocklist.Auth); err != nil {
+				return fmt.Errorf("blocklist %s of %s: %w", repo.blocklist.URL, target, err)
+			}
+		}
+	}
+	if _, _, _, err := newRateLimits(s.Server.RateLimit); err != nil {
+		return err
+	}
+	if _, err := parseNetworks("trusted proxy", s.Server.TrustedProxies); err != nil {
+		return err
+	}
+	if _, err := resolveAdminTokens(s.Admin); err != nil {
+		return err
+	}
+	return nil
+}
+
+// maxConcurrentFetches returns the upstream download limit of registry.
+func maxConcurrentFetches(registry string) int {
+	s := config.Current()
+	switch registry {
+	case models.RegistryNPM:
+		return s.NPM.MaxConcurrentFetches
+	case models.RegistryPyPI:
+		return s.PyPI.MaxConcurrentFetches
+	case models.RegistryRubyGems:
+		return s.RubyGems.MaxConcurrentFetches
+	}
+	return 0
+}
+
+// reloadedRegistries are the registries this process serves, which a
+// reload checks and puts the configuration into effect for.
+var reloadedRegistries []string
+
+// ReloadConfig reads the configuration file again and puts it into effect
+// for the registries this process serves: upstreams and their credentials,
+// policies, blocklists, limits, admin tokens and TTLs. Downloads in flight
+// finish with the settings they started with. actor is who the changes are
+// audited as. It returns the changed settings only read at startup, and
+// leaves the configuration as it was when the new one is invalid.
+func ReloadConfig(actor string) ([]string, error) {
+	previous := config.Current().Server
+	fetches := make(map[string]int)
+	for _, registry := range reloadedRegistries {
+		fetches[registry] = maxConcurrentFetches(registry)
+	}
+	var creds *upstream.Credentials
+	restartOnly, err := config.Reload(func(s *config.Settings) error {
+		creds = upstream.NewCredentials()
+		for _, registry := range reloadedRegistries {
+			if err := checkReload(registry, s, creds); err != nil {
+				return err
+			}
+		}
+		// The primary a standby syncs from is only read at startup
+		if sync := s.Server.Sync; sync.Primary != "" {
+			if err := creds.Add(sync.Primary, sync.Auth); err != nil {
+				return fmt.Errorf("sync primary: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	upstream.InstallCredentials(creds)
+
+	current := config.Current()
+	if !reflect.DeepEqual(current.Server.RateLimit, previous.RateLimit) {
+		requests, bandwidth, exempt, err := newRateLimits(current.Server.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		requestLimits, bandwidthLimits, rateLimitExempt = requests, bandwidth, exempt
+	}
+	if err := InitTrustedProxies(); err != nil {
+		return nil, err
+	}
+	if tokens, err := resolveAdminTokens(current.Admin); err == nil {
+		adminTokens = tokens
+	}
+	if current.Server.UpstreamBytesPerSecond != previous.UpstreamBytesPerSecond {
+		upstream.SetBandwidthLimit(current.Server.UpstreamBytesPerSecond)
+	}
+	upstream.ConfigureBreaker(current.Server.CircuitBreaker.FailureThreshold, current.Server.CircuitBreaker.Cooldown.Duration)
+	for _, registry := range reloadedRegistries {
+		if n := maxConcurrentFetches(registry); n != fetches[registry] {
+			InitFetchLimit(registry, n)
+		}
+		var blocklists error
+		switch registry {
+		case models.RegistryNPM:
+			blocklists = InitNPMBlocklists()
+		case models.RegistryPyPI:
+			blocklists = InitPyPIBlocklists()
+		case models.RegistryRubyGems:
+			blocklists = InitRubyGemsBlocklists()
+		}
+		if blocklists != nil {
+			log.Printf("Failed to start %s blocklists after reload: %v", registry, blocklists)
+		}
+	}
+
+	log.Printf("Configuration reloaded from %s", config.Path())
+	if len(restartOnly) > 0 {
+		log.Printf("Configuration changes needing a restart: %s", strings.Join(restartOnly, ", "))
+	}
+	if repositories.AuditEventRepo != nil && !readOnlyReplica() {
+		for _, registry := range reloadedRegistries {
+			auditConfigChanges(registry, actor)
+		}
+	}
+	return restartOnly, nil
+}
+
+// StartConfigReload reloads the configuration of this process serving
+// registries on SIGHUP and, with config_watch_interval set, whenever the
+// configuration file changes.
+func StartConfigReload(registries ...string) {
+	reloadedRegistries = registries
+	path := config.Path()
+	if path == "" {
+		return
+	}
+	reload := func(reason string) {
+		log.Printf("Reloading configuration on %s", reason)
+		if _, err := ReloadConfig(auditSystemActor); err != nil {
+			log.Printf("Configuration reload failed, keeping the current one: %v", err)
+		}
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reload("SIGHUP")
+		}
+	}()
+
+	interval := config.Server.ConfigWatchInterval.Duration
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		last, _ := os.Stat(path)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			reload("change of " + path)
+		}
+	}()
+}
+
+// reloadConfig answers POST /api/v1/reload, reloading the configuration of
+// the instance the request reached for every registry it serves.
+func (reg apiRegistry) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if config.Path() == "" {
+		writeAPIError(w, http.StatusConflict, "No configuration file to reload, PKGBIN_CONFIG is not set")
+		return
+	}
+	restartOnly, err := ReloadConfig(clientIdentity(r))
+	if err != nil {
+		log.Printf("Configuration reload failed, keeping the current one: %v", err)
+		writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Invalid configuration, keeping the current one: %v", err))
+		return
+	}
+	response := ReloadResponse{Success: true, Message: "Configuration reloaded", RestartRequired: restartOnly}
+	if len(restartOnly) > 0 {
+		response.Message = "Configuration reloaded; some changes need a restart"
+		noteAudit(r, "restart required for %s", strings.Join(restartOnly, ", "))
+	}
+	writeAPIJSON(w, http.StatusOK, response)
+}
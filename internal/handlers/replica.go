@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// readOnlyReplica reports whether this instance is a read-only replica,
+// which serves what its writer cached but never writes to the cache or the
+// database itself.
+func readOnlyReplica() bool {
+	return config.Server.ReplicaOf != ""
+}
+
+// replicaWriterURL returns the URL of the writer instance a read-only
+// replica sends the cache misses of r to, which the writer caches and
+// serves under the same path.
+func replicaWriterURL(r *http.Request) string {
+	return strings.TrimSuffix(config.Server.ReplicaOf, "/") + RepositoryPathPrefix(r) + r.URL.RequestURI()
+}
+
+// refuseReplicaWrite answers requests that would change the cache or the
+// database of a read-only replica, pointing clients at the writer. It
+// reports whether r was refused.
+func refuseReplicaWrite(w http.ResponseWriter, r *http.Request) bool {
+	if !readOnlyReplica() {
+		return false
+	}
+	writeAdminError(w, http.StatusForbidden, "This instance is a read-only replica, send writes to "+config.Server.ReplicaOf)
+	return true
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+)
+
+// repositoryKey is the request context key of the named repository a
+// request was made to.
+type repositoryKey struct{}
+
+// splitRepositoryPath splits /~<name>/<rest> into the repository name and
+// the registry path it addresses.
+func splitRepositoryPath(urlPath string) (name, rest string, ok bool) {
+	trimmed, ok := strings.CutPrefix(urlPath, config.RepositoryPrefix)
+	if !ok {
+		return "", "", false
+	}
+	name, rest, _ = strings.Cut(trimmed, "/")
+	return name, "/" + rest, name != ""
+}
+
+// settingsKey is the request context key of the configuration in effect
+// when a request started.
+type settingsKey struct{}
+
+// requestSettings returns the configuration a request started with, or the
+// one in effect for work outside of requests.
+func requestSettings(ctx context.Context) *config.Settings {
+	if s, ok := ctx.Value(settingsKey{}).(*config.Settings); ok {
+		return s
+	}
+	return config.Current()
+}
+
+// repositoryHandler serves requests under a repository prefix with next,
+// as if they had been made to the registry root, after attaching the
+// configuration in effect and the repository of it found by lookup to the
+// request context, so reloads leave the request with the settings it
+// started with. Requests made to a host byHost finds a repository for are
+// served by that repository, and requests outside any repository prefix
+// go to next with defaultRepo attached.
+func repositoryHandler(next http.Handler, defaultRepo func(*config.Settings) any, lookup func(s *config.Settings, name string) (any, bool), byHost func(s *config.Settings, host string) (any, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := config.Current()
+		r = r.WithContext(context.WithValue(r.Context(), settingsKey{}, s))
+		if repo, ok := byHost(s, requestHostname(r)); ok {
+			serveTransparent(w, r, repo, next)
+			return
+		}
+		name, rest, ok := splitRepositoryPath(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), repositoryKey{}, defaultRepo(s))))
+			return
+		}
+		repo, found := lookup(s, name)
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := r.WithContext(context.WithValue(r.Context(), repositoryKey{}, repo))
+		u := *r.URL
+		u.Path = rest
+		if u.RawPath != "" {
+			if _, rawRest, ok := splitRepositoryPath(u.RawPath); ok {
+				u.RawPath = rawRest
+			} else {
+				u.RawPath = ""
+			}
+		}
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// RepositoryPathPrefix returns the URL prefix of the named repository a
+// request was made to, or "" for the default repository and transparent
+// hosts.
+func RepositoryPathPrefix(r *http.Request) string {
+	if transparentRequest(r) {
+		return ""
+	}
+	var name string
+	switch repo := r.Context().Value(repositoryKey{}).(type) {
+	case *config.NPMProxyConfig:
+		name = repo.Name
+	case *config.PyPIProxyConfig:
+		name = repo.Name
+	case *config.RubyGemsProxyConfig:
+		name = repo.Name
+	}
+	if name == "" {
+		return ""
+	}
+	return config.RepositoryPrefix + name
+}
+
+// requestRegistry returns the registry of the repository a request was
+// made to.
+func requestRegistry(r *http.Request) string {
+	switch r.Context().Value(repositoryKey{}).(type) {
+	case *config.NPMProxyConfig:
+		return models.RegistryNPM
+	case *config.PyPIProxyConfig:
+		return models.RegistryPyPI
+	case *config.RubyGemsProxyConfig:
+		return models.RegistryRubyGems
+	}
+	return ""
+}
+
+// repositoryExternalURL returns the configured external URL of the
+// repository a request was made to, if any.
+func repositoryExternalURL(r *http.Request) string {
+	switch repo := r.Context().Value(repositoryKey{}).(type) {
+	case *config.NPMProxyConfig:
+		return repo.ExternalURL
+	case *config.PyPIProxyConfig:
+		return repo.ExternalURL
+	case *config.RubyGemsProxyConfig:
+		return repo.ExternalURL
+	}
+	return ""
+}
+
+// NPMRepositoryHandler routes requests under /~<name>/ to the named npm
+// repository.
+func NPMRepositoryHandler(next http.Handler) http.Handler {
+	return repositoryHandler(next, func(s *config.Settings) any { return &s.NPM }, func(s *config.Settings, name string) (any, bool) {
+		for _, repo := range s.NPM.Repositories {
+			if repo.Name == name {
+				return repo, true
+			}
+		}
+		return nil, false
+	}, func(s *config.Settings, host string) (any, bool) {
+		return transparentRepository(host, append([]*config.NPMProxyConfig{&s.NPM}, s.NPM.Repositories...),
+			func(repo *config.NPMProxyConfig) []string { return repo.TransparentHosts })
+	})
+}
+
+// NPMRepository returns the npm repository a request was made to.
+func NPMRepository(r *http.Request) *config.NPMProxyConfig {
+	if repo, ok := r.Context().Value(repositoryKey{}).(*config.NPMProxyConfig); ok {
+		return repo
+	}
+	return &requestSettings(r.Context()).NPM
+}
+
+// PyPIRepositoryHandler routes requests under /~<name>/ to the named PyPI
+// repository.
+func PyPIRepositoryHandler(next http.Handler) http.Handler {
+	return repositoryHandler(next, func(s *config.Settings) any { return &s.PyPI }, func(s *config.Settings, name string) (any, bool) {
+		for _, repo := range s.PyPI.Repositories {
+			if repo.Name == name {
+				return repo, true
+			}
+		}
+		return nil, false
+	}, func(s *config.Settings, host string) (any, bool) {
+		return transparentRepository(host, append([]*config.PyPIProxyConfig{&s.PyPI}, s.PyPI.Repositories...),
+			func(repo *config.PyPIProxyConfig) []string { return repo.TransparentHosts })
+	})
+}
+
+// PyPIRepository returns the PyPI repository a request was made to.
+func PyPIRepository(r *http.Request) *config.PyPIProxyConfig {
+	if repo, ok := r.Context().Value(repositoryKey{}).(*config.PyPIProxyConfig); ok {
+		return repo
+	}
+	return &requestSettings(r.Context()).PyPI
+}
+
+// RubyGemsRepositoryHandler routes requests under /~<name>/ to the named
+// RubyGems repository.
+func RubyGemsRepositoryHandler(next http.Handler) http.Handler {
+	return repositoryHandler(next, func(s *config.Settings) any { return &s.RubyGems }, func(s *config.Settings, name string) (any, bool) {
+		for _, repo := range s.RubyGems.Repositories {
+			if repo.Name == name {
+				return repo, true
+			}
+		}
+		return nil, false
+	}, func(s *config.Settings, host string) (any, bool) {
+		return transparentRepository(host, append([]*config.RubyGemsProxyConfig{&s.RubyGems}, s.RubyGems.Repositories...),
+			func(repo *config.RubyGemsProxyConfig) []string { return repo.TransparentHosts })
+	})
+}
+
+// RubyGemsRepository returns the RubyGems repository a request was made to.
+func RubyGemsRepository(r *http.Request) *config.RubyGemsProxyConfig {
+	if repo, ok := r.Context().Value(repositoryKey{}).(*config.RubyGemsProxyConfig); ok {
+		return repo
+	}
+	return &requestSettings(r.Context()).RubyGems
+}
+
+// NPMDataDirs lists the directories the npm repositories write to, only
+// their metadata directories on a read-only replica.
+func NPMDataDirs() []string {
+	var dirs []string
+	for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+		if readOnlyReplica() {
+			dirs = append(dirs, repo.MetadataDir)
+			continue
+		}
+		dirs = append(dirs, repo.CacheDir, repo.MetadataDir, repo.LocalDir)
+	}
+	return dirs
+}
+
+// PyPIDataDirs lists the directories the PyPI repositories write to, only
+// their metadata directories on a read-only replica.
+func PyPIDataDirs() []string {
+	var dirs []string
+	for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+		if readOnlyReplica() {
+			dirs = append(dirs, repo.MetadataDir)
+			continue
+		}
+		dirs = append(dirs, repo.CacheDir, repo.MetadataDir)
+		if repo.Mirror.Interval.Duration > 0 && repo.Mirror.Dir != "" {
+			dirs = append(dirs, repo.Mirror.Dir)
+		}
+	}
+	return dirs
+}
+
+// NPMUpstreams lists the upstreams of the npm repositories and their
+// routes.
+func NPMUpstreams() []string {
+	var urls []string
+	for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+		urls = appendUpstreams(urls, repo.Upstream, repo.Routes)
+	}
+	return urls
+}
+
+// PyPIUpstreams lists the upstreams of the PyPI repositories and their
+// routes.
+func PyPIUpstreams() []string {
+	var urls []string
+	for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+		urls = appendUpstreams(urls, repo.Upstream, repo.Routes)
+	}
+	return urls
+}
+
+// RubyGemsUpstreams lists the upstreams of the RubyGems repositories and
+// their routes.
+func RubyGemsUpstreams() []string {
+	var urls []string
+	for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+		urls = appendUpstreams(urls, repo.Upstream, repo.Routes)
+	}
+	return urls
+}
+
+// appendUpstreams adds upstream and the upstreams of routes to urls,
+// skipping those already listed.
+func appendUpstreams(urls []string, upstream string, routes []config.UpstreamRoute) []string {
+	candidates := []string{upstream}
+	for _, route := range routes {
+		candidates = append(candidates, route.Upstream)
+	}
+	for _, u := range candidates {
+		if u = strings.TrimSuffix(u, "/"); !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// RubyGemsDataDirs lists the directories the RubyGems repositories write
+// to, only their metadata directories on a read-only replica.
+func RubyGemsDataDirs() []string {
+	var dirs []string
+	for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+		if readOnlyReplica() {
+			dirs = append(dirs, repo.MetadataDir)
+			continue
+		}
+		dirs = append(dirs, repo.CacheDir, repo.MetadataDir)
+	}
+	return dirs
+}
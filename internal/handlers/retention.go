@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+)
+
+// retentionClient is who retention evictions are attributed to in the
+// activity feed.
+const retentionClient = "retention"
+
+// retentionRepo is a repository whose cached versions are limited.
+type retentionRepo struct {
+	name     string
+	cacheDir string
+	cfg      config.Retention
+	// mirrored lists the packages the repository mirrors in full, which
+	// keep every version
+	mirrored map[string]bool
+	// npmRepo and gemRepo are the repository, for the metadata referencing
+	// evicted files
+	npmRepo *config.NPMProxyConfig
+	gemRepo *config.RubyGemsProxyConfig
+}
+
+// retainedVersion is a cached version of a package, with its files.
+type retainedVersion struct {
+	version string
+	// lastUsed is when any of its files was last accessed, or cached if
+	// never
+	lastUsed time.Time
+	files    []string
+}
+
+// retentionRepos returns the repositories of registry limiting their
+// cached versions.
+func retentionRepos(registry string) []retentionRepo {
+	var repos []retentionRepo
+	add := func(name, cacheDir string, cfg config.Retention, mirror config.FullMirror, npmRepo *config.NPMProxyConfig, gemRepo *config.RubyGemsProxyConfig) {
+		if !cfg.Enabled() || cfg.Interval.Duration <= 0 {
+			return
+		}
+		repos = append(repos, retentionRepo{name, cacheDir, cfg, fullMirrorNames(registry, mirror), npmRepo, gemRepo})
+	}
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+			add(repo.Name, repo.CacheDir, repo.Retention, repo.FullMirror, repo, &config.RubyGemsConfig)
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+			add(repo.Name, repo.CacheDir, repo.Retention, repo.FullMirror, &config.NPMConfig, &config.RubyGemsConfig)
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+			add(repo.Name, repo.CacheDir, repo.Retention, repo.FullMirror, &config.NPMConfig, repo)
+		}
+	}
+	return repos
+}
+
+// StartRetention periodically evicts the cached versions of each package
+// of the repositories of registry past their retention limit, those
+// accessed longest ago, within the maintenance windows. The leader of a
+// cluster evicts for every node, and read-only replicas leave it to their
+// writer.
+func StartRetention(registry string) {
+	if readOnlyReplica() || repositories.PackageRepo == nil {
+		return
+	}
+	for _, repo := range retentionRepos(registry) {
+		go func() {
+			ticker := time.NewTicker(repo.cfg.Interval.Duration)
+			defer ticker.Stop()
+			for range ticker.C {
+				maintenance.Wait(config.MaintenanceRetention)
+				if cluster.IsLeader(registry) {
+					enforceRetention(registry, repo)
+				}
+			}
+		}()
+	}
+}
+
+// enforceRetention evicts the files of the versions past the limit of
+// their package from the cache directory of repo. The cached files are
+// aggregated by the package name and version parsed from their names;
+// files that could not be parsed are left alone.
+func enforceRetention(registry string, repo retentionRepo) {
+	start := time.Now()
+	entries, err := os.ReadDir(repo.cacheDir)
+	if err != nil {
+		log.Printf("Failed to list %s for retention: %v", repo.cacheDir, err)
+		return
+	}
+	// Rows are shared by the repositories of the registry, so only the
+	// files in this one's directory count
+	cached := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		cached[entry.Name()] = true
+	}
+
+	packages := make(map[string]map[string]*retainedVersion)
+	err = repositories.PackageRepo.EachPackage(registry, evictionBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			if pkg.PackageName == "" || pkg.Version == "" || !cached[pkg.Name] || repo.mirrored[pkg.PackageName] {
+				continue
+			}
+			if packages[pkg.PackageName] == nil {
+				packages[pkg.PackageName] = make(map[string]*retainedVersion)
+			}
+			v := packages[pkg.PackageName][pkg.Version]
+			if v == nil {
+				v = &retainedVersion{version: pkg.Version}
+				packages[pkg.PackageName][pkg.Version] = v
+			}
+			used := pkg.CreatedAt
+			if pkg.LastAccessedAt != nil {
+				used = *pkg.LastAccessedAt
+			}
+			if used.After(v.lastUsed) {
+				v.lastUsed = used
+			}
+			v.files = append(v.files, pkg.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to list cached files for retention: %v", err)
+		return
+	}
+
+	var evicted []string
+	versions := 0
+	for pkgName, byVersion := range packages {
+		keep := repo.cfg.KeepFor(pkgName)
+		if keep <= 0 || len(byVersion) <= keep {
+			continue
+		}
+		sorted := make([]*retainedVersion, 0, len(byVersion))
+		for _, v := range byVersion {
+			sorted = append(sorted, v)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if !sorted[i].lastUsed.Equal(sorted[j].lastUsed) {
+				return sorted[i].lastUsed.After(sorted[j].lastUsed)
+			}
+			return sorted[i].version > sorted[j].version
+		})
+		for _, v := range sorted[keep:] {
+			versions++
+			for _, fileName := range v.files {
+				if err := os.Remove(filepath.Join(repo.cacheDir, fileName)); err != nil {
+					if !os.IsNotExist(err) {
+						log.Printf("Failed to evict %s: %v", fileName, err)
+					}
+					continue
+				}
+				evicted = append(evicted, fileName)
+				invalidateRepositoryMetadata(repo.npmRepo, repo.gemRepo, registry, fileName)
+			}
+		}
+	}
+	if len(evicted) == 0 {
+		return
+	}
+
+	// The row stays while another repository still caches the file
+	var stale []string
+	for _, fileName := range evicted {
+		if !cachedElsewhere(registry, repo.cacheDir, fileName) {
+			stale = append(stale, fileName)
+		}
+	}
+	for len(stale) > 0 {
+		batch := stale[:min(len(stale), 500)]
+		stale = stale[len(batch):]
+		if err := repositories.PackageRepo.DeletePackagesByNames(registry, batch); err != nil {
+			log.Printf("Failed to delete %d evicted file(s) from database: %v", len(batch), err)
+		}
+	}
+	recordPurges(retentionClient, registry, evicted)
+
+	target := registry
+	if repo.name != "" {
+		target += " repository " + repo.name
+	}
+	log.Printf("Retention of %s evicted %d file(s) of %d version(s), in %s",
+		target, len(evicted), versions, time.Since(start).Round(time.Millisecond))
+}
+
+// cachedElsewhere reports whether a cache directory of registry other than
+// cacheDir holds fileName.
+func cachedElsewhere(registry, cacheDir, fileName string) bool {
+	for _, dir := range reconcileDirs(registry) {
+		if filepath.Clean(dir) == filepath.Clean(cacheDir) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, fileName)); err == nil {
+			return true
+		}
+	}
+	return false
+}
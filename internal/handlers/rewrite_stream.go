@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+)
+
+// replaceWriter replaces fixed strings in what is written through it before
+// passing it on. Only the bytes that may start a match split across writes
+// are held back, so memory stays bounded by the longest string replaced
+// whatever the size of the document.
+type replaceWriter struct {
+	w          io.Writer
+	olds, news [][]byte
+	// keep is how many trailing bytes may be the start of a match
+	keep int
+	buf  []byte
+}
+
+// newReplaceWriter returns a writer replacing every olds[i] with news[i],
+// the leftmost and then longest match first.
+func newReplaceWriter(w io.Writer, olds, news [][]byte) *replaceWriter {
+	rw := &replaceWriter{w: w}
+	for i, old := range olds {
+		if len(old) == 0 {
+			continue
+		}
+		rw.olds = append(rw.olds, old)
+		rw.news = append(rw.news, news[i])
+		rw.keep = max(rw.keep, len(old)-1)
+	}
+	return rw
+}
+
+func (rw *replaceWriter) Write(p []byte) (int, error) {
+	rw.buf = append(rw.buf, p...)
+	if err := rw.flush(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes out what was held back. It does not close the underlying
+// writer.
+func (rw *replaceWriter) Close() error {
+	return rw.flush(true)
+}
+
+// flush writes the buffered bytes with their matches replaced, keeping back
+// the tail that could still turn into a match unless final.
+func (rw *replaceWriter) flush(final bool) error {
+	buf := rw.buf
+	limit := len(buf)
+	if !final {
+		limit -= rw.keep
+	}
+	start := 0
+	for start < limit {
+		at, which := -1, -1
+		for i, old := range rw.olds {
+			idx := bytes.Index(buf[start:], old)
+			if idx < 0 {
+				continue
+			}
+			idx += start
+			if at < 0 || idx < at || (idx == at && len(old) > len(rw.olds[which])) {
+				at, which = idx, i
+			}
+		}
+		if at < 0 || at >= limit {
+			break
+		}
+		if _, err := rw.w.Write(buf[start:at]); err != nil {
+			return err
+		}
+		if _, err := rw.w.Write(rw.news[which]); err != nil {
+			return err
+		}
+		start = at + len(rw.olds[which])
+	}
+	end := max(start, limit)
+	if _, err := rw.w.Write(buf[start:end]); err != nil {
+		return err
+	}
+	rw.buf = append(buf[:0], buf[end:]...)
+	return nil
+}
+
+// RewrittenAcceptEncoding narrows the Accept-Encoding of a request proxied
+// upstream to the codings RewriteResponseBody decodes: gzip for clients
+// that accept it, identity for the others, which then get what upstream
+// sends as it is when the response is not rewritten.
+func RewrittenAcceptEncoding(req *http.Request) {
+	if acceptsGzip(req.Header) {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// RewriteResponseBody replaces the body of resp with what rewrite writes
+// given the upstream body, streamed as it is produced instead of being
+// buffered. Gzip-encoded upstream bodies are decoded for rewrite, and the
+// result is gzip-encoded again for clients that accept it. Bodies in other
+// codings, which RewrittenAcceptEncoding keeps upstream from sending, are
+// an error rather than sent with URLs of upstream.
+func RewriteResponseBody(resp *http.Response, rewrite func(w io.Writer, r io.Reader) error) error {
+	body := resp.Body
+	var src io.Reader = body
+	// The length of the rewritten body is only known once it is sent, the
+	// upstream one tells whether it is worth compressing
+	size := resp.ContentLength
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		src = gr
+		size = -1
+	default:
+		return fmt.Errorf("cannot rewrite a body in %s coding", resp.Header.Get("Content-Encoding"))
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+
+	pr, pw := io.Pipe()
+	out, closeOut := metadataWriter(resp.Request, resp.Header, pw, size)
+	go func() {
+		defer body.Close()
+		err := rewrite(out, src)
+		if err == nil {
+			err = closeOut()
+		}
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("Failed to rewrite %s [%s]: %v", resp.Request.URL.Path, requestid.FromContext(resp.Request.Context()), err)
+		}
+		pw.CloseWithError(err)
+	}()
+	resp.Body = pr
+	return nil
+}
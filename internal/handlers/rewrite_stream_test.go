@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewrittenAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		accept, want string
+	}{
+		{"", "identity"},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "gzip"},
+		{"br, zstd", "identity"},
+		{"br;q=1.0, *;q=0.5", "gzip"},
+		{"gzip;q=0", "identity"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/simple/requests/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Encoding", tt.accept)
+		}
+		RewrittenAcceptEncoding(r)
+		if got := r.Header.Get("Accept-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q sent upstream as %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteResponseBody(t *testing.T) {
+	const document = `{"tarball":"https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz"}`
+	const rewritten = `{"tarball":"http://proxy.local/lodash/-/lodash-4.17.21.tgz"}`
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(document))
+	gw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{"identity", "", []byte(document), false},
+		{"gzip", "gzip", gzipped.Bytes(), false},
+		{"brotli", "br", []byte("not really brotli"), true},
+		{"zstd", "zstd", []byte("not really zstd"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header:        make(http.Header),
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+				Request:       httptest.NewRequest(http.MethodGet, "/lodash", nil),
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			err := RewriteResponseBody(resp, func(w io.Writer, r io.Reader) error {
+				body, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(w, strings.ReplaceAll(string(body), "https://registry.npmjs.org", "http://proxy.local"))
+				return err
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("body in an undecodable coding passed through unrewritten")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != rewritten || resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("body %q in coding %q, want %q", got, resp.Header.Get("Content-Encoding"), rewritten)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// NPMUpstreamFor returns the upstream of repo serving the npm package pkgName.
+func NPMUpstreamFor(repo *config.NPMProxyConfig, pkgName string) string {
+	return upstream.Resolve(repo.Routes, pkgName, repo.Upstream)
+}
+
+// PyPIUpstreamFor returns the upstream of repo serving the PyPI project.
+func PyPIUpstreamFor(repo *config.PyPIProxyConfig, project string) string {
+	return upstream.Resolve(repo.Routes, normalizePyPIName(project), repo.Upstream)
+}
+
+// GemUpstreamFor returns the upstream of repo serving the gem gemName.
+func GemUpstreamFor(repo *config.RubyGemsProxyConfig, gemName string) string {
+	return upstream.Resolve(repo.Routes, gemName, repo.Upstream)
+}
+
+// RewriteNPMUpstreamURLs points every URL of an upstream of repo (the
+// default and any routed ones) in a metadata document of pkgName at
+// proxyAddr, and the tarball URLs on its tarball_hosts at the remote
+// tarball paths of the proxy. Provenance attestation URLs keep pointing
+// upstream, so attestations are fetched from the registry that signed
+// them.
+func RewriteNPMUpstreamURLs(repo *config.NPMProxyConfig, body []byte, proxyAddr, pkgName string) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(body))
+	rw := NewNPMURLRewriter(repo, &buf, proxyAddr, pkgName)
+	rw.Write(body)
+	rw.Close()
+	return buf.Bytes()
+}
+
+// NewNPMURLRewriter returns a writer doing what RewriteNPMUpstreamURLs does
+// to the document written through it, as it streams to w. Close must be
+// called at the end of the document. pkgName is empty for documents that
+// are not about one package, whose tarball URLs of other hosts are kept.
+func NewNPMURLRewriter(repo *config.NPMProxyConfig, w io.Writer, proxyAddr, pkgName string) io.WriteCloser {
+	olds := [][]byte{[]byte(repo.Upstream)}
+	for _, route := range repo.Routes {
+		olds = append(olds, []byte(strings.TrimSuffix(route.Upstream, "/")))
+	}
+	news := make([][]byte, len(olds))
+	for i := range news {
+		news[i] = []byte(proxyAddr)
+	}
+	// Replaced with themselves, as the longer match wins
+	for _, base := range olds[:len(news)] {
+		attestations := []byte(strings.TrimSuffix(string(base), "/") + npmAttestationsPath)
+		olds = append(olds, attestations)
+		news = append(news, attestations)
+	}
+	rw := newReplaceWriter(w, olds, news)
+	if len(repo.TarballHosts) == 0 || pkgName == "" {
+		return rw
+	}
+	tw := &tarballWriter{w: rw, rewrite: npmRemoteTarballRewrite(repo, proxyAddr, pkgName)}
+	return chainedWriteCloser{Writer: tw, closers: []io.Closer{tw, rw}}
+}
+
+// npmPackageFromPath returns the package a registry path refers to:
+// packuments, tarballs, dist-tags and publishes. Paths that do not name a
+// package (search, audits, logins) return false.
+func npmPackageFromPath(urlPath string) (string, bool) {
+	if name, ok := parseNPMPackagePath(urlPath); ok {
+		return name, true
+	}
+	if m := npmDistTagsPath.FindStringSubmatch(urlPath); m != nil {
+		return m[1], true
+	}
+	trimmed := strings.TrimPrefix(urlPath, "/")
+	if strings.HasPrefix(trimmed, "-/") {
+		return "", false
+	}
+	segments := strings.Split(trimmed, "/")
+	if strings.HasPrefix(trimmed, "@") {
+		if len(segments) < 2 {
+			return "", false
+		}
+		return segments[0] + "/" + segments[1], true
+	}
+	return segments[0], segments[0] != ""
+}
+
+// NPMPackageOfPath returns the package a registry path refers to, or ""
+// when it names none.
+func NPMPackageOfPath(urlPath string) string {
+	name, _ := npmPackageFromPath(urlPath)
+	return name
+}
+
+// NPMUpstreamForPath returns the upstream a proxied npm request should go
+// to, so requests for routed packages never reach the default registry.
+func NPMUpstreamForPath(repo *config.NPMProxyConfig, urlPath string) string {
+	if name, ok := npmPackageFromPath(urlPath); ok {
+		return NPMUpstreamFor(repo, name)
+	}
+	return repo.Upstream
+}
+
+// pypiProjectFromPath returns the project a PyPI path refers to: Simple
+// API pages, JSON API documents and distribution files.
+func pypiProjectFromPath(urlPath string) (string, bool) {
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(segments) >= 2 && (segments[0] == "simple" || segments[0] == "pypi") {
+		return segments[1], true
+	}
+	if isPyPIDistributionPath(urlPath) {
+		if project := pypiProjectFromFilename(path.Base(strings.TrimSuffix(urlPath, ".metadata"))); project != "" {
+			return project, true
+		}
+	}
+	return "", false
+}
+
+// isPyPIDistributionPath reports whether urlPath names a distribution file
+// or its PEP 658 core metadata.
+func isPyPIDistributionPath(urlPath string) bool {
+	lower := strings.ToLower(strings.TrimSuffix(urlPath, ".metadata"))
+	for _, ext := range []string{".whl", ".tar.gz", ".zip", ".egg", ".tar.bz2"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// PyPIUpstreamForPath returns the upstream a proxied PyPI request should go
+// to.
+func PyPIUpstreamForPath(repo *config.PyPIProxyConfig, urlPath string) string {
+	if project, ok := pypiProjectFromPath(urlPath); ok {
+		return PyPIUpstreamFor(repo, project)
+	}
+	return repo.Upstream
+}
+
+// gemNameFromPath returns the gem a RubyGems path refers to: gem files,
+// compact index info files and quick gemspecs.
+func gemNameFromPath(urlPath string) (string, bool) {
+	switch {
+	case strings.HasPrefix(urlPath, "/info/"):
+		return strings.TrimPrefix(urlPath, "/info/"), true
+	case strings.HasPrefix(urlPath, "/gems/") && strings.HasSuffix(urlPath, ".gem"):
+		return gemNameFromFileName(strings.TrimSuffix(path.Base(urlPath), ".gem"))
+	case strings.HasPrefix(urlPath, gemQuickSpecPrefix):
+		return gemNameFromFileName(strings.TrimSuffix(path.Base(urlPath), ".gemspec.rz"))
+	}
+	return "", false
+}
+
+// gemNameFromFileName extracts the gem name from "<name>-<version>[-<platform>]".
+func gemNameFromFileName(base string) (string, bool) {
+	m := gemNameVersionPattern.FindStringSubmatch(base)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// GemUpstreamForPath returns the upstream a proxied RubyGems request should
+// go to.
+func GemUpstreamForPath(repo *config.RubyGemsProxyConfig, urlPath string) string {
+	if name, ok := gemNameFromPath(urlPath); ok {
+		return GemUpstreamFor(repo, name)
+	}
+	return repo.Upstream
+}
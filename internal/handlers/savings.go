@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+)
+
+// savingsMonths is how many months the savings reports cover, as far as
+// the download history retained goes.
+const savingsMonths = 12
+
+// bytesPerGB is the GB cost_per_gb prices, as cloud egress is billed.
+const bytesPerGB = 1 << 30
+
+// APIMonthlySavings sums the downloads of one month served from cache.
+type APIMonthlySavings struct {
+	Month      string `json:"month"`
+	CacheHit   int64  `json:"cache_hit"`
+	BytesSaved int64  `json:"bytes_saved"`
+	// CostSaved is only set when cost_per_gb is
+	CostSaved *float64 `json:"cost_saved,omitempty"`
+}
+
+// DashboardMonth is one month of the savings table.
+type DashboardMonth struct {
+	Month          string
+	CacheHit       int64
+	BandwidthSaved string
+	CostSaved      string
+}
+
+// costSaved returns the estimated cost of fetching bytes from upstream,
+// or nil without a cost_per_gb.
+func costSaved(bytes int64) *float64 {
+	costPerGB := config.Current().Server.CostPerGB
+	if costPerGB <= 0 {
+		return nil
+	}
+	cost := float64(bytes) / bytesPerGB * costPerGB
+	return &cost
+}
+
+// formatCostSaved returns the estimated cost of fetching bytes from
+// upstream, e.g. "$12.34", or "" without a cost_per_gb.
+func formatCostSaved(bytes int64) string {
+	cost := costSaved(bytes)
+	if cost == nil {
+		return ""
+	}
+	return config.Current().Server.Currency + strconv.FormatFloat(*cost, 'f', 2, 64)
+}
+
+// savingsSince returns the start of the first month the savings reports
+// cover.
+func savingsSince() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -(savingsMonths - 1), 0)
+}
+
+// apiMonthlySavings returns the downloads of registry served from cache
+// for each month with any, oldest first.
+func apiMonthlySavings(registry string) []APIMonthlySavings {
+	if repositories.DownloadEventRepo == nil {
+		return nil
+	}
+	months, err := repositories.DownloadEventRepo.MonthlySavings(registry, savingsSince())
+	if err != nil {
+		log.Printf("Failed to load monthly savings: %v", err)
+		return nil
+	}
+	var savings []APIMonthlySavings
+	for _, m := range months {
+		savings = append(savings, APIMonthlySavings{
+			Month:      m.Month,
+			CacheHit:   m.CacheHit,
+			BytesSaved: m.BytesSaved,
+			CostSaved:  costSaved(m.BytesSaved),
+		})
+	}
+	return savings
+}
+
+// monthlySavings returns the savings table of the dashboard, newest month
+// first.
+func monthlySavings(registry string) []DashboardMonth {
+	savings := apiMonthlySavings(registry)
+	months := make([]DashboardMonth, 0, len(savings))
+	for i := len(savings) - 1; i >= 0; i-- {
+		m := savings[i]
+		month := m.Month
+		if t, err := time.Parse("2006-01", m.Month); err == nil {
+			month = t.Format("January 2006")
+		}
+		months = append(months, DashboardMonth{
+			Month:          month,
+			CacheHit:       m.CacheHit,
+			BandwidthSaved: stats.FormatBytes(m.BytesSaved),
+			CostSaved:      formatCostSaved(m.BytesSaved),
+		})
+	}
+	return months
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+	"github.com/pkgb-in/pkgbin/internal/ratelimit"
+)
+
+// scrubBatchSize is how many rows the scrubber loads at once.
+const scrubBatchSize = 200
+
+// errMaintenanceWindowClosed stops a pass of a job confined to maintenance
+// windows once the window it started in closes.
+var errMaintenanceWindowClosed = errors.New("maintenance window closed")
+
+// scrubClient is who corrupted files removed by the scrubber are attributed
+// to in the activity feed.
+const scrubClient = "scrub"
+
+// ScrubReport describes one pass of the integrity scrubber.
+type ScrubReport struct {
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	// Files re-hashed, their total size, and those whose digest no longer
+	// matched the recorded one
+	Checked   int   `json:"checked"`
+	Bytes     int64 `json:"bytes"`
+	Corrupted int   `json:"corrupted"`
+	// Skipped counts the files cached under the same name by several
+	// repositories, whose row records the digest of only one of them
+	Skipped int `json:"skipped"`
+}
+
+var (
+	// lastScrub maps each registry to its latest scrub report
+	lastScrub   = make(map[string]ScrubReport)
+	lastScrubMu sync.Mutex
+
+	// Totals since the proxy started, published on /debug/vars
+	scrubStats = expvar.NewMap("scrub")
+)
+
+// LastScrub returns the report of the most recent scrub of registry; its
+// Time is zero if none finished yet.
+func LastScrub(registry string) ScrubReport {
+	lastScrubMu.Lock()
+	defer lastScrubMu.Unlock()
+	return lastScrub[registry]
+}
+
+// StartScrubber periodically re-hashes the cached files of registry against
+// the digests recorded in the packages table, removing the corrupted ones
+// (bit rot, truncated writes) so they are fetched again. A zero interval
+// disables it.
+func StartScrubber(registry string, cfg config.Scrub) {
+	if cfg.Interval.Duration <= 0 {
+		return
+	}
+	var pace *ratelimit.Bucket
+	if cfg.BytesPerSecond > 0 {
+		pace = ratelimit.NewBucket(float64(cfg.BytesPerSecond), float64(max(cfg.BytesPerSecond, throttleChunkSize)))
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			maintenance.Wait(config.MaintenanceScrub)
+			scrub(registry, cfg, pace)
+		}
+	}()
+}
+
+// scrub runs one pass over the rows of registry that have a digest.
+func scrub(registry string, cfg config.Scrub, pace *ratelimit.Bucket) {
+	// The leader of a cluster scrubs the shared cache for every node
+	if !cluster.IsLeader(registry) {
+		return
+	}
+	refreshMutex.Lock()
+	refreshing := refreshInProgress
+	refreshMutex.Unlock()
+	if refreshing {
+		log.Println("Skipping cache scrub while a database refresh is running")
+		return
+	}
+
+	unlock, ok := cluster.TryLock(refreshLockKey(registry))
+	if !ok {
+		log.Println("Skipping cache scrub while a database refresh is running on another node")
+		return
+	}
+	defer unlock()
+
+	start := time.Now()
+	report := ScrubReport{Time: start}
+	cutoff := start.Add(-reconcileGracePeriod)
+	dirs := reconcileDirs(registry)
+	var corrupted []string
+	err := repositories.PackageRepo.EachPackage(registry, scrubBatchSize, func(pkgs []models.Package) error {
+		if !maintenance.Open(config.MaintenanceScrub, time.Now()) {
+			return errMaintenanceWindowClosed
+		}
+		for _, pkg := range pkgs {
+			if pkg.SHA256 == "" && pkg.SHA512 == "" {
+				continue
+			}
+			// Repositories may cache different files under one name, so
+			// the row is only known to describe the file when a single
+			// repository holds it
+			var path string
+			var info os.FileInfo
+			copies := 0
+			for _, dir := range dirs {
+				if fi, err := os.Stat(filepath.Join(dir, pkg.Name)); err == nil && !fi.IsDir() {
+					path, info = filepath.Join(dir, pkg.Name), fi
+					copies++
+				}
+			}
+			if copies > 1 {
+				report.Skipped += copies
+				continue
+			}
+			if copies == 0 || info.ModTime().After(cutoff) {
+				continue
+			}
+			ok, err := verifyCachedFile(path, pkg, pace)
+			if err != nil {
+				log.Printf("Failed to scrub %s: %v", path, err)
+				continue
+			}
+			report.Checked++
+			report.Bytes += info.Size()
+			if !ok {
+				report.Corrupted++
+				if quarantineCachedFile(cfg, registry, path) {
+					corrupted = append(corrupted, pkg.Name)
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errMaintenanceWindowClosed) {
+		log.Printf("Cache scrub stopped after %d files, as the maintenance window closed", report.Checked)
+	} else if err != nil {
+		log.Printf("Cache scrub failed: %v", err)
+		return
+	}
+
+	if len(corrupted) > 0 {
+		if err := repositories.PackageRepo.DeletePackagesByNames(registry, corrupted); err != nil {
+			log.Printf("Failed to delete %d corrupted file(s) from database: %v", len(corrupted), err)
+		}
+		recordPurges(scrubClient, registry, corrupted)
+	}
+	report.Duration = time.Since(start).Round(time.Second).String()
+	log.Printf("Cache scrub checked %d files (%d bytes) in %s, %d corrupted, %d held by several repositories skipped",
+		report.Checked, report.Bytes, report.Duration, report.Corrupted, report.Skipped)
+
+	scrubStats.Add("runs", 1)
+	scrubStats.Add("files_checked", int64(report.Checked))
+	scrubStats.Add("bytes_checked", report.Bytes)
+	scrubStats.Add("corrupted_files", int64(report.Corrupted))
+	scrubStats.Add("skipped_files", int64(report.Skipped))
+	lastScrubMu.Lock()
+	lastScrub[registry] = report
+	lastScrubMu.Unlock()
+}
+
+// verifyCachedFile reports whether the file at path still hashes to the
+// SHA-256, or else SHA-512, recorded for pkg, reading it through pace.
+func verifyCachedFile(path string, pkg models.Package, pace *ratelimit.Bucket) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var h hash.Hash
+	want := pkg.SHA256
+	if want != "" {
+		h = sha256.New()
+	} else {
+		h, want = sha512.New(), pkg.SHA512
+	}
+	buf := make([]byte, throttleChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if pace != nil {
+				pace.Wait(context.Background(), n)
+			}
+			h.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)) == want, nil
+}
+
+// quarantineCachedFile takes a corrupted file out of the cache, moving it
+// under the quarantine directory when one is configured, and reports
+// whether it is gone.
+func quarantineCachedFile(cfg config.Scrub, registry, path string) bool {
+	if cfg.QuarantineDir == "" {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove corrupted file %s: %v", path, err)
+			return false
+		}
+		log.Printf("Removed corrupted file %s", path)
+		return true
+	}
+	dir := filepath.Join(cfg.QuarantineDir, registry)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Failed to create quarantine directory %s: %v", dir, err)
+		return false
+	}
+	target := filepath.Join(dir, time.Now().Format("20060102T150405")+"-"+filepath.Base(path))
+	if err := os.Rename(path, target); err != nil {
+		// Still keep the file from being served, e.g. when the quarantine
+		// directory is on another filesystem
+		log.Printf("Failed to quarantine corrupted file %s, removing it: %v", path, err)
+		cfg.QuarantineDir = ""
+		return quarantineCachedFile(cfg, registry, path)
+	}
+	log.Printf("Quarantined corrupted file %s as %s", path, target)
+	return true
+}
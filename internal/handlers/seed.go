@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cachekey"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"golang.org/x/crypto/blake2b"
+)
+
+// maxSeedManifestSize bounds the package.json read from a seeded tarball.
+const maxSeedManifestSize = 1 << 20
+
+// APISeedResult reports the outcome of seeding one file.
+type APISeedResult struct {
+	// File is the name the file is cached under.
+	File string `json:"file"`
+	// Cached is false when the file was already cached.
+	Cached bool `json:"cached"`
+}
+
+// seedFile caches the artifact sent as the request body, named by the file
+// query parameter, once it is checked to be a valid artifact of the
+// registry. Files already cached are left alone.
+func (reg apiRegistry) seedFile(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if registry := q.Get("registry"); registry != "" && registry != reg.registry {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("This proxy caches %s files, not %s", reg.registry, registry))
+		return
+	}
+	fileName := q.Get("file")
+	if fileName == "" || filepath.Base(fileName) != fileName || strings.HasPrefix(fileName, ".") {
+		writeAPIError(w, http.StatusBadRequest, "file must be the name of the file sent")
+		return
+	}
+
+	cacheDir := reg.cacheDir(r)
+	temp, err := os.CreateTemp(cacheDir, "seed-*"+janitor.TempSuffix)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "File creation failed")
+		return
+	}
+	defer janitor.Track(temp.Name())()
+	// Nothing is left once the file is moved into the cache
+	defer os.Remove(temp.Name())
+	hasher := newArtifactHasher()
+	b2, _ := blake2b.New256(nil)
+	size, err := io.Copy(io.MultiWriter(temp, hasher, b2), r.Body)
+	if err != nil {
+		temp.Close()
+		writeAPIError(w, http.StatusBadRequest, "Failed to read the file sent")
+		return
+	}
+
+	name, err := seedCacheFileName(reg.registry, fileName, temp, size)
+	temp.Close()
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("%s is not a valid %s file: %v", fileName, reg.registry, err))
+		return
+	}
+	if reg.registry == models.RegistryPyPI {
+		name = pypiDigestFileName(hex.EncodeToString(b2.Sum(nil)), name)
+	}
+
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	lock := downloadLock(reg.registry, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	localPath := filepath.Join(cacheDir, name)
+	if _, err := os.Stat(localPath); err == nil {
+		writeAPIJSON(w, http.StatusOK, APISeedResult{File: name})
+		return
+	}
+	if err := os.Rename(temp.Name(), localPath); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "File move failed")
+		return
+	}
+	recordImport(reg.registry, name, &cachedArtifact{
+		Size:   size,
+		SHA256: hex.EncodeToString(hasher.Sum("sha256")),
+		SHA512: hex.EncodeToString(hasher.Sum("sha512")),
+	}, time.Now())
+	noteAudit(r, "%s", name)
+	writeAPIJSON(w, http.StatusCreated, APISeedResult{File: name, Cached: true})
+}
+
+// seedCacheFileName checks that f, of size bytes and sent as fileName, is
+// an artifact of registry, and returns the name it is cached under. For
+// PyPI the digest directories are left to the caller.
+func seedCacheFileName(registry, fileName string, f *os.File, size int64) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	switch registry {
+	case models.RegistryNPM:
+		if !strings.HasSuffix(fileName, ".tgz") {
+			return "", errors.New("npm packages are .tgz tarballs")
+		}
+		return npmSeedFileName(f)
+	case models.RegistryPyPI:
+		if _, ok := importCacheFileName(registry, fileName); !ok {
+			return "", errors.New("not a wheel, egg or source distribution name")
+		}
+		lower := strings.ToLower(fileName)
+		var found bool
+		var err error
+		switch {
+		case strings.HasSuffix(lower, ".tar.gz"):
+			found, err = tarGzContains(f, isPyPIMetadata)
+		case strings.HasSuffix(lower, ".tar.bz2"):
+			found, err = tarContains(tar.NewReader(bzip2.NewReader(f)), isPyPIMetadata)
+		default:
+			found, err = zipContains(f, size, isPyPIMetadata)
+		}
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", errors.New("no METADATA or PKG-INFO in the distribution")
+		}
+		return fileName, nil
+	case models.RegistryRubyGems:
+		if _, ok := importCacheFileName(registry, fileName); !ok {
+			return "", errors.New("gems are .gem files")
+		}
+		if gemNameVersionPattern.FindStringSubmatch(strings.TrimSuffix(fileName, ".gem")) == nil {
+			return "", errors.New("the name is not <name>-<version>.gem")
+		}
+		var metadata, data bool
+		_, err := tarContains(tar.NewReader(f), func(name string) bool {
+			metadata = metadata || name == "metadata.gz"
+			data = data || name == "data.tar.gz"
+			return metadata && data
+		})
+		if err != nil {
+			return "", err
+		}
+		if !metadata || !data {
+			return "", errors.New("no metadata.gz and data.tar.gz in the gem")
+		}
+		return fileName, nil
+	}
+	return "", fmt.Errorf("unknown registry %s", registry)
+}
+
+// npmSeedFileName returns the cache file name of the npm tarball read
+// from r, from the name and version of its package.json.
+func npmSeedFileName(r io.Reader) (string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return "", fmt.Errorf("not gzip-compressed: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("no package.json in the tarball")
+		}
+		if err != nil {
+			return "", fmt.Errorf("not a tarball: %w", err)
+		}
+		// Tarballs hold the package in one top directory, package/ usually
+		dir, file, ok := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if !ok || dir == "" || file != "package.json" {
+			continue
+		}
+		var manifest struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		if err := json.NewDecoder(io.LimitReader(tr, maxSeedManifestSize)).Decode(&manifest); err != nil {
+			return "", fmt.Errorf("invalid package.json: %w", err)
+		}
+		if _, ok := parseNPMPackagePath(manifest.Name); !ok || strings.Contains(manifest.Name, "..") {
+			return "", fmt.Errorf("invalid package name %q", manifest.Name)
+		}
+		tarball := path.Base(manifest.Name) + "-" + manifest.Version + ".tgz"
+		if _, version := parseNPMCacheFileName(tarball); version == "" || strings.Contains(manifest.Version, "/") {
+			return "", fmt.Errorf("invalid version %q", manifest.Version)
+		}
+		return cachekey.NPM("/" + manifest.Name + "/-/" + tarball), nil
+	}
+}
+
+// isPyPIMetadata reports whether a distribution entry is its metadata:
+// METADATA of a wheel's .dist-info, or PKG-INFO of a source distribution
+// or egg.
+func isPyPIMetadata(name string) bool {
+	dir, file := path.Split(strings.TrimPrefix(name, "./"))
+	if strings.Count(dir, "/") > 1 {
+		return false
+	}
+	return file == "PKG-INFO" || (file == "METADATA" && strings.HasSuffix(dir, ".dist-info/"))
+}
+
+// tarGzContains reports whether the gzip-compressed tarball read from r
+// has an entry match accepts.
+func tarGzContains(r io.Reader, match func(name string) bool) (bool, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return false, fmt.Errorf("not gzip-compressed: %w", err)
+	}
+	return tarContains(tar.NewReader(gz), match)
+}
+
+// tarContains reports whether tr has an entry match accepts.
+func tarContains(tr *tar.Reader, match func(name string) bool) (bool, error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("not a tarball: %w", err)
+		}
+		if match(hdr.Name) {
+			return true, nil
+		}
+	}
+}
+
+// zipContains reports whether the zip archive r of size bytes has an entry
+// match accepts.
+func zipContains(r io.ReaderAt, size int64, match func(name string) bool) (bool, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false, fmt.Errorf("not a zip archive: %w", err)
+	}
+	for _, f := range zr.File {
+		if match(f.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
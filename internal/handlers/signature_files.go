@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/metacache"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// detachedSignatureSuffixes are the extensions of the signatures published
+// next to artifacts: ASCII-armored OpenPGP signatures, and binary ones or
+// those of other signing tools.
+var detachedSignatureSuffixes = []string{".asc", ".sig"}
+
+// detachedSignatureTTL is how long a cached signature is served without
+// revalidating it, when upstream sends no caching headers. Signatures do
+// not change once published.
+const detachedSignatureTTL = 24 * time.Hour
+
+// detachedSignatureKeyPrefix keeps signatures apart from the other
+// documents of the metadata cache.
+const detachedSignatureKeyPrefix = "signatures"
+
+// signedArtifactPath returns the path of the artifact the detached
+// signature at urlPath signs, false if urlPath is no signature.
+func signedArtifactPath(urlPath string) (string, bool) {
+	for _, suffix := range detachedSignatureSuffixes {
+		if artifact, ok := strings.CutSuffix(urlPath, suffix); ok {
+			return artifact, true
+		}
+	}
+	return "", false
+}
+
+// isDetachedSignatureRequest reports whether r reads the detached signature
+// of an artifact isArtifact recognizes by its path.
+func isDetachedSignatureRequest(r *http.Request, isArtifact func(urlPath string) bool) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	artifact, ok := signedArtifactPath(r.URL.Path)
+	return ok && isArtifact(artifact)
+}
+
+// IsNPMDetachedSignatureRequest reports whether r reads the signature of a
+// tarball.
+func IsNPMDetachedSignatureRequest(r *http.Request) bool {
+	return isDetachedSignatureRequest(r, func(urlPath string) bool {
+		return strings.HasSuffix(urlPath, ".tgz")
+	})
+}
+
+// IsPyPIDetachedSignatureRequest reports whether r reads the signature of a
+// distribution file, such as the .asc files PEP 503 pages flag with
+// data-gpg-sig.
+func IsPyPIDetachedSignatureRequest(r *http.Request) bool {
+	return isDetachedSignatureRequest(r, func(urlPath string) bool {
+		return isPyPIDistributionPath(urlPath) && !strings.HasSuffix(urlPath, ".metadata")
+	})
+}
+
+// IsGemDetachedSignatureRequest reports whether r reads the signature of a
+// gem.
+func IsGemDetachedSignatureRequest(r *http.Request) bool {
+	return isDetachedSignatureRequest(r, func(urlPath string) bool {
+		return strings.HasPrefix(urlPath, "/gems/") && strings.HasSuffix(urlPath, ".gem")
+	})
+}
+
+// NPMDetachedSignatureHandler serves the signature of a tarball from the
+// metadata cache, fetching it from the upstream of its package.
+func NPMDetachedSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	repo := NPMRepository(r)
+	artifact, _ := signedArtifactPath(r.URL.Path)
+	serveDetachedSignature(w, r, npmMetadataStore(repo), NPMUpstreamForPath(repo, artifact))
+}
+
+// PyPIDetachedSignatureHandler serves the signature of a distribution file
+// from the metadata cache, fetching it from where the file is downloaded:
+// the files host of PyPI, or the upstream the project is routed to.
+func PyPIDetachedSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	repo := PyPIRepository(r)
+	artifact, _ := signedArtifactPath(r.URL.Path)
+	base := PyPIUpstreamForPath(repo, artifact)
+	if base == repo.Upstream && strings.HasPrefix(artifact, "/packages/") {
+		base = "https://" + pypiFilesHost
+	}
+	serveDetachedSignature(w, r, pypiMetadataStores[repo.MetadataDir], base)
+}
+
+// GemDetachedSignatureHandler serves the signature of a gem from the
+// metadata cache, fetching it from the upstream of the gem.
+func GemDetachedSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	repo := RubyGemsRepository(r)
+	artifact, _ := signedArtifactPath(r.URL.Path)
+	serveDetachedSignature(w, r, gemMetadataStore(repo), GemUpstreamForPath(repo, artifact))
+}
+
+// serveDetachedSignature serves the signature r asks for from store,
+// fetching it from base once and revalidating it daily. Cached signatures
+// keep being served while upstream is unreachable.
+func serveDetachedSignature(w http.ResponseWriter, r *http.Request, store *metacache.Store, base string) {
+	upstreamURL := upstream.Join(base, r.URL.EscapedPath())
+	entry, stale, err := store.Fetch(r.Context(), metadataClient, detachedSignatureKeyPrefix+r.URL.Path, upstreamURL, nil, detachedSignatureTTL)
+	if err != nil {
+		var statusErr *metacache.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			http.Error(w, "Signature not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to fetch signature %s [%s]: %v", r.URL.Path, requestid.FromContext(r.Context()), err)
+		http.Error(w, "Failed to fetch signature from upstream", http.StatusBadGateway)
+		return
+	}
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	store.Serve(w, r, entry)
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/oidc"
+)
+
+// Roles granted to single sign-on users from their groups.
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
+
+const (
+	sessionCookie = "pkgbin_session"
+	loginCookie   = "pkgbin_login"
+	// loginTimeout bounds the time between starting a login and the
+	// provider redirecting back.
+	loginTimeout = 10 * time.Minute
+)
+
+var (
+	ssoProvider   *oidc.Provider
+	sessionSecret []byte
+)
+
+// ssoSession is the signed content of the session cookie.
+type ssoSession struct {
+	Subject string    `json:"sub"`
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"exp"`
+}
+
+// ssoLogin is the signed state kept in a cookie while the user signs in at
+// the provider.
+type ssoLogin struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Next     string    `json:"next"`
+	Expires  time.Time `json:"exp"`
+}
+
+// InitSSO discovers the configured OIDC provider. Without one, the
+// dashboard stays public and admin endpoints rely on tokens alone.
+func InitSSO() error {
+	cfg := config.OIDC
+	if !cfg.Enabled() {
+		return nil
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return errors.New("oidc client_id and redirect_url are required")
+	}
+	clientSecret, err := cfg.ClientSecret.Value()
+	if err != nil {
+		return fmt.Errorf("oidc client secret: %w", err)
+	}
+	if cfg.SessionSecret.IsSet() {
+		secret, err := cfg.SessionSecret.Value()
+		if err != nil {
+			return fmt.Errorf("oidc session secret: %w", err)
+		}
+		if len(secret) < 32 {
+			return errors.New("oidc session secret must be at least 32 characters")
+		}
+		sessionSecret = []byte(secret)
+	} else {
+		sessionSecret = []byte(randomToken())
+		log.Printf("WARNING: no oidc session_secret configured, sessions end on restart")
+	}
+
+	provider, err := oidc.Discover(cfg.Issuer, cfg.ClientID, clientSecret, cfg.RedirectURL, cfg.Scopes)
+	if err != nil {
+		return err
+	}
+	ssoProvider = provider
+	log.Printf("Single sign-on enabled with %s", cfg.Issuer)
+	return nil
+}
+
+// ssoEnabled reports whether single sign-on is configured.
+func ssoEnabled() bool {
+	return ssoProvider != nil
+}
+
+// roleForGroups maps the user's groups to a role; "" denies access.
+func roleForGroups(groups []string) string {
+	if anyGroup(groups, config.OIDC.AdminGroups) {
+		return roleAdmin
+	}
+	if len(config.OIDC.ViewerGroups) == 0 || anyGroup(groups, config.OIDC.ViewerGroups) {
+		return roleViewer
+	}
+	return ""
+}
+
+func anyGroup(groups, allowed []string) bool {
+	for _, g := range groups {
+		for _, a := range allowed {
+			if g == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// currentSession returns the signed-in user of r, if any.
+func currentSession(r *http.Request) (ssoSession, bool) {
+	var s ssoSession
+	if !ssoEnabled() || !readSignedCookie(r, sessionCookie, &s) || time.Now().After(s.Expires) {
+		return ssoSession{}, false
+	}
+	return s, true
+}
+
+// RequireViewer wraps the dashboard so that, with single sign-on enabled,
+// only signed-in users with a role may see it.
+func RequireViewer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ssoEnabled() {
+			next(w, r)
+			return
+		}
+		s, ok := currentSession(r)
+		if !ok {
+			base := externalBasePath(r)
+			target := base + r.URL.RequestURI()
+			http.Redirect(w, r, base+"/auth/login?next="+url.QueryEscape(target), http.StatusFound)
+			return
+		}
+		if s.Role == "" {
+			http.Error(w, "Your account has no access to this dashboard", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// SSOLoginHandler sends the user to the provider to sign in.
+func SSOLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !ssoEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	login := ssoLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Next:     safeRedirectTarget(r.URL.Query().Get("next")),
+		Expires:  time.Now().Add(loginTimeout),
+	}
+	setSignedCookie(w, r, loginCookie, login, login.Expires)
+	http.Redirect(w, r, ssoProvider.AuthCodeURL(login.State, login.Nonce, login.Verifier), http.StatusFound)
+}
+
+// SSOCallbackHandler completes a sign-in and starts a session.
+func SSOCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !ssoEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	var login ssoLogin
+	if !readSignedCookie(r, loginCookie, &login) || time.Now().After(login.Expires) {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	clearCookie(w, r, loginCookie)
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("Single sign-on failed: %s %s", errCode, query.Get("error_description"))
+		http.Error(w, "Sign-in failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+	if !hmac.Equal([]byte(query.Get("state")), []byte(login.State)) {
+		http.Error(w, "Invalid sign-in state", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := ssoProvider.Exchange(query.Get("code"), login.Verifier)
+	if err != nil {
+		log.Printf("Single sign-on code exchange failed: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := ssoProvider.Verify(rawIDToken, login.Nonce)
+	if err != nil {
+		log.Printf("Single sign-on rejected ID token: %v", err)
+		recordAdminAudit(r, clientIdentity(r), AuditLoginDenied, "ID token rejected")
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	name := claims.String("email")
+	if name == "" {
+		name = claims.String("preferred_username")
+	}
+	if name == "" {
+		name = claims.String("sub")
+	}
+	session := ssoSession{
+		Subject: claims.String("sub"),
+		Name:    name,
+		Role:    roleForGroups(claims.Strings(config.OIDC.GroupsClaim)),
+		Expires: time.Now().Add(config.OIDC.SessionTTL.Duration),
+	}
+	if session.Role == "" {
+		log.Printf("Single sign-on user %s has no pkgbin role", name)
+		recordAdminAudit(r, "sso:"+name, AuditLoginDenied, "no pkgbin role")
+		http.Error(w, "Your account has no access to pkgbin", http.StatusForbidden)
+		return
+	}
+	setSignedCookie(w, r, sessionCookie, session, session.Expires)
+	log.Printf("Single sign-on user %s signed in as %s", name, session.Role)
+	recordAdminAudit(r, "sso:"+name, AuditLogin, "signed in as "+session.Role)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+// SSOLogoutHandler ends the session.
+func SSOLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if s, ok := currentSession(r); ok {
+		recordAdminAudit(r, "sso:"+s.Name, AuditLogout, "")
+	}
+	clearCookie(w, r, sessionCookie)
+	http.Redirect(w, r, externalBasePath(r)+"/dashboard", http.StatusFound)
+}
+
+// safeRedirectTarget only allows local paths, so the login flow cannot be
+// used as an open redirect.
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/dashboard"
+	}
+	return next
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signCookieValue(payload []byte) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func setSignedCookie(w http.ResponseWriter, r *http.Request, name string, v any, expires time.Time) {
+	payload, _ := json.Marshal(v)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    signCookieValue(payload),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(config.OIDC.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readSignedCookie(r *http.Request, name string, v any) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	encoded, _, _ := strings.Cut(cookie.Value, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(signCookieValue(payload)), []byte(cookie.Value)) {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
+
+func clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil})
+}
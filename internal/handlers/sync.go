@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// syncPageSize is how many package rows one listing of the primary returns.
+const syncPageSize = apiMaxPageSize
+
+// StartSync copies the files the primary instance of the sync settings
+// caches for registry into cacheDir every sync interval, recording their
+// package rows, so this instance can take over with a warm cache. Nothing
+// runs without a primary.
+func StartSync(registry, cacheDir string) error {
+	cfg := config.Server.Sync
+	if cfg.Primary == "" || cfg.Interval.Duration <= 0 {
+		return nil
+	}
+	if err := upstream.RegisterCredentials(cfg.Primary, cfg.Auth); err != nil {
+		return err
+	}
+	s := &syncer{registry: registry, cacheDir: cacheDir, primary: strings.TrimSuffix(cfg.Primary, "/")}
+	log.Printf("Syncing the %s cache from %s every %s", registry, cfg.Primary, cfg.Interval.Duration)
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.sync()
+		}
+	}()
+	return nil
+}
+
+// syncer pulls the cache of one registry from the primary.
+type syncer struct {
+	registry, cacheDir, primary string
+	// since is the last update time on the primary of the packages synced
+	// so far
+	since time.Time
+}
+
+// sync copies the files of the packages updated on the primary since the
+// last sync that are missing here. Packages that failed are tried again on
+// the next sync. The leader of a cluster syncs for every node.
+func (s *syncer) sync() {
+	if !cluster.IsLeader(s.registry) {
+		return
+	}
+	ctx := context.Background()
+	latest := s.since
+	var copied, failed int
+	for page := 1; ; page++ {
+		pkgs, err := s.listPackages(ctx, page)
+		if err != nil {
+			log.Printf("Failed to list the packages of %s to sync: %v", s.primary, err)
+			return
+		}
+		for _, pkg := range pkgs {
+			ok, err := s.syncPackage(ctx, pkg)
+			if err != nil {
+				log.Printf("Failed to sync %s from %s: %v", pkg.Name, s.primary, err)
+				failed++
+				continue
+			}
+			if ok {
+				copied++
+			}
+			if pkg.UpdatedAt.After(latest) {
+				latest = pkg.UpdatedAt
+			}
+		}
+		if len(pkgs) < syncPageSize {
+			break
+		}
+	}
+	if failed == 0 {
+		s.since = latest
+	}
+	if copied > 0 || failed > 0 {
+		log.Printf("Synced %d file(s) from %s, %d failed", copied, s.primary, failed)
+	}
+}
+
+// listPackages returns a page of the packages updated on the primary since
+// the last sync, oldest update first.
+func (s *syncer) listPackages(ctx context.Context, page int) ([]APIPackage, error) {
+	q := url.Values{}
+	q.Set("sort", "updated_at")
+	q.Set("page", strconv.Itoa(page))
+	q.Set("per_page", strconv.Itoa(syncPageSize))
+	if !s.since.IsZero() {
+		q.Set("updated_since", s.since.Format(time.RFC3339Nano))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.primary+APIPrefix+"packages?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upstream.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("primary returned %s", resp.Status)
+	}
+	var list APIPackageList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Packages, nil
+}
+
+// syncPackage copies the file of pkg from the primary unless it is already
+// cached, and reports whether it did. Packages the primary has not cached
+// a file for are skipped.
+func (s *syncer) syncPackage(ctx context.Context, pkg APIPackage) (bool, error) {
+	if pkg.SHA256 == "" && pkg.SHA512 == "" {
+		return false, nil
+	}
+	if filepath.Base(pkg.Name) != pkg.Name || strings.HasPrefix(pkg.Name, ".") {
+		return false, fmt.Errorf("invalid file name")
+	}
+	localPath := filepath.Join(s.cacheDir, pkg.Name)
+	if info, err := os.Stat(localPath); err == nil && info.Size() == pkg.SizeBytes {
+		return false, nil
+	}
+
+	expected := &expectedDigest{Algorithm: "sha256"}
+	hexDigest := pkg.SHA256
+	if hexDigest == "" {
+		expected.Algorithm, hexDigest = "sha512", pkg.SHA512
+	}
+	value, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s digest: %w", expected.Algorithm, err)
+	}
+	expected.Value = value
+
+	// Like a cache miss filling the same file
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	lock := downloadLock(s.registry, pkg.Name)
+	lock.Lock()
+	defer lock.Unlock()
+	unlockCluster, err := cluster.Lock(ctx, s.registry+"/"+pkg.Name)
+	if err != nil {
+		return false, err
+	}
+	defer unlockCluster()
+	if info, err := os.Stat(localPath); err == nil && info.Size() == pkg.SizeBytes {
+		return false, nil
+	}
+
+	fileURL := s.primary + APIPrefix + "files/" + url.PathEscape(pkg.Name) + "/content"
+	artifact, err := fetchArtifact(ctx, s.registry, upstream.Client, fileURL, localPath, expected, 0)
+	if errors.Is(err, errNotFoundUpstream) {
+		// Purged on the primary since it was listed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	recordArtifact(s.registry, pkg.Name, artifact)
+	return true, nil
+}
+
+// downloadLock returns the lock the download handler of registry holds
+// while caching fileName.
+func downloadLock(registry, fileName string) *sync.Mutex {
+	locks, mu := downloadLocks, &downloadLocksMutex
+	switch registry {
+	case models.RegistryPyPI:
+		locks, mu = pypiDownloadLocks, &pypiDownloadLocksMutex
+	case models.RegistryRubyGems:
+		locks, mu = gemDownloadLocks, &gemDownloadLocksMutex
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	lock, ok := locks[fileName]
+	if !ok {
+		lock = &sync.Mutex{}
+		locks[fileName] = lock
+	}
+	return lock
+}
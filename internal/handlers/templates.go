@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"embed"
+	"html/template"
+	"maps"
+
+	"github.com/pkgb-in/pkgbin/static"
+)
+
+// templateFiles holds the dashboard pages and the fragments they share.
+//
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// parseTemplate parses the page template file called name with funcs and
+// the shared fragments.
+func parseTemplate(name string, funcs template.FuncMap) *template.Template {
+	all := template.FuncMap{"bootstrap": static.BootstrapURL}
+	maps.Copy(all, funcs)
+	return template.Must(template.New(name).Funcs(all).ParseFS(templateFiles, "templates/"+name, "templates/admin_fetch.html"))
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// transparentKey is the request context key marking requests made to a
+// transparent host of their repository.
+type transparentKey struct{}
+
+// transparentRequest reports whether r was made to a transparent host.
+func transparentRequest(r *http.Request) bool {
+	transparent, _ := r.Context().Value(transparentKey{}).(bool)
+	return transparent
+}
+
+// requestHostname returns the host name r was sent to, without its port,
+// as requests are routed on it.
+func requestHostname(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// transparentRepository returns the repository among repos whose
+// transparent_hosts list host.
+func transparentRepository[T any](host string, repos []*T, hosts func(*T) []string) (any, bool) {
+	for _, repo := range repos {
+		if slices.Contains(hosts(repo), host) {
+			return repo, true
+		}
+	}
+	return nil, false
+}
+
+// transparentHosts returns the transparent_hosts of the repositories of
+// registry.
+func transparentHosts(registry string) []string {
+	var hosts []string
+	switch registry {
+	case models.RegistryNPM:
+		for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+			hosts = append(hosts, repo.TransparentHosts...)
+		}
+	case models.RegistryPyPI:
+		for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+			hosts = append(hosts, repo.TransparentHosts...)
+		}
+	case models.RegistryRubyGems:
+		for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+			hosts = append(hosts, repo.TransparentHosts...)
+		}
+	}
+	return hosts
+}
+
+// HandleTransparentHosts has mux serve every request made to a transparent
+// host of the repositories of registry with handler, the registry itself,
+// so pkgbin's own endpoints such as /dashboard never shadow a package of
+// the same name.
+func HandleTransparentHosts(mux *http.ServeMux, registry string, handler http.Handler) {
+	for _, host := range transparentHosts(registry) {
+		mux.Handle(host+"/", handler)
+		log.Printf("Answering for %s transparently", host)
+	}
+}
+
+// serveTransparent serves r, made to a transparent host of repo, with
+// next. Requests pkgbin itself sent upstream that came back to it are
+// refused, as they would loop until the connections run out.
+func serveTransparent(w http.ResponseWriter, r *http.Request, repo any, next http.Handler) {
+	if upstream.LoopedBack(r) {
+		log.Printf("Refused %s%s [%s]: request to upstream looped back to this proxy, set http_client.resolver to a DNS server resolving %s to the real registry",
+			r.Host, r.URL.Path, requestid.FromContext(r.Context()), requestHostname(r))
+		http.Error(w, "Request looped back to the proxy", http.StatusLoopDetected)
+		return
+	}
+	ctx := context.WithValue(context.WithValue(r.Context(), repositoryKey{}, repo), transparentKey{}, true)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+)
+
+// trashDirName is the hidden directory of each cache directory purged files
+// are moved to. Hidden directories are left out of the cache walks, so
+// trashed files are not counted, reconciled or served.
+const trashDirName = ".trash"
+
+// trashSweepInterval is how often trashed files past purge_retention are
+// deleted.
+const trashSweepInterval = 10 * time.Minute
+
+// maxRestoreFiles bounds the files restored by one request.
+const maxRestoreFiles = 1000
+
+// APITrashedFile is a purged file kept in the trash.
+type APITrashedFile struct {
+	File        string    `json:"file"`
+	PackageName string    `json:"package_name"`
+	Version     string    `json:"version"`
+	Size        int64     `json:"size"`
+	PurgedAt    time.Time `json:"purged_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// APIRestoreResult reports the outcome of a restore.
+type APIRestoreResult struct {
+	Restored []string `json:"restored"`
+	// Cached lists the files that were cached again since their purge,
+	// whose trashed copy is left to expire.
+	Cached  []string `json:"cached,omitempty"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+// removeCachedFile deletes the cached file at path, or moves it to the
+// trash of its cache directory while purge_retention is set. Its purge
+// time is kept as its modification time.
+func removeCachedFile(path string) error {
+	if config.Current().Server.PurgeRetention.Duration <= 0 {
+		return os.Remove(path)
+	}
+	dir := filepath.Join(filepath.Dir(path), trashDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	trashed := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, trashed); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.Chtimes(trashed, now, now); err != nil {
+		log.Printf("Failed to timestamp trashed %s: %v", trashed, err)
+	}
+	return nil
+}
+
+// StartTrashSweeper periodically deletes the purged files of registry kept
+// in the trash for longer than purge_retention. The leader of a cluster
+// sweeps for every node, and read-only replicas leave it to their writer.
+func StartTrashSweeper(registry string) {
+	if config.Server.PurgeRetention.Duration <= 0 || readOnlyReplica() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(trashSweepInterval)
+		defer ticker.Stop()
+		for {
+			sweepTrash(registry)
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepTrash deletes the trashed files of registry past purge_retention.
+func sweepTrash(registry string) {
+	if !cluster.IsLeader(registry) {
+		return
+	}
+	retention := config.Current().Server.PurgeRetention.Duration
+	cutoff := time.Now().Add(-retention)
+	var removed int
+	for _, dir := range reconcileDirs(registry) {
+		entries, err := os.ReadDir(filepath.Join(dir, trashDirName))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() || info.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, trashDirName, entry.Name())); err != nil {
+				log.Printf("Failed to delete trashed %s: %v", entry.Name(), err)
+				continue
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Deleted %d %s file(s) purged more than %s ago", removed, registry, retention)
+	}
+}
+
+// trash lists the purged files kept in the trash of the repository, most
+// recently purged first.
+func (reg apiRegistry) trash(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(filepath.Join(reg.cacheDir(r), trashDirName))
+	if err != nil && !os.IsNotExist(err) {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to list the trash")
+		return
+	}
+	files := []APITrashedFile{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !janitor.IsArtifact(entry.Name(), info) {
+			continue
+		}
+		f := APITrashedFile{
+			File:      entry.Name(),
+			Size:      info.Size(),
+			PurgedAt:  info.ModTime(),
+			ExpiresAt: info.ModTime().Add(requestSettings(r.Context()).Server.PurgeRetention.Duration),
+		}
+		f.PackageName, f.Version = parseCachedFileName(reg.registry, entry.Name())
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].PurgedAt.After(files[j].PurgedAt) })
+	writeAPIJSON(w, http.StatusOK, files)
+}
+
+// restore moves the files listed in the request body back from the trash
+// of the repository into its cache, recording them as cached again.
+func (reg apiRegistry) restore(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Files []string `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Files) == 0 || len(req.Files) > maxRestoreFiles {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("files must list between 1 and %d files", maxRestoreFiles))
+		return
+	}
+	for _, name := range req.Files {
+		if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid file name %q", name))
+			return
+		}
+	}
+
+	cacheDir := reg.cacheDir(r)
+	result := APIRestoreResult{Restored: []string{}}
+	for _, name := range req.Files {
+		restored, err := restoreTrashedFile(reg.registry, cacheDir, name)
+		switch {
+		case os.IsNotExist(err):
+			result.Missing = append(result.Missing, name)
+		case err != nil:
+			log.Printf("Failed to restore %s: %v", name, err)
+			writeAPIError(w, http.StatusInternalServerError, "Failed to restore "+name)
+			return
+		case restored:
+			result.Restored = append(result.Restored, name)
+		default:
+			result.Cached = append(result.Cached, name)
+		}
+	}
+	if len(result.Restored) > 0 {
+		log.Printf("Restored %d %s file(s) from the trash", len(result.Restored), reg.registry)
+	}
+	noteAudit(r, "%d restored: %s", len(result.Restored), strings.Join(result.Restored, ", "))
+	writeAPIJSON(w, http.StatusOK, result)
+}
+
+// restoreTrashedFile moves fileName back from the trash of cacheDir and
+// adds its package row, and reports whether it did. Files cached again
+// since their purge are left alone.
+func restoreTrashedFile(registry, cacheDir, fileName string) (bool, error) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	lock := downloadLock(registry, fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	trashed := filepath.Join(cacheDir, trashDirName, fileName)
+	if _, err := os.Stat(trashed); err != nil {
+		return false, err
+	}
+	localPath := filepath.Join(cacheDir, fileName)
+	if _, err := os.Stat(localPath); err == nil {
+		return false, nil
+	}
+	if err := os.Rename(trashed, localPath); err != nil {
+		return false, err
+	}
+	var pkg models.Package
+	info, err := os.Stat(localPath)
+	if err == nil {
+		err = hashCachedFile(localPath, &pkg)
+	}
+	if err != nil {
+		// The reconciler adds the row of the restored file
+		log.Printf("Failed to hash restored %s: %v", fileName, err)
+		return true, nil
+	}
+	recordImport(registry, fileName, &cachedArtifact{Size: info.Size(), SHA256: pkg.SHA256, SHA512: pkg.SHA512}, time.Now())
+	return true, nil
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/vulnscan"
+)
+
+// npmScanTarget identifies the tarball r downloads for vulnerability scans.
+func npmScanTarget(r *http.Request, fileName string) vulnscan.Target {
+	pkgName, _ := npmPackageFromPath(r.URL.Path)
+	return vulnscan.Target{FileName: fileName, Ecosystem: "npm", Name: pkgName, Version: npmVersionFromPath(pkgName, r.URL.Path)}
+}
+
+// pypiScanTarget identifies the distribution file r downloads.
+func pypiScanTarget(r *http.Request, fileName string) vulnscan.Target {
+	base := path.Base(r.URL.Path)
+	return vulnscan.Target{FileName: fileName, Ecosystem: "PyPI", Name: normalizePyPIName(pypiProjectFromFilename(base)), Version: pypiVersionFromFilename(base)}
+}
+
+// gemScanTarget identifies the gem r downloads.
+func gemScanTarget(r *http.Request, fileName string) vulnscan.Target {
+	gemName, _ := gemNameFromPath(r.URL.Path)
+	return vulnscan.Target{FileName: fileName, Ecosystem: "RubyGems", Name: gemName, Version: gemVersionFromPath(r.URL.Path)}
+}
+
+// vulnerabilityDenial reports whether t must be refused because it has a
+// known vulnerability at or above the configured block severity. Versions
+// are scanned synchronously here so a blocked version is never cached;
+// when OSV cannot be reached the download is allowed.
+func vulnerabilityDenial(scan config.VulnerabilityScan, t vulnscan.Target) (string, bool) {
+	if !scan.Enabled || scan.BlockSeverity == "" || t.Name == "" || t.Version == "" {
+		return "", false
+	}
+	vulns, err := vulnscan.Findings(scan, t)
+	if err != nil {
+		log.Printf("Vulnerability scan of %s %s failed, allowing download: %v", t.Name, t.Version, err)
+		return "", false
+	}
+	v, blocked := vulnscan.Blocking(scan, vulns)
+	if !blocked {
+		return "", false
+	}
+	message := fmt.Sprintf("%s %s is blocked: known %s vulnerability %s", t.Name, t.Version, v.Severity, v.VulnID)
+	if v.Summary != "" {
+		message += " (" + strings.TrimSpace(v.Summary) + ")"
+	}
+	log.Print(message)
+	return message, true
+}
+
+// scanOnCacheMiss records the vulnerabilities of a newly cached version in
+// the background when findings are only reported, not enforced.
+func scanOnCacheMiss(scan config.VulnerabilityScan, t vulnscan.Target) {
+	if !scan.Enabled || scan.BlockSeverity != "" || t.Name == "" || t.Version == "" {
+		return
+	}
+	vulnscan.ScanAsync(scan, t)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+)
+
+// sourcePlatform is what source distributions are counted under in the
+// platform stats.
+const sourcePlatform = "source"
+
+// wheelTags are the compatibility tags of a wheel file name.
+type wheelTags struct {
+	python string
+	abi    string
+	// platform is the platform tag as written, several joined by "." for
+	// wheels built for more than one, e.g.
+	// "manylinux_2_17_x86_64.manylinux2014_x86_64"
+	platform string
+}
+
+// platforms returns each of the platform tags of t.
+func (t wheelTags) platforms() []string {
+	return strings.Split(t.platform, ".")
+}
+
+// parseWheelTags returns the tags of the wheel cached as fileName, named
+// "{name}-{version}(-{build})?-{python}-{abi}-{platform}.whl", and false
+// for other files.
+func parseWheelTags(fileName string) (wheelTags, bool) {
+	name := pypiDistributionName(fileName)
+	if len(name) < len(".whl") || !strings.EqualFold(name[len(name)-len(".whl"):], ".whl") {
+		return wheelTags{}, false
+	}
+	fields := strings.Split(name[:len(name)-len(".whl")], "-")
+	if len(fields) != 5 && len(fields) != 6 {
+		return wheelTags{}, false
+	}
+	n := len(fields)
+	t := wheelTags{python: fields[n-3], abi: fields[n-2], platform: strings.ToLower(fields[n-1])}
+	if t.python == "" || t.abi == "" || t.platform == "" {
+		return wheelTags{}, false
+	}
+	return t, true
+}
+
+// wheelPlatformRefused reports whether fileName is a wheel none of whose
+// platform tags cfg caches.
+func wheelPlatformRefused(cfg config.WheelPlatforms, fileName string) bool {
+	if !cfg.Enabled() {
+		return false
+	}
+	tags, ok := parseWheelTags(fileName)
+	if !ok {
+		return false
+	}
+	for _, platform := range tags.platforms() {
+		if cfg.Allows(platform) {
+			return false
+		}
+	}
+	return true
+}
+
+// wheelPlatformMatches reports whether fileName is a wheel one of whose
+// platform tags matches the path.Match pattern.
+func wheelPlatformMatches(pattern, fileName string) bool {
+	tags, ok := parseWheelTags(fileName)
+	if !ok {
+		return false
+	}
+	for _, platform := range tags.platforms() {
+		if matched, _ := path.Match(pattern, platform); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// APIPlatform is the cached PyPI distributions of one platform tag, as
+// returned by the API. Wheels built for several platforms are counted
+// under their tags as written, and source distributions under "source".
+type APIPlatform struct {
+	Platform string `json:"platform"`
+	// ABIs lists the ABI tags of its wheels, e.g. "cp312", "abi3" or
+	// "none"
+	ABIs      []string `json:"abis,omitempty"`
+	Files     int64    `json:"files"`
+	SizeBytes int64    `json:"size_bytes"`
+	CacheHit  int64    `json:"cache_hit"`
+	CacheMiss int64    `json:"cache_miss"`
+	// Refused is whether the wheel_platforms of the repository now stream
+	// its wheels through, so those cached can be purged
+	Refused bool `json:"refused,omitempty"`
+}
+
+// platformStats answers GET /api/v1/platforms with the cached PyPI
+// distributions per platform tag, the largest first.
+func (reg apiRegistry) platformStats(w http.ResponseWriter, r *http.Request) {
+	if reg.registry != models.RegistryPyPI {
+		writeAPIError(w, http.StatusNotFound, "Platform stats are only kept for PyPI wheels")
+		return
+	}
+	if repositories.PackageRepo == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "Database not available")
+		return
+	}
+	cfg := PyPIRepository(r).WheelPlatforms
+	byPlatform := make(map[string]*APIPlatform)
+	abis := make(map[string]map[string]bool)
+	err := repositories.PackageRepo.EachPackage(models.RegistryPyPI, exportBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			platform := sourcePlatform
+			tags, isWheel := parseWheelTags(pkg.Name)
+			if isWheel {
+				platform = tags.platform
+			}
+			p := byPlatform[platform]
+			if p == nil {
+				p = &APIPlatform{Platform: platform, Refused: isWheel && wheelPlatformRefused(cfg, pkg.Name)}
+				byPlatform[platform] = p
+				abis[platform] = make(map[string]bool)
+			}
+			p.Files++
+			p.SizeBytes += pkg.SizeBytes
+			p.CacheHit += pkg.CacheHit
+			p.CacheMiss += pkg.CacheMiss
+			if isWheel {
+				abis[platform][tags.abi] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to aggregate platform stats: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to aggregate platform stats")
+		return
+	}
+
+	list := make([]APIPlatform, 0, len(byPlatform))
+	for platform, p := range byPlatform {
+		for abi := range abis[platform] {
+			p.ABIs = append(p.ABIs, abi)
+		}
+		sort.Strings(p.ABIs)
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SizeBytes != list[j].SizeBytes {
+			return list[i].SizeBytes > list[j].SizeBytes
+		}
+		return list[i].Platform < list[j].Platform
+	})
+	writeAPIJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// revalidateBatchSize is how many rows revalidation loads at once.
+const revalidateBatchSize = 500
+
+// maxYankedReasonLength is the size of the yanked_reason column.
+const maxYankedReasonLength = 255
+
+// revalidateClient is who files purged by revalidation, as gone upstream,
+// are attributed to in the activity feed and the audit log.
+const revalidateClient = "revalidation"
+
+var (
+	// yankedVersions maps each registry to the versions flagged as yanked,
+	// keyed by package name and version, with the reason
+	yankedVersions   = make(map[string]map[string]string)
+	yankedVersionsMu sync.RWMutex
+)
+
+// yankedReason returns why version of the package name of registry is no
+// longer served upstream, if it was found yanked or unpublished.
+func yankedReason(registry, name, version string) (string, bool) {
+	yankedVersionsMu.RLock()
+	defer yankedVersionsMu.RUnlock()
+	reason, ok := yankedVersions[registry][name+"\x00"+version]
+	return reason, ok
+}
+
+// StartRevalidation periodically checks the versions of the files of
+// registry cached against the metadata of the upstream of the default
+// repository, flagging those yanked or unpublished since and clearing the
+// flags of those served again. Every node reloads the flags after each
+// pass, for the yanked policy. A zero interval disables it.
+func StartRevalidation(registry string, interval time.Duration) {
+	if interval <= 0 || repositories.PackageRepo == nil {
+		return
+	}
+	go func() {
+		loadYanked(registry)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			maintenance.Wait(config.MaintenanceRevalidate)
+			revalidate(registry)
+			loadYanked(registry)
+		}
+	}()
+}
+
+// loadYanked reads the versions of registry flagged as yanked.
+func loadYanked(registry string) {
+	pkgs, err := repositories.PackageRepo.ListYanked(registry)
+	if err != nil {
+		log.Printf("Failed to load yanked %s versions: %v", registry, err)
+		return
+	}
+	yanked := make(map[string]string, len(pkgs))
+	for _, pkg := range pkgs {
+		if name, version := parseCachedFileName(registry, pkg.Name); name != "" && version != "" {
+			yanked[name+"\x00"+version] = pkg.YankedReason
+		}
+	}
+	yankedVersionsMu.Lock()
+	yankedVersions[registry] = yanked
+	yankedVersionsMu.Unlock()
+}
+
+// upstreamStatus is whether upstream still serves a cached file.
+type upstreamStatus struct {
+	// reason is why the file is no longer served upstream, "" while it is
+	reason string
+	// deleted is set when the file cannot be downloaded from upstream
+	// anymore, rather than only being flagged
+	deleted bool
+}
+
+// yankChecker returns whether a cached file of a package is still served
+// upstream.
+type yankChecker func(fileName string) upstreamStatus
+
+// revalidate runs one pass over the cached files of registry, fetching the
+// upstream metadata of each package once. Packages whose metadata cannot
+// be fetched keep their flags. Files deleted upstream are kept or purged as
+// upstream_deletions says, and audited either way. The leader of a cluster
+// revalidates for every node.
+func revalidate(registry string) {
+	if !cluster.IsLeader(registry) {
+		return
+	}
+	files := make(map[string][]models.Package)
+	err := repositories.PackageRepo.EachPackage(registry, revalidateBatchSize, func(pkgs []models.Package) error {
+		for _, pkg := range pkgs {
+			if name, version := parseCachedFileName(registry, pkg.Name); name != "" && version != "" {
+				files[name] = append(files[name], pkg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Revalidation of %s versions failed: %v", registry, err)
+		return
+	}
+
+	ctx := context.Background()
+	purge := config.Current().Server.UpstreamDeletions == config.UpstreamDeletionsPurge
+	var flagged, cleared, purged, failed int
+	for name, pkgs := range files {
+		if !maintenance.Open(config.MaintenanceRevalidate, time.Now()) {
+			log.Printf("Revalidation of %s versions stopped, as the maintenance window closed", registry)
+			break
+		}
+		check, err := upstreamYankChecker(ctx, registry, name)
+		if err != nil {
+			log.Printf("Failed to revalidate %s: %v", name, err)
+			failed++
+			continue
+		}
+		if check == nil {
+			continue
+		}
+		now := time.Now()
+		for _, pkg := range pkgs {
+			status := check(pkg.Name)
+			reason := status.reason
+			if len(reason) > maxYankedReasonLength {
+				reason = strings.ToValidUTF8(reason[:maxYankedReasonLength], "")
+			}
+			if status.deleted && purge {
+				if purgeDeletedUpstream(registry, pkg.Name) {
+					log.Printf("Purged %s, %s", pkg.Name, reason)
+					recordAudit(revalidateClient, registry, AuditUpstreamDeletionPurged, pkg.Name, reason)
+					purged++
+				}
+				continue
+			}
+			if reason == pkg.YankedReason && (reason == "") == (pkg.YankedAt == nil) {
+				continue
+			}
+			yankedAt := &now
+			if reason == "" {
+				yankedAt = nil
+			} else if pkg.YankedAt != nil {
+				yankedAt = pkg.YankedAt
+			}
+			if err := repositories.PackageRepo.SetYanked(registry, []string{pkg.Name}, yankedAt, reason); err != nil {
+				log.Printf("Failed to flag %s as yanked: %v", pkg.Name, err)
+				continue
+			}
+			if reason == "" {
+				log.Printf("%s is served upstream again", pkg.Name)
+				cleared++
+			} else {
+				log.Printf("%s was %s", pkg.Name, reason)
+				flagged++
+			}
+			if status.deleted {
+				recordAudit(revalidateClient, registry, AuditUpstreamDeletionKept, pkg.Name, reason)
+			}
+		}
+	}
+	if flagged > 0 || cleared > 0 || purged > 0 || failed > 0 {
+		log.Printf("Revalidated %d %s package(s): %d file(s) newly yanked, %d served again, %d purged, %d package(s) failed",
+			len(files), registry, flagged, cleared, purged, failed)
+	}
+}
+
+// purgeDeletedUpstream removes fileName, gone upstream, from the cache of
+// every repository of registry and from the packages table, as a purge
+// does, and reports whether it did.
+func purgeDeletedUpstream(registry, fileName string) bool {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	lock := downloadLock(registry, fileName)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, dir := range reconcileDirs(registry) {
+		if err := removeCachedFile(filepath.Join(dir, fileName)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to purge %s, gone upstream: %v", fileName, err)
+			return false
+		}
+	}
+	if err := repositories.PackageRepo.DeletePackagesByNames(registry, []string{fileName}); err != nil {
+		log.Printf("Failed to delete %s, gone upstream, from database: %v", fileName, err)
+		return false
+	}
+	invalidateRepositoryMetadata(&config.NPMConfig, &config.RubyGemsConfig, registry, fileName)
+	recordPurges(revalidateClient, registry, []string{fileName})
+	return true
+}
+
+// upstreamYankChecker fetches the upstream metadata of the package name of
+// registry. It returns nil for packages not to revalidate, such as those
+// published locally.
+func upstreamYankChecker(ctx context.Context, registry, name string) (yankChecker, error) {
+	s := config.Current()
+	switch registry {
+	case models.RegistryNPM:
+		return npmYankChecker(ctx, &s.NPM, name)
+	case models.RegistryPyPI:
+		return pypiYankChecker(ctx, &s.PyPI, name)
+	case models.RegistryRubyGems:
+		return gemYankChecker(ctx, &s.RubyGems, name)
+	}
+	return nil, nil
+}
+
+// npmYankChecker flags the tarballs whose version is gone from the
+// packument, which unpublished versions are.
+func npmYankChecker(ctx context.Context, repo *config.NPMProxyConfig, pkgName string) (yankChecker, error) {
+	if _, local, err := readNPMLocalPackument(repo, pkgName); err != nil || local {
+		return nil, err
+	}
+	resp, err := fetchReleaseListing(ctx, upstream.Join(NPMUpstreamFor(repo, pkgName), "/"+url.PathEscape(pkgName)), npmAbbreviatedMediaType)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("decoding packument: %w", err)
+		}
+	}
+	return func(fileName string) upstreamStatus {
+		if _, version := parseNPMCacheFileName(fileName); doc.Versions[version] != nil {
+			return upstreamStatus{}
+		}
+		return upstreamStatus{reason: "unpublished upstream", deleted: true}
+	}, nil
+}
+
+// pypiYankChecker flags the distribution files the PEP 691 JSON project
+// page marks as yanked (PEP 592), or no longer lists.
+func pypiYankChecker(ctx context.Context, repo *config.PyPIProxyConfig, project string) (yankChecker, error) {
+	resp, err := fetchReleaseListing(ctx, upstream.Join(PyPIUpstreamFor(repo, project), "/simple/"+project+"/"), "application/vnd.pypi.simple.v1+json")
+	if err != nil {
+		return nil, err
+	}
+	// yanked is false, true, or the reason given
+	var doc struct {
+		Files []struct {
+			Filename string `json:"filename"`
+			Yanked   any    `json:"yanked"`
+		} `json:"files"`
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("decoding simple index: %w", err)
+		}
+	}
+	reasons := make(map[string]string, len(doc.Files))
+	for _, f := range doc.Files {
+		reason := ""
+		switch yanked := f.Yanked.(type) {
+		case string:
+			reason = "yanked upstream"
+			if yanked != "" {
+				reason += ": " + yanked
+			}
+		case bool:
+			if yanked {
+				reason = "yanked upstream"
+			}
+		}
+		reasons[f.Filename] = reason
+	}
+	return func(fileName string) upstreamStatus {
+		if reason, ok := reasons[pypiDistributionName(fileName)]; ok {
+			// Yanked files can still be downloaded
+			return upstreamStatus{reason: reason}
+		}
+		return upstreamStatus{reason: "removed upstream", deleted: true}
+	}, nil
+}
+
+// gemYankChecker flags the gems whose version and platform are gone from
+// the compact index, which yanked gems are.
+func gemYankChecker(ctx context.Context, repo *config.RubyGemsProxyConfig, gemName string) (yankChecker, error) {
+	resp, err := fetchReleaseListing(ctx, upstream.Join(GemUpstreamFor(repo, gemName), "/info/"+gemName), "")
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	if resp != nil {
+		defer resp.Body.Close()
+		// Each line is "<version>[-<platform>] <deps>|<requirements>",
+		// after a "---" header
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if version, _, found := strings.Cut(scanner.Text(), " "); found {
+				listed[version] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return func(fileName string) upstreamStatus {
+		m := gemNameVersionPattern.FindStringSubmatch(strings.TrimSuffix(fileName, ".gem"))
+		if m != nil && listed[m[2]] {
+			return upstreamStatus{}
+		}
+		// Yanked gems are removed from the gem server
+		return upstreamStatus{reason: "yanked upstream", deleted: true}
+	}, nil
+}
+
+// fetchReleaseListing GETs the upstream metadata listing the releases of a
+// package. The response is nil when upstream no longer knows the package.
+func fetchReleaseListing(ctx context.Context, url, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("upstream returned status %d for %s", resp.StatusCode, url)
+}
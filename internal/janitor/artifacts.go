@@ -0,0 +1,41 @@
+package janitor
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsArtifact reports whether the file at path, found in a cache directory,
+// is a committed artifact rather than the temporary file of a write in
+// progress or a hidden file such as .DS_Store or an editor swap file.
+func IsArtifact(path string, info fs.FileInfo) bool {
+	name := filepath.Base(path)
+	return info.Mode().IsRegular() && !strings.HasSuffix(name, TempSuffix) && !strings.HasPrefix(name, ".")
+}
+
+// WalkArtifacts calls fn with every committed artifact under root, leaving
+// out hidden directories. Paths that cannot be accessed are logged and
+// skipped.
+func WalkArtifacts(root string, fn func(path string, info fs.FileInfo)) error {
+	return filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Error accessing path %s: %v", path, err)
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if IsArtifact(path, info) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
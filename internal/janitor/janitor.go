@@ -0,0 +1,115 @@
+package janitor
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TempSuffix is the suffix of the temporary files cache writes go through
+// before being renamed into place.
+const TempSuffix = ".tmp"
+
+// sweepInterval is how often Start looks for abandoned temporary files.
+const sweepInterval = 10 * time.Minute
+
+var (
+	inFlight   = make(map[string]bool)
+	inFlightMu sync.Mutex
+)
+
+// Track records that path is being written by this process, so sweeps
+// leave it alone. The returned func must be called once the file has been
+// renamed or removed.
+func Track(path string) (done func()) {
+	inFlightMu.Lock()
+	inFlight[path] = true
+	inFlightMu.Unlock()
+	return func() {
+		inFlightMu.Lock()
+		delete(inFlight, path)
+		inFlightMu.Unlock()
+	}
+}
+
+func tracked(path string) bool {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	return inFlight[path]
+}
+
+// Sweep removes the temporary files under dirs that are not being written
+// and were last modified more than maxAge ago. A zero maxAge removes every
+// such file, which is what a freshly started process wants: any temporary
+// file left on disk was orphaned by a previous run.
+func Sweep(dirs []string, maxAge time.Duration) (removed int) {
+	cutoff := time.Now().Add(-maxAge)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, TempSuffix) || tracked(path) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove stale temporary file %s: %v", path, err)
+				return nil
+			}
+			removed++
+			return nil
+		})
+	}
+	return removed
+}
+
+// Start removes the temporary files orphaned under dirs by a previous run,
+// then keeps sweeping for ones abandoned for longer than maxAge. A zero
+// maxAge only cleans up at startup. When dirs are shared with other
+// processes, whose writes may be under way, the startup cleanup only
+// removes files older than maxAge too.
+func Start(dirs []string, maxAge time.Duration, shared bool) {
+	if !shared {
+		if removed := Sweep(dirs, 0); removed > 0 {
+			log.Printf("Removed %d temporary file(s) left by an interrupted run", removed)
+		}
+	}
+	if maxAge <= 0 {
+		return
+	}
+	if shared {
+		if removed := Sweep(dirs, maxAge); removed > 0 {
+			log.Printf("Removed %d temporary file(s) older than %s", removed, maxAge)
+		}
+	}
+	go func() {
+		for range time.Tick(sweepInterval) {
+			if removed := Sweep(dirs, maxAge); removed > 0 {
+				log.Printf("Removed %d temporary file(s) older than %s", removed, maxAge)
+			}
+		}
+	}()
+}
+
+// RemoveInFlight deletes the temporary files of writes that are still
+// running, for use on shutdown once in-flight requests have been given
+// their chance to finish. The writes are abandoned with the process, so
+// their partial files would otherwise be orphaned.
+func RemoveInFlight() {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	for path := range inFlight {
+		if err := os.Remove(path); err == nil {
+			log.Printf("Removed unfinished download %s", path)
+		}
+		delete(inFlight, path)
+	}
+}
@@ -0,0 +1,264 @@
+// Package lockfile reads the package versions the lockfile of a project
+// pins, for garbage collection to keep them cached. The format is told
+// from the content, so lockfiles can be sent under any name.
+package lockfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+)
+
+// Package is a version of a package a lockfile pins. PyPI names are left
+// as written.
+type Package struct {
+	Name    string
+	Version string
+}
+
+// ErrEmpty is returned for lockfiles that pin no package.
+var ErrEmpty = errors.New("the lockfile pins no package")
+
+// requirementPattern matches a pinned requirement, e.g.
+// "requests[socks]==2.31.0 ; python_version >= '3.8'".
+var requirementPattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)\s*(?:\[[^\]]*\])?\s*===?\s*([^\s,;\\]+)`)
+
+// gemSpecPattern matches a gem of the specs of a Gemfile.lock, indented by
+// four spaces, e.g. "    nokogiri (1.16.0-x86_64-linux)".
+var gemSpecPattern = regexp.MustCompile(`^    ([^\s(]+) \(([^)\s]+)\)$`)
+
+// Parse returns the packages the lockfile data of registry pins, sorted
+// and without duplicates: package-lock.json or npm-shrinkwrap.json for
+// npm; Pipfile.lock, poetry.lock, uv.lock or a requirements.txt with
+// pinned versions for PyPI; Gemfile.lock for RubyGems. Gem versions
+// exclude the platform.
+func Parse(registry string, data []byte) ([]Package, error) {
+	trimmed := bytes.TrimSpace(data)
+	var pkgs []Package
+	var err error
+	switch registry {
+	case models.RegistryNPM:
+		pkgs, err = parsePackageLock(trimmed)
+	case models.RegistryPyPI:
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("{")):
+			pkgs, err = parsePipfileLock(trimmed)
+		case bytes.Contains(trimmed, []byte("[[package]]")):
+			pkgs, err = parseTOMLLock(trimmed)
+		default:
+			pkgs, err = parseRequirements(trimmed)
+		}
+	case models.RegistryRubyGems:
+		pkgs, err = parseGemfileLock(trimmed)
+	default:
+		return nil, fmt.Errorf("unknown registry %q", registry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, ErrEmpty
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Version < pkgs[j].Version
+	})
+	return dedupe(pkgs), nil
+}
+
+// dedupe drops the repeats of the sorted pkgs.
+func dedupe(pkgs []Package) []Package {
+	out := pkgs[:0]
+	for i, pkg := range pkgs {
+		if i == 0 || pkg != pkgs[i-1] {
+			out = append(out, pkg)
+		}
+	}
+	return out
+}
+
+// lockDependency is an entry of the nested dependencies of a version 1
+// package-lock.json.
+type lockDependency struct {
+	Version      string                    `json:"version"`
+	Dependencies map[string]lockDependency `json:"dependencies"`
+}
+
+// parsePackageLock reads a package-lock.json of lockfile version 1 to 3.
+// Linked workspace packages and dependencies installed from git, a URL or
+// the file system are skipped.
+func parsePackageLock(data []byte) ([]Package, error) {
+	var lock struct {
+		Packages map[string]struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Link    bool   `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]lockDependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("not a package-lock.json: %w", err)
+	}
+	var pkgs []Package
+	add := func(name, version string) {
+		// Aliases install another package: "npm:real-name@1.0.0"
+		if alias, ok := strings.CutPrefix(version, "npm:"); ok {
+			if at := strings.LastIndex(alias, "@"); at > 0 {
+				name, version = alias[:at], alias[at+1:]
+			}
+		}
+		if name == "" || version == "" || strings.ContainsAny(version, ":/") {
+			return
+		}
+		pkgs = append(pkgs, Package{Name: name, Version: version})
+	}
+	for key, pkg := range lock.Packages {
+		_, name, found := cutLast(key, "node_modules/")
+		if !found || pkg.Link {
+			continue
+		}
+		if pkg.Name != "" {
+			name = pkg.Name
+		}
+		add(name, pkg.Version)
+	}
+	var walk func(deps map[string]lockDependency)
+	walk = func(deps map[string]lockDependency) {
+		for name, dep := range deps {
+			add(name, dep.Version)
+			walk(dep.Dependencies)
+		}
+	}
+	walk(lock.Dependencies)
+	return pkgs, nil
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// parsePipfileLock reads the default and develop packages of a
+// Pipfile.lock, pinned as "==1.0".
+func parsePipfileLock(data []byte) ([]Package, error) {
+	var lock map[string]json.RawMessage
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("not a Pipfile.lock: %w", err)
+	}
+	var pkgs []Package
+	for _, section := range []string{"default", "develop"} {
+		var deps map[string]struct {
+			Version string `json:"version"`
+		}
+		if raw, ok := lock[section]; ok {
+			if err := json.Unmarshal(raw, &deps); err != nil {
+				return nil, fmt.Errorf("not a Pipfile.lock: %w", err)
+			}
+		}
+		for name, dep := range deps {
+			if version, ok := strings.CutPrefix(dep.Version, "=="); ok {
+				pkgs = append(pkgs, Package{Name: name, Version: version})
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// parseTOMLLock reads the name and version of the [[package]] tables of a
+// poetry.lock or uv.lock.
+func parseTOMLLock(data []byte) ([]Package, error) {
+	var pkgs []Package
+	var current *Package
+	flush := func() {
+		if current != nil && current.Name != "" && current.Version != "" {
+			pkgs = append(pkgs, *current)
+		}
+		current = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			flush()
+			if line == "[[package]]" {
+				current = &Package{}
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch strings.TrimSpace(key) {
+		case "name":
+			current.Name = value
+		case "version":
+			current.Version = value
+		}
+	}
+	flush()
+	return pkgs, scanner.Err()
+}
+
+// parseRequirements reads the requirements pinned with == or === of a
+// requirements.txt, such as pip freeze or pip-compile write. Options,
+// comments and unpinned requirements are skipped.
+func parseRequirements(data []byte) ([]Package, error) {
+	var pkgs []Package
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if m := requirementPattern.FindStringSubmatch(line); m != nil {
+			pkgs = append(pkgs, Package{Name: m[1], Version: m[2]})
+		}
+	}
+	return pkgs, scanner.Err()
+}
+
+// parseGemfileLock reads the specs of the GEM sections of a Gemfile.lock.
+// Gems of PATH and GIT sources are not downloaded from a registry and are
+// skipped.
+func parseGemfileLock(data []byte) ([]Package, error) {
+	var pkgs []Package
+	inGem := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line != "" && !strings.HasPrefix(line, " ") {
+			inGem = line == "GEM"
+			continue
+		}
+		if !inGem {
+			continue
+		}
+		if m := gemSpecPattern.FindStringSubmatch(line); m != nil {
+			version, _, _ := strings.Cut(m[2], "-")
+			pkgs = append(pkgs, Package{Name: m[1], Version: version})
+		}
+	}
+	return pkgs, scanner.Err()
+}
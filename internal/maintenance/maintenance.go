@@ -0,0 +1,62 @@
+// Package maintenance confines the heavy background jobs to the maintenance
+// windows configured, so they do not compete with peak traffic.
+package maintenance
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// horizon is how far ahead Next looks for a window to open; validation
+// makes sure every window opens within it.
+const horizon = 366 * 24 * time.Hour
+
+// Open reports whether job may run at t: always unless maintenance windows
+// confine it, else while one of them is open.
+func Open(job string, t time.Time) bool {
+	m := config.Current().Server.Maintenance
+	if !m.Confines(job) {
+		return true
+	}
+	t = t.Local()
+	for _, w := range m.Windows {
+		// The window is open if it opened within its duration before t
+		start := t.Truncate(time.Minute)
+		for earliest := t.Add(-w.Duration.Duration); start.After(earliest); start = start.Add(-time.Minute) {
+			if w.Start.Matches(start) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next returns when job may run next from t on: t itself while it may run,
+// else when the next window opens.
+func Next(job string, t time.Time) time.Time {
+	if Open(job, t) {
+		return t
+	}
+	next := t.Local().Truncate(time.Minute).Add(time.Minute)
+	for end := t.Add(horizon); !next.After(end); next = next.Add(time.Minute) {
+		for _, w := range config.Current().Server.Maintenance.Windows {
+			if w.Start.Matches(next) {
+				return next
+			}
+		}
+	}
+	return t.Add(horizon)
+}
+
+// Wait blocks until job may run.
+func Wait(job string) {
+	now := time.Now()
+	next := Next(job, now)
+	if !next.After(now) {
+		return
+	}
+	log.Printf("Waiting for the maintenance window opening at %s to run %s", next.Format(time.RFC3339), job)
+	time.Sleep(time.Until(next))
+}
@@ -0,0 +1,85 @@
+package metacache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validated records that upstream confirmed entry at now with a response
+// carrying header. Its Cache-Control and Expires headers are kept, unless
+// the response has neither as 304 responses may, and decide until when the
+// entry is fresh.
+func (e *Entry) Validated(header http.Header, now time.Time) {
+	if cacheControl, expires := header.Get("Cache-Control"), header.Get("Expires"); cacheControl != "" || expires != "" {
+		e.UpstreamCacheControl, e.UpstreamExpires = cacheControl, expires
+	}
+	e.ValidatedAt = now
+	e.FreshUntil = freshUntil(e.UpstreamCacheControl, e.UpstreamExpires, header.Get("Date"), now)
+}
+
+// Fresh reports whether the entry can be served without revalidation: until
+// the time its upstream caching headers allow or, when upstream gave none,
+// for ttl after it was last validated.
+func (e Entry) Fresh(ttl time.Duration) bool {
+	if !e.FreshUntil.IsZero() {
+		return time.Now().Before(e.FreshUntil)
+	}
+	return time.Since(e.ValidatedAt) < ttl
+}
+
+// WriteCacheHeaders forwards the upstream caching headers of the entry to a
+// client. Age accounts for the time the entry spent in the cache, so
+// clients do not keep it longer than upstream allows.
+func (e Entry) WriteCacheHeaders(h http.Header) {
+	switch {
+	case e.UpstreamCacheControl != "":
+		h.Set("Cache-Control", e.UpstreamCacheControl)
+		h.Set("Age", strconv.FormatInt(int64(max(time.Since(e.ValidatedAt), 0)/time.Second), 10))
+	case e.UpstreamExpires != "":
+		h.Set("Expires", e.UpstreamExpires)
+	}
+}
+
+// freshUntil returns until when a response validated at now may be reused
+// according to its Cache-Control and Expires headers, preferring s-maxage
+// as a shared cache does. It returns now for no-cache and no-store, and the
+// zero time when the headers say nothing.
+func freshUntil(cacheControl, expires, date string, now time.Time) time.Time {
+	maxAge, sharedMaxAge := int64(-1), int64(-1)
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return now
+		case "max-age":
+			if err == nil && seconds >= 0 {
+				maxAge = seconds
+			}
+		case "s-maxage":
+			if err == nil && seconds >= 0 {
+				sharedMaxAge = seconds
+			}
+		}
+	}
+	switch {
+	case sharedMaxAge >= 0:
+		return now.Add(time.Duration(sharedMaxAge) * time.Second)
+	case maxAge >= 0:
+		return now.Add(time.Duration(maxAge) * time.Second)
+	case expires != "":
+		// An invalid Expires, such as "0", means already expired
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return now
+		}
+		// Measure against the upstream clock when it sent one
+		if sent, err := http.ParseTime(date); err == nil {
+			return now.Add(t.Sub(sent))
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,338 @@
+package metacache
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/internal/cachestatus"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+)
+
+// Entry describes a cached metadata document. The body is stored next to it
+// on disk; the entry itself is persisted as a JSON sidecar.
+type Entry struct {
+	Key                  string    `json:"key"`
+	URL                  string    `json:"url"`
+	UpstreamETag         string    `json:"upstream_etag,omitempty"`
+	UpstreamLastModified string    `json:"upstream_last_modified,omitempty"`
+	ContentType          string    `json:"content_type,omitempty"`
+	Size                 int64     `json:"size"`
+	MD5                  string    `json:"md5"`
+	SHA256               string    `json:"sha256"`
+	FetchedAt            time.Time `json:"fetched_at"`
+	ValidatedAt          time.Time `json:"validated_at"`
+	// Caching headers of the last upstream response, forwarded to clients,
+	// and until when they let the entry be served without revalidation;
+	// zero when upstream did not say, leaving it to the TTL
+	UpstreamCacheControl string    `json:"upstream_cache_control,omitempty"`
+	UpstreamExpires      string    `json:"upstream_expires,omitempty"`
+	FreshUntil           time.Time `json:"fresh_until"`
+}
+
+// ETag returns the strong ETag pkgbin serves for the cached body.
+func (e Entry) ETag() string {
+	return `"` + e.MD5 + `"`
+}
+
+// ReprDigest returns the RFC 9530 Repr-Digest header value for the body.
+func (e Entry) ReprDigest() string {
+	sum, err := hex.DecodeString(e.SHA256)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Store is a disk-backed cache of metadata documents keyed by a
+// registry-specific name such as "info/rails" or "@types/node".
+type Store struct {
+	dir string
+
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+}
+
+// New creates a store rooted at dir, creating the directory if needed.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, locks: make(map[string]*sync.Mutex)}, nil
+}
+
+// Lock serializes work on a single key and returns the matching unlock func.
+func (s *Store) Lock(key string) func() {
+	s.locksMu.Lock()
+	lock, exists := s.locks[key]
+	if !exists {
+		lock = &sync.Mutex{}
+		s.locks[key] = lock
+	}
+	s.locksMu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// LockCount returns how many keys have a lock. Locks are never released, so
+// this grows with the keys ever accessed.
+func (s *Store) LockCount() int {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	return len(s.locks)
+}
+
+func (s *Store) bodyPath(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+".body")
+}
+
+func (s *Store) entryPath(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+".meta")
+}
+
+// Lookup returns the cached entry for key, if any.
+func (s *Store) Lookup(key string) (Entry, bool) {
+	data, err := os.ReadFile(s.entryPath(key))
+	if err != nil {
+		return Entry{}, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("Corrupted metadata cache entry for %s, ignoring: %v", key, err)
+		return Entry{}, false
+	}
+	if _, err := os.Stat(s.bodyPath(key)); err != nil {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Open opens the cached body for key.
+func (s *Store) Open(key string) (*os.File, error) {
+	return os.Open(s.bodyPath(key))
+}
+
+// ReadAll returns the cached body for key.
+func (s *Store) ReadAll(key string) ([]byte, error) {
+	return os.ReadFile(s.bodyPath(key))
+}
+
+// Commit atomically replaces the cached body for key with body and records
+// entry alongside it.
+func (s *Store) Commit(key string, entry Entry, body io.Reader) (Entry, error) {
+	bodyPath := s.bodyPath(key)
+	tempPath := bodyPath + janitor.TempSuffix
+	defer janitor.Track(tempPath)()
+	outFile, err := os.Create(tempPath)
+	if err != nil {
+		return entry, err
+	}
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(outFile, md5Hash, sha256Hash), body)
+	outFile.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return entry, err
+	}
+
+	if err := os.Rename(tempPath, bodyPath); err != nil {
+		os.Remove(tempPath)
+		return entry, err
+	}
+
+	entry.Key = key
+	entry.Size = size
+	entry.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	entry.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	return entry, s.writeEntry(key, entry)
+}
+
+// Append adds body to the end of the cached document for key, for
+// append-only indexes, and records entry with the digests of the result.
+func (s *Store) Append(key string, entry Entry, body io.Reader) (Entry, error) {
+	bodyPath := s.bodyPath(key)
+	outFile, err := os.OpenFile(bodyPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return entry, err
+	}
+	_, err = io.Copy(outFile, body)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	// Re-hash the whole document so the served digests stay exact
+	inFile, err := os.Open(bodyPath)
+	if err != nil {
+		return entry, err
+	}
+	defer inFile.Close()
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), inFile)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Key = key
+	entry.Size = size
+	entry.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	entry.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	return entry, s.writeEntry(key, entry)
+}
+
+// Touch records a successful revalidation without changing the body,
+// taking the caching headers of the upstream response.
+func (s *Store) Touch(key string, entry Entry, header http.Header) (Entry, error) {
+	entry.Validated(header, time.Now())
+	return entry, s.writeEntry(key, entry)
+}
+
+// Invalidate removes the cached document for key.
+func (s *Store) Invalidate(key string) error {
+	errBody := os.Remove(s.bodyPath(key))
+	errEntry := os.Remove(s.entryPath(key))
+	for _, err := range []error{errBody, errEntry} {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) writeEntry(key string, entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	entryPath := s.entryPath(key)
+	tempPath := entryPath + janitor.TempSuffix
+	defer janitor.Track(tempPath)()
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, entryPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// Fetch returns the cached entry for key, revalidating it against
+// upstreamURL with a conditional request once it is no longer fresh, as
+// told by the upstream caching headers or else by ttl. If
+// upstream cannot be reached the stale entry is returned along with stale
+// set to true, so metadata keeps being served through upstream blips. The
+// upstream request carries the values of ctx, such as the request ID, but
+// is not cancelled with it since other requests may wait on the entry.
+func (s *Store) Fetch(ctx context.Context, client *http.Client, key, upstreamURL string, header http.Header, ttl time.Duration) (entry Entry, stale bool, err error) {
+	unlock := s.Lock(key)
+	defer unlock()
+
+	cached, ok := s.Lookup(key)
+	if ok && cached.Fresh(ttl) {
+		cachestatus.Set(ctx, cachestatus.Hit)
+		return cached, false, nil
+	}
+
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if ok {
+		if cached.UpstreamETag != "" {
+			req.Header.Set("If-None-Match", cached.UpstreamETag)
+		}
+		if cached.UpstreamLastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.UpstreamLastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ok {
+			log.Printf("Upstream unavailable for %s, serving stale metadata: %v", key, err)
+			cachestatus.Set(ctx, cachestatus.Stale)
+			return cached, true, nil
+		}
+		return Entry{}, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		cachestatus.Set(ctx, cachestatus.Hit)
+		entry, err = s.Touch(key, cached, resp.Header)
+		return entry, false, err
+	case resp.StatusCode == http.StatusOK:
+		entry = Entry{
+			URL:                  upstreamURL,
+			UpstreamETag:         resp.Header.Get("ETag"),
+			UpstreamLastModified: resp.Header.Get("Last-Modified"),
+			ContentType:          resp.Header.Get("Content-Type"),
+			FetchedAt:            time.Now(),
+		}
+		entry.Validated(resp.Header, entry.FetchedAt)
+		cachestatus.Set(ctx, cachestatus.Miss)
+		entry, err = s.Commit(key, entry, resp.Body)
+		return entry, false, err
+	case resp.StatusCode >= http.StatusInternalServerError && ok:
+		log.Printf("Upstream returned %d for %s, serving stale metadata", resp.StatusCode, key)
+		cachestatus.Set(ctx, cachestatus.Stale)
+		return cached, true, nil
+	default:
+		return Entry{}, false, &StatusError{StatusCode: resp.StatusCode}
+	}
+}
+
+// StatusError reports an upstream response that could not be cached.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.StatusCode)
+}
+
+// Serve writes the cached document for entry to the client with the
+// upstream caching headers, honoring conditional and range requests
+// against the pkgbin-computed ETag.
+func (s *Store) Serve(w http.ResponseWriter, r *http.Request, entry Entry) {
+	f, err := s.Open(entry.Key)
+	if err != nil {
+		http.Error(w, "Cached metadata unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if entry.ContentType != "" {
+		w.Header().Set("Content-Type", entry.ContentType)
+	}
+	w.Header().Set("ETag", entry.ETag())
+	if digest := entry.ReprDigest(); digest != "" {
+		w.Header().Set("Repr-Digest", digest)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	entry.WriteCacheHeaders(w.Header())
+	http.ServeContent(w, r, "", entry.FetchedAt, f)
+}
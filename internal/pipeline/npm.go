@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/handlers"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// npmRegistry returns the setup of the npm registry.
+func npmRegistry() *registry {
+	reg := &registry{
+		name:                 "npm",
+		cacheDir:             config.NPMConfig.CacheDir,
+		maxConcurrentFetches: config.NPMConfig.MaxConcurrentFetches,
+		initBlocklists:       handlers.InitNPMBlocklists,
+		initMetadataCache:    handlers.InitNPMMetadataCache,
+		dataDirs:             handlers.NPMDataDirs,
+		upstreams:            handlers.NPMUpstreams,
+		routes:               npmRoutes,
+		repositoryHandler:    handlers.NPMRepositoryHandler,
+	}
+	for _, repo := range append([]*config.NPMProxyConfig{&config.NPMConfig}, config.NPMConfig.Repositories...) {
+		reg.repositories = append(reg.repositories, repository{repo.Name, repo.Upstream, repo.CacheDir, repo.Auth, repo.Routes, repo.Policy, repo.Vulnerabilities})
+	}
+	return reg
+}
+
+// npmRoutes registers the npm dashboard and admin endpoints on mux and
+// returns the handler of the npm registry API.
+func npmRoutes(mux *http.ServeMux) http.Handler {
+	mux.HandleFunc("/dashboard", handlers.RequireViewer(handlers.NPMDashboardHandler))
+	mux.HandleFunc("/dashboard/package", handlers.RequireViewer(handlers.NPMPackageDetailHandler))
+	mux.HandleFunc("/dashboard/export", handlers.RequireViewer(handlers.NPMExportHandler))
+	mux.HandleFunc("/dashboard/live", handlers.RequireViewer(handlers.NPMLiveHandler))
+	mux.HandleFunc("/purge", handlers.RequireAdmin(config.PermissionPurge, handlers.NPMPurgeHandler))
+	mux.HandleFunc("/purge-all", handlers.RequireAdmin(config.PermissionPurge, handlers.NPMPurgeAllHandler))
+	mux.HandleFunc("/refresh-db", handlers.RequireAdmin(config.PermissionRefresh, handlers.NPMRefreshHandler))
+	// Prefetches are served like client downloads, by the handlers below
+	mux.HandleFunc(handlers.APIPrefix, handlers.NPMAPIHandler(mux))
+
+	target, _ := url.Parse(config.NPMConfig.Upstream)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = upstream.Transport
+
+	// The Director sends each request to the upstream its package is routed
+	// to and ensures the outgoing request has the correct Host header. The
+	// client-facing URL is kept for rewriting the response, and upstream
+	// only sends codings the rewrite decodes.
+	proxy.Director = func(req *http.Request) {
+		handlers.RememberBaseURL(req)
+		handlers.RewrittenAcceptEncoding(req)
+		if err := upstream.Direct(req, handlers.NPMUpstreamForPath(handlers.NPMRepository(req), req.URL.Path)); err != nil {
+			log.Printf("Invalid upstream for %s: %v", req.URL.Path, err)
+		}
+	}
+
+	// Modify the response for metadata (JSON) to rewrite URLs to this proxy.
+	// Responses to writes go back as sent, so packuments read to be written
+	// back keep their upstream tarball URLs, and so do signing keys and
+	// attestations.
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if r := resp.Request; r != nil && !strings.HasSuffix(r.URL.Path, ".tgz") && !handlers.IsNPMWriteRequest(r) && !handlers.IsNPMSignatureRequest(r) {
+			// Only rewrite if it's likely a JSON metadata response, including
+			// abbreviated packuments (application/vnd.npm.install-v1+json)
+			contentType := resp.Header.Get("Content-Type")
+			if strings.Contains(contentType, "application/json") || strings.Contains(contentType, "+json") {
+				repo, proxyAddr, pkgName := handlers.NPMRepository(r), handlers.NPMProxyAddr(r), handlers.NPMPackageOfPath(r.URL.Path)
+				return handlers.RewriteResponseBody(resp, func(w io.Writer, body io.Reader) error {
+					rw := handlers.NewNPMURLRewriter(repo, w, proxyAddr, pkgName)
+					if _, err := io.Copy(rw, body); err != nil {
+						return err
+					}
+					return rw.Close()
+				})
+			}
+		}
+		return nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s [%s]", r.Method, r.URL.Path, requestid.FromContext(r.Context()))
+
+		// Refuse packages denied by policy before anything is fetched or cached
+		if handlers.NPMPolicyDenied(w, r) {
+			return
+		}
+
+		// 1. Intercept GET requests for tarballs, including those of other
+		// hosts, to handle caching
+		if r.Method == http.MethodGet && (strings.HasSuffix(r.URL.Path, ".tgz") || handlers.IsNPMRemoteTarballRequest(r)) {
+			handlers.HandleTarballDownload(w, r)
+			return
+		}
+
+		// 2. Serve detached signatures of tarballs from the metadata cache
+		if handlers.IsNPMDetachedSignatureRequest(r) {
+			handlers.NPMDetachedSignatureHandler(w, r)
+			return
+		}
+
+		// 3. Serve packuments and dist-tags from the metadata cache
+		if handlers.IsNPMMetadataRequest(r) {
+			handlers.NPMMetadataHandler(w, r)
+			return
+		}
+
+		// 4. Answer security audits, falling back to an empty advisory set
+		if handlers.IsNPMAuditRequest(r) {
+			handlers.NPMAuditHandler(w, r)
+			return
+		}
+
+		// 5. Store publishes of locally hosted scopes
+		if handlers.IsNPMPublishRequest(r) {
+			handlers.NPMPublishHandler(w, r)
+			return
+		}
+
+		// 6. Forward everything else (other publishes, logins, etc.). Writes
+		// outside the npm registry API are refused, and the others
+		// authenticate as the client only, never with upstream credentials.
+		if handlers.NPMWriteRefused(w, r) {
+			return
+		}
+		if handlers.IsNPMWriteRequest(r) {
+			r = r.WithContext(upstream.WithoutCredentials(r.Context()))
+		}
+		proxy.ServeHTTP(w, r)
+
+		// Writes change the packument, so drop any cached copy
+		handlers.InvalidateNPMMetadataForRequest(r)
+	})
+}
@@ -0,0 +1,282 @@
+// Package pipeline sets up the registries a pkgbin process serves: it
+// checks their configuration, opens the database, starts their background
+// work and assembles the handler chain of each, for the proxy of one
+// registry as for the server answering for all of them on one listener.
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/initializers"
+	"github.com/pkgb-in/pkgbin/internal/alerts"
+	"github.com/pkgb-in/pkgbin/internal/cachestatus"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/handlers"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
+	"github.com/pkgb-in/pkgbin/internal/policy"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/server"
+	"github.com/pkgb-in/pkgbin/internal/stats"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+	"github.com/pkgb-in/pkgbin/internal/vulnscan"
+	"github.com/pkgb-in/pkgbin/static"
+)
+
+// registry is what the setup of the registries differs in.
+type registry struct {
+	name     string
+	cacheDir string
+	// repositories lists the default repository first, then the named ones
+	repositories         []repository
+	maxConcurrentFetches int
+	initBlocklists       func() error
+	initMetadataCache    func() error
+	dataDirs             func() []string
+	upstreams            func() []string
+	// start runs the background work only this registry has
+	start func()
+	// routes registers the dashboard and admin endpoints of the registry
+	// on mux, and returns the handler of the registry API itself
+	routes func(mux *http.ServeMux) http.Handler
+	// repositoryHandler routes requests to the named repositories
+	repositoryHandler func(next http.Handler) http.Handler
+}
+
+// repository is the settings of a default or named repository checked
+// before it is served.
+type repository struct {
+	name, upstream, cacheDir string
+	auth                     config.UpstreamAuth
+	routes                   []config.UpstreamRoute
+	policy                   config.Policy
+	vulnerabilities          config.VulnerabilityScan
+}
+
+// lookup returns the setup of the registry named key.
+func lookup(key string) (*registry, error) {
+	switch key {
+	case models.RegistryNPM:
+		return npmRegistry(), nil
+	case models.RegistryPyPI:
+		return pypiRegistry(), nil
+	case models.RegistryRubyGems:
+		return rubyGemsRegistry(), nil
+	}
+	return nil, fmt.Errorf("unknown registry %q", key)
+}
+
+// Setup prepares this process to serve the registries named keys, in
+// order, and returns the handler chain of each by key. The configuration
+// must be loaded and the upstream HTTP client configured.
+func Setup(keys ...string) (map[string]http.Handler, error) {
+	// replica_of and sync.primary each name the instance of one registry
+	if len(keys) > 1 && (config.Server.ReplicaOf != "" || config.Server.Sync.Primary != "") {
+		return nil, fmt.Errorf("server.replica_of and server.sync need an instance serving one registry, not %d", len(keys))
+	}
+	regs := make([]*registry, len(keys))
+	for i, key := range keys {
+		reg, err := lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := validate(reg); err != nil {
+			return nil, err
+		}
+		regs[i] = reg
+	}
+	if err := initShared(); err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		// Upstream requests are counted for the whole process, so their
+		// error rate is watched once
+		if err := start(key, regs[i], i > 0); err != nil {
+			return nil, err
+		}
+	}
+	handlers.StartConfigReload(keys...)
+
+	chains := make(map[string]http.Handler, len(keys))
+	for i, key := range keys {
+		chain, err := handler(key, regs[i])
+		if err != nil {
+			return nil, err
+		}
+		chains[key] = chain
+	}
+	return chains, nil
+}
+
+// validate checks the upstream credentials, routes, policies and
+// vulnerability scanning of the repositories of reg, creating their cache
+// directories.
+func validate(reg *registry) error {
+	for i, repo := range reg.repositories {
+		target := "repository " + repo.name
+		if i == 0 {
+			target = reg.name
+		}
+		if err := upstream.RegisterCredentials(repo.upstream, repo.auth); err != nil {
+			return fmt.Errorf("upstream credentials for %s: %w", target, err)
+		}
+		if err := upstream.RegisterRoutes(repo.routes); err != nil {
+			return fmt.Errorf("upstream routes for %s: %w", target, err)
+		}
+		if err := policy.Validate(repo.policy); err != nil {
+			return fmt.Errorf("policy for %s: %w", target, err)
+		}
+		if err := vulnscan.ValidateConfig(repo.vulnerabilities); err != nil {
+			return fmt.Errorf("vulnerability scanning for %s: %w", target, err)
+		}
+		_ = os.MkdirAll(repo.cacheDir, 0755)
+		if i > 0 {
+			log.Printf("Serving repository %s from %s under %s%s/", repo.name, repo.upstream, config.RepositoryPrefix, repo.name)
+		}
+	}
+	return nil
+}
+
+// initShared opens the database and starts what the registries of this
+// process share: limits, sign-on, statistics flushing and the shutdown
+// hooks.
+func initShared() error {
+	if err := initializers.InitDatabase(); err != nil {
+		return fmt.Errorf("database init failed: %w", err)
+	}
+	// The writer a read-only replica serves for owns the schema
+	if config.Server.ReplicaOf != "" {
+		log.Printf("Serving as a read-only replica of %s", config.Server.ReplicaOf)
+	} else if err := initializers.MigrateDatabase(); err != nil {
+		return fmt.Errorf("database migration failed: %w", err)
+	}
+	if err := cluster.Init(); err != nil {
+		return fmt.Errorf("cluster: %w", err)
+	}
+	repositories.InitPackageRepository()
+	repositories.InitVulnerabilityRepository()
+	repositories.InitClientDownloadRepository()
+	repositories.InitDownloadEventRepository()
+	repositories.InitCacheSnapshotRepository()
+	repositories.InitPurgeEventRepository()
+	repositories.InitAuditEventRepository()
+	repositories.InitProjectRepository()
+	repositories.InitBackupRepository()
+	upstream.SetBandwidthLimit(config.Server.UpstreamBytesPerSecond)
+	upstream.ConfigureBreaker(config.Server.CircuitBreaker.FailureThreshold, config.Server.CircuitBreaker.Cooldown.Duration)
+	if err := handlers.InitRateLimit(); err != nil {
+		return fmt.Errorf("rate limit init failed: %w", err)
+	}
+	if err := handlers.InitTrustedProxies(); err != nil {
+		return fmt.Errorf("trusted proxies init failed: %w", err)
+	}
+	if err := handlers.InitSSO(); err != nil {
+		return fmt.Errorf("single sign-on init failed: %w", err)
+	}
+	if err := handlers.InitAdminTokens(); err != nil {
+		return fmt.Errorf("admin token init failed: %w", err)
+	}
+	stats.StartFlusher(config.Server.StatsFlushInterval.Duration)
+	stats.StartHistoryPruner(config.Server.HistoryRetention.Duration)
+	server.StartDebug()
+
+	// Live dashboard streams never finish on their own
+	server.OnDrain(handlers.StopLiveUpdates)
+	// Once in-flight requests have drained, let background work finish
+	// before closing the database it writes to
+	server.OnShutdown(stats.StopStats)
+	server.OnShutdown(vulnscan.Wait)
+	server.OnShutdown(janitor.RemoveInFlight)
+	server.OnShutdown(func() {
+		if err := initializers.CloseDatabase(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+		}
+	})
+	return nil
+}
+
+// start starts the background work of the registry key, leaving out the
+// upstream error rate alert with ignoreUpstreamErrors.
+func start(key string, reg *registry, ignoreUpstreamErrors bool) error {
+	cluster.StartLeaderElection(key)
+	handlers.InitAuditLog(key)
+	handlers.InitFetchLimit(key, reg.maxConcurrentFetches)
+	if err := reg.initBlocklists(); err != nil {
+		return fmt.Errorf("blocklist init failed: %w", err)
+	}
+	if err := reg.initMetadataCache(); err != nil {
+		return fmt.Errorf("metadata cache init failed: %w", err)
+	}
+
+	// Clean up downloads interrupted by a previous run before counting the
+	// cache
+	janitor.Start(reg.dataDirs(), config.Server.TempFileMaxAge.Duration, config.Server.Cluster.Enabled)
+
+	// Initialize cache statistics with 5-minute update interval
+	stats.InitStats(key, reg.cacheDir, 5*time.Minute)
+	handlers.StartReconciler(key, config.Server.ReconcileInterval.Duration)
+	handlers.StartScrubber(key, config.Server.Scrub)
+	handlers.StartRevalidation(key, config.Server.RevalidateInterval.Duration)
+	handlers.StartTrashSweeper(key)
+	handlers.StartBackups(key)
+	handlers.StartRetention(key)
+	if reg.start != nil {
+		reg.start()
+	}
+	if err := handlers.StartSync(key, reg.cacheDir); err != nil {
+		return fmt.Errorf("sync init failed: %w", err)
+	}
+	handlers.ShareDownloadCounts(key)
+	err := alerts.Start(alerts.Source{
+		Registry: key,
+		CacheDir: reg.cacheDir,
+		Downloads: func() (int64, int64) {
+			return handlers.DownloadCounts(key)
+		},
+		IgnoreUpstreamErrors: ignoreUpstreamErrors,
+	})
+	if err != nil {
+		return fmt.Errorf("alerts init failed: %w", err)
+	}
+	upstream.StartProbes(reg.upstreams(), config.Server.UpstreamProbeInterval.Duration)
+	return nil
+}
+
+// handler registers the routes of the registry key on a mux of its own and
+// returns the handler chain serving it, with request IDs, cache status,
+// named repositories and rate limits.
+func handler(key string, reg *registry) (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dashboard/all", handlers.RequireViewer(handlers.DashboardHandler))
+	mux.HandleFunc("/dashboard/all/package", handlers.RequireViewer(handlers.PackageDetailHandler))
+	mux.HandleFunc("/auth/login", handlers.SSOLoginHandler)
+	mux.HandleFunc("/auth/callback", handlers.SSOCallbackHandler)
+	mux.HandleFunc("/auth/logout", handlers.SSOLogoutHandler)
+	mux.HandleFunc("/ping", PingHandler)
+	mux.HandleFunc("/healthz", handlers.HealthzHandler)
+	mux.Handle("/static/", http.StripPrefix("/static/", static.Handler()))
+
+	registryHandler := reg.routes(mux)
+	mux.Handle("/", registryHandler)
+	handlers.HandleTransparentHosts(mux, key, registryHandler)
+
+	// Mirroring downloads through the routes above, so it starts once
+	// they are all registered
+	if err := handlers.StartFullMirror(key, mux); err != nil {
+		return nil, fmt.Errorf("full mirror: %w", err)
+	}
+	return requestid.Handler(cachestatus.Handler(reg.repositoryHandler(handlers.RateLimitHandler(mux)))), nil
+}
+
+// PingHandler answers /ping, showing the process is up.
+func PingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message":"pong"}`))
+}
@@ -0,0 +1,146 @@
+package pipeline
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/handlers"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// pypiRegistry returns the setup of the PyPI registry.
+func pypiRegistry() *registry {
+	reg := &registry{
+		name:                 "pypi",
+		cacheDir:             config.PyPIConfig.CacheDir,
+		maxConcurrentFetches: config.PyPIConfig.MaxConcurrentFetches,
+		initBlocklists:       handlers.InitPyPIBlocklists,
+		initMetadataCache:    handlers.InitPyPIMetadataCache,
+		dataDirs:             handlers.PyPIDataDirs,
+		upstreams:            handlers.PyPIUpstreams,
+		start:                handlers.StartPyPIMirrors,
+		routes:               pypiRoutes,
+		repositoryHandler:    handlers.PyPIRepositoryHandler,
+	}
+	for _, repo := range append([]*config.PyPIProxyConfig{&config.PyPIConfig}, config.PyPIConfig.Repositories...) {
+		reg.repositories = append(reg.repositories, repository{repo.Name, repo.Upstream, repo.CacheDir, repo.Auth, repo.Routes, repo.Policy, repo.Vulnerabilities})
+	}
+	return reg
+}
+
+// pypiRoutes registers the PyPI dashboard and admin endpoints on mux and
+// returns the handler of the PyPI APIs.
+func pypiRoutes(mux *http.ServeMux) http.Handler {
+	mux.HandleFunc("/dashboard", handlers.RequireViewer(handlers.PyPIDashboardHandler))
+	mux.HandleFunc("/dashboard/package", handlers.RequireViewer(handlers.PyPIPackageDetailHandler))
+	mux.HandleFunc("/dashboard/export", handlers.RequireViewer(handlers.PyPIExportHandler))
+	mux.HandleFunc("/dashboard/live", handlers.RequireViewer(handlers.PyPILiveHandler))
+	mux.HandleFunc("/purge", handlers.RequireAdmin(config.PermissionPurge, handlers.PyPIPurgeHandler))
+	mux.HandleFunc("/purge-all", handlers.RequireAdmin(config.PermissionPurge, handlers.PyPIPurgeAllHandler))
+	mux.HandleFunc("/refresh-db", handlers.RequireAdmin(config.PermissionRefresh, handlers.PyPIRefreshHandler))
+	// Prefetches are served like client downloads, by the handlers below
+	mux.HandleFunc(handlers.APIPrefix, handlers.PyPIAPIHandler(mux))
+
+	target, _ := url.Parse(config.PyPIConfig.Upstream)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = upstream.Transport
+
+	// The Director sends each request to the upstream its project is routed
+	// to with the correct Host header. We preserve the client-facing URL to
+	// use in URL rewriting, and have upstream only send codings the rewrite
+	// decodes.
+	proxy.Director = func(req *http.Request) {
+		// Keep the client-facing URL before the Host is changed
+		handlers.RememberBaseURL(req)
+		handlers.RewrittenAcceptEncoding(req)
+
+		if err := upstream.Direct(req, handlers.PyPIUpstreamForPath(handlers.PyPIRepository(req), req.URL.Path)); err != nil {
+			log.Printf("Invalid upstream for %s: %v", req.URL.Path, err)
+		}
+	}
+
+	// Modify the response to rewrite CDN URLs to point to our proxy
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Only process Simple API responses
+		if !strings.Contains(resp.Request.URL.Path, "/simple/") {
+			return nil
+		}
+
+		contentType := resp.Header.Get("Content-Type")
+		// Only process JSON and HTML responses
+		if !strings.Contains(contentType, "json") && !strings.Contains(contentType, "html") {
+			return nil
+		}
+
+		// Point distribution URLs at our proxy as the document streams
+		// through, preserving hash fragments and metadata attributes
+		repo, proxyURL := handlers.PyPIRepository(resp.Request), handlers.ExternalBaseURL(resp.Request)
+		return handlers.RewriteResponseBody(resp, func(w io.Writer, body io.Reader) error {
+			return handlers.RewritePyPISimple(repo, w, body, contentType, proxyURL)
+		})
+	}
+
+	// Other files under /packages/ (e.g. PEP 658 .metadata files advertised
+	// via data-dist-info-metadata) live on the files CDN, not on pypi.org
+	filesTarget, _ := url.Parse("https://files.pythonhosted.org")
+	filesProxy := httputil.NewSingleHostReverseProxy(filesTarget)
+	filesProxy.Transport = upstream.Transport
+	originalFilesDirector := filesProxy.Director
+	filesProxy.Director = func(req *http.Request) {
+		originalFilesDirector(req)
+		req.Host = filesTarget.Host
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s [%s]", r.Method, r.URL.Path, requestid.FromContext(r.Context()))
+
+		// Refuse projects denied by policy before anything is fetched or cached
+		if handlers.PyPIPolicyDenied(w, r) {
+			return
+		}
+
+		// 1. Intercept GET requests for package files (.whl, .tar.gz, .zip, .egg)
+		if r.Method == http.MethodGet && isPackageFile(r.URL.Path) {
+			handlers.PyPIDownloadHandler(w, r)
+			return
+		}
+
+		// 2. Serve detached signatures of package files from the metadata cache
+		if handlers.IsPyPIDetachedSignatureRequest(r) {
+			handlers.PyPIDetachedSignatureHandler(w, r)
+			return
+		}
+
+		// 3. Forward other CDN files such as core metadata, unless the
+		// project is routed to an upstream that hosts its own files
+		if strings.HasPrefix(r.URL.Path, "/packages/") && handlers.PyPIUpstreamForPath(handlers.PyPIRepository(r), r.URL.Path) == handlers.PyPIRepository(r).Upstream {
+			filesProxy.ServeHTTP(w, r)
+			return
+		}
+
+		// 4. Serve PEP 740 provenance from the metadata cache
+		if handlers.IsPyPIProvenanceRequest(r) {
+			handlers.PyPIProvenanceHandler(w, r)
+			return
+		}
+
+		// 5. Forward everything else (simple API, JSON API, metadata, etc.)
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// isPackageFile checks if the URL path points to a Python package file
+func isPackageFile(path string) bool {
+	lowerPath := strings.ToLower(path)
+	return strings.HasSuffix(lowerPath, ".whl") ||
+		strings.HasSuffix(lowerPath, ".tar.gz") ||
+		strings.HasSuffix(lowerPath, ".zip") ||
+		strings.HasSuffix(lowerPath, ".egg") ||
+		strings.HasSuffix(lowerPath, ".tar.bz2")
+}
@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/handlers"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// rubyGemsRegistry returns the setup of the RubyGems registry.
+func rubyGemsRegistry() *registry {
+	reg := &registry{
+		name:                 "rubygems",
+		cacheDir:             config.RubyGemsConfig.CacheDir,
+		maxConcurrentFetches: config.RubyGemsConfig.MaxConcurrentFetches,
+		initBlocklists:       handlers.InitRubyGemsBlocklists,
+		initMetadataCache:    handlers.InitGemMetadataCache,
+		dataDirs:             handlers.RubyGemsDataDirs,
+		upstreams:            handlers.RubyGemsUpstreams,
+		routes:               rubyGemsRoutes,
+		repositoryHandler:    handlers.RubyGemsRepositoryHandler,
+	}
+	for _, repo := range append([]*config.RubyGemsProxyConfig{&config.RubyGemsConfig}, config.RubyGemsConfig.Repositories...) {
+		reg.repositories = append(reg.repositories, repository{repo.Name, repo.Upstream, repo.CacheDir, repo.Auth, repo.Routes, repo.Policy, repo.Vulnerabilities})
+	}
+	return reg
+}
+
+// rubyGemsRoutes registers the RubyGems dashboard and admin endpoints on
+// mux and returns the handler of the RubyGems APIs.
+func rubyGemsRoutes(mux *http.ServeMux) http.Handler {
+	mux.HandleFunc("/dashboard", handlers.RequireViewer(handlers.RubyDashboardHandler))
+	mux.HandleFunc("/dashboard/package", handlers.RequireViewer(handlers.RubyPackageDetailHandler))
+	mux.HandleFunc("/dashboard/export", handlers.RequireViewer(handlers.RubyExportHandler))
+	mux.HandleFunc("/dashboard/live", handlers.RequireViewer(handlers.RubyLiveHandler))
+	mux.HandleFunc("/purge", handlers.RequireAdmin(config.PermissionPurge, handlers.RubyPurgeHandler))
+	mux.HandleFunc("/purge-all", handlers.RequireAdmin(config.PermissionPurge, handlers.RubyPurgeAllHandler))
+	mux.HandleFunc("/refresh-db", handlers.RequireAdmin(config.PermissionRefresh, handlers.RubyRefreshHandler))
+	// Prefetches are served like client downloads, by the handlers below
+	mux.HandleFunc(handlers.APIPrefix, handlers.RubyAPIHandler(mux))
+
+	target, _ := url.Parse(config.RubyGemsConfig.Upstream)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = upstream.Transport
+
+	// Custom Director to route each gem to its upstream and ensure the Host
+	// header is set correctly for RubyGems/S3
+	proxy.Director = func(req *http.Request) {
+		if err := upstream.Direct(req, handlers.GemUpstreamForPath(handlers.RubyGemsRepository(req), req.URL.Path)); err != nil {
+			log.Printf("Invalid upstream for %s: %v", req.URL.Path, err)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s [%s]", r.Method, r.URL.Path, requestid.FromContext(r.Context()))
+
+		// Refuse gems denied by policy before anything is fetched or cached
+		if handlers.RubyGemsPolicyDenied(w, r) {
+			return
+		}
+
+		// 1. Handle Gem Downloads (The Caching Part)
+		if strings.HasPrefix(r.URL.Path, "/gems/") && strings.HasSuffix(r.URL.Path, ".gem") {
+			handlers.GemDownloadHandler(w, r)
+			return
+		}
+
+		// 2. Serve detached signatures of gems from the metadata cache
+		if handlers.IsGemDetachedSignatureRequest(r) {
+			handlers.GemDetachedSignatureHandler(w, r)
+			return
+		}
+
+		// 3. Serve compact index metadata (/versions, /names, /info/*) from cache
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && handlers.IsGemCompactIndexPath(r.URL.Path) {
+			handlers.GemCompactIndexHandler(w, r)
+			return
+		}
+
+		// 4. Serve quick gemspecs and specs.4.8.gz indexes from cache
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && handlers.IsGemSpecsPath(r.URL.Path) {
+			handlers.GemSpecsHandler(w, r)
+			return
+		}
+
+		// 5. Relay everything else (API calls, specs, etc.)
+		log.Printf("Proxying metadata request: %s", r.URL.Path)
+		proxy.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// Decision is the outcome of evaluating a policy for a package.
+type Decision struct {
+	Allowed bool
+	Message string
+}
+
+var (
+	regexCache   = make(map[string]*regexp.Regexp)
+	regexCacheMu sync.Mutex
+)
+
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	regexCacheMu.Lock()
+	defer regexCacheMu.Unlock()
+	if re, ok := regexCache[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[expr] = re
+	return re, nil
+}
+
+// Validate checks every rule of p so configuration mistakes are reported
+// at startup rather than on the first request.
+func Validate(p config.Policy) error {
+	switch p.Default {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("invalid default policy %q", p.Default)
+	}
+	switch p.Yanked {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("invalid yanked policy %q", p.Yanked)
+	}
+	for i, rule := range p.Rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return fmt.Errorf("rule %d: invalid action %q", i+1, rule.Action)
+		}
+		if rule.Name == "" && rule.Scope == "" && rule.Regex == "" && rule.Versions == "" {
+			return fmt.Errorf("rule %d: no criteria", i+1)
+		}
+		if rule.Name != "" {
+			if _, err := path.Match(rule.Name, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid name pattern %q: %w", i+1, rule.Name, err)
+			}
+		}
+		if rule.Regex != "" {
+			if _, err := compileRegex(rule.Regex); err != nil {
+				return fmt.Errorf("rule %d: invalid regex: %w", i+1, err)
+			}
+		}
+		if rule.Versions != "" {
+			if _, err := ParseRange(rule.Versions); err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate decides whether the package name may be served. version is
+// empty for metadata requests, in which case rules restricted to a version
+// range do not apply.
+func Evaluate(p config.Policy, name, version string) Decision {
+	for _, rule := range p.Rules {
+		if !matches(rule, name, version) {
+			continue
+		}
+		if rule.Action == "allow" {
+			return Decision{Allowed: true}
+		}
+		return Decision{Allowed: false, Message: denialMessage(rule, name, version)}
+	}
+	if p.Default == "deny" {
+		return Decision{Allowed: false, Message: fmt.Sprintf("%s is not on the list of allowed packages", name)}
+	}
+	return Decision{Allowed: true}
+}
+
+func matches(rule config.PolicyRule, name, version string) bool {
+	if rule.Name != "" {
+		if ok, _ := path.Match(rule.Name, name); !ok {
+			return false
+		}
+	}
+	if rule.Scope != "" && !strings.HasPrefix(name, strings.TrimSuffix(rule.Scope, "/")+"/") {
+		return false
+	}
+	if rule.Regex != "" {
+		re, err := compileRegex(rule.Regex)
+		if err != nil || !re.MatchString(name) {
+			return false
+		}
+	}
+	if rule.Versions != "" {
+		if version == "" {
+			return false
+		}
+		r, err := ParseRange(rule.Versions)
+		if err != nil || !r.Contains(version) {
+			return false
+		}
+	}
+	return true
+}
+
+func denialMessage(rule config.PolicyRule, name, version string) string {
+	subject := name
+	if version != "" {
+		subject += " " + version
+	}
+	if rule.Message != "" {
+		return fmt.Sprintf("%s is blocked by policy: %s", subject, rule.Message)
+	}
+	return fmt.Sprintf("%s is blocked by policy", subject)
+}
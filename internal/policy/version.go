@@ -0,0 +1,245 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Range is a set of version constraints: the alternatives separated by
+// "||" each hold a list of comparisons that must all be satisfied.
+type Range [][]comparison
+
+type comparison struct {
+	op      string
+	version string
+	// release compares only the release numbers of the version checked,
+	// so the pre-releases of the upper bound of a caret or tilde range
+	// are outside of it like the release itself
+	release bool
+}
+
+// ParseRange parses ranges such as "<1.2.0", ">=1.0.0 <2.0.0",
+// "1.2.3 || >=2.0.0" or "*". Comparisons may be separated by spaces or
+// commas, so PEP 440 style ">=1.0,<2.0" works as well, and an operator may
+// be written apart from its version, as in RubyGems' "~> 1.2". The npm
+// caret and tilde ranges "^1.2.3" and "~1.2.3", RubyGems' pessimistic
+// "~> 1.2" and PEP 440's compatible release "~=1.2" stand for the versions
+// from the one given up to the next release they exclude.
+func ParseRange(expr string) (Range, error) {
+	var r Range
+	for _, alternative := range strings.Split(expr, "||") {
+		var set []comparison
+		fields := strings.FieldsFunc(alternative, func(c rune) bool { return c == ',' || unicode.IsSpace(c) })
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if field == "*" {
+				continue
+			}
+			op := field[:len(field)-len(strings.TrimLeft(field, "<>=!^~"))]
+			if op == field && i+1 < len(fields) {
+				i++
+				field += fields[i]
+			}
+			version := strings.TrimPrefix(field[len(op):], "v")
+			if version == "" || !unicode.IsDigit(rune(version[0])) {
+				return nil, fmt.Errorf("invalid version constraint %q", field)
+			}
+			switch op {
+			case "", "=", "==":
+				set = append(set, comparison{op: "=", version: version})
+			case "<", "<=", ">", ">=", "!=":
+				set = append(set, comparison{op: op, version: version})
+			case "^", "~", "~>", "~=":
+				upper, ok := nextExcludedRelease(op, version)
+				if !ok {
+					return nil, fmt.Errorf("invalid version constraint %q", field)
+				}
+				set = append(set, comparison{op: ">=", version: version}, comparison{op: "<", version: upper, release: true})
+			default:
+				return nil, fmt.Errorf("invalid version constraint %q", field)
+			}
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+// nextExcludedRelease returns the first release the range of op and version
+// excludes: for "^", the next release of the leftmost non-zero number
+// (^1.2.3 stops at 2.0.0, ^0.2.3 at 0.3.0); for "~", the next minor
+// release, or major one when only the major is given; for "~>" and "~=",
+// the next release of the second to last number (~> 1.2.3 stops at 1.3,
+// ~> 1.2 at 2). PEP 440 needs two numbers for "~=".
+func nextExcludedRelease(op, version string) (string, bool) {
+	release, _, _ := strings.Cut(version, "+")
+	release, _, _ = strings.Cut(release, "-")
+	var numbers []int
+	for _, part := range strings.Split(release, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	if len(numbers) == 0 || (op == "~=" && len(numbers) < 2) {
+		return "", false
+	}
+
+	var bump int
+	switch op {
+	case "^":
+		bump = len(numbers) - 1
+		for i, n := range numbers {
+			if n != 0 {
+				bump = i
+				break
+			}
+		}
+	case "~":
+		bump = min(1, len(numbers)-1)
+	default:
+		bump = max(len(numbers)-2, 0)
+	}
+	upper := make([]string, bump+1)
+	for i := range bump {
+		upper[i] = strconv.Itoa(numbers[i])
+	}
+	upper[bump] = strconv.Itoa(numbers[bump] + 1)
+	return strings.Join(upper, "."), true
+}
+
+// Contains reports whether version satisfies the range.
+func (r Range) Contains(version string) bool {
+	for _, set := range r {
+		ok := true
+		for _, c := range set {
+			if !c.satisfiedBy(version) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c comparison) satisfiedBy(version string) bool {
+	if c.release {
+		version = releaseOf(version)
+	}
+	cmp := CompareVersions(version, c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// CompareVersions compares two version strings loosely enough to cover
+// semver, PEP 440 and RubyGems versions: numeric segments compare as
+// numbers, and a textual segment (a pre-release such as "beta" or "rc1")
+// sorts before the release it precedes, so 1.0.0-rc.1 < 1.0.0 < 1.0.1.
+// Build metadata after "+" is ignored.
+func CompareVersions(a, b string) int {
+	a, _, _ = strings.Cut(a, "+")
+	b, _, _ = strings.Cut(b, "+")
+	as, bs := versionSegments(a), versionSegments(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if c := compareSegment(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// releaseOf returns the leading numbers of version, without its
+// pre-release label: "2.0.0-beta.1" and "2.0.0rc1" become "2.0.0".
+func releaseOf(version string) string {
+	version, _, _ = strings.Cut(version, "+")
+	var numbers []string
+	for _, segment := range versionSegments(version) {
+		if !unicode.IsDigit(rune(segment[0])) {
+			break
+		}
+		numbers = append(numbers, segment)
+	}
+	return strings.Join(numbers, ".")
+}
+
+// versionSegments splits a version into runs of digits and runs of
+// letters, dropping separators: "1.0.0rc1" becomes [1 0 0 rc 1].
+func versionSegments(v string) []string {
+	var segments []string
+	start := -1
+	for i, c := range v {
+		isDigit, isLetter := unicode.IsDigit(c), unicode.IsLetter(c)
+		if !isDigit && !isLetter {
+			if start >= 0 {
+				segments = append(segments, v[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start >= 0 && unicode.IsDigit(rune(v[start])) != isDigit {
+			segments = append(segments, v[start:i])
+			start = -1
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		segments = append(segments, v[start:])
+	}
+	return segments
+}
+
+// compareSegment orders two segments; a missing segment counts as a zero
+// release segment, which sorts after any pre-release label.
+func compareSegment(x, y string) int {
+	xNum, xErr := strconv.ParseUint(orZero(x), 10, 64)
+	yNum, yErr := strconv.ParseUint(orZero(y), 10, 64)
+	switch {
+	case xErr == nil && yErr == nil:
+		switch {
+		case xNum < yNum:
+			return -1
+		case xNum > yNum:
+			return 1
+		}
+		return 0
+	case xErr == nil:
+		return 1
+	case yErr == nil:
+		return -1
+	}
+	return strings.Compare(strings.ToLower(x), strings.ToLower(y))
+}
+
+func orZero(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
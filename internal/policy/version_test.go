@@ -0,0 +1,69 @@
+package policy
+
+import "testing"
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		expr    string
+		in, out []string
+	}{
+		{"*", []string{"0.0.1", "99.0.0"}, nil},
+		{"3.3.6", []string{"3.3.6"}, []string{"3.3.5", "3.3.7"}},
+		{">=1.0.0 <2.0.0", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{">=1.0,<2.0", []string{"1.5"}, []string{"2.0"}},
+		{">= 1.0, < 2.0", []string{"1.5"}, []string{"2.0"}},
+		{"1.2.3 || >=2.0.0", []string{"1.2.3", "2.1.0"}, []string{"1.2.4"}},
+
+		// npm caret ranges
+		{"^1.2.3", []string{"1.2.3", "1.3.0", "1.99.99"}, []string{"1.2.2", "2.0.0", "2.0.0-beta.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.2.2", "0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4", "0.1.0"}},
+		{"^1.2", []string{"1.2.0", "1.9.0"}, []string{"1.1.9", "2.0.0"}},
+		{"^0.0", []string{"0.0.0", "0.0.9"}, []string{"0.1.0"}},
+		{"^1.2.3-beta.2", []string{"1.2.3-beta.2", "1.2.3", "1.5.0"}, []string{"1.2.3-beta.1", "2.0.0"}},
+		{"^1 || ^3", []string{"1.0.0", "3.4.0"}, []string{"2.0.0", "4.0.0"}},
+
+		// npm tilde ranges
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.2.2", "1.3.0", "1.3.0-rc.1"}},
+		{"~1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"~0.2.3", []string{"0.2.5"}, []string{"0.3.0"}},
+
+		// RubyGems pessimistic constraints
+		{"~> 1.2.3", []string{"1.2.3", "1.2.10"}, []string{"1.2.2", "1.3", "1.3.0"}},
+		{"~> 1.2", []string{"1.2", "1.9.9"}, []string{"1.1", "2.0", "2.0.0.rc1"}},
+		{"~>1.2", []string{"1.5"}, []string{"2.0"}},
+		{"~> 1", []string{"1.0", "1.9"}, []string{"2.0"}},
+		{"~> 4.1, >= 4.1.2", []string{"4.1.2", "4.9"}, []string{"4.1.1", "5.0"}},
+
+		// PEP 440 compatible releases
+		{"~=1.4.5", []string{"1.4.5", "1.4.9"}, []string{"1.5.0", "1.5a1"}},
+		{"~=2.2", []string{"2.2", "2.9"}, []string{"3.0", "2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			r, err := ParseRange(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseRange: %v", err)
+			}
+			for _, v := range tt.in {
+				if !r.Contains(v) {
+					t.Errorf("%s does not contain %s", tt.expr, v)
+				}
+			}
+			for _, v := range tt.out {
+				if r.Contains(v) {
+					t.Errorf("%s contains %s", tt.expr, v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRangeInvalid(t *testing.T) {
+	for _, expr := range []string{"^", "~>", "^x", "~latest", "~=1", ">=", "=>1.0", "<>1.0", "^^1.0"} {
+		if _, err := ParseRange(expr); err == nil {
+			t.Errorf("ParseRange(%q) accepted", expr)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// cleanupInterval is how often buckets of idle keys are dropped.
+const cleanupInterval = time.Minute
+
+// Keyed holds one Bucket per key, such as a client IP. Buckets that have
+// refilled completely are dropped, so memory stays bounded by active keys.
+type Keyed struct {
+	rate  float64
+	burst float64
+
+	mu          sync.Mutex
+	buckets     map[string]*Bucket
+	lastCleanup time.Time
+}
+
+// NewKeyed returns buckets of the given rate and burst per key.
+func NewKeyed(rate, burst float64) *Keyed {
+	return &Keyed{rate: rate, burst: burst, buckets: make(map[string]*Bucket), lastCleanup: time.Now()}
+}
+
+// Limits returns the rate and burst of the buckets.
+func (k *Keyed) Limits() (rate, burst float64) {
+	return k.rate, k.burst
+}
+
+// Get returns the bucket for key, creating a full one if needed.
+func (k *Keyed) Get(key string) *Bucket {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(k.lastCleanup) > cleanupInterval {
+		for key, b := range k.buckets {
+			if b.full(now) {
+				delete(k.buckets, key)
+			}
+		}
+		k.lastCleanup = now
+	}
+
+	b, ok := k.buckets[key]
+	if !ok {
+		b = NewBucket(k.rate, k.burst)
+		k.buckets[key] = b
+	}
+	return b
+}
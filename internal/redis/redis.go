@@ -0,0 +1,212 @@
+// Package redis is a minimal client of the Redis protocol (RESP2), enough
+// for the commands pkgbin runs: strings, hashes and Lua scripts.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultTimeout bounds a command whose context has no deadline.
+	defaultTimeout = 5 * time.Second
+	// maxIdle is how many connections are kept open between commands.
+	maxIdle = 16
+)
+
+// Error is an error reply of the server.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Client runs commands against one Redis server over a small pool of
+// connections. It is safe for concurrent use.
+type Client struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *conn
+}
+
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+}
+
+// New returns a client of the server at addr, authenticating with
+// password unless empty and selecting database db. Connections are opened
+// on first use.
+func New(addr, password string, db int) *Client {
+	return &Client{addr: addr, password: password, db: db, idle: make(chan *conn, maxIdle)}
+}
+
+// Do runs a command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers, a []any for arrays and nil for null
+// replies. Error replies are returned as Error.
+func (c *Client) Do(ctx context.Context, args ...any) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(ctx, args)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is out of step with the server
+		cn.nc.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.nc.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	d := net.Dialer{Timeout: defaultTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, br: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := cn.do(ctx, []any{"AUTH", c.password}); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do(ctx, []any{"SELECT", c.db}); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.nc.Close()
+	}
+}
+
+func (cn *conn) do(ctx context.Context, args []any) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	cn.nc.SetDeadline(deadline)
+
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if _, err := cn.nc.Write(buf); err != nil {
+		return nil, err
+	}
+	return cn.readReply()
+}
+
+func (cn *conn) readReply() (any, error) {
+	line, err := cn.br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, Error(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.br, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			// Error replies within an array belong to their element
+			item, err := cn.readReply()
+			var replyErr Error
+			if errors.As(err, &replyErr) {
+				item = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// Int converts the reply of an integer command.
+func Int(reply any, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %T", reply)
+}
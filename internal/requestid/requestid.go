@@ -0,0 +1,65 @@
+// Package requestid tags every request with an X-Request-ID, taken from the
+// client or generated, so a failed install can be matched with the proxy
+// and upstream logs.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header carries the request ID to the client and to upstream.
+const Header = "X-Request-ID"
+
+// maxLength bounds the IDs accepted from clients.
+const maxLength = 128
+
+type contextKey struct{}
+
+// Handler gives every request an ID, echoes it in the response and stores it
+// in the request context. The ID is also set on the request headers, so
+// requests proxied upstream carry it along.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = generate()
+			r.Header.Set(Header, id)
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID of ctx, if any.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// valid accepts IDs of printable ASCII characters, so client supplied IDs
+// cannot forge log lines or headers.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func generate() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
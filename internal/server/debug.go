@@ -0,0 +1,51 @@
+package server
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// StartDebug serves the pprof profiles under /debug/pprof/ and the expvar
+// variables under /debug/vars on the configured debug listener, if any.
+func StartDebug() {
+	cfg := config.Server.Debug
+	if cfg.Port == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	// No write timeout: CPU profiles and traces stream for as long as asked
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 30 * time.Second}
+	log.Printf("Serving debug endpoints on %s", addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			log.Printf("Debug server stopped: %v", err)
+		}
+	}()
+}
+
+// withoutDebugRoutes hides the routes net/http/pprof and expvar register on
+// http.DefaultServeMux, so they are only reachable on the debug listener.
+func withoutDebugRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof/") || r.URL.Path == "/debug/vars" {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
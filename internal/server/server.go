@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultACMECacheDir keeps ACME account keys and certificates when no
+// cache directory is configured.
+const defaultACMECacheDir = "./acme_cache_data"
+
+var (
+	shutdownHooks   []func()
+	drainHooks      []func()
+	shutdownHooksMu sync.Mutex
+	// draining is set once a shutdown signal was received
+	draining atomic.Bool
+)
+
+// Draining reports whether the server received SIGINT or SIGTERM and is
+// shutting down.
+func Draining() bool {
+	return draining.Load()
+}
+
+// OnShutdown registers fn to run once the server has stopped and drained
+// its in-flight requests, e.g. to flush buffers or close the database.
+// Hooks run in the order they were registered.
+func OnShutdown(fn func()) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// OnDrain registers fn to run when the server starts draining, e.g. to end
+// long-lived streams that would otherwise hold up the shutdown.
+func OnDrain(fn func()) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	drainHooks = append(drainHooks, fn)
+}
+
+// ListenAndServe serves handler on addr, over HTTPS when TLS is configured,
+// until SIGINT or SIGTERM. It then keeps serving for the configured
+// shutdown delay, stops accepting connections, lets in-flight requests such
+// as cache misses finish within the configured shutdown timeout, runs the
+// shutdown hooks and returns nil.
+func ListenAndServe(addr string, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           withoutDebugRoutes(handler),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	serve, err := serveFunc(srv)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 1)
+	go func() { errs <- serve() }()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		draining.Store(true)
+		if delay := config.Current().Server.ShutdownDelay.Duration; delay > 0 {
+			log.Printf("Received %s, draining connections in %s", sig, delay)
+			select {
+			case err := <-errs:
+				return err
+			case <-signals:
+				// A second signal skips the delay
+			case <-time.After(delay):
+			}
+		} else {
+			log.Printf("Received %s, draining connections", sig)
+		}
+	}
+
+	shutdownHooksMu.Lock()
+	for _, hook := range drainHooks {
+		srv.RegisterOnShutdown(hook)
+	}
+	shutdownHooksMu.Unlock()
+
+	timeout := config.Current().Server.ShutdownTimeout.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running after %s, closing them: %v", timeout, err)
+		srv.Close()
+	}
+
+	shutdownHooksMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	log.Printf("Shutdown complete")
+	return nil
+}
+
+// serveFunc returns how srv should serve: over HTTPS with files or ACME
+// certificates, or plain HTTP.
+func serveFunc(srv *http.Server) (func() error, error) {
+	addr := srv.Addr
+	cfg := config.Server.TLS
+	extra, err := loadCertificates(cfg.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.CertFile != "" && len(cfg.ACME.Domains) > 0:
+		return nil, errors.New("tls: configure either cert_file/key_file or acme, not both")
+	case cfg.CertFile != "":
+		if cfg.KeyFile == "" {
+			return nil, errors.New("tls: key_file is required with cert_file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		// Certificates are picked by the name the client asks for, the
+		// first one otherwise
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: append([]tls.Certificate{cert}, extra...)}
+		log.Printf("Serving HTTPS on %s with certificate %s", addr, cfg.CertFile)
+		return func() error { return srv.ListenAndServeTLS("", "") }, nil
+	case len(cfg.ACME.Domains) > 0:
+		cacheDir := cfg.ACME.CacheDir
+		if cacheDir == "" {
+			cacheDir = defaultACMECacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACME.Domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      cfg.ACME.Email,
+		}
+		if cfg.ACME.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: cfg.ACME.DirectoryURL}
+		}
+		srv.TLSConfig = manager.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		if len(extra) > 0 {
+			srv.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				for i := range extra {
+					if hello.SupportsCertificate(&extra[i]) == nil {
+						return &extra[i], nil
+					}
+				}
+				return manager.GetCertificate(hello)
+			}
+		}
+		log.Printf("Serving HTTPS on %s with ACME certificates for %v", addr, cfg.ACME.Domains)
+		return func() error { return srv.ListenAndServeTLS("", "") }, nil
+	case len(extra) > 0:
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: extra}
+		log.Printf("Serving HTTPS on %s with %d certificate(s)", addr, len(extra))
+		return func() error { return srv.ListenAndServeTLS("", "") }, nil
+	default:
+		return srv.ListenAndServe, nil
+	}
+}
+
+// loadCertificates reads the certificates and keys of certs.
+func loadCertificates(certs []config.Certificate) ([]tls.Certificate, error) {
+	var loaded []tls.Certificate
+	for _, c := range certs {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: certificate %s: %w", c.CertFile, err)
+		}
+		log.Printf("Serving certificate %s to the names it covers", c.CertFile)
+		loaded = append(loaded, cert)
+	}
+	return loaded, nil
+}
@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/repositories"
+)
+
+var (
+	pendingAccess   = make(map[string]*repositories.PackageAccess) // registry/file name -> counts
+	pendingAccessMu sync.Mutex
+)
+
+// RecordAccess adds the hits and misses of access to the counters of its
+// package. Counts are kept in memory and written to the database in
+// batches by the access flusher.
+func RecordAccess(access repositories.PackageAccess) {
+	addPending(access)
+}
+
+func addPending(access repositories.PackageAccess) {
+	pendingAccessMu.Lock()
+	defer pendingAccessMu.Unlock()
+	// File names are only unique within a registry
+	key := access.Registry + "/" + access.Name
+	pending, ok := pendingAccess[key]
+	if !ok {
+		pending = &repositories.PackageAccess{Name: access.Name, Registry: access.Registry, PackageName: access.PackageName, Version: access.Version}
+		pendingAccess[key] = pending
+	}
+	pending.Hits += access.Hits
+	pending.Misses += access.Misses
+	if access.LastAccess.After(pending.LastAccess) {
+		pending.LastAccess = access.LastAccess
+	}
+}
+
+// FlushAccesses writes the buffered hit and miss counts to the database.
+// Counts that cannot be written are kept for the next flush.
+func FlushAccesses() {
+	pendingAccessMu.Lock()
+	batch := make([]repositories.PackageAccess, 0, len(pendingAccess))
+	for _, access := range pendingAccess {
+		batch = append(batch, *access)
+	}
+	pendingAccess = make(map[string]*repositories.PackageAccess)
+	pendingAccessMu.Unlock()
+
+	if len(batch) == 0 || repositories.PackageRepo == nil {
+		return
+	}
+	if err := repositories.PackageRepo.RecordPackageAccesses(batch); err != nil {
+		log.Printf("Failed to record access of %d package(s), retrying later: %v", len(batch), err)
+		for _, access := range batch {
+			addPending(access)
+		}
+	}
+}
+
+// defaultFlushInterval is used when no positive flush interval is set.
+const defaultFlushInterval = 5 * time.Second
+
+// Flush writes the buffered access counts and download events to the
+// database.
+func Flush() {
+	FlushAccesses()
+	flushHistory()
+}
+
+// StartFlusher flushes the buffered access counts and download events
+// every interval until StopStats, which flushes a final time.
+func StartFlusher(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				Flush()
+			case <-stopStats:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,23 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+)
+
+func TestPendingAccessByRegistry(t *testing.T) {
+	t.Cleanup(func() { pendingAccess = make(map[string]*repositories.PackageAccess) })
+	RecordAccess(repositories.PackageAccess{Name: "six-1.16.0.tar.gz", Registry: models.RegistryPyPI, Hits: 1})
+	RecordAccess(repositories.PackageAccess{Name: "six-1.16.0.tar.gz", Registry: models.RegistryRubyGems, Misses: 1})
+
+	if len(pendingAccess) != 2 {
+		t.Fatalf("%d pending counters, want one per registry", len(pendingAccess))
+	}
+	for _, access := range pendingAccess {
+		if access.Hits+access.Misses != 1 {
+			t.Errorf("%s of %s counts %d hits and %d misses", access.Name, access.Registry, access.Hits, access.Misses)
+		}
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/janitor"
 )
 
 // CacheStats holds cached statistics about the cache directory and database
@@ -20,33 +20,64 @@ type CacheStats struct {
 	mu             sync.RWMutex
 }
 
-// Global instance
-var GlobalStats *CacheStats
+var (
+	// registryStats maps each registry to the stats InitStats keeps
+	registryStats   = make(map[string]*CacheStats)
+	registryStatsMu sync.RWMutex
+)
+
+// stopStats ends the background updates started by InitStats.
+var stopStats = make(chan struct{})
 
-// InitStats initializes the global stats instance and starts background updates
-func InitStats(cacheDir string, updateInterval time.Duration) {
-	GlobalStats = &CacheStats{}
+// InitStats initializes the stats instance for the packages of registry
+// and starts background updates
+func InitStats(registry, cacheDir string, updateInterval time.Duration) {
+	s := &CacheStats{}
+	registryStatsMu.Lock()
+	registryStats[registry] = s
+	registryStatsMu.Unlock()
 
 	// Initial update
-	GlobalStats.updateStats(cacheDir)
+	s.updateStats(registry, cacheDir)
 
 	// Start background goroutine for periodic updates
 	go func() {
 		ticker := time.NewTicker(updateInterval)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			GlobalStats.updateStats(cacheDir)
+		for {
+			select {
+			case <-ticker.C:
+				s.updateStats(registry, cacheDir)
+			case <-stopStats:
+				return
+			}
 		}
 	}()
 
-	log.Printf("Cache stats initialized with update interval: %v", updateInterval)
+	log.Printf("Cache stats of %s initialized with update interval: %v", registry, updateInterval)
+}
+
+// For returns the stats of registry, or nil when InitStats was not called
+// for it.
+func For(registry string) *CacheStats {
+	registryStatsMu.RLock()
+	defer registryStatsMu.RUnlock()
+	return registryStats[registry]
+}
+
+// StopStats stops the background updates and flushes the buffered
+// statistics, e.g. before the database is closed on shutdown.
+func StopStats() {
+	close(stopStats)
+	Flush()
 }
 
-// updateStats calculates and updates all statistics
-func (s *CacheStats) updateStats(cacheDir string) {
+// updateStats calculates and updates all statistics, keeping a snapshot
+// for the history charts
+func (s *CacheStats) updateStats(registry, cacheDir string) {
 	fileCount, totalSize := calculateCacheStats(cacheDir)
-	packagesServed := getTotalPackagesServed()
+	packagesServed := getTotalPackagesServed(registry)
 
 	s.mu.Lock()
 	s.FileCount = fileCount
@@ -55,6 +86,8 @@ func (s *CacheStats) updateStats(cacheDir string) {
 	s.LastUpdated = time.Now()
 	s.mu.Unlock()
 
+	recordSnapshot(registry, fileCount, totalSize)
+
 	log.Printf("Stats updated: %d files, %d bytes, %d packages served", fileCount, totalSize, packagesServed)
 }
 
@@ -65,22 +98,12 @@ func (s *CacheStats) Get() (fileCount int64, totalSizeBytes int64, packagesServe
 	return s.FileCount, s.TotalSizeBytes, s.PackagesServed, s.LastUpdated
 }
 
-// calculateCacheStats walks the cache directory and calculates file count and total size
+// calculateCacheStats walks the cache directory and calculates the count
+// and total size of the committed artifacts
 func calculateCacheStats(cacheDir string) (fileCount int64, totalSize int64) {
-	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			// Log error but continue walking
-			log.Printf("Error accessing path %s: %v", path, err)
-			return nil
-		}
-
-		// Only count regular files, not directories
-		if !info.IsDir() {
-			fileCount++
-			totalSize += info.Size()
-		}
-
-		return nil
+	err := janitor.WalkArtifacts(cacheDir, func(path string, info os.FileInfo) {
+		fileCount++
+		totalSize += info.Size()
 	})
 
 	if err != nil {
@@ -90,14 +113,15 @@ func calculateCacheStats(cacheDir string) (fileCount int64, totalSize int64) {
 	return fileCount, totalSize
 }
 
-// getTotalPackagesServed queries the database for total packages served
-func getTotalPackagesServed() int64 {
+// getTotalPackagesServed queries the database for total packages of a
+// registry served
+func getTotalPackagesServed(registry string) int64 {
 	if repositories.PackageRepo == nil {
 		log.Println("PackageRepo is nil, returning 0 for packages served")
 		return 0
 	}
 
-	total, err := repositories.PackageRepo.GetTotalPackagesServed()
+	total, err := repositories.PackageRepo.GetTotalPackagesServed(registry)
 	if err != nil {
 		log.Printf("Error getting total packages served: %v", err)
 		return 0
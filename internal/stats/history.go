@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+	"github.com/pkgb-in/pkgbin/internal/cluster"
+	"github.com/pkgb-in/pkgbin/internal/maintenance"
+)
+
+// maxPendingEvents bounds the download events kept in memory while the
+// database cannot be written; the oldest are dropped beyond it.
+const maxPendingEvents = 100000
+
+// pruneInterval is how often events past the retention period are deleted.
+const pruneInterval = time.Hour
+
+var (
+	pendingEvents   []models.DownloadEvent
+	pendingEventsMu sync.Mutex
+)
+
+// RecordDownload adds a download to the history. Events are written to the
+// database in batches by the flusher.
+func RecordDownload(event models.DownloadEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	pendingEventsMu.Lock()
+	defer pendingEventsMu.Unlock()
+	pendingEvents = append(pendingEvents, event)
+	if dropped := len(pendingEvents) - maxPendingEvents; dropped > 0 {
+		log.Printf("Download history backlog full, dropping %d event(s)", dropped)
+		pendingEvents = pendingEvents[dropped:]
+	}
+}
+
+// flushHistory writes the buffered download events to the database,
+// keeping them for the next flush when that fails.
+func flushHistory() {
+	pendingEventsMu.Lock()
+	batch := pendingEvents
+	pendingEvents = nil
+	pendingEventsMu.Unlock()
+
+	if len(batch) == 0 || repositories.DownloadEventRepo == nil {
+		return
+	}
+	if err := repositories.DownloadEventRepo.InsertEvents(batch); err != nil {
+		log.Printf("Failed to record %d download event(s), retrying later: %v", len(batch), err)
+		pendingEventsMu.Lock()
+		pendingEvents = append(batch, pendingEvents...)
+		pendingEventsMu.Unlock()
+	}
+}
+
+// StartHistoryPruner deletes download and purge events and cache
+// snapshots older than retention every hour. A zero retention keeps the
+// history forever.
+func StartHistoryPruner(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	prune := func() {
+		// The leader of a cluster prunes the shared history, within the
+		// maintenance windows
+		if !cluster.LeadsAny() || !maintenance.Open(config.MaintenanceHistoryPrune, time.Now()) {
+			return
+		}
+		cutoff := time.Now().Add(-retention)
+		if repositories.DownloadEventRepo != nil {
+			removed, err := repositories.DownloadEventRepo.DeleteBefore(cutoff)
+			if err != nil {
+				log.Printf("Failed to prune download history: %v", err)
+			} else if removed > 0 {
+				log.Printf("Pruned %d download event(s) older than %s", removed, retention)
+			}
+		}
+		if repositories.PurgeEventRepo != nil {
+			removed, err := repositories.PurgeEventRepo.DeleteBefore(cutoff)
+			if err != nil {
+				log.Printf("Failed to prune purge history: %v", err)
+			} else if removed > 0 {
+				log.Printf("Pruned %d purge event(s) older than %s", removed, retention)
+			}
+		}
+		if repositories.CacheSnapshotRepo != nil {
+			removed, err := repositories.CacheSnapshotRepo.DeleteBefore(cutoff)
+			if err != nil {
+				log.Printf("Failed to prune cache snapshots: %v", err)
+			} else if removed > 0 {
+				log.Printf("Pruned %d cache snapshot(s) older than %s", removed, retention)
+			}
+		}
+	}
+	go func() {
+		prune()
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				prune()
+			case <-stopStats:
+				return
+			}
+		}
+	}()
+}
+
+// recordSnapshot stores the cache size and download counters of registry
+// for the history charts.
+func recordSnapshot(registry string, fileCount, sizeBytes int64) {
+	// One snapshot per update for the whole cluster
+	if repositories.CacheSnapshotRepo == nil || repositories.PackageRepo == nil || !cluster.IsLeader(registry) {
+		return
+	}
+	totals, err := repositories.PackageRepo.GetCacheTotals(registry)
+	if err != nil {
+		log.Printf("Failed to load download counters for cache snapshot: %v", err)
+		return
+	}
+	snapshot := models.CacheSnapshot{
+		Registry:  registry,
+		FileCount: fileCount,
+		SizeBytes: sizeBytes,
+		CacheHit:  totals.CacheHit,
+		CacheMiss: totals.CacheMiss,
+		CreatedAt: time.Now(),
+	}
+	if err := repositories.CacheSnapshotRepo.InsertSnapshot(&snapshot); err != nil {
+		log.Printf("Failed to record cache snapshot: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/internal/requestid"
+)
+
+// Credentials are the upstreams pkgbin makes requests to and the
+// Authorization headers it sends them. A table being built has no effect
+// on requests until it is installed.
+type Credentials struct {
+	headers  map[string]string // upstream URL prefix -> Authorization header
+	baseURLs []string
+}
+
+// NewCredentials returns an empty credentials table.
+func NewCredentials() *Credentials {
+	return &Credentials{headers: make(map[string]string)}
+}
+
+var (
+	credentials   = NewCredentials()
+	credentialsMu sync.RWMutex
+)
+
+// Add resolves auth and records it for the URLs under upstreamURL, along
+// with upstreamURL as a base URL. Empty credentials only record the base
+// URL.
+func (c *Credentials) Add(upstreamURL string, auth config.UpstreamAuth) error {
+	_, err := c.add(upstreamURL, auth)
+	return err
+}
+
+// add is Add, returning the prefix credentials were recorded for, if any.
+func (c *Credentials) add(upstreamURL string, auth config.UpstreamAuth) (string, error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid upstream URL %q", upstreamURL)
+	}
+	c.addBaseURL(upstreamURL)
+
+	var header string
+	switch {
+	case auth.Token.IsSet():
+		token, err := auth.Token.Value()
+		if err != nil {
+			return "", fmt.Errorf("resolving token for %s: %w", u.Host, err)
+		}
+		header = "Bearer " + token
+	case auth.Username != "":
+		password, err := auth.Password.Value()
+		if err != nil {
+			return "", fmt.Errorf("resolving password for %s: %w", u.Host, err)
+		}
+		header = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+password))
+	default:
+		return "", nil
+	}
+	prefix := credentialsPrefix(u)
+	c.headers[prefix] = header
+	return prefix, nil
+}
+
+// credentialsPrefix is the scheme, host and path of u that credentials are
+// recorded under and requests are matched against. The path is cleaned so
+// dot segments cannot climb out of an upstream into another one.
+func credentialsPrefix(u *url.URL) string {
+	p := path.Clean("/" + u.Path)
+	if p == "/" {
+		p = ""
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + p
+}
+
+// RegisterCredentials resolves auth and attaches it to every request pkgbin
+// makes under upstreamURL. Empty credentials are ignored. The
+// requests also carry upstreamURL in BaseURLHeader.
+func RegisterCredentials(upstreamURL string, auth config.UpstreamAuth) error {
+	credentialsMu.Lock()
+	prefix, err := credentials.add(upstreamURL, auth)
+	credentialsMu.Unlock()
+	if prefix != "" {
+		log.Printf("Upstream credentials configured for %s", prefix)
+	}
+	return err
+}
+
+// InstallCredentials replaces the credentials and base URLs of upstream
+// requests with c, dropping those it lacks.
+func InstallCredentials(c *Credentials) {
+	credentialsMu.Lock()
+	credentials = c
+	credentialsMu.Unlock()
+	log.Printf("Upstream credentials configured for %d upstreams", len(c.headers))
+}
+
+// authorizationFor returns the Authorization header of the longest
+// upstream URL with credentials u is under, so upstreams sharing a host
+// each get their own.
+func authorizationFor(u *url.URL) (string, bool) {
+	target := credentialsPrefix(u)
+	credentialsMu.RLock()
+	defer credentialsMu.RUnlock()
+	var best, header string
+	for prefix, h := range credentials.headers {
+		if len(prefix) > len(best) && (target == prefix || strings.HasPrefix(target, prefix+"/")) {
+			best, header = prefix, h
+		}
+	}
+	return header, best != ""
+}
+
+// noCredentialsKey marks the context of requests sent with the client's
+// credentials only.
+type noCredentialsKey struct{}
+
+// WithoutCredentials returns a context whose upstream requests never get
+// the configured credentials, for writes made on behalf of a client that
+// must authenticate as itself.
+func WithoutCredentials(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCredentialsKey{}, true)
+}
+
+// authTransport adds configured upstream credentials to outgoing requests.
+// Requests that already carry an Authorization header (e.g. a client's own
+// token on a passthrough publish) or whose context is WithoutCredentials
+// are left alone, and credentials are only sent under the exact upstream
+// URL they were configured for, so redirects to CDNs or object storage
+// and other upstreams of the same host never receive them.
+type authTransport struct {
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(noCredentialsKey{}) != nil {
+		return t.base.RoundTrip(req)
+	}
+	if header, ok := authorizationFor(req.URL); ok && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", header)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// requestIDTransport passes the ID of the client request an upstream
+// request is made for, so both sides' logs can be correlated.
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestid.FromContext(req.Context()); id != "" && req.Header.Get(requestid.Header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestid.Header, id)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Transport is the RoundTripper used for every upstream request.
+var Transport http.RoundTripper = &timingTransport{base: &requestIDTransport{base: &baseURLTransport{base: &viaTransport{base: &authTransport{base: &breakerTransport{base: &throttleTransport{base: Base}}}}}}}
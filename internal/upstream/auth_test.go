@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+func TestInstallCredentials(t *testing.T) {
+	saved := credentials
+	t.Cleanup(func() { InstallCredentials(saved) })
+	InstallCredentials(NewCredentials())
+	t.Setenv("PKGBIN_TEST_TOKEN", "secret")
+	auth := config.UpstreamAuth{Token: config.Secret{Env: "PKGBIN_TEST_TOKEN"}}
+
+	if err := RegisterCredentials("https://a.example.com", auth); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCredentials()
+	if err := c.Add("https://b.example.com", auth); err != nil {
+		t.Fatal(err)
+	}
+	// A table being built changes nothing until installed
+	if _, ok := authorizationFor(&url.URL{Scheme: "https", Host: "b.example.com"}); ok {
+		t.Error("credentials of b.example.com in effect before the table is installed")
+	}
+	if _, ok := authorizationFor(&url.URL{Scheme: "https", Host: "a.example.com"}); !ok {
+		t.Error("credentials of a.example.com dropped before the table is installed")
+	}
+
+	InstallCredentials(c)
+	if _, ok := authorizationFor(&url.URL{Scheme: "https", Host: "a.example.com"}); ok {
+		t.Error("credentials of a.example.com kept once dropped from the configuration")
+	}
+	if header, _ := authorizationFor(&url.URL{Scheme: "https", Host: "b.example.com"}); header != "Bearer secret" {
+		t.Errorf("b.example.com gets %q", header)
+	}
+}
+
+func TestCredentialsByURLPrefix(t *testing.T) {
+	saved := credentials
+	t.Cleanup(func() { InstallCredentials(saved) })
+	t.Setenv("PKGBIN_TEST_TEAM_TOKEN", "team")
+	t.Setenv("PKGBIN_TEST_ADMIN_TOKEN", "admin")
+	c := NewCredentials()
+	if err := c.Add("https://nexus.example.com/repository/team/", config.UpstreamAuth{Token: config.Secret{Env: "PKGBIN_TEST_TEAM_TOKEN"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("https://nexus.example.com/repository/team/admin", config.UpstreamAuth{Token: config.Secret{Env: "PKGBIN_TEST_ADMIN_TOKEN"}}); err != nil {
+		t.Fatal(err)
+	}
+	InstallCredentials(c)
+
+	for target, want := range map[string]string{
+		"https://nexus.example.com/repository/team/lodash":              "Bearer team",
+		"https://nexus.example.com/repository/team/admin/-/x-1.0.0.tgz": "Bearer admin",
+		"https://nexus.example.com/repository/team/administrator":       "Bearer team",
+		"https://nexus.example.com/repository/other/lodash":             "",
+		"https://nexus.example.com/repository/team/../other/lodash":     "",
+		"https://nexus.example.com/repository/team/%2e%2e/other/lodash": "",
+		"http://nexus.example.com/repository/team/lodash":               "",
+		"https://cdn.example.com/repository/team/lodash":                "",
+	} {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header, _ := authorizationFor(u); header != want {
+			t.Errorf("%s gets %q, want %q", target, header, want)
+		}
+	}
+}
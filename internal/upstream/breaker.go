@@ -0,0 +1,176 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCircuitOpen is returned for requests to an upstream whose circuit
+// breaker has tripped.
+var ErrCircuitOpen = errors.New("upstream circuit breaker open")
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// BreakerState describes the circuit breaker of one upstream host.
+type BreakerState struct {
+	Host      string    `json:"host"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	OpenUntil time.Time `json:"open_until"`
+}
+
+type breaker struct {
+	failures  int
+	state     string
+	openUntil time.Time
+}
+
+var (
+	breakers         = make(map[string]*breaker)
+	breakersMu       sync.Mutex
+	breakerThreshold int
+	breakerCooldown  time.Duration
+)
+
+// Requests sent to upstreams since the process started, and how many of
+// them failed or were refused by an open circuit
+var upstreamRequests, upstreamFailures atomic.Int64
+
+// RequestCounts returns how many upstream requests were made since the
+// process started and how many of them failed, counting those refused by
+// an open circuit.
+func RequestCounts() (requests, failures int64) {
+	return upstreamRequests.Load(), upstreamFailures.Load()
+}
+
+// ConfigureBreaker trips the circuit of an upstream host after threshold
+// consecutive failures (transport errors or 5xx responses) and keeps it
+// open for cooldown. A threshold of zero disables the breaker.
+func ConfigureBreaker(threshold int, cooldown time.Duration) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breakerThreshold, breakerCooldown = threshold, cooldown
+}
+
+// allow reports whether a request to host may go out. Once the cooldown
+// has passed a single trial request is let through to probe the upstream.
+func allow(host string, now time.Time) (bool, time.Time) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok || breakerThreshold <= 0 {
+		return true, time.Time{}
+	}
+	switch b.state {
+	case CircuitOpen:
+		if now.Before(b.openUntil) {
+			return false, b.openUntil
+		}
+		b.state = CircuitHalfOpen
+		return true, time.Time{}
+	case CircuitHalfOpen:
+		// The trial request is still in flight
+		return false, b.openUntil
+	}
+	return true, time.Time{}
+}
+
+// record updates the breaker of host with the outcome of a request.
+func record(host string, failed bool) {
+	upstreamRequests.Add(1)
+	if failed {
+		upstreamFailures.Add(1)
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if breakerThreshold <= 0 {
+		return
+	}
+	b, ok := breakers[host]
+	if !ok {
+		if !failed {
+			return
+		}
+		b = &breaker{state: CircuitClosed}
+		breakers[host] = b
+	}
+
+	if !failed {
+		if b.state != CircuitClosed {
+			log.Printf("Upstream %s recovered, closing circuit", host)
+		}
+		delete(breakers, host)
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= breakerThreshold {
+		if b.state != CircuitOpen {
+			log.Printf("Upstream %s failing (%d consecutive errors), opening circuit for %s", host, b.failures, breakerCooldown)
+		}
+		b.state = CircuitOpen
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// abandon lets the next request probe host again when a trial request was
+// cancelled before the upstream answered.
+func abandon(host string) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[host]; ok && b.state == CircuitHalfOpen {
+		b.state = CircuitOpen
+		b.openUntil = time.Now()
+	}
+}
+
+// BreakerStates returns the upstream hosts whose requests are currently
+// failing, sorted by host.
+func BreakerStates() []BreakerState {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	var states []BreakerState
+	for host, b := range breakers {
+		states = append(states, BreakerState{Host: host, State: b.state, Failures: b.failures, OpenUntil: b.openUntil})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+// breakerTransport short-circuits requests to upstreams whose circuit is
+// open, so callers fall back to stale data or fail fast instead of waiting
+// on timeouts.
+type breakerTransport struct {
+	base http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if ok, until := allow(host, time.Now()); !ok {
+		upstreamRequests.Add(1)
+		upstreamFailures.Add(1)
+		return nil, fmt.Errorf("%w for %s until %s", ErrCircuitOpen, host, until.Format(time.TimeOnly))
+	}
+	resp, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// Requests abandoned by the client say nothing about the upstream
+		abandon(host)
+	case err != nil:
+		record(host, true)
+	default:
+		record(host, resp.StatusCode >= http.StatusInternalServerError)
+	}
+	return resp, err
+}
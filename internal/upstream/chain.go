@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// BaseURLHeader tells an upstream that is itself a pkgbin the URL it is
+// reached at, so the artifact URLs of its metadata point there whatever
+// its own external URL, and are rewritten to the downstream proxy like
+// those of any upstream.
+const BaseURLHeader = "X-Pkgbin-Base-URL"
+
+// addBaseURL records upstreamURL as the base URL of the requests made
+// under it.
+func (c *Credentials) addBaseURL(upstreamURL string) {
+	upstreamURL = strings.TrimSuffix(upstreamURL, "/")
+	if !slices.Contains(c.baseURLs, upstreamURL) {
+		c.baseURLs = append(c.baseURLs, upstreamURL)
+	}
+}
+
+// baseURLFor returns the longest registered upstream URL u is under.
+func baseURLFor(u *url.URL) string {
+	target := u.Scheme + "://" + u.Host + u.EscapedPath()
+	credentialsMu.RLock()
+	defer credentialsMu.RUnlock()
+	var best string
+	for _, base := range credentials.baseURLs {
+		if len(base) > len(best) && (target == base || strings.HasPrefix(target, base+"/")) {
+			best = base
+		}
+	}
+	return best
+}
+
+// baseURLTransport sets BaseURLHeader on requests to a configured upstream,
+// replacing any passed on from the client of a reverse-proxied request.
+type baseURLTransport struct {
+	base http.RoundTripper
+}
+
+func (t *baseURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := baseURLFor(req.URL)
+	if base != "" || req.Header.Get(BaseURLHeader) != "" {
+		req = req.Clone(req.Context())
+		req.Header.Del(BaseURLHeader)
+		if base != "" {
+			req.Header.Set(BaseURLHeader, base)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
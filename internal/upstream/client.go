@@ -0,0 +1,153 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// base holds the *http.Transport built from the HTTP client config.
+var base atomic.Pointer[http.Transport]
+
+func init() {
+	t, _ := newBaseTransport(config.HTTP)
+	base.Store(t)
+}
+
+// Base is the configured transport without upstream credentials, circuit
+// breaking or throttling, for outside services such as identity providers.
+var Base http.RoundTripper = baseTransport{}
+
+// Client is the shared client for upstream downloads. It has no overall
+// timeout since artifacts can be large; stalled connections are cut by the
+// configured read timeout instead.
+var Client = &http.Client{Transport: Transport}
+
+type baseTransport struct{}
+
+func (baseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return base.Load().RoundTrip(req)
+}
+
+// ConfigureHTTPClient applies timeouts, pooling, proxy and CA settings to
+// every outgoing connection.
+func ConfigureHTTPClient(cfg config.HTTPClient) error {
+	t, err := newBaseTransport(cfg)
+	if err != nil {
+		return err
+	}
+	if old := base.Swap(t); old != nil {
+		old.CloseIdleConnections()
+	}
+	if cfg.Proxy != "" {
+		log.Printf("Using outbound proxy %s", redactURL(cfg.Proxy))
+	}
+	if cfg.Resolver != "" {
+		log.Printf("Resolving upstream hosts with %s", cfg.Resolver)
+	}
+	return nil
+}
+
+func newBaseTransport(cfg config.HTTPClient) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", redactURL(cfg.Proxy))
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout.Duration, KeepAlive: 30 * time.Second}
+	if cfg.Resolver != "" {
+		resolver, err := newResolver(cfg.Resolver, cfg.ConnectTimeout.Duration)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Resolver = resolver
+	}
+	readTimeout := cfg.ReadTimeout.Duration
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || readTimeout <= 0 {
+				return conn, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: readTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSTimeout.Duration,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout.Duration,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       cfg.IdleConnTimeout.Duration,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+	}, nil
+}
+
+// idleTimeoutConn fails a read that receives nothing within timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// redactURL hides any password in a proxy URL before it is logged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
+
+// newResolver returns a resolver querying the DNS server at addr, with
+// port 53 when it has none.
+func newResolver(addr string, timeout time.Duration) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	if host, _, _ := net.SplitHostPort(addr); host == "" {
+		return nil, fmt.Errorf("invalid resolver %q", addr)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
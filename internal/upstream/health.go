@@ -0,0 +1,146 @@
+package upstream
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// probeTimeout bounds a single health probe.
+	probeTimeout = 10 * time.Second
+	// probeWindow is how many recent probes the availability covers.
+	probeWindow = 60
+)
+
+// UpstreamHealth is what the probes of one upstream found.
+type UpstreamHealth struct {
+	URL string `json:"url"`
+	Up  bool   `json:"up"`
+	// StatusCode is the status of the last probe, and Error why it got no
+	// response
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// LatencyMS is how long the last probe waited for the response headers.
+	LatencyMS int64 `json:"latency_ms"`
+	// Availability is the share of the recent probes that succeeded, from 0
+	// to 1.
+	Availability float64    `json:"availability"`
+	CheckedAt    time.Time  `json:"checked_at"`
+	LastUpAt     *time.Time `json:"last_up_at"`
+}
+
+type probeState struct {
+	health  UpstreamHealth
+	results []bool
+}
+
+var (
+	probes   []*probeState
+	probesMu sync.Mutex
+)
+
+// probeClient sends probes with the upstream credentials but around the
+// circuit breaker, so an open circuit does not hide a recovered upstream
+// and probes do not count as upstream traffic.
+var probeClient = &http.Client{Timeout: probeTimeout, Transport: &authTransport{base: Base}}
+
+// StartProbes requests the root of every upstream in urls now and then
+// every interval. Any response below 500 counts as the upstream being up.
+// A zero interval disables probing. The upstreams of every call are
+// probed and reported together.
+func StartProbes(urls []string, interval time.Duration) {
+	if interval <= 0 || len(urls) == 0 {
+		return
+	}
+	probesMu.Lock()
+	first := len(probes)
+	for _, u := range urls {
+		probes = append(probes, &probeState{health: UpstreamHealth{URL: redactURL(u)}})
+	}
+	probesMu.Unlock()
+	log.Printf("Probing %d upstream(s) every %s", len(urls), interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for i, u := range urls {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					probe(first+i, u)
+				}()
+			}
+			wg.Wait()
+			<-ticker.C
+		}
+	}()
+}
+
+// probe requests upstreamURL and records the result as the state of the
+// i-th probed upstream.
+func probe(i int, upstreamURL string) {
+	start := time.Now()
+	resp, err := probeClient.Get(upstreamURL)
+	latency := time.Since(start)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	p := probes[i]
+	wasUp, checked := p.health.Up, !p.health.CheckedAt.IsZero()
+	p.health.CheckedAt = start
+	p.health.LatencyMS = latency.Milliseconds()
+	p.health.StatusCode, p.health.Error = 0, ""
+	if err != nil {
+		p.health.Error = err.Error()
+	} else {
+		p.health.StatusCode = resp.StatusCode
+	}
+	p.health.Up = err == nil && resp.StatusCode < http.StatusInternalServerError
+	if p.health.Up {
+		p.health.LastUpAt = &start
+	}
+
+	p.results = append(p.results, p.health.Up)
+	if len(p.results) > probeWindow {
+		p.results = p.results[len(p.results)-probeWindow:]
+	}
+	up := 0
+	for _, ok := range p.results {
+		if ok {
+			up++
+		}
+	}
+	p.health.Availability = float64(up) / float64(len(p.results))
+
+	switch {
+	case !p.health.Up && (wasUp || !checked):
+		detail := p.health.Error
+		if detail == "" {
+			detail = resp.Status
+		}
+		log.Printf("Upstream %s is down: %s", p.health.URL, detail)
+	case p.health.Up && checked && !wasUp:
+		log.Printf("Upstream %s is back up", p.health.URL)
+	}
+}
+
+// HealthStates returns the last probe results of every upstream, in the
+// order they were configured.
+func HealthStates() []UpstreamHealth {
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	states := make([]UpstreamHealth, 0, len(probes))
+	for _, p := range probes {
+		states = append(states, p.health)
+	}
+	return states
+}
@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkgb-in/pkgbin/config"
+)
+
+// RegisterRoutes validates the routes of a registry and registers the
+// credentials of each routed upstream.
+func RegisterRoutes(routes []config.UpstreamRoute) error {
+	for _, route := range routes {
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid route pattern %q: %w", route.Pattern, err)
+		}
+		if err := RegisterCredentials(route.Upstream, route.Auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddRoutes validates the routes of a registry and adds the credentials of
+// each routed upstream to c.
+func (c *Credentials) AddRoutes(routes []config.UpstreamRoute) error {
+	for _, route := range routes {
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid route pattern %q: %w", route.Pattern, err)
+		}
+		if err := c.Add(route.Upstream, route.Auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve returns the upstream serving the package name: the upstream of
+// the first route whose pattern matches, or defaultURL.
+func Resolve(routes []config.UpstreamRoute, name, defaultURL string) string {
+	for _, route := range routes {
+		if ok, _ := path.Match(route.Pattern, name); ok {
+			return strings.TrimSuffix(route.Upstream, "/")
+		}
+	}
+	return defaultURL
+}
+
+// Join appends urlPath to upstreamURL. When urlPath already starts with the
+// upstream's path prefix (an absolute file URL from a rewritten index), the
+// prefix is not repeated.
+func Join(upstreamURL, urlPath string) string {
+	target, err := url.Parse(upstreamURL)
+	if err != nil {
+		return upstreamURL + urlPath
+	}
+	prefix := strings.TrimSuffix(target.Path, "/")
+	if prefix != "" && strings.HasPrefix(urlPath, prefix+"/") {
+		return target.Scheme + "://" + target.Host + urlPath
+	}
+	return strings.TrimSuffix(upstreamURL, "/") + urlPath
+}
+
+// Direct points a reverse-proxied request at upstreamURL, keeping any path
+// prefix of the upstream (e.g. an Artifactory repository path) in front of
+// the request path.
+func Direct(req *http.Request, upstreamURL string) error {
+	target, err := url.Parse(upstreamURL)
+	if err != nil {
+		return err
+	}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if prefix := strings.TrimSuffix(target.Path, "/"); prefix != "" && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+		req.URL.Path = prefix + req.URL.Path
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + req.URL.RawPath
+		}
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Explicitly disable the default Go User-Agent, as httputil does
+		req.Header.Set("User-Agent", "")
+	}
+	req.Host = target.Host
+	return nil
+}
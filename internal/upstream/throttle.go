@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkgb-in/pkgbin/internal/ratelimit"
+)
+
+// throttleChunkSize bounds each read from a throttled upstream body so the
+// shared bandwidth is interleaved fairly between downloads.
+const throttleChunkSize = 32 << 10
+
+// bandwidth is the bucket shared by every upstream response body, or nil
+// when upstream bandwidth is not capped.
+var bandwidth atomic.Pointer[ratelimit.Bucket]
+
+// SetBandwidthLimit caps the aggregate rate at which pkgbin downloads from
+// all upstreams. Zero removes the cap.
+func SetBandwidthLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		bandwidth.Store(nil)
+		return
+	}
+	bandwidth.Store(ratelimit.NewBucket(float64(bytesPerSecond), float64(max(bytesPerSecond, throttleChunkSize))))
+	log.Printf("Limiting upstream bandwidth to %d bytes/s", bytesPerSecond)
+}
+
+// throttleTransport paces upstream response bodies through the shared
+// bandwidth bucket.
+type throttleTransport struct {
+	base http.RoundTripper
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if bucket := bandwidth.Load(); bucket != nil && resp.Body != nil {
+		resp.Body = &throttledBody{ReadCloser: resp.Body, ctx: req.Context(), bucket: bucket}
+	}
+	return resp, nil
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *ratelimit.Bucket
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := b.bucket.Wait(b.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
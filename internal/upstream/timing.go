@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/pkgb-in/pkgbin/internal/cachestatus"
+)
+
+// timingTransport adds the time upstream requests take, until their body
+// is read or closed, to the upstream time of the client request they are
+// made for.
+type timingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done := cachestatus.BeginUpstream(req.Context())
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		done()
+		return resp, err
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+type timedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
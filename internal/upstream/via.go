@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// viaPseudonym names this process in the Via header of its upstream
+// requests, so one that reaches it again is recognized.
+var viaPseudonym = newViaPseudonym()
+
+func newViaPseudonym() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "pkgbin-" + hex.EncodeToString(b)
+}
+
+// viaTransport adds this process to the Via header of upstream requests,
+// after the proxies the client's request already went through.
+type viaTransport struct {
+	base http.RoundTripper
+}
+
+func (t *viaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Add("Via", "1.1 "+viaPseudonym)
+	return t.base.RoundTrip(req)
+}
+
+// LoopedBack reports whether r is an upstream request of this process
+// that came back to it, as when the DNS record pointing a registry host at
+// pkgbin is also used for pkgbin's own lookups.
+func LoopedBack(r *http.Request) bool {
+	for _, via := range r.Header.Values("Via") {
+		for _, hop := range strings.Split(via, ",") {
+			if fields := strings.Fields(hop); len(fields) >= 2 && fields[1] == viaPseudonym {
+				return true
+			}
+		}
+	}
+	return false
+}
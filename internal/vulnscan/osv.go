@@ -0,0 +1,84 @@
+package vulnscan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/internal/upstream"
+)
+
+// client is used for OSV queries; they are small and must not hold up
+// downloads for long when scanning synchronously.
+var client = &http.Client{Timeout: 15 * time.Second, Transport: upstream.Transport}
+
+// osvQuery is the body of POST /v1/query.
+type osvQuery struct {
+	Package struct {
+		Name      string `json:"name"`
+		Ecosystem string `json:"ecosystem"`
+	} `json:"package"`
+	Version   string `json:"version"`
+	PageToken string `json:"page_token,omitempty"`
+}
+
+// osvResponse is the subset of a /v1/query response pkgbin records.
+type osvResponse struct {
+	Vulns []struct {
+		ID               string `json:"id"`
+		Summary          string `json:"summary"`
+		DatabaseSpecific struct {
+			Severity string `json:"severity"`
+		} `json:"database_specific"`
+	} `json:"vulns"`
+	NextPageToken string `json:"next_page_token"`
+}
+
+// query asks the OSV API at apiURL for the vulnerabilities affecting one
+// package version, following pagination.
+func query(apiURL, ecosystem, name, version string) ([]models.Vulnerability, error) {
+	var q osvQuery
+	q.Package.Name = name
+	q.Package.Ecosystem = ecosystem
+	q.Version = version
+
+	var vulns []models.Vulnerability
+	for {
+		body, err := json.Marshal(q)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Post(strings.TrimSuffix(apiURL, "/")+"/v1/query", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		var result osvResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("OSV query returned status %d", resp.StatusCode)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding OSV response: %w", err)
+		}
+
+		for _, v := range result.Vulns {
+			vulns = append(vulns, models.Vulnerability{
+				Ecosystem:   ecosystem,
+				PackageName: name,
+				Version:     version,
+				VulnID:      v.ID,
+				Summary:     v.Summary,
+				Severity:    NormalizeSeverity(v.DatabaseSpecific.Severity),
+			})
+		}
+		if result.NextPageToken == "" {
+			return vulns, nil
+		}
+		q.PageToken = result.NextPageToken
+	}
+}
@@ -0,0 +1,176 @@
+package vulnscan
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkgb-in/pkgbin/config"
+	"github.com/pkgb-in/pkgbin/db/models"
+	"github.com/pkgb-in/pkgbin/db/repositories"
+)
+
+// severities in increasing order. GitHub advisories report "MODERATE",
+// which is recorded as MEDIUM.
+var severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// NormalizeSeverity maps an advisory severity onto one of severities.
+func NormalizeSeverity(severity string) string {
+	severity = strings.ToUpper(strings.TrimSpace(severity))
+	if severity == "MODERATE" {
+		return "MEDIUM"
+	}
+	for _, s := range severities {
+		if s == severity {
+			return s
+		}
+	}
+	return "UNKNOWN"
+}
+
+// SeverityRank orders severities; UNKNOWN ranks lowest.
+func SeverityRank(severity string) int {
+	severity = NormalizeSeverity(severity)
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return 0
+}
+
+// ValidateConfig checks the scan settings of a registry.
+func ValidateConfig(scan config.VulnerabilityScan) error {
+	if scan.BlockSeverity != "" && NormalizeSeverity(scan.BlockSeverity) == "UNKNOWN" {
+		return fmt.Errorf("invalid block_severity %q", scan.BlockSeverity)
+	}
+	if scan.Enabled && scan.APIURL == "" {
+		return fmt.Errorf("vulnerability scanning needs an api_url")
+	}
+	return nil
+}
+
+// Target identifies a package version being served.
+type Target struct {
+	FileName  string // name the cached file is tracked under
+	Ecosystem string // OSV ecosystem: npm, PyPI or RubyGems
+	Name      string
+	Version   string
+}
+
+func (t Target) key() string {
+	return t.Ecosystem + "\x00" + t.Name + "\x00" + t.Version
+}
+
+type result struct {
+	vulns     []models.Vulnerability
+	scannedAt time.Time
+}
+
+var (
+	results   = make(map[string]result)
+	resultsMu sync.Mutex
+
+	inFlight   = make(map[string]*sync.WaitGroup)
+	inFlightMu sync.Mutex
+)
+
+// Findings returns the vulnerabilities affecting t, scanning it now when
+// it has not been scanned within the configured result TTL.
+func Findings(scan config.VulnerabilityScan, t Target) ([]models.Vulnerability, error) {
+	resultsMu.Lock()
+	cached, ok := results[t.key()]
+	resultsMu.Unlock()
+	if ok && time.Since(cached.scannedAt) < scan.ResultTTL.Duration {
+		return cached.vulns, nil
+	}
+	return scanOnce(scan, t)
+}
+
+// background tracks scans started by ScanAsync.
+var background sync.WaitGroup
+
+// ScanAsync scans t in the background and records the findings.
+func ScanAsync(scan config.VulnerabilityScan, t Target) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		if _, err := scanOnce(scan, t); err != nil {
+			log.Printf("Vulnerability scan of %s %s failed: %v", t.Name, t.Version, err)
+		}
+	}()
+}
+
+// Wait blocks until background scans have recorded their findings.
+func Wait() {
+	background.Wait()
+}
+
+// scanOnce queries OSV for t, sharing the result with concurrent callers
+// scanning the same version.
+func scanOnce(scan config.VulnerabilityScan, t Target) ([]models.Vulnerability, error) {
+	key := t.key()
+	inFlightMu.Lock()
+	if wg, ok := inFlight[key]; ok {
+		inFlightMu.Unlock()
+		wg.Wait()
+		resultsMu.Lock()
+		cached, ok := results[key]
+		resultsMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("concurrent scan of %s %s failed", t.Name, t.Version)
+		}
+		return cached.vulns, nil
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	inFlight[key] = wg
+	inFlightMu.Unlock()
+
+	defer func() {
+		inFlightMu.Lock()
+		delete(inFlight, key)
+		inFlightMu.Unlock()
+		wg.Done()
+	}()
+
+	vulns, err := query(scan.APIURL, t.Ecosystem, t.Name, t.Version)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vulns {
+		vulns[i].FileName = t.FileName
+	}
+
+	resultsMu.Lock()
+	results[key] = result{vulns: vulns, scannedAt: time.Now()}
+	resultsMu.Unlock()
+
+	if len(vulns) > 0 {
+		log.Printf("Found %d known vulnerabilities in %s %s", len(vulns), t.Name, t.Version)
+	}
+	// Read-only replicas keep their findings in memory
+	if repositories.VulnerabilityRepo != nil && config.Server.ReplicaOf == "" {
+		if err := repositories.VulnerabilityRepo.ReplaceFindings(t.Ecosystem, t.Name, t.Version, vulns); err != nil {
+			log.Printf("Failed to record vulnerabilities of %s %s: %v", t.Name, t.Version, err)
+		}
+	}
+	return vulns, nil
+}
+
+// Blocking returns the first finding at or above the block severity of
+// scan, if any.
+func Blocking(scan config.VulnerabilityScan, vulns []models.Vulnerability) (models.Vulnerability, bool) {
+	if scan.BlockSeverity == "" {
+		return models.Vulnerability{}, false
+	}
+	threshold := SeverityRank(scan.BlockSeverity)
+	for _, v := range vulns {
+		if SeverityRank(v.Severity) >= threshold {
+			return v, true
+		}
+	}
+	return models.Vulnerability{}, false
+}
@@ -0,0 +1,20 @@
+#!/bin/sh
+# Downloads the third-party dashboard assets into static/lib so they are
+# embedded into the binaries, for air-gapped installations.
+set -eu
+
+cd "$(dirname "$0")/.."
+
+version=$(sed -n 's/^const BootstrapVersion = "\(.*\)"$/\1/p' static/static.go)
+base="https://cdn.jsdelivr.net/npm/bootstrap@${version}/dist"
+
+for file in css/bootstrap.min.css js/bootstrap.bundle.min.js; do
+  mkdir -p "static/lib/bootstrap/$(dirname "$file")"
+  echo "Fetching Bootstrap ${version} ${file}"
+  wget -q -O "static/lib/bootstrap/${file}" "${base}/${file}"
+  # An empty file would be embedded and served as the stylesheet
+  if [ ! -s "static/lib/bootstrap/${file}" ]; then
+    echo "Fetched an empty Bootstrap ${file}" >&2
+    exit 1
+  fi
+done
@@ -0,0 +1,34 @@
+// Package static holds the files the proxies serve under /static/. They
+// are embedded so the binaries work regardless of the working directory.
+package static
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// BootstrapVersion is the Bootstrap release the dashboard is built with.
+const BootstrapVersion = "5.3.0"
+
+// files holds the logos and the third-party assets fetched into lib/ by
+// scripts/fetch-assets.sh.
+//
+//go:embed *.svg lib
+var files embed.FS
+
+// Handler serves the embedded files.
+func Handler() http.Handler {
+	return http.FileServerFS(files)
+}
+
+// BootstrapURL returns the URL of a Bootstrap dist file, such as
+// "css/bootstrap.min.css": the embedded copy under basePath when it was
+// fetched before building, as the Docker image build requires, or the CDN
+// for source builds without it.
+func BootstrapURL(basePath, file string) string {
+	if _, err := fs.Stat(files, "lib/bootstrap/"+file); err == nil {
+		return basePath + "/static/lib/bootstrap/" + file
+	}
+	return "https://cdn.jsdelivr.net/npm/bootstrap@" + BootstrapVersion + "/dist/" + file
+}